@@ -6,6 +6,7 @@ require (
 	github.com/dapr/go-sdk v1.10.1
 	github.com/joho/godotenv v1.5.1
 	github.com/khaledhikmat/threat-detection-shared v1.1.2
+	github.com/khaledhikmat/threat-detection/custody v0.0.0-00010101000000-000000000000
 	github.com/mitchellh/mapstructure v1.5.1-0.20220423185008-bf980b35cac4
 )
 
@@ -59,3 +60,6 @@ require (
 	google.golang.org/protobuf v1.34.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+// The custody package is shared by all the services of this repository
+replace github.com/khaledhikmat/threat-detection/custody => ../custody
@@ -24,6 +24,8 @@ import (
 	"github.com/khaledhikmat/threat-detection-shared/service/pubsub"
 	"github.com/khaledhikmat/threat-detection-shared/service/storage"
 	otelprovider "github.com/khaledhikmat/threat-detection-shared/telemetry/provider"
+
+	"github.com/khaledhikmat/threat-detection/custody"
 )
 
 var alertTopicSubscription = &common.Subscription{
@@ -36,6 +38,7 @@ var alertTopicSubscription = &common.Subscription{
 var configSvc config.IService
 var pubsubSvc pubsub.IService
 var storageSvc storage.IService
+var custodyLog *custody.CustodyLog
 
 var modeProcs = map[string]func(ctx context.Context) error{
 	"dapr": daprModeProc,
@@ -47,6 +50,7 @@ var alertProcs = map[string]func(ctx context.Context, clip models.RecordingClip)
 	"snow":  snow,
 	"pers":  pers,
 	"slack": slack,
+	"ptz":   ptz,
 }
 
 var alertsTopic = models.AlertsTopic
@@ -113,6 +117,11 @@ func daprModeProc(_ context.Context) error {
 	// WARNING I am using AWS storage while in DAPR runtime mode because I can store to S3
 	//storageSvc = storage.NewDaprStorage(c, configSvc)
 	storageSvc = storage.NewAwsStorage(configSvc)
+	custodyLog, err = custody.NewCustodyLog(c, storageSvc, fmt.Sprintf("alert-notifier-%s", configSvc.GetSupportedAlertType()))
+	if err != nil {
+		fmt.Println("Failed to start the custody log", err)
+		return err
+	}
 
 	// Create a DAPR service using the app port
 	s := daprd.NewService(":" + os.Getenv("APP_PORT"))
@@ -148,6 +157,12 @@ func daprAlertHandler(ctx context.Context, e *common.TopicEvent) (bool, error) {
 func awsModeProc(ctx context.Context) error {
 	pubsubSvc = pubsub.NewAwsPubsub(configSvc)
 	storageSvc = storage.NewAwsStorage(configSvc)
+	var err error
+	custodyLog, err = custody.NewCustodyLog(nil, storageSvc, fmt.Sprintf("alert-notifier-%s", configSvc.GetSupportedAlertType()))
+	if err != nil {
+		fmt.Println("Failed to start the custody log", err)
+		return err
+	}
 
 	// Create a topic for my alerts if it does not exist
 	// There could be some competition here, but we will ignore it for now
@@ -221,3 +236,13 @@ func processRecordingClip(ctx context.Context, evt models.RecordingClip) error {
 
 	return nil
 }
+
+// retrieveAlertClip retrieves the alert's clip and verifies it against its custody log. An alert the capturer
+// raises without a clip (i.e. a camera quarantine) has no cloud reference and is notified without one.
+func retrieveAlertClip(ctx context.Context, clip models.RecordingClip) ([]byte, error) {
+	if clip.CloudReference == "" {
+		return []byte{}, nil
+	}
+
+	return custodyLog.RetrieveVerifiedClip(ctx, clip)
+}
@@ -10,8 +10,8 @@ import (
 
 func pers(ctx context.Context, clip models.RecordingClip) error {
 
-	// Retrieve the recording clip from storage
-	b, err := storageSvc.RetrieveRecordingClip(ctx, clip)
+	// Retrieve the recording clip (if the alert has one) from storage and verify it was not modified since capture
+	b, err := retrieveAlertClip(ctx, clip)
 	if err != nil {
 		fmt.Println("Failed to retrieve event's clip", err)
 		return err
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+	"github.com/khaledhikmat/threat-detection-shared/utils"
+)
+
+// PTZRule points PTZ cameras at an alerting camera's area. A rule without models applies to the alerts of all models.
+// WARNING: Must match the rules file
+type PTZRule struct {
+	Camera  string      `json:"camera"`
+	Models  []string    `json:"models"`
+	Targets []PTZTarget `json:"targets"`
+}
+
+// PTZTarget is a PTZ camera and the preset (token or name) covering the alerting camera's area.
+// If the capturer is empty, the target is on the alerting camera's capturer.
+type PTZTarget struct {
+	Capturer string `json:"capturer"`
+	Camera   string `json:"camera"`
+	Preset   string `json:"preset"`
+}
+
+var ptzRules []PTZRule
+var ptzRulesOnce sync.Once
+var ptzRulesErr error
+
+// ptz moves the PTZ cameras near an alerting camera to their presets through their capturers' control API.
+// The rules are read from the `PTZ_RULES_FILE` JSON file.
+func ptz(ctx context.Context, clip models.RecordingClip) error {
+	fmt.Printf("ptz alert notifier received a recording clip - TYPE %s - MODEL %s - CAPTURER %s - AGENT %s\n",
+		configSvc.GetSupportedAlertType(), clip.ModelInvoker, clip.Capturer, clip.Camera)
+
+	rules, err := loadPTZRules()
+	if err != nil {
+		return err
+	}
+
+	apiClient := &http.Client{Timeout: 10 * time.Second}
+	failures := 0
+	for _, rule := range rules {
+		if rule.Camera != clip.Camera || (len(rule.Models) > 0 && !utils.Contains(rule.Models, clip.ModelInvoker)) {
+			continue
+		}
+
+		for _, target := range rule.Targets {
+			capturer := target.Capturer
+			if capturer == "" {
+				capturer = clip.Capturer
+			}
+
+			err := gotoPreset(ctx, apiClient, capturer, target.Camera, target.Preset)
+			if err != nil {
+				fmt.Printf("ptz alert notifier is unable to move %s to preset %s: %v\n", target.Camera, target.Preset, err)
+				failures++
+				continue
+			}
+			fmt.Printf("ptz alert notifier moved %s to preset %s for an alert on %s\n", target.Camera, target.Preset, clip.Camera)
+		}
+	}
+
+	// Indicate the alert invocation has ended
+	clip.AlertInvocationBeginTime = time.Now()
+
+	if failures > 0 {
+		return fmt.Errorf("%d PTZ cameras could not be moved", failures)
+	}
+
+	return nil
+}
+
+func loadPTZRules() ([]PTZRule, error) {
+	ptzRulesOnce.Do(func() {
+		file := os.Getenv("PTZ_RULES_FILE")
+		if file == "" {
+			ptzRulesErr = fmt.Errorf("%s env var is required by the ptz alert notifier", "PTZ_RULES_FILE")
+			return
+		}
+
+		b, err := os.ReadFile(file)
+		if err != nil {
+			ptzRulesErr = err
+			return
+		}
+
+		err = json.Unmarshal(b, &ptzRules)
+		if err != nil {
+			ptzRulesErr = fmt.Errorf("unable to decode the PTZ rules %s: %v", file, err)
+		}
+	})
+
+	return ptzRules, ptzRulesErr
+}
+
+// gotoPreset asks the capturer's agent of a PTZ camera to move it to a preset.
+func gotoPreset(ctx context.Context, apiClient *http.Client, capturer, camera, preset string) error {
+	apiURL := os.Getenv("CAPTURER_API_URL")
+	if apiURL == "" {
+		apiURL = "http://localhost:8080"
+	}
+
+	target := fmt.Sprintf("%s/agents/%s/presets/%s",
+		strings.TrimSuffix(strings.ReplaceAll(apiURL, "{capturer}", url.PathEscape(capturer)), "/"),
+		url.PathEscape(camera),
+		url.PathEscape(preset))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("CAPTURER_API_KEY"))
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("capturer %s returned %s: %s", capturer, res.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
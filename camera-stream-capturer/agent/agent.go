@@ -2,29 +2,39 @@ package agent
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 
 	"github.com/khaledhikmat/threat-detection-shared/models"
 	"github.com/khaledhikmat/threat-detection-shared/service/config"
-	"github.com/khaledhikmat/threat-detection-shared/service/pubsub"
 	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
 	"github.com/khaledhikmat/threat-detection-shared/service/storage"
 	"github.com/khaledhikmat/threat-detection-shared/utils"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/errorlog"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/health"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/lease"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/live"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/preview"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/spool"
 )
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-// There is one agent per camera.
-func Run(canxCtx context.Context, configsvc config.IService, storagesvc storage.IService, pubsubsvc pubsub.IService, recordingsTopic string, commandsStream chan string, capturer string, camera soicat.Camera) error {
+// There is one agent per camera. It runs as long as the capturer holds the camera's lease.
+func Run(canxCtx context.Context, configsvc config.IService, storagesvc storage.IService, spooler *spool.Spool, errorLog *errorlog.ErrorLog, leasesvc lease.IService, fence lease.Lease, liveStreams *live.Streams, stats *Stats, commandsStream chan string, capturer string, camera soicat.Camera) error {
 
 	// Create a cemra folder within the recordings folder if not exist
 	err := utils.CreateDirIfNotExist(fmt.Sprintf("%s/%s", configsvc.GetCapturer().RecordingsFolder, camera.Name))
@@ -32,111 +42,194 @@ func Run(canxCtx context.Context, configsvc config.IService, storagesvc storage.
 		return fmt.Errorf("unable to create a folder: %s/%s - error: %v", configsvc.GetCapturer().RecordingsFolder, camera.Name, err)
 	}
 
-	// Create a recording stream
-	recordingStream := captureRecordingClip(canxCtx, configsvc, storagesvc, pubsubsvc, recordingsTopic)
+	// Load the camera settings that are not part of the camera catalogue
+	settings, err := LoadCameraSettings(camera)
+	if err != nil {
+		return fmt.Errorf("unable to load camera %s settings - error: %v", camera.Name, err)
+	}
 
-	if configsvc.GetCapturer().AgentMode == "streaming" {
-		return runStreaming(canxCtx, configsvc, recordingStream, commandsStream, capturer, camera)
+	// Create a recording stream and wait for it to spool the last clips before the lease is released
+	recordingCtx, recordingCancel := context.WithCancel(canxCtx)
+	recordingStream, recordingDone := captureRecordingClip(recordingCtx, spooler, errorLog, leasesvc, fence, settings, stats, capturer, camera)
+	defer func() {
+		recordingCancel()
+		<-recordingDone
+	}()
+
+	mode := configsvc.GetCapturer().AgentMode
+	if mode == "streaming" || mode == "triggered" || mode == "motion" {
+		// Finalise and spool the clips that a previous run did not close
+		recoverClips(configsvc, recordingStream, capturer, camera)
+		return runStreaming(canxCtx, configsvc, storagesvc, spooler, errorLog, settings, liveStreams, stats, recordingStream, commandsStream, capturer, camera)
 	}
 
-	return runFiles(canxCtx, configsvc, recordingStream, commandsStream, capturer, camera)
+	return runFiles(canxCtx, configsvc, storagesvc, spooler, errorLog, stats, recordingStream, commandsStream, capturer, camera)
 }
 
 func runStreaming(canxCtx context.Context,
 	configsvc config.IService,
+	storagesvc storage.IService,
+	spooler *spool.Spool,
+	errorLog *errorlog.ErrorLog,
+	settings CameraSettings,
+	liveStreams *live.Streams,
+	stats *Stats,
 	recordingStream chan models.RecordingClip,
 	commandsStream chan string,
 	capturer string,
 	camera soicat.Camera) error {
-	mode := "streaming"
+	mode := configsvc.GetCapturer().AgentMode
 	// Establishing the camera connection without backchannel if no substream
 	if camera.RtspURL == "" {
-		return fmt.Errorf("capturer %s - agent %s mode %s: no rtsp url found in config, please provide one", capturer, camera.Name, mode)
+		return fmt.Errorf("capturer %s - agent %s mode %s: no camera url found in config, please provide one", capturer, camera.Name, mode)
 	}
 
-	rtspClient := NewRTSPClient(camera.RtspURL)
-	defer rtspClient.Close()
-
-	err := rtspClient.Connect(canxCtx)
-	if err != nil {
-		return fmt.Errorf("capturer %s - agent %s mode %s: error connecting to rtsp stream: %v", capturer, camera.Name, mode, err)
-	}
-
-	fmt.Printf("capturer.agent - opened RTSP stream: %s\n", camera.RtspURL)
+	// Capture errors. The errors stream is closed once its senders are done: the sessions wait for theirs.
+	errorsStream := captureErrors(canxCtx, storagesvc, spooler, errorLog, stats, commandsStream, capturer, camera, mode)
+	var senders sync.WaitGroup
+	defer func() {
+		senders.Wait()
+		close(errorsStream)
+	}()
 
-	// Get the video streams from the RTSP server.
-	videoStreams, err := rtspClient.GetVideoStreams()
-	if err != nil || len(videoStreams) == 0 {
-		return fmt.Errorf("capturer %s - agent %s mode %s: no video stream found, might be the wrong codec (we only support H264 for the moment)", capturer, camera.Name, mode)
+	// Move the camera as told by the PTZ commands and its preset tours
+	var ptzStream chan string
+	if settings.PTZ != nil {
+		ptzStream = make(chan string, 10)
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			runPTZ(canxCtx, *settings.PTZ, errorsStream, ptzStream, capturer, camera)
+		}()
 	}
 
-	// Get the video stream from the RTSP server.
-	videoStream := videoStreams[0]
-
-	// Get some information from the video stream.
-	width := videoStream.Width
-	height := videoStream.Height
-
-	// Override config values as well
-	camera.CaptureWidth = width
-	camera.CaptureHeight = height
-
-	// Capture errors
-	errorsStream := captureErrors(canxCtx, capturer, camera, mode)
-
-	// Create a packet stream
-	packetsStream := make(chan Packet, 10)
-	defer close(packetsStream)
+	// Supervise the camera sessions: when a session fails or stalls, reconnect with a jittered exponential backoff.
+	// A stopped (or quarantined) session stays down until it is started again. The camera's schedule picks the session mode and
+	// the camera is not connected at all while its schedule is off.
+	// A camera quarantined before the capturer (or another capturer) stopped stays quarantined.
+	scheduleTicker := time.NewTicker(1 * time.Second)
+	defer scheduleTicker.Stop()
+	attempts := 0
+	quarantined := cameraQuarantined(canxCtx, capturer, camera)
+	for {
+		var err error
+		streamed := false
+		scheduled := sessionMode(settings, mode, time.Now())
+		stats.setMode(scheduled)
+		if quarantined {
+			fmt.Printf("capturer %s - agent %s mode %s - quarantined until started again\n", capturer, camera.Name, mode)
+			quarantined = false
+			publishCameraHealth(canxCtx, storagesvc, capturer, camera, []string{health.Quarantined})
+			err = errSessionQuarantined
+		} else if scheduled == ScheduleOff {
+			fmt.Printf("capturer %s - agent %s mode %s - off by schedule\n", capturer, camera.Name, mode)
+			publishCameraState(canxCtx, storagesvc, stats, capturer, camera, CameraOff)
+			err = errScheduleOff
+		} else {
+			publishCameraState(canxCtx, storagesvc, stats, capturer, camera, CameraConnecting)
+			streamed, err = runSession(canxCtx, configsvc, storagesvc, settings, liveStreams, stats, errorsStream, recordingStream, commandsStream, ptzStream, scheduled, capturer, camera)
+		}
+		if canxCtx.Err() != nil {
+			fmt.Printf("capturer %s - agent %s context cancelled...existing!!!\n", capturer, camera.Name)
+			return canxCtx.Err()
+		}
 
-	go func() {
-		err := rtspClient.Start(canxCtx, errorsStream, packetsStream, camera)
-		if err != nil {
-			errorsStream <- fmt.Errorf("capturer %s - agent %s mode %s - starting an RSTP client failed: %v", capturer, camera.Name, mode, err)
-			return
+		// A session that made it to streaming resets the backoff
+		if streamed {
+			attempts = 0
 		}
-	}()
 
-	// Capture stream and write mp4 clips to destination (i.e. disk, S3, etc).
-	go func() {
-		CaptureStream(canxCtx, configsvc, errorsStream, packetsStream, recordingStream, capturer, camera)
-	}()
+		var retry <-chan time.Time
+		off := false
+		if errors.Is(err, errSessionRestarted) {
+			fmt.Printf("capturer %s - agent %s mode %s - restarting\n", capturer, camera.Name, mode)
+			attempts = 0
+			continue
+		} else if errors.Is(err, errScheduleChanged) {
+			fmt.Printf("capturer %s - agent %s mode %s - schedule changed from %s\n", capturer, camera.Name, mode, scheduled)
+			attempts = 0
+			continue
+		} else if errors.Is(err, errScheduleOff) {
+			off = true
+		} else if errors.Is(err, errSessionStopped) {
+			publishCameraState(canxCtx, storagesvc, stats, capturer, camera, CameraStopped)
+		} else if errors.Is(err, errSessionQuarantined) {
+			publishCameraState(canxCtx, storagesvc, stats, capturer, camera, CameraQuarantined)
+		} else {
+			state := CameraFailed
+			if errors.Is(err, errSessionStalled) {
+				state = CameraStalled
+			}
+			publishCameraState(canxCtx, storagesvc, stats, capturer, camera, state)
+			errorsStream <- errorlog.Errorf(errorlog.Connect, "capturer %s - agent %s mode %s - session ended: %v", capturer, camera.Name, mode, err)
+
+			backoff := reconnectBackoff(attempts)
+			attempts++
+			fmt.Printf("capturer %s - agent %s mode %s - reconnecting in %v (attempt %d)\n", capturer, camera.Name, mode, backoff, attempts)
+			timer := time.NewTimer(backoff)
+			retry = timer.C
+		}
 
-	// Wait for cancellation, command or periodic timer
-	for {
-		select {
-		case <-canxCtx.Done():
-			fmt.Printf("capturer %s - agent %s context cancelled...existing!!!\n", capturer, camera.Name)
-			return (canxCtx).Err()
-		case cmd := <-commandsStream:
-			fmt.Printf("capturer %s - agent %s mode %s - command %s\n", capturer, camera.Name, mode, cmd)
-			if cmd == "Start" {
-				fmt.Printf("capturer %s - agent %s mode %s - start command processor\n", capturer, camera.Name, mode)
-			} else if cmd == "Stop" {
-				fmt.Printf("capturer %s - agent %s mode %s - stop command processor\n", capturer, camera.Name, mode)
-			} else if cmd == "Pause" {
-				fmt.Printf("capturer %s - agent %s mode %s - pause command processor\n", capturer, camera.Name, mode)
-				err := rtspClient.Pause()
-				if err != nil {
-					errorsStream <- fmt.Errorf("capturer %s - agent %s mode %s - pausing an RSTP client failed: %v", capturer, camera.Name, mode, err)
+		// Wait for the backoff (or forever if stopped or quarantined) or the end of the off schedule, but keep the commands stream flowing
+	wait:
+		for {
+			select {
+			case <-canxCtx.Done():
+				fmt.Printf("capturer %s - agent %s context cancelled...existing!!!\n", capturer, camera.Name)
+				return canxCtx.Err()
+			case cmd := <-commandsStream:
+				if isPTZCommand(cmd) {
+					forwardPTZCommand(ptzStream, errorsStream, capturer, camera, cmd)
+				} else if off && (cmd == "Start" || cmd == "Restart" || cmd == "Record") {
+					fmt.Printf("capturer %s - agent %s mode %s - command %s ignored while off by schedule\n", capturer, camera.Name, mode, cmd)
+				} else if cmd == "Start" || cmd == "Restart" {
+					fmt.Printf("capturer %s - agent %s mode %s - start command processor\n", capturer, camera.Name, mode)
+					// The camera is released from quarantine...its health monitor raises its conditions again
+					if stats.Snapshot().State == CameraQuarantined {
+						publishCameraHealth(canxCtx, storagesvc, capturer, camera, nil)
+					}
+					attempts = 0
+					break wait
+				} else if cmd == "Stop" {
+					fmt.Printf("capturer %s - agent %s mode %s - stop command processor\n", capturer, camera.Name, mode)
+					publishCameraState(canxCtx, storagesvc, stats, capturer, camera, CameraStopped)
+					retry = nil
+					off = false
+				} else if cmd == quarantineCommand {
+					fmt.Printf("capturer %s - agent %s mode %s - quarantine command processor\n", capturer, camera.Name, mode)
+					publishCameraState(canxCtx, storagesvc, stats, capturer, camera, CameraQuarantined)
+					retry = nil
+					off = false
+				} else {
+					fmt.Printf("capturer %s - agent %s mode %s - command %s ignored while disconnected\n", capturer, camera.Name, mode, cmd)
 				}
-			} else if cmd == "Resume" {
-				fmt.Printf("capturer %s - agent %s mode %s - resume command processor\n", capturer, camera.Name, mode)
-				err := rtspClient.Resume()
-				if err != nil {
-					errorsStream <- fmt.Errorf("capturer %s - agent %s mode %s - resuming an RSTP client failed: %v", capturer, camera.Name, mode, err)
+			case <-retry:
+				break wait
+			case <-scheduleTicker.C:
+				if off && sessionMode(settings, mode, time.Now()) != ScheduleOff {
+					break wait
 				}
 			}
-		case <-time.After(time.Duration(20 * time.Second)):
-			fmt.Printf("capturer %s - agent %s mode %s - timeout....perform periodic tasks...\n", capturer, camera.Name, mode)
 		}
 	}
 }
 
-func runFiles(canxCtx context.Context, configsvc config.IService, recordingStream chan models.RecordingClip, commandsStream chan string, capturer string, camera soicat.Camera) error {
+func runFiles(canxCtx context.Context, configsvc config.IService, storagesvc storage.IService, spooler *spool.Spool, errorLog *errorlog.ErrorLog, stats *Stats, recordingStream chan models.RecordingClip, commandsStream chan string, capturer string, camera soicat.Camera) error {
 	mode := "files"
+	stopped := false
+	stats.setState(CameraStreaming)
+
+	// A camera quarantined before the capturer (or another capturer) stopped stays quarantined
+	if cameraQuarantined(canxCtx, capturer, camera) {
+		fmt.Printf("capturer %s - agent %s mode %s - quarantined until started again\n", capturer, camera.Name, mode)
+		stopped = true
+		publishCameraState(canxCtx, storagesvc, stats, capturer, camera, CameraQuarantined)
+		publishCameraHealth(canxCtx, storagesvc, capturer, camera, []string{health.Quarantined})
+	}
 
-	// Capture errors
-	errorsStream := captureErrors(canxCtx, capturer, camera, mode)
+	// Capture errors...this loop is their only sender
+	errorsStream := captureErrors(canxCtx, storagesvc, spooler, errorLog, stats, commandsStream, capturer, camera, mode)
+	defer close(errorsStream)
 
 	// Wait for cancellation, command or periodic timer
 	for {
@@ -146,103 +239,284 @@ func runFiles(canxCtx context.Context, configsvc config.IService, recordingStrea
 			return (canxCtx).Err()
 		case cmd := <-commandsStream:
 			fmt.Printf("capturer %s - agent %s mode %s - command %s\n", capturer, camera.Name, mode, cmd)
-			if cmd == "Start" {
+			if cmd == "Start" || cmd == "Restart" {
 				fmt.Printf("capturer %s - agent %s mode %s - start command processor\n", capturer, camera.Name, mode)
+				stopped = false
+				// The camera is released from quarantine
+				if stats.Snapshot().State == CameraQuarantined {
+					publishCameraHealth(canxCtx, storagesvc, capturer, camera, nil)
+				}
+				publishCameraState(canxCtx, storagesvc, stats, capturer, camera, CameraStreaming)
 			} else if cmd == "Stop" {
 				fmt.Printf("capturer %s - agent %s mode %s - stop command processor\n", capturer, camera.Name, mode)
+				stopped = true
+				publishCameraState(canxCtx, storagesvc, stats, capturer, camera, CameraStopped)
+			} else if cmd == quarantineCommand {
+				fmt.Printf("capturer %s - agent %s mode %s - quarantine command processor\n", capturer, camera.Name, mode)
+				stopped = true
+				publishCameraState(canxCtx, storagesvc, stats, capturer, camera, CameraQuarantined)
 			} else if cmd == "Pause" {
 				fmt.Printf("capturer %s - agent %s mode %s - pause command processor\n", capturer, camera.Name, mode)
+				stats.setPaused(true)
 			} else if cmd == "Resume" {
 				fmt.Printf("capturer %s - agent %s mode %s - resume command processor\n", capturer, camera.Name, mode)
+				stats.setPaused(false)
+			} else if cmd == "Record" && stopped {
+				fmt.Printf("capturer %s - agent %s mode %s - command %s ignored while stopped\n", capturer, camera.Name, mode, cmd)
+			} else if cmd == "Record" {
+				fmt.Printf("capturer %s - agent %s mode %s - record command processor\n", capturer, camera.Name, mode)
+				err := produceClip(recordingStream, configsvc, storagesvc, configsvc.GetCapturer().SamplesFolder, configsvc.GetCapturer().RecordingsFolder, capturer, camera)
+				if err != nil {
+					errorsStream <- errorlog.Errorf(errorlog.Upload, "capturer %s - agent %s mode %s - uploading files: %v", capturer, camera.Name, mode, err)
+				}
 			}
 		case <-time.After(time.Duration(3 * time.Second)):
 			fmt.Printf("capturer %s - agent %s mode %s - timeout....perform periodic tasks...\n", capturer, camera.Name, mode)
+			if stopped || stats.Snapshot().Paused {
+				continue
+			}
 
-			err := produceClip(recordingStream, configsvc, configsvc.GetCapturer().SamplesFolder, configsvc.GetCapturer().RecordingsFolder, capturer, camera)
+			err := produceClip(recordingStream, configsvc, storagesvc, configsvc.GetCapturer().SamplesFolder, configsvc.GetCapturer().RecordingsFolder, capturer, camera)
 			if err != nil {
-				errorsStream <- fmt.Errorf("capturer %s - agent %s mode %s - uploading files: %v", capturer, camera.Name, mode, err)
+				errorsStream <- errorlog.Errorf(errorlog.Upload, "capturer %s - agent %s mode %s - uploading files: %v", capturer, camera.Name, mode, err)
 			}
 		}
 	}
 }
 
-func captureErrors(canxCtx context.Context, capturer string, camera soicat.Camera, mode string) chan interface{} {
+// The pre-event duration is how far back a triggered recording reaches into the GOP ring buffer.
+func preEventDuration() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("CAPTURER_PRE_EVENT_SECONDS"))
+	if err != nil || seconds < 0 {
+		seconds = 5
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// captureErrors runs an error processor that records the agent's errors in the error log. When the camera's
+// error rate goes over the quarantine threshold, the camera is quarantined: its session is stopped until it
+// is started again, its health is `quarantined` and a camera health alert is raised.
+func captureErrors(canxCtx context.Context,
+	storagesvc storage.IService,
+	spooler *spool.Spool,
+	errorLog *errorlog.ErrorLog,
+	stats *Stats,
+	commandsStream chan string,
+	capturer string,
+	camera soicat.Camera,
+	mode string) chan interface{} {
 	// Create an error stream
 	errorsStream := make(chan interface{}, 10)
 
-	// Run an error processor to capture agent errors
+	// Run an error processor to capture agent errors until the agent closes the errors stream. The agent
+	// owns the stream: it closes it once every sender is done, so errors sent while it stops are not lost.
 	go func() {
-		defer close(errorsStream)
+		policy := newQuarantinePolicy()
+
+		for err := range errorsStream {
+			fmt.Printf("capturer %s - agent %s mode %s - error processed received from a downstream error: %v\n", capturer, camera.Name, mode, err)
+			stats.error(err)
+
+			// The agent may be stopping, so do not tie the late errors to its context
+			if canxCtx.Err() != nil {
+				recordCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				errorLog.Record(recordCtx, camera.Name, err)
+				cancel()
+				continue
+			}
 
-		for {
-			select {
-			case <-canxCtx.Done():
-				fmt.Printf("capturer %s - agent %s mode %s - error processor context cancelled\n", capturer, camera.Name, mode)
-				return
-			case err := <-errorsStream:
-				fmt.Printf("capturer %s - agent %s mode %s - error processed received from a downstream error: %v\n", capturer, camera.Name, mode, err)
-				// TODO: Agent errors can be sent to key/value storage
-				// where the key = capturer_camera_name_ts
-				// and the value = error.Error()
+			entry := errorLog.Record(canxCtx, camera.Name, err)
+			if policy.check(entry.Type, entry.Time) {
+				quarantineCamera(canxCtx, storagesvc, spooler, commandsStream, policy, capturer, camera, mode)
 			}
 		}
+
+		fmt.Printf("capturer %s - agent %s mode %s - error processor done\n", capturer, camera.Name, mode)
 	}()
 
 	return errorsStream
 }
 
+// quarantineCamera tells the agent to stop its session and raises the quarantine. The agent may be busy
+// sending an error itself, so the command is sent without holding up the error processor.
+func quarantineCamera(canxCtx context.Context, storagesvc storage.IService, spooler *spool.Spool, commandsStream chan string, policy *quarantinePolicy, capturer string, camera soicat.Camera, mode string) {
+	fmt.Printf("capturer %s - agent %s mode %s - more than %d errors in %v...quarantining the camera\n", capturer, camera.Name, mode, policy.threshold, policy.window)
+
+	go func() {
+		select {
+		case commandsStream <- quarantineCommand:
+		case <-canxCtx.Done():
+		}
+	}()
+
+	publishCameraHealth(canxCtx, storagesvc, capturer, camera, []string{health.Quarantined})
+
+	// The alert has no clip: the camera may not have recorded one at all
+	num, _ := strconv.Atoi(camera.ID)
+	alert := models.RecordingClip{
+		ID:                uuid.NewString(),
+		CreateTime:        time.Now(),
+		Capturer:          capturer,
+		Camera:            camera.Name,
+		CameraID:          num,
+		Region:            camera.Region,
+		Location:          camera.Location,
+		Priority:          camera.Priority,
+		Analytics:         camera.Analytics,
+		AlertTypes:        camera.AlertTypes,
+		MediaIndexerTypes: camera.MediaIndexerTypes,
+	}
+	err := spooler.PublishHealthAlert(canxCtx, alert, health.Quarantined)
+	if err != nil {
+		fmt.Printf("capturer %s - agent %s mode %s - unable to raise the quarantine alert: %v\n", capturer, camera.Name, mode, err)
+	}
+}
+
+// captureRecordingClip hands the recorded clips over to the capturer's spool which uploads and publishes them.
+// If the camera has privacy settings, the clips are redacted first. The clips' renditions are transcoded
+// once they are hashed. When the context is cancelled, it keeps spooling the clips that are closed while the agent stops until the
+// stream is idle, then closes the returned done channel.
 func captureRecordingClip(canxCtx context.Context,
-	configsvc config.IService,
-	storagesvc storage.IService,
-	pubsubsvc pubsub.IService,
-	recordingsTopic string) chan models.RecordingClip {
+	spooler *spool.Spool,
+	errorLog *errorlog.ErrorLog,
+	leasesvc lease.IService,
+	fence lease.Lease,
+	settings CameraSettings,
+	stats *Stats,
+	capturer string,
+	camera soicat.Camera) (chan models.RecordingClip, chan struct{}) {
 	// Create a recording stream
 	recordingStream := make(chan models.RecordingClip, 10)
+	done := make(chan struct{})
+
+	// The renditions are a convenience...the clips are delivered without them if they are misconfigured
+	renditions, err := cameraRenditions(settings)
+	if err != nil {
+		fmt.Printf("recording processor - no renditions: %v\n", err)
+	}
+
+	spoolClip := func(recording models.RecordingClip) {
+		fmt.Printf("recording processor file %s received\n", recording.LocalReference)
+
+		// A capturer that lost the camera's lease must not publish its recordings
+		if !leasesvc.Valid(fence) {
+			fmt.Printf("recording processor file %s dropped - fencing token %d is stale\n", recording.LocalReference, fence.Token)
+			files := append([]string{recording.LocalReference}, preview.Files(recording.LocalReference)...)
+			files = append(files, spool.SubStreamFile(recording.LocalReference), spool.OriginalFile(recording.LocalReference))
+			files = append(files, spool.RenditionFiles(recording.LocalReference)...)
+			for _, file := range files {
+				err := os.Remove(file)
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					fmt.Printf("unable to remove file: %s %v\n", file, err)
+				}
+			}
+			return
+		}
+
+		// An unredacted clip must not leave the capturer...it is kept for inspection
+		if settings.Privacy != nil {
+			redacted, err := redactRecordingClip(*settings.Privacy, recording)
+			if errors.Is(err, errSubStreamUnredacted) {
+				// The clip is redacted...it is delivered without its sub-stream clip
+				recordCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				errorLog.Record(recordCtx, camera.Name, err)
+				cancel()
+			} else if err != nil {
+				recordCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				errorLog.Record(recordCtx, camera.Name, errorlog.Errorf(errorlog.Mux, "capturer %s - agent %s - clip %s dropped, it cannot be redacted: %v", capturer, camera.Name, recording.LocalReference, err))
+				cancel()
+				err = os.Rename(recording.LocalReference, recording.LocalReference+unredactedSuffix)
+				if err != nil {
+					fmt.Printf("unable to rename file: %s %v\n", recording.LocalReference, err)
+				}
+				return
+			}
+			recording = redacted
+		}
+
+		// Hash the recording. The consumers reject a clip without a capture hash, so a clip that cannot be hashed
+		// is not spooled...it is left in the recordings folder without a manifest and the agent's next start
+		// recovers, hashes and spools it.
+		hash, err := hashRecordingClip(recording)
+		for attempt := 1; err != nil && attempt < hashAttempts; attempt++ {
+			time.Sleep(time.Duration(attempt) * time.Second)
+			hash, err = hashRecordingClip(recording)
+		}
+		if err != nil {
+			recordCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			errorLog.Record(recordCtx, camera.Name, errorlog.Errorf(errorlog.Mux, "capturer %s - agent %s - unable to hash recording clip %s, keeping it for the next start: %v", capturer, camera.Name, recording.LocalReference, err))
+			cancel()
+			return
+		}
+
+		err = transcodeRecordingClip(renditions, recording)
+		if err != nil {
+			// The agent may be stopping, so do not tie the record to the context
+			recordCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			errorLog.Record(recordCtx, camera.Name, errorlog.Errorf(errorlog.Mux, "capturer %s - agent %s - %v", capturer, camera.Name, err))
+			cancel()
+		}
+
+		// The spool uploads and publishes the clip...even after a restart
+		err = spooler.Add(recording, fence.Token, hash)
+		if err != nil {
+			fmt.Printf("unable to spool recording clip: %s %v\n", recording.LocalReference, err)
+			return
+		}
+		stats.clip()
+	}
 
 	go func() {
-		defer close(recordingStream)
+		defer close(done)
 
 		// Recording processor
 		for {
 			select {
 			case <-canxCtx.Done():
 				fmt.Println("recording processor context cancelled...")
-				return
-			case recording := <-recordingStream:
-				fmt.Printf("recording processor file %s received\n", recording.LocalReference)
-
-				// Upload to Cloud Storage i.e. S3, Azure Storage, etc
-				url, err := storagesvc.StoreRecordingClip(canxCtx, recording)
-				if err != nil {
-					fmt.Printf("unable to store recording clip: %s in %s due to: %v\n", recording.LocalReference, configsvc.GetRuntimeMode(), err)
-				}
-				recording.CloudReference = url
-				recording.StorageProvider = configsvc.GetRuntimeMode()
-				fmt.Printf("Uploaded %s to %s => %s\n", recording.LocalReference, configsvc.GetRuntimeMode(), recording.CloudReference)
-
-				// Publish event
-				fmt.Printf("Publishing %s recording clip\n", recording.CloudReference)
-				recording.PublishTime = time.Now()
-				err = pubsubsvc.PublishRecordingClip(canxCtx, models.ThreatDetectionPubSub, recordingsTopic, recording)
-				if err != nil {
-					fmt.Printf("unable to publish event: %s %v\n", recording.LocalReference, err)
-				}
-
-				// Delete local file
-				fmt.Printf("Deleting %s from local\n", recording.LocalReference)
-				err = os.Remove(recording.LocalReference)
-				if err != nil {
-					fmt.Printf("unable to remove file: %s %v\n", recording.LocalReference, err)
+				// Spool the clips that are finalized while the agent stops
+				for {
+					select {
+					case recording := <-recordingStream:
+						spoolClip(recording)
+					case <-time.After(2 * time.Second):
+						return
+					}
 				}
+			case recording := <-recordingStream:
+				spoolClip(recording)
 			}
 		}
 	}()
 
-	return recordingStream
+	return recordingStream, done
+}
+
+// A clip is hashed this many times before it is left for the agent's next start.
+const hashAttempts = 3
+
+// hashRecordingClip returns the hex SHA-256 of the clip. The spool keeps it in the clip's manifest and starts
+// the clip's chain of custody with it, so it never depends on the clip's name.
+func hashRecordingClip(recording models.RecordingClip) (string, error) {
+	file, err := os.Open(recording.LocalReference)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 func produceClip(recordingStream chan models.RecordingClip,
 	configsvc config.IService,
+	storagesvc storage.IService,
 	samplesFolder, recordingsFolder string,
 	capturer string,
 	camera soicat.Camera) error {
@@ -276,12 +550,18 @@ func produceClip(recordingStream chan models.RecordingClip,
 		return fmt.Errorf("unable to copy source %s to dest file %s: %v", source.Name(), destination.Name(), err)
 	}
 
+	// The sample is replayed as if it was recorded until now
+	timing, err := sampleClipTiming(source.Name(), camera.Name)
+	if err != nil {
+		return fmt.Errorf("unable to time sample file %s: %v", source.Name(), err)
+	}
+
 	// Send the recording clip via the storage stream
 	num, err := strconv.Atoi(camera.ID)
 	if err != nil {
 		return fmt.Errorf("capturestream - unable to create a clip %v", err)
 	}
-	recordingStream <- models.RecordingClip{
+	clip := models.RecordingClip{
 		ID:                       uuid.NewString(),
 		CreateTime:               time.Now(),
 		LocalReference:           destination.Name(),
@@ -296,9 +576,9 @@ func produceClip(recordingStream chan models.RecordingClip,
 		Analytics:                camera.Analytics,
 		AlertTypes:               camera.AlertTypes,
 		MediaIndexerTypes:        camera.MediaIndexerTypes,
-		Frames:                   122,
-		RecordingBeginTime:       time.Now().Add(-3 * time.Second),
-		RecordingEndTime:         time.Now(),
+		Frames:                   timing.Frames,
+		RecordingBeginTime:       timing.BeginTime,
+		RecordingEndTime:         timing.EndTime,
 		PublishTime:              time.Now(),
 		ModelInvocationBeginTime: time.Now(),
 		ModelInvocationEndTime:   time.Now(),
@@ -307,5 +587,12 @@ func produceClip(recordingStream chan models.RecordingClip,
 		IndexTime:                time.Now(),
 	}
 
+	timing.ClipID = clip.ID
+	err = storeClipTiming(storagesvc, timing)
+	if err != nil {
+		fmt.Printf("capturestream - unable to store the timing of %s: %v\n", destination.Name(), err)
+	}
+
+	recordingStream <- clip
 	return nil
 }
@@ -7,140 +7,552 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
 	"github.com/google/uuid"
 	"github.com/yapingcat/gomedia/go-mp4"
 
 	"github.com/khaledhikmat/threat-detection-shared/models"
 	"github.com/khaledhikmat/threat-detection-shared/service/config"
 	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
+	"github.com/khaledhikmat/threat-detection-shared/service/storage"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/errorlog"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/health"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/spool"
 )
 
+// CaptureStream records the packets stream continuously into fixed-length clips.
+// A clip is closed on the first keyframe after the camera's max recording length
+// and the next clip starts on that same keyframe so nothing is lost between clips.
 func CaptureStream(canxCtx context.Context,
 	configsvc config.IService,
+	storagesvc storage.IService,
 	errorsStream chan interface{},
 	packetsStream chan Packet,
+	subPacketsStream chan Packet,
+	healthStream chan string,
+	streams []Stream,
+	subStreams []Stream,
 	storageStream chan models.RecordingClip,
 	capturer string,
 	camera soicat.Camera) {
-	var file *os.File
-	var myMuxer *mp4.Movmuxer
-	var videoTrack uint32
-
-	// Get as many packets we need.
-	recordingStatus := "idle"
-	recordingStart := time.Now().Unix()
-	recordingStartTS := time.Now()
-	frames := 0
+	var writer *clipWriter
+	conditions := []string{}
 
 	for {
 		select {
 		case <-canxCtx.Done():
 			fmt.Printf("CaptureStream context is cancelled\n")
+			// Finalize the clip in progress so it is still playable
+			closeClip(configsvc, storagesvc, errorsStream, storageStream, writer, capturer, camera)
 			return
+		case pkt := <-subPacketsStream:
+			writeSubPacket(errorsStream, writer, subStreams, pkt)
+		case condition := <-healthStream:
+			conditions = tagHealth(writer, append(conditions, condition))
 		case pkt := <-packetsStream:
-			if recordingStatus == "idle" {
+			conditions = tagHealth(writer, conditions)
+
+			if writer == nil {
 				// Start recording only when we receive a key frame packet
 				if pkt.IsVideo && pkt.IsKeyFrame {
-					recordingStart = time.Now().Unix()
-					recordingStartTS = time.Now()
-					fullName := fmt.Sprintf("%s/%s/%s.mp4", configsvc.GetCapturer().RecordingsFolder, camera.Name, strconv.FormatInt(recordingStart, 10))
-
-					var err error
-					file, err = os.Create(fullName)
-					if err != nil {
-						errorsStream <- fmt.Errorf("capturestream: %v", err.Error())
-					}
-
-					myMuxer, _ = mp4.CreateMp4Muxer(file)
-					// We choose between H264 and H265
-					width := camera.CaptureWidth
-					height := camera.CaptureHeight
-					widthOption := mp4.WithVideoWidth(uint32(width))
-					heightOption := mp4.WithVideoHeight(uint32(height))
-
-					// Write video header
-					if pkt.Codec == "H264" {
-						videoTrack = myMuxer.AddVideoTrack(mp4.MP4_CODEC_H264, widthOption, heightOption)
-					} else if pkt.Codec == "H265" {
-						videoTrack = myMuxer.AddVideoTrack(mp4.MP4_CODEC_H265, widthOption, heightOption)
-					}
-
-					// Write video packet
-					ttime := uint64(pkt.Time.Milliseconds())
-					if err := myMuxer.Write(videoTrack, pkt.Data, ttime, ttime); err != nil {
-						errorsStream <- fmt.Errorf("capturestream: %v", err.Error())
-					}
-
-					// Reset the frames counter (header + 1st packet)
-					frames = 2
-
-					// Switch to recording mode
-					recordingStatus = "recording"
+					writer = openClip(configsvc, errorsStream, camera, streams, pkt)
+				}
+				continue
+			}
+
+			// Rotate the clip only if we have exceeded the max length and a keyframe arrives
+			if pkt.IsVideo && pkt.IsKeyFrame && writer.elapsed() >= maxRecordingLength(camera) {
+				closeClip(configsvc, storagesvc, errorsStream, storageStream, writer, capturer, camera)
+				writer = openClip(configsvc, errorsStream, camera, streams, pkt)
+				continue
+			}
+
+			writePacket(errorsStream, writer, pkt)
+		}
+	}
+}
+
+// CaptureTriggered buffers the packets stream in a GOP ring buffer and records only when triggered.
+// A trigger carries the time recording was requested: the clip starts from the buffered keyframe
+// preceding that time minus the pre-event duration, and keeps recording for the camera's max
+// recording length after the latest trigger. Triggers that arrive while recording extend the clip.
+func CaptureTriggered(canxCtx context.Context,
+	configsvc config.IService,
+	storagesvc storage.IService,
+	errorsStream chan interface{},
+	packetsStream chan Packet,
+	subPacketsStream chan Packet,
+	healthStream chan string,
+	triggersStream chan time.Time,
+	streams []Stream,
+	subStreams []Stream,
+	storageStream chan models.RecordingClip,
+	capturer string,
+	camera soicat.Camera) {
+	var writer *clipWriter
+	buffer := NewGOPBuffer(preEventDuration())
+	recordUntil := time.Time{}
+	pending := false
+	conditions := []string{}
+
+	for {
+		select {
+		case <-canxCtx.Done():
+			fmt.Printf("CaptureTriggered context is cancelled\n")
+			// Finalize the clip in progress so it is still playable
+			closeClip(configsvc, storagesvc, errorsStream, storageStream, writer, capturer, camera)
+			return
+		case pkt := <-subPacketsStream:
+			writeSubPacket(errorsStream, writer, subStreams, pkt)
+		case condition := <-healthStream:
+			conditions = tagHealth(writer, append(conditions, condition))
+		case t := <-triggersStream:
+			if t.Add(maxRecordingLength(camera)).After(recordUntil) {
+				recordUntil = t.Add(maxRecordingLength(camera))
+			}
+
+			if writer != nil {
+				continue
+			}
+
+			// Flush the pre-event packets into a new clip
+			packets := buffer.Since(t.Add(-buffer.Duration()))
+			if len(packets) == 0 {
+				// No keyframe yet...start on the next one
+				pending = true
+				continue
+			}
+
+			writer = openClip(configsvc, errorsStream, camera, streams, packets[0])
+			if writer == nil {
+				// Keep the pre-event packets for the next trigger
+				continue
+			}
+			for _, pkt := range packets[1:] {
+				writePacket(errorsStream, writer, pkt)
+			}
+			buffer.Reset()
+		case pkt := <-packetsStream:
+			conditions = tagHealth(writer, conditions)
+
+			if writer == nil {
+				if pending && pkt.IsVideo && pkt.IsKeyFrame {
+					pending = false
+					writer = openClip(configsvc, errorsStream, camera, streams, pkt)
+					continue
+				}
+
+				buffer.Push(pkt)
+				continue
+			}
+
+			if pkt.IsVideo && pkt.IsKeyFrame {
+				// Stop recording once the latest trigger has expired
+				if !time.Now().Before(recordUntil) {
+					closeClip(configsvc, storagesvc, errorsStream, storageStream, writer, capturer, camera)
+					writer = nil
+					buffer.Push(pkt)
+					continue
 				}
-			} else {
-				// Stop recording only if we have exceeded the timeout and a keyframe arrives
-				if pkt.IsVideo && pkt.IsKeyFrame && ((recordingStart + camera.MaxLengthRecording) <= time.Now().Unix()) {
-
-					// Write video trailer
-					if err := myMuxer.WriteTrailer(); err != nil {
-						errorsStream <- fmt.Errorf("capturestream: %v", err.Error())
-					}
-
-					// Include the trailer
-					frames++
-
-					fmt.Printf("CaptureStream - file save: %s - frames: %d\n", file.Name(), frames)
-
-					// Close the file and cleanup muxer
-					file.Close()
-
-					// Send the recording clip via the storage stream
-					num, err := strconv.Atoi(camera.ID)
-					if err != nil {
-						fmt.Printf("capturestream - unable to create a clip %v\n", err)
-						errorsStream <- fmt.Errorf("capturestream: %v", err.Error())
-					}
-					storageStream <- models.RecordingClip{
-						ID:                       uuid.NewString(),
-						CreateTime:               time.Now(),
-						LocalReference:           fmt.Sprintf("%s/%s/%s", configsvc.GetCapturer().RecordingsFolder, camera.Name, file.Name()),
-						CloudReference:           "",
-						Capturer:                 capturer,
-						Camera:                   camera.Name,
-						CameraID:                 num,
-						Region:                   camera.Region,
-						Location:                 camera.Location,
-						Priority:                 camera.Priority,
-						Analytics:                camera.Analytics,
-						AlertTypes:               camera.AlertTypes,
-						MediaIndexerTypes:        camera.MediaIndexerTypes,
-						Frames:                   frames,
-						RecordingBeginTime:       recordingStartTS,
-						RecordingEndTime:         time.Now(),
-						PublishTime:              time.Now(),
-						ModelInvocationBeginTime: time.Now(),
-						ModelInvocationEndTime:   time.Now(),
-						AlertInvocationBeginTime: time.Now(),
-						AlertInvocationEndTime:   time.Now(),
-						IndexTime:                time.Now(),
-					}
-
-					// Remove the file reference
-					file = nil
-
-					// Switch to idle mode
-					recordingStatus = "idle"
-				} else if pkt.IsVideo {
-					// Write video packet
-					ttime := uint64(pkt.Time.Milliseconds())
-					if err := myMuxer.Write(videoTrack, pkt.Data, ttime, ttime); err != nil {
-						errorsStream <- fmt.Errorf("capturestream: %v", err.Error())
-					}
-
-					// Add a video frame
-					frames++
+
+				// Still triggered but the clip is long enough...rotate it
+				if writer.elapsed() >= maxRecordingLength(camera) {
+					closeClip(configsvc, storagesvc, errorsStream, storageStream, writer, capturer, camera)
+					writer = openClip(configsvc, errorsStream, camera, streams, pkt)
+					continue
 				}
 			}
+
+			writePacket(errorsStream, writer, pkt)
+		}
+	}
+}
+
+func maxRecordingLength(camera soicat.Camera) time.Duration {
+	return time.Duration(camera.MaxLengthRecording) * time.Second
+}
+
+// Fragmented clips survive a crash: they can be finalised at the next start.
+func fragmentedMP4() bool {
+	return os.Getenv("CAPTURER_FRAGMENTED_MP4") == "true"
+}
+
+func openClip(configsvc config.IService, errorsStream chan interface{}, camera soicat.Camera, streams []Stream, pkt Packet) *clipWriter {
+	writer, err := newClipWriter(configsvc, camera, streams, pkt)
+	if err != nil {
+		errorsStream <- errorlog.Errorf(errorlog.Mux, "capturestream: %v", err.Error())
+		return nil
+	}
+
+	writePacket(errorsStream, writer, pkt)
+	return writer
+}
+
+// writeSubPacket records a sub-stream packet into the sub-stream clip of the clip in progress.
+// The sub-stream clip starts on the first sub-stream key frame after the clip started.
+func writeSubPacket(errorsStream chan interface{}, writer *clipWriter, subStreams []Stream, pkt Packet) {
+	if writer == nil || !pkt.IsVideo {
+		return
+	}
+
+	if writer.sub == nil {
+		if !pkt.IsKeyFrame || writer.subFailed {
+			return
+		}
+
+		sub, err := newSubStreamWriter(writer, subStreams, pkt.Codec)
+		if err != nil {
+			// Do not try again for every key frame of this clip
+			writer.subFailed = true
+			errorsStream <- errorlog.Errorf(errorlog.Mux, "capturestream: %v", err.Error())
+			return
+		}
+		writer.sub = sub
+	}
+
+	writePacket(errorsStream, writer.sub, pkt)
+}
+
+// tagHealth hands the camera health conditions to the clip in progress. They wait for the next clip if there is none.
+func tagHealth(writer *clipWriter, conditions []string) []string {
+	if writer == nil || len(conditions) == 0 {
+		return conditions
+	}
+
+	writer.health = append(writer.health, conditions...)
+	return []string{}
+}
+
+func writePacket(errorsStream chan interface{}, writer *clipWriter, pkt Packet) {
+	if writer == nil {
+		return
+	}
+
+	if err := writer.write(pkt); err != nil {
+		errorsStream <- errorlog.Errorf(errorlog.Mux, "capturestream: %v", err.Error())
+	}
+}
+
+func closeClip(configsvc config.IService,
+	storagesvc storage.IService,
+	errorsStream chan interface{},
+	storageStream chan models.RecordingClip,
+	writer *clipWriter,
+	capturer string,
+	camera soicat.Camera) {
+	if writer == nil {
+		return
+	}
+
+	if err := writer.close(); err != nil {
+		errorsStream <- errorlog.Errorf(errorlog.Mux, "capturestream: %v", err.Error())
+	}
+
+	fmt.Printf("CaptureStream - file save: %s - frames: %d\n", writer.name, writer.clock.frames)
+
+	// The previews are a convenience...the clip is sent without them if they fail
+	if writer.preview != nil {
+		if err := writer.preview.close(writer.name); err != nil {
+			fmt.Printf("capturestream - unable to save the previews of %s: %v\n", writer.name, err)
 		}
 	}
+
+	// Send the recording clip via the storage stream stamped with its media time
+	timing := writer.clock.timing(camera.Name)
+	clip, err := newRecordingClip(configsvc, capturer, camera, writer.name, timing.Frames, timing.BeginTime, timing.EndTime)
+	if err != nil {
+		fmt.Printf("capturestream - unable to create a clip %v\n", err)
+		errorsStream <- errorlog.Errorf(errorlog.Mux, "capturestream: %v", err.Error())
+	}
+
+	// The spool raises a camera health alert for every condition the clip is tagged with
+	for _, condition := range writer.health {
+		clip.Tags = append(clip.Tags, health.Tag(condition))
+	}
+	clip.TagsCount = len(clip.Tags)
+
+	// The timing is a convenience...the clip is sent without it if it fails
+	timing.ClipID = clip.ID
+	fmt.Printf("CaptureStream - file timing: %s - clock: %s - begin: %s - duration: %dms - fps: %.2f - dropped frames: %d\n",
+		writer.name, timing.Clock, timing.BeginTime.UTC().Format(time.RFC3339Nano), timing.Duration, timing.FPS, timing.DroppedFrames)
+	err = storeClipTiming(storagesvc, timing)
+	if err != nil {
+		fmt.Printf("capturestream - unable to store the timing of %s: %v\n", writer.name, err)
+	}
+	storageStream <- clip
+}
+
+// clipWriter muxes packets into a single MP4 clip in the camera's recordings folder.
+// MJPEG packets cannot be muxed into MP4, so they are transcoded to H264 by FFmpeg instead.
+// The clip's key frames feed its thumbnail and sprite sheet and its video frames are timed by its clock.
+// A fragmented clip gets a moof/mdat fragment per GOP so it stays playable up to its last
+// fragment if the capturer dies before the clip is closed.
+// If the camera has a sub-stream, it is recorded into a sub-stream clip next to the clip.
+// The camera health conditions raised while recording are tagged on the clip.
+type clipWriter struct {
+	name       string
+	file       *os.File
+	muxer      *mp4.Movmuxer
+	transcoder *clipTranscoder
+	preview    *clipPreview
+	videoTrack uint32
+	clock      clipClock
+	beginTime  time.Time
+	fragmented bool
+	sub        *clipWriter
+	subFailed  bool
+	health     []string // camera health conditions raised while recording
+
+	// Audio is optional
+	audioTrack  uint32
+	audioCodec  string
+	audioConfig *mpeg4audio.Config
+
+	// The first video packet time, audio before it is dropped
+	startTime time.Duration
+	started   bool
+}
+
+// newClipWriter creates a clip that begins with its first packet. In triggered mode, the first packet is the
+// buffered pre-event key frame, so the clip begins when that packet arrived, not when it is flushed.
+func newClipWriter(configsvc config.IService, camera soicat.Camera, streams []Stream, first Packet) (*clipWriter, error) {
+	beginTime := first.ArrivalTime
+	if beginTime.IsZero() {
+		beginTime = time.Now()
+	}
+
+	fullName := fmt.Sprintf("%s/%s/%s.mp4", configsvc.GetCapturer().RecordingsFolder, camera.Name, strconv.FormatInt(beginTime.Unix(), 10))
+	return createClipWriter(fullName, beginTime, camera, streams, first.Codec, true)
+}
+
+// newSubStreamWriter creates the sub-stream clip of a clip. It has no previews: the clip has them.
+func newSubStreamWriter(w *clipWriter, subStreams []Stream, codec string) (*clipWriter, error) {
+	if len(subStreams) == 0 {
+		return nil, fmt.Errorf("no sub-stream to record")
+	}
+
+	subCamera := soicat.Camera{
+		CaptureWidth:  subStreams[0].Width,
+		CaptureHeight: subStreams[0].Height,
+	}
+	return createClipWriter(spool.SubStreamFile(w.name), time.Now(), subCamera, subStreams, codec, false)
+}
+
+// openClipPreview opens the clip's preview once the clip is created so its decoder never leaks.
+func openClipPreview(codec string, withPreview bool) *clipPreview {
+	if !withPreview {
+		return nil
+	}
+
+	return openPreview(codec)
+}
+
+func createClipWriter(fullName string, beginTime time.Time, camera soicat.Camera, streams []Stream, codec string, withPreview bool) (*clipWriter, error) {
+	if codec == "MJPEG" {
+		transcoder, err := newClipTranscoder(fullName, streams)
+		if err != nil {
+			return nil, err
+		}
+
+		return &clipWriter{
+			name:       fullName,
+			transcoder: transcoder,
+			preview:    openClipPreview(codec, withPreview),
+			beginTime:  beginTime,
+		}, nil
+	}
+
+	file, err := os.Create(fullName)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []mp4.MuxerOption{}
+	if fragmentedMP4() {
+		options = append(options, mp4.WithMp4Flag(mp4.MP4_FLAG_FRAGMENT))
+	}
+
+	muxer, err := mp4.CreateMp4Muxer(file, options...)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// We choose between H264 and H265
+	widthOption := mp4.WithVideoWidth(uint32(camera.CaptureWidth))
+	heightOption := mp4.WithVideoHeight(uint32(camera.CaptureHeight))
+
+	// Write video header
+	var videoTrack uint32
+	if codec == "H264" {
+		videoTrack = muxer.AddVideoTrack(mp4.MP4_CODEC_H264, widthOption, heightOption)
+	} else if codec == "H265" {
+		videoTrack = muxer.AddVideoTrack(mp4.MP4_CODEC_H265, widthOption, heightOption)
+	}
+
+	writer := &clipWriter{
+		name:       fullName,
+		file:       file,
+		muxer:      muxer,
+		preview:    openClipPreview(codec, withPreview),
+		videoTrack: videoTrack,
+		beginTime:  beginTime,
+		fragmented: fragmentedMP4(),
+	}
+
+	// Write audio header if the camera has audio
+	for _, stream := range streams {
+		if !stream.IsAudio || stream.IsBackChannel {
+			continue
+		}
+
+		channelsOption := mp4.WithAudioChannelCount(uint8(stream.ChannelCount))
+		sampleRateOption := mp4.WithAudioSampleRate(uint32(stream.SampleRate))
+		if stream.Name == "AAC" {
+			var config mpeg4audio.Config
+			err := config.Unmarshal(stream.Config)
+			if err != nil {
+				fmt.Printf("capturestream - unable to decode the AAC config, dropping audio: %v\n", err)
+				break
+			}
+			writer.audioConfig = &config
+			writer.audioTrack = muxer.AddAudioTrack(mp4.MP4_CODEC_AAC, channelsOption, sampleRateOption)
+		} else if stream.Name == "PCMU" {
+			writer.audioTrack = muxer.AddAudioTrack(mp4.MP4_CODEC_G711U, channelsOption, sampleRateOption, mp4.WithAudioSampleBits(8))
+		} else if stream.Name == "PCMA" {
+			writer.audioTrack = muxer.AddAudioTrack(mp4.MP4_CODEC_G711A, channelsOption, sampleRateOption, mp4.WithAudioSampleBits(8))
+		} else {
+			continue
+		}
+		writer.audioCodec = stream.Name
+		break
+	}
+
+	return writer, nil
+}
+
+func (w *clipWriter) write(pkt Packet) error {
+	if pkt.IsAudio {
+		return w.writeAudio(pkt)
+	}
+
+	if !pkt.IsVideo {
+		return nil
+	}
+
+	w.clock.add(pkt)
+
+	if w.preview != nil {
+		w.preview.write(pkt)
+	}
+
+	if w.transcoder != nil {
+		if err := w.transcoder.write(pkt.Data); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	if !w.started {
+		w.started = true
+		w.startTime = pkt.Time
+	} else if w.fragmented && pkt.IsKeyFrame {
+		// The GOP is complete...write it as a fragment and make sure it is on disk
+		if err := w.muxer.FlushFragment(); err != nil {
+			return err
+		}
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	// Write video packet
+	ttime := uint64(pkt.Time.Milliseconds())
+	if err := w.muxer.Write(w.videoTrack, pkt.Data, ttime, ttime); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (w *clipWriter) writeAudio(pkt Packet) error {
+	// Audio must not start before the video
+	if w.transcoder != nil || w.audioCodec == "" || pkt.Codec != w.audioCodec || !w.started || pkt.Time < w.startTime {
+		return nil
+	}
+
+	data := pkt.Data
+	if w.audioCodec == "AAC" {
+		// The MP4 muxer expects ADTS framed access units
+		adts, err := mpeg4audio.ADTSPackets{{
+			Type:         w.audioConfig.Type,
+			SampleRate:   w.audioConfig.SampleRate,
+			ChannelCount: w.audioConfig.ChannelCount,
+			AU:           pkt.Data,
+		}}.Marshal()
+		if err != nil {
+			return err
+		}
+		data = adts
+	}
+
+	// Write audio packet on the same timeline as the video
+	ttime := uint64(pkt.Time.Milliseconds())
+	return w.muxer.Write(w.audioTrack, data, ttime, ttime)
+}
+
+func (w *clipWriter) elapsed() time.Duration {
+	return time.Since(w.beginTime)
+}
+
+func (w *clipWriter) close() error {
+	// The sub-stream clip is a convenience...the clip is closed without it if it fails
+	if w.sub != nil {
+		if err := w.sub.close(); err != nil {
+			fmt.Printf("capturestream - unable to close the sub-stream clip %s: %v\n", w.sub.name, err)
+		}
+	}
+
+	if w.transcoder != nil {
+		return w.transcoder.close()
+	}
+
+	// Write video trailer
+	err := w.muxer.WriteTrailer()
+
+	// Close the file and cleanup muxer
+	w.file.Close()
+	return err
+}
+
+func newRecordingClip(configsvc config.IService, capturer string, camera soicat.Camera, name string, frames int, beginTime, endTime time.Time) (models.RecordingClip, error) {
+	num, err := strconv.Atoi(camera.ID)
+
+	return models.RecordingClip{
+		ID:                       uuid.NewString(),
+		CreateTime:               time.Now(),
+		LocalReference:           name,
+		CloudReference:           "",
+		StorageProvider:          configsvc.GetRuntimeMode(),
+		Capturer:                 capturer,
+		Camera:                   camera.Name,
+		CameraID:                 num,
+		Region:                   camera.Region,
+		Location:                 camera.Location,
+		Priority:                 camera.Priority,
+		Analytics:                camera.Analytics,
+		AlertTypes:               camera.AlertTypes,
+		MediaIndexerTypes:        camera.MediaIndexerTypes,
+		Frames:                   frames,
+		RecordingBeginTime:       beginTime,
+		RecordingEndTime:         endTime,
+		PublishTime:              time.Now(),
+		ModelInvocationBeginTime: time.Now(),
+		ModelInvocationEndTime:   time.Now(),
+		AlertInvocationBeginTime: time.Now(),
+		AlertInvocationEndTime:   time.Now(),
+		IndexTime:                time.Now(),
+	}, err
 }
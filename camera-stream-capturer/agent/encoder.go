@@ -0,0 +1,200 @@
+package agent
+
+// #cgo pkg-config: libavcodec libavutil libswscale
+// #include <stdlib.h>
+// #include <libavcodec/avcodec.h>
+// #include <libavutil/opt.h>
+// #include <libswscale/swscale.h>
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"unsafe"
+)
+
+// Encoder scales decoded YUV 4:2:0 frames to a rendition's size and encodes them into H264 with libx264.
+// Frames are timestamped in milliseconds at the frame rate.
+type Encoder struct {
+	codecCtx  *C.AVCodecContext
+	swsCtx    *C.struct_SwsContext
+	dstFrame  *C.AVFrame
+	avPacket  *C.AVPacket
+	srcWidth  int
+	srcHeight int
+	frameRate float64
+	frames    int64
+}
+
+// EncodedPacket is an H264 access unit (Annex-B) coming out of the encoder.
+type EncodedPacket struct {
+	Data []byte
+	PTS  int64 // milliseconds
+	DTS  int64 // milliseconds
+}
+
+// newEncoder allocates an encoder for the profile and the frames' size.
+func newEncoder(profile TranscodingProfile, srcWidth, srcHeight int, frameRate float64) (*Encoder, error) {
+	name := C.CString("libx264")
+	defer C.free(unsafe.Pointer(name))
+	codec := C.avcodec_find_encoder_by_name(name)
+	if codec == nil {
+		return nil, fmt.Errorf("avcodec_find_encoder_by_name(libx264) failed")
+	}
+
+	codecCtx := C.avcodec_alloc_context3(codec)
+	if codecCtx == nil {
+		return nil, fmt.Errorf("avcodec_alloc_context3() failed")
+	}
+
+	width, height := renditionSize(srcWidth, srcHeight, profile.Height)
+	codecCtx.width = C.int(width)
+	codecCtx.height = C.int(height)
+	codecCtx.pix_fmt = C.AV_PIX_FMT_YUV420P
+	codecCtx.time_base = C.AVRational{num: 1, den: 1000}
+	codecCtx.framerate = C.AVRational{num: C.int(frameRate * 1000), den: 1000}
+	codecCtx.gop_size = C.int(frameRate * profile.keyFrameSeconds())
+	// Browsers play baseline without B-frames...and so are the other profiles to keep the timestamps simple
+	codecCtx.max_b_frames = 0
+	codecCtx.bit_rate = C.int64_t(profile.bitrate() * 1000)
+
+	for option, value := range map[string]string{"preset": "veryfast", "profile": profile.h264Profile()} {
+		cOption := C.CString(option)
+		cValue := C.CString(value)
+		res := C.av_opt_set(codecCtx.priv_data, cOption, cValue, 0)
+		C.free(unsafe.Pointer(cOption))
+		C.free(unsafe.Pointer(cValue))
+		if res < 0 {
+			C.avcodec_free_context(&codecCtx)
+			return nil, fmt.Errorf("av_opt_set(%s=%s) failed", option, value)
+		}
+	}
+
+	res := C.avcodec_open2(codecCtx, codec, nil)
+	if res < 0 {
+		C.avcodec_free_context(&codecCtx)
+		return nil, fmt.Errorf("avcodec_open2() failed")
+	}
+
+	e := &Encoder{
+		codecCtx:  codecCtx,
+		srcWidth:  srcWidth,
+		srcHeight: srcHeight,
+		frameRate: frameRate,
+	}
+
+	e.swsCtx = C.sws_getContext(C.int(srcWidth), C.int(srcHeight), C.AV_PIX_FMT_YUV420P,
+		C.int(width), C.int(height), C.AV_PIX_FMT_YUV420P, C.SWS_BILINEAR, nil, nil, nil)
+	if e.swsCtx == nil {
+		e.Close()
+		return nil, fmt.Errorf("sws_getContext() failed")
+	}
+
+	e.dstFrame = C.av_frame_alloc()
+	if e.dstFrame == nil {
+		e.Close()
+		return nil, fmt.Errorf("av_frame_alloc() failed")
+	}
+	e.dstFrame.format = C.AV_PIX_FMT_YUV420P
+	e.dstFrame.width = C.int(width)
+	e.dstFrame.height = C.int(height)
+	res = C.av_frame_get_buffer(e.dstFrame, 0)
+	if res < 0 {
+		e.Close()
+		return nil, fmt.Errorf("av_frame_get_buffer() failed")
+	}
+
+	e.avPacket = C.av_packet_alloc()
+	if e.avPacket == nil {
+		e.Close()
+		return nil, fmt.Errorf("av_packet_alloc() failed")
+	}
+
+	return e, nil
+}
+
+// Close frees the encoder.
+func (e *Encoder) Close() {
+	if e.swsCtx != nil {
+		C.sws_freeContext(e.swsCtx)
+		e.swsCtx = nil
+	}
+	if e.dstFrame != nil {
+		C.av_frame_free(&e.dstFrame)
+	}
+	if e.avPacket != nil {
+		C.av_packet_free(&e.avPacket)
+	}
+	C.avcodec_free_context(&e.codecCtx)
+}
+
+// encode scales the frame and hands the packets the encoder has ready to fn. The frame must be
+// a decoder's frame (C memory) of the encoder's source size.
+func (e *Encoder) encode(img image.YCbCr, fn func(pkt EncodedPacket) error) error {
+	if img.Rect.Dx() != e.srcWidth || img.Rect.Dy() != e.srcHeight {
+		return fmt.Errorf("frame size %dx%d is not the encoder's %dx%d", img.Rect.Dx(), img.Rect.Dy(), e.srcWidth, e.srcHeight)
+	}
+
+	res := C.av_frame_make_writable(e.dstFrame)
+	if res < 0 {
+		return fmt.Errorf("av_frame_make_writable() failed")
+	}
+
+	srcData := [4]*C.uint8_t{
+		(*C.uint8_t)(unsafe.Pointer(&img.Y[0])),
+		(*C.uint8_t)(unsafe.Pointer(&img.Cb[0])),
+		(*C.uint8_t)(unsafe.Pointer(&img.Cr[0])),
+		nil,
+	}
+	srcStride := [4]C.int{C.int(img.YStride), C.int(img.CStride), C.int(img.CStride), 0}
+	C.sws_scale(e.swsCtx, &srcData[0], &srcStride[0], 0, C.int(e.srcHeight), &e.dstFrame.data[0], &e.dstFrame.linesize[0])
+
+	e.dstFrame.pts = C.int64_t(float64(e.frames) * 1000 / e.frameRate)
+	e.frames++
+
+	res = C.avcodec_send_frame(e.codecCtx, e.dstFrame)
+	if res < 0 {
+		return fmt.Errorf("avcodec_send_frame() failed")
+	}
+
+	return e.receive(fn)
+}
+
+// drain signals the end of the frames and hands the packets the encoder still holds back to fn.
+func (e *Encoder) drain(fn func(pkt EncodedPacket) error) error {
+	res := C.avcodec_send_frame(e.codecCtx, nil)
+	if res < 0 {
+		return fmt.Errorf("avcodec_send_frame() failed")
+	}
+
+	return e.receive(fn)
+}
+
+func (e *Encoder) receive(fn func(pkt EncodedPacket) error) error {
+	for C.avcodec_receive_packet(e.codecCtx, e.avPacket) == 0 {
+		pkt := EncodedPacket{
+			Data: C.GoBytes(unsafe.Pointer(e.avPacket.data), e.avPacket.size),
+			PTS:  int64(e.avPacket.pts),
+			DTS:  int64(e.avPacket.dts),
+		}
+		C.av_packet_unref(e.avPacket)
+
+		err := fn(pkt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renditionSize scales the frames down to the height, keeping their aspect ratio. Frames are never scaled up.
+// yuv420p needs even dimensions.
+func renditionSize(srcWidth, srcHeight, height int) (int, int) {
+	if height <= 0 || height > srcHeight {
+		height = srcHeight
+	}
+
+	width := srcWidth * height / srcHeight
+	return width &^ 1, height &^ 1
+}
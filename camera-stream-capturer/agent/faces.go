@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// FaceDetector finds the faces in a frame so they can be blurred. The rectangles are in the frame's coordinates.
+type FaceDetector interface {
+	DetectFaces(img image.Image) ([]image.Rectangle, error)
+}
+
+// Face detectors are selected by the camera's privacy settings.
+var faceDetectors = map[string]func() (FaceDetector, error){
+	"http": newHTTPFaceDetector,
+}
+
+// RegisterFaceDetector makes a face detector available to the cameras' privacy settings.
+func RegisterFaceDetector(name string, fn func() (FaceDetector, error)) {
+	faceDetectors[name] = fn
+}
+
+func newFaceDetector(name string) (FaceDetector, error) {
+	fn, ok := faceDetectors[name]
+	if !ok {
+		return nil, fmt.Errorf("face detector %s not supported", name)
+	}
+
+	return fn()
+}
+
+// httpFaceDetector posts every frame as a JPEG to the face detection API at `CAPTURER_FACE_DETECTOR_URL`
+// which answers with the faces in normalized coordinates (0 ~ 1):
+//
+//	{"faces": [{"x": 0.42, "y": 0.18, "width": 0.06, "height": 0.1}]}
+type httpFaceDetector struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPFaceDetector() (FaceDetector, error) {
+	url := os.Getenv("CAPTURER_FACE_DETECTOR_URL")
+	if url == "" {
+		return nil, fmt.Errorf("%s env var is required by the http face detector", "CAPTURER_FACE_DETECTOR_URL")
+	}
+
+	return &httpFaceDetector{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (d *httpFaceDetector) DetectFaces(img image.Image) ([]image.Rectangle, error) {
+	var body bytes.Buffer
+	err := jpeg.Encode(&body, img, &jpeg.Options{Quality: 80})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := d.client.Post(d.url, "image/jpeg", &body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("face detector returned %s: %s", res.Status, strings.TrimSpace(string(b)))
+	}
+
+	response := struct {
+		Faces []struct {
+			X      float64 `json:"x"`
+			Y      float64 `json:"y"`
+			Width  float64 `json:"width"`
+			Height float64 `json:"height"`
+		} `json:"faces"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode the detected faces: %v", err)
+	}
+
+	bounds := img.Bounds()
+	faces := []image.Rectangle{}
+	for _, face := range response.Faces {
+		faces = append(faces, image.Rect(
+			bounds.Min.X+int(face.X*float64(bounds.Dx())),
+			bounds.Min.Y+int(face.Y*float64(bounds.Dy())),
+			bounds.Min.X+int((face.X+face.Width)*float64(bounds.Dx())),
+			bounds.Min.Y+int((face.Y+face.Height)*float64(bounds.Dy()))))
+	}
+
+	return faces, nil
+}
@@ -22,10 +22,15 @@ import (
 	"github.com/bluenviron/gortsplib/v4/pkg/format"
 	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
 	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph265"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtplpcm"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtpmpeg4audio"
 	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
 	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
 	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
 	"github.com/pion/rtp"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/errorlog"
 )
 
 func NewRTSPClient(rtspURL string) *Golibrtsp {
@@ -54,7 +59,20 @@ type Golibrtsp struct {
 	VideoH265Decoder      *rtph265.Decoder
 	VideoH265FrameDecoder *Decoder
 
+	AudioMPEG4Index   int8
+	AudioMPEG4Media   *description.Media
+	AudioMPEG4Forma   *format.MPEG4Audio
+	AudioMPEG4Decoder *rtpmpeg4audio.Decoder
+
+	AudioG711Index   int8
+	AudioG711Media   *description.Media
+	AudioG711Forma   *format.G711
+	AudioG711Decoder *rtplpcm.Decoder
+
 	Streams []Stream
+
+	// Called with every H264 video RTP packet, i.e. to forward them to WebRTC viewers
+	VideoRTPForwarder func(pkt *rtp.Packet)
 }
 
 // Connect to the RTSP server.
@@ -98,6 +116,15 @@ func (g *Golibrtsp) Connect(_ context.Context) error {
 		return fmt.Errorf("both H264 and H265 are not supported: %v and %v", h264Err.Error(), h265Err.Error())
 	}
 
+	// Setup audio (AAC or G711), audio is optional
+	mpeg4Err := g.setupMPEG4Audio(desc)
+	if mpeg4Err != nil {
+		g711Err := g.setupG711(desc)
+		if g711Err != nil {
+			fmt.Printf("capture.golibrtsp.Connect(): no audio: %v and %v\n", mpeg4Err, g711Err)
+		}
+	}
+
 	return nil
 }
 
@@ -227,8 +254,111 @@ func (g *Golibrtsp) setupH265(desc *description.Session) error {
 	return nil
 }
 
+func (g *Golibrtsp) setupMPEG4Audio(desc *description.Session) error {
+	// find the AAC media and format
+	var formaMPEG4 *format.MPEG4Audio
+	mediMPEG4 := desc.FindFormat(&formaMPEG4)
+	if mediMPEG4 == nil {
+		return fmt.Errorf("capture.golibrtsp.Connect(AAC) - audio media not found")
+	}
+
+	// Get the audio specific config from the SDP
+	config := formaMPEG4.Config
+	if formaMPEG4.LATM {
+		if formaMPEG4.StreamMuxConfig == nil || len(formaMPEG4.StreamMuxConfig.Programs) == 0 || len(formaMPEG4.StreamMuxConfig.Programs[0].Layers) == 0 {
+			return fmt.Errorf("capture.golibrtsp.Connect(AAC) - stream mux config not found")
+		}
+		config = formaMPEG4.StreamMuxConfig.Programs[0].Layers[0].AudioSpecificConfig
+	}
+	if config == nil {
+		return fmt.Errorf("capture.golibrtsp.Connect(AAC) - audio specific config not found")
+	}
+
+	asc, err := config.Marshal()
+	if err != nil {
+		return err
+	}
+
+	// setup RTP/AAC -> AAC access units decoder
+	rtpDec, err := formaMPEG4.CreateDecoder()
+	if err != nil {
+		return err
+	}
+
+	// setup an audio media
+	_, err = g.Client.Setup(desc.BaseURL, mediMPEG4, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	g.AudioMPEG4Media = mediMPEG4
+	g.AudioMPEG4Forma = formaMPEG4
+	g.AudioMPEG4Decoder = rtpDec
+
+	g.Streams = append(g.Streams, Stream{
+		Name:          "AAC",
+		IsVideo:       false,
+		IsAudio:       true,
+		SampleRate:    config.SampleRate,
+		ChannelCount:  config.ChannelCount,
+		Config:        asc,
+		IsBackChannel: false,
+	})
+
+	// Set the index for the audio
+	g.AudioMPEG4Index = int8(len(g.Streams)) - 1
+
+	return nil
+}
+
+func (g *Golibrtsp) setupG711(desc *description.Session) error {
+	// find the G711 media and format
+	var formaG711 *format.G711
+	mediG711 := desc.FindFormat(&formaG711)
+	if mediG711 == nil {
+		return fmt.Errorf("capture.golibrtsp.Connect(G711) - audio media not found")
+	}
+
+	// setup RTP/G711 -> samples decoder
+	rtpDec, err := formaG711.CreateDecoder()
+	if err != nil {
+		return err
+	}
+
+	// setup an audio media
+	_, err = g.Client.Setup(desc.BaseURL, mediG711, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	g.AudioG711Media = mediG711
+	g.AudioG711Forma = formaG711
+	g.AudioG711Decoder = rtpDec
+
+	g.Streams = append(g.Streams, Stream{
+		Name:          g711Codec(formaG711),
+		IsVideo:       false,
+		IsAudio:       true,
+		SampleRate:    formaG711.SampleRate,
+		ChannelCount:  formaG711.ChannelCount,
+		IsBackChannel: false,
+	})
+
+	// Set the index for the audio
+	g.AudioG711Index = int8(len(g.Streams)) - 1
+
+	return nil
+}
+
+func g711Codec(forma *format.G711) string {
+	if forma.MULaw {
+		return "PCMU"
+	}
+	return "PCMA"
+}
+
 // Start the RTSP client, and start reading packets.
-func (g *Golibrtsp) Start(_ context.Context, errorsStream chan interface{}, packetsStream chan Packet, camera soicat.Camera) error {
+func (g *Golibrtsp) Start(_ context.Context, errorsStream chan interface{}, push func(Packet), camera soicat.Camera) error {
 	fmt.Printf("capture.golibrtsp.Start(): started\n")
 
 	// called when a video RTP packet arrives for H264
@@ -238,10 +368,15 @@ func (g *Golibrtsp) Start(_ context.Context, errorsStream chan interface{}, pack
 
 			if len(rtppkt.Payload) > 0 {
 
+				// forward the packet as is
+				if g.VideoRTPForwarder != nil {
+					g.VideoRTPForwarder(rtppkt)
+				}
+
 				// decode timestamp
 				pts, ok := g.Client.PacketPTS(g.VideoH264Media, rtppkt)
 				if !ok {
-					errorsStream <- fmt.Errorf("capture.golibrtsp.Start(): %s", "unable to get PTS")
+					reportError(errorsStream, errorlog.Errorf(errorlog.Decode, "capture.golibrtsp.Start(): %s", "unable to get PTS"))
 					return
 				}
 
@@ -252,7 +387,7 @@ func (g *Golibrtsp) Start(_ context.Context, errorsStream chan interface{}, pack
 				au, errDecode := g.VideoH264Decoder.Decode(rtppkt)
 				if errDecode != nil {
 					if errDecode != rtph264.ErrNonStartingPacketAndNoPrevious && errDecode != rtph264.ErrMorePacketsNeeded {
-						errorsStream <- fmt.Errorf("capture.golibrtsp.Start(): %v", errDecode)
+						reportError(errorsStream, errorlog.Errorf(errorlog.Decode, "capture.golibrtsp.Start(): %v", errDecode))
 					}
 					return
 				}
@@ -306,7 +441,7 @@ func (g *Golibrtsp) Start(_ context.Context, errorsStream chan interface{}, pack
 				// Convert to packet.
 				enc, err := h264.AnnexBMarshal(filteredAU)
 				if err != nil {
-					errorsStream <- fmt.Errorf("capture.golibrtsp.Start(): %v", err)
+					reportError(errorsStream, errorlog.Errorf(errorlog.Decode, "capture.golibrtsp.Start(): %v", err))
 					return
 				}
 
@@ -320,6 +455,12 @@ func (g *Golibrtsp) Start(_ context.Context, errorsStream chan interface{}, pack
 					IsVideo:         true,
 					IsAudio:         false,
 					Codec:           "H264",
+					ArrivalTime:     time.Now(),
+				}
+
+				// Map the RTP time to the camera's wall-clock
+				if ntp, ok := g.Client.PacketNTP(g.VideoH264Media, rtppkt); ok {
+					pkt.NTP = ntp
 				}
 
 				pkt.Data = pkt.Data[4:]
@@ -332,7 +473,7 @@ func (g *Golibrtsp) Start(_ context.Context, errorsStream chan interface{}, pack
 					pkt.Data = append(annexbNALUStartCode(), pkt.Data...)
 				}
 
-				packetsStream <- pkt
+				push(pkt)
 			}
 
 		})
@@ -347,7 +488,7 @@ func (g *Golibrtsp) Start(_ context.Context, errorsStream chan interface{}, pack
 				// decode timestamp
 				pts, ok := g.Client.PacketPTS(g.VideoH265Media, rtppkt)
 				if !ok {
-					errorsStream <- fmt.Errorf("capture.golibrtsp.Start(): %s", "unable to get PTS")
+					reportError(errorsStream, errorlog.Errorf(errorlog.Decode, "capture.golibrtsp.Start(): %s", "unable to get PTS"))
 					return
 				}
 
@@ -358,7 +499,7 @@ func (g *Golibrtsp) Start(_ context.Context, errorsStream chan interface{}, pack
 				au, errDecode := g.VideoH265Decoder.Decode(rtppkt)
 				if errDecode != nil {
 					if errDecode != rtph265.ErrNonStartingPacketAndNoPrevious && errDecode != rtph265.ErrMorePacketsNeeded {
-						errorsStream <- fmt.Errorf("capture.golibrtsp.Start(): %v", errDecode)
+						reportError(errorsStream, errorlog.Errorf(errorlog.Decode, "capture.golibrtsp.Start(): %v", errDecode))
 					}
 					return
 				}
@@ -401,7 +542,7 @@ func (g *Golibrtsp) Start(_ context.Context, errorsStream chan interface{}, pack
 
 				enc, err := h264.AnnexBMarshal(au)
 				if err != nil {
-					errorsStream <- fmt.Errorf("capture.golibrtsp.Start(): %v", err)
+					reportError(errorsStream, errorlog.Errorf(errorlog.Decode, "capture.golibrtsp.Start(): %v", err))
 					return
 				}
 
@@ -415,11 +556,85 @@ func (g *Golibrtsp) Start(_ context.Context, errorsStream chan interface{}, pack
 					IsVideo:         true,
 					IsAudio:         false,
 					Codec:           "H265",
+					ArrivalTime:     time.Now(),
 				}
 
-				packetsStream <- pkt
+				// Map the RTP time to the camera's wall-clock
+				if ntp, ok := g.Client.PacketNTP(g.VideoH265Media, rtppkt); ok {
+					pkt.NTP = ntp
+				}
+
+				push(pkt)
+			}
+
+		})
+	}
+
+	// called when an audio RTP packet arrives for AAC
+	if g.AudioMPEG4Media != nil && g.AudioMPEG4Forma != nil {
+		sampleRate := g.Streams[g.AudioMPEG4Index].SampleRate
+		g.Client.OnPacketRTP(g.AudioMPEG4Media, g.AudioMPEG4Forma, func(rtppkt *rtp.Packet) {
+			// decode timestamp, it is synchronized with the video timestamps
+			pts, ok := g.Client.PacketPTS(g.AudioMPEG4Media, rtppkt)
+			if !ok {
+				reportError(errorsStream, errorlog.Errorf(errorlog.Decode, "capture.golibrtsp.Start(): %s", "unable to get PTS"))
+				return
+			}
+
+			// Extract access units from RTP packets
+			aus, errDecode := g.AudioMPEG4Decoder.Decode(rtppkt)
+			if errDecode != nil {
+				if errDecode != rtpmpeg4audio.ErrMorePacketsNeeded {
+					reportError(errorsStream, errorlog.Errorf(errorlog.Decode, "capture.golibrtsp.Start(): %v", errDecode))
+				}
+				return
+			}
+
+			// An RTP packet can carry several access units of 1024 samples each
+			for i, au := range aus {
+				push(Packet{
+					IsKeyFrame:      false,
+					Packet:          rtppkt,
+					Data:            au,
+					Time:            pts + time.Duration(i*mpeg4audio.SamplesPerAccessUnit)*time.Second/time.Duration(sampleRate),
+					CompositionTime: pts,
+					Idx:             g.AudioMPEG4Index,
+					IsVideo:         false,
+					IsAudio:         true,
+					Codec:           "AAC",
+				})
+			}
+		})
+	}
+
+	// called when an audio RTP packet arrives for G711
+	if g.AudioG711Media != nil && g.AudioG711Forma != nil {
+		codec := g711Codec(g.AudioG711Forma)
+		g.Client.OnPacketRTP(g.AudioG711Media, g.AudioG711Forma, func(rtppkt *rtp.Packet) {
+			// decode timestamp, it is synchronized with the video timestamps
+			pts, ok := g.Client.PacketPTS(g.AudioG711Media, rtppkt)
+			if !ok {
+				reportError(errorsStream, errorlog.Errorf(errorlog.Decode, "capture.golibrtsp.Start(): %s", "unable to get PTS"))
+				return
 			}
 
+			samples, errDecode := g.AudioG711Decoder.Decode(rtppkt)
+			if errDecode != nil {
+				reportError(errorsStream, errorlog.Errorf(errorlog.Decode, "capture.golibrtsp.Start(): %v", errDecode))
+				return
+			}
+
+			push(Packet{
+				IsKeyFrame:      false,
+				Packet:          rtppkt,
+				Data:            samples,
+				Time:            pts,
+				CompositionTime: pts,
+				Idx:             g.AudioG711Index,
+				IsVideo:         false,
+				IsAudio:         true,
+				Codec:           codec,
+			})
 		})
 	}
 
@@ -521,11 +736,16 @@ func (g *Golibrtsp) Resume() error {
 	return err
 }
 
+// Wait until the connection to the RTSP server is closed or fails.
+func (g *Golibrtsp) Wait() error {
+	return g.Client.Wait()
+}
+
 // Close the connection to the RTSP server.
 func (g *Golibrtsp) Close() error {
 	// Close the demuxer.
 	g.Client.Close()
-	if g.VideoH264Decoder != nil {
+	if g.VideoH264FrameDecoder != nil {
 		g.VideoH264FrameDecoder.Close()
 	}
 	if g.VideoH265FrameDecoder != nil {
@@ -610,26 +830,43 @@ func (d *Decoder) decode(nalu []byte) (image.YCbCr, error) {
 	}
 
 	if res == 0 {
-		fr := d.srcFrame
-		w := int(fr.width)
-		h := int(fr.height)
-		ys := int(fr.linesize[0])
-		cs := int(fr.linesize[1])
-
-		return image.YCbCr{
-			Y:              fromCPtr(unsafe.Pointer(fr.data[0]), ys*h),
-			Cb:             fromCPtr(unsafe.Pointer(fr.data[1]), cs*h/2),
-			Cr:             fromCPtr(unsafe.Pointer(fr.data[2]), cs*h/2),
-			YStride:        ys,
-			CStride:        cs,
-			SubsampleRatio: image.YCbCrSubsampleRatio420,
-			Rect:           image.Rect(0, 0, w, h),
-		}, nil
+		return d.frameYCbCr(), nil
 	}
 
 	return image.YCbCr{}, nil
 }
 
+// drain signals the end of the input and hands the frames the decoder still holds back to fn.
+// The images point to the decoder's memory: they are only valid until fn returns.
+func (d *Decoder) drain(fn func(img image.YCbCr)) {
+	res := C.avcodec_send_packet(d.codecCtx, nil)
+	if res < 0 {
+		return
+	}
+
+	for C.avcodec_receive_frame(d.codecCtx, d.srcFrame) == 0 {
+		fn(d.frameYCbCr())
+	}
+}
+
+func (d *Decoder) frameYCbCr() image.YCbCr {
+	fr := d.srcFrame
+	w := int(fr.width)
+	h := int(fr.height)
+	ys := int(fr.linesize[0])
+	cs := int(fr.linesize[1])
+
+	return image.YCbCr{
+		Y:              fromCPtr(unsafe.Pointer(fr.data[0]), ys*h),
+		Cb:             fromCPtr(unsafe.Pointer(fr.data[1]), cs*h/2),
+		Cr:             fromCPtr(unsafe.Pointer(fr.data[2]), cs*h/2),
+		YStride:        ys,
+		CStride:        cs,
+		SubsampleRatio: image.YCbCrSubsampleRatio420,
+		Rect:           image.Rect(0, 0, w, h),
+	}
+}
+
 func (d *Decoder) decodeRaw(nalu []byte) (image.Gray, error) {
 	nalu = append([]uint8{0x00, 0x00, 0x00, 0x01}, []uint8(nalu)...)
 
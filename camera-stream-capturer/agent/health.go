@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
+	"github.com/khaledhikmat/threat-detection-shared/service/storage"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/errorlog"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/health"
+)
+
+// MonitorHealth analyses a key frame every health interval for blackout, covered lens, moved camera, blur and
+// frozen pictures. H264/H265 key frames are decoded by a decoder of its own so the motion detector's decoder
+// is not disturbed. A condition that starts is handed to the capture processor so the clip in progress is
+// tagged with it and raises a camera health alert. In triggered and motion modes, it also requests a recording.
+// PTZ cameras are not checked for moves.
+// Camera health is stored in key/value storage where the key = camera_health_capturer_camera
+// and the value = ts_conditions
+func MonitorHealth(canxCtx context.Context,
+	storagesvc storage.IService,
+	settings CameraSettings,
+	errorsStream chan interface{},
+	healthPacketsStream chan Packet,
+	healthStream chan string,
+	triggersStream chan time.Time,
+	mode string,
+	capturer string,
+	camera soicat.Camera) {
+	// A PTZ camera is moved on purpose
+	ignored := []string{}
+	if settings.PTZ != nil {
+		ignored = append(ignored, health.Moved)
+	}
+	detector := health.NewDetector(healthChecks(), ignored...)
+	interval := healthInterval()
+	lastCheck := time.Time{}
+
+	var decoder *Decoder
+	defer func() {
+		if decoder != nil {
+			decoder.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-canxCtx.Done():
+			return
+		case pkt := <-healthPacketsStream:
+			if time.Since(lastCheck) < interval {
+				continue
+			}
+			lastCheck = time.Now()
+
+			if decoder == nil && (pkt.Codec == "H264" || pkt.Codec == "H265") {
+				d, err := newDecoder(pkt.Codec)
+				if err != nil {
+					reportError(errorsStream, errorlog.Errorf(errorlog.Decode, "capturer %s - agent %s - unable to create a health decoder, camera health is not monitored: %v", capturer, camera.Name, err))
+					return
+				}
+				decoder = d
+			}
+
+			img, ok := decodeHealthFrame(decoder, pkt)
+			if !ok {
+				continue
+			}
+
+			started, stopped := detector.Check(img)
+			if len(started) == 0 && len(stopped) == 0 {
+				continue
+			}
+
+			fmt.Printf("capturer %s - agent %s - camera health: %s (started: %s - stopped: %s)\n",
+				capturer, camera.Name, health.String(detector.Active()), health.String(started), health.String(stopped))
+			publishCameraHealth(canxCtx, storagesvc, capturer, camera, detector.Active())
+
+			for _, condition := range started {
+				select {
+				case healthStream <- condition:
+				default:
+					reportError(errorsStream, errorlog.Errorf(errorlog.Other, "monitorhealth: health stream is full, dropping camera health condition %s", condition))
+				}
+			}
+
+			if len(started) > 0 && (mode == "triggered" || mode == "motion") {
+				select {
+				case triggersStream <- time.Now():
+				default:
+					reportError(errorsStream, errorlog.Errorf(errorlog.Other, "monitorhealth: triggers stream is full, dropping a camera health trigger"))
+				}
+			}
+		}
+	}
+}
+
+// decodeHealthFrame returns the luma plane of a key frame. The decoder may hold the frame back
+// until it gets the next key frame...the frame is then checked with the next one.
+func decodeHealthFrame(decoder *Decoder, pkt Packet) (image.Gray, bool) {
+	if decoder == nil {
+		img, err := decodeJPEGRaw(pkt.Data)
+		return img, err == nil
+	}
+
+	img, err := decoder.decode(pkt.Data)
+	if err != nil || img.Bounds().Empty() {
+		return image.Gray{}, false
+	}
+
+	return image.Gray{Pix: img.Y, Stride: img.YStride, Rect: img.Rect}, true
+}
+
+func publishCameraHealth(canxCtx context.Context, storagesvc storage.IService, capturer string, camera soicat.Camera, conditions []string) {
+	err := storagesvc.StoreKeyValue(canxCtx,
+		models.ThreatDetectionStateStore,
+		fmt.Sprintf("%s_%s_%s", "camera_health", capturer, camera.Name),
+		fmt.Sprintf("%s_%s", time.Now().UTC().Format("2006-01-02 15:04:05"), health.String(conditions)))
+	if err != nil {
+		fmt.Printf("capturer %s - agent %s - unable to publish camera health %s: %v\n", capturer, camera.Name, health.String(conditions), err)
+	}
+}
+
+// A key frame is checked every health interval. Zero disables camera health monitoring.
+func healthInterval() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("CAPTURER_HEALTH_INTERVAL_SECONDS"))
+	if err != nil || seconds < 0 {
+		seconds = 5
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// A condition must be seen on this many consecutive checks before it is raised.
+func healthChecks() int {
+	checks, err := strconv.Atoi(os.Getenv("CAPTURER_HEALTH_CHECKS"))
+	if err != nil || checks <= 0 {
+		checks = 3
+	}
+
+	return checks
+}
@@ -0,0 +1,410 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
+)
+
+const (
+	// JPEG frames larger than this are rejected
+	maxJPEGFrameSize = 10 * 1024 * 1024
+	// MJPEG streams whose frame rate cannot be measured are assumed to run at this rate
+	defaultMJPEGFrameRate = 10
+)
+
+// httpSource carries what the HTTP camera sources have in common: they produce JPEG frames
+// that are all key frames and they cannot pause the camera, so frames are dropped while paused.
+type httpSource struct {
+	URL    string
+	Client *http.Client
+	Stream Stream
+
+	paused atomic.Bool
+	begin  time.Time
+
+	// Closed when the source stops producing frames
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+}
+
+func newHTTPSource(url string) *httpSource {
+	return &httpSource{
+		URL:    url,
+		Client: &http.Client{},
+		done:   make(chan struct{}),
+	}
+}
+
+// Frames are sent as MJPEG video packets timed since the source started.
+func (h *httpSource) send(ctx context.Context, push func(Packet), frame []byte) bool {
+	if h.paused.Load() {
+		return true
+	}
+
+	pkt := Packet{
+		IsVideo:     true,
+		IsKeyFrame:  true,
+		Codec:       "MJPEG",
+		Time:        time.Since(h.begin),
+		Data:        frame,
+		ArrivalTime: time.Now(),
+	}
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	push(pkt)
+	return true
+}
+
+func (h *httpSource) stop(err error) {
+	h.doneOnce.Do(func() {
+		h.err = err
+		close(h.done)
+	})
+}
+
+// Decode a packet into a image.
+func (h *httpSource) DecodePacketRaw(pkt Packet) (image.Gray, error) {
+	return decodeJPEGRaw(pkt.Data)
+}
+
+// Pause the recording/play from the camera.
+func (h *httpSource) Pause() error {
+	h.paused.Store(true)
+	return nil
+}
+
+// Resume the recording/play from the camera.
+func (h *httpSource) Resume() error {
+	h.paused.Store(false)
+	return nil
+}
+
+// Wait until the connection to the camera is closed or fails.
+func (h *httpSource) Wait() error {
+	<-h.done
+	return h.err
+}
+
+// Get a list of streams from the camera.
+func (h *httpSource) GetStreams() ([]Stream, error) {
+	return []Stream{h.Stream}, nil
+}
+
+// Get a list of video streams from the camera.
+func (h *httpSource) GetVideoStreams() ([]Stream, error) {
+	return []Stream{h.Stream}, nil
+}
+
+// Implements the CameraSource interface for cameras that stream MJPEG over HTTP (multipart/x-mixed-replace).
+type MJPEGClient struct {
+	*httpSource
+	FrameRate float64
+
+	response *http.Response
+	reader   *multipart.Reader
+}
+
+func NewMJPEGClient(url string, frameRate float64) *MJPEGClient {
+	return &MJPEGClient{
+		httpSource: newHTTPSource(url),
+		FrameRate:  frameRate,
+	}
+}
+
+// Connect to the MJPEG stream, read the first frames to find out the resolution and the frame rate.
+func (m *MJPEGClient) Connect(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	m.response, err = m.Client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if m.response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", m.response.Status)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(m.response.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("unable to parse the content type: %v", err)
+	}
+
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return fmt.Errorf("not an MJPEG stream: %s", mediaType)
+	}
+
+	// Some cameras prefix the boundary with dashes in the header
+	m.reader = multipart.NewReader(m.response.Body, strings.TrimPrefix(params["boundary"], "--"))
+
+	frame, err := m.nextFrame()
+	if err != nil {
+		return err
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(frame))
+	if err != nil {
+		return fmt.Errorf("unable to decode the first frame: %v", err)
+	}
+
+	frameRate := m.FrameRate
+	if frameRate <= 0 {
+		frameRate = m.measureFrameRate()
+	}
+
+	m.Stream = Stream{
+		Name:    "MJPEG",
+		URL:     m.URL,
+		IsVideo: true,
+		Width:   config.Width,
+		Height:  config.Height,
+		FPS:     frameRate,
+	}
+
+	fmt.Printf("capture.mjpeg.Connect(): %dx%d at %.2f fps\n", config.Width, config.Height, frameRate)
+	return nil
+}
+
+// measureFrameRate times a few frames. The frames are dropped: the stream has not started yet.
+func (m *MJPEGClient) measureFrameRate() float64 {
+	start := time.Now()
+	frames := 0
+	for frames < 10 && time.Since(start) < 2*time.Second {
+		_, err := m.nextFrame()
+		if err != nil {
+			break
+		}
+		frames++
+	}
+
+	elapsed := time.Since(start).Seconds()
+	if frames < 2 || elapsed <= 0 {
+		return defaultMJPEGFrameRate
+	}
+
+	return float64(frames) / elapsed
+}
+
+func (m *MJPEGClient) nextFrame() ([]byte, error) {
+	part, err := m.reader.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	defer part.Close()
+
+	frame, err := io.ReadAll(io.LimitReader(part, maxJPEGFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(frame) > maxJPEGFrameSize {
+		return nil, fmt.Errorf("frame is larger than %d bytes", maxJPEGFrameSize)
+	}
+
+	return frame, nil
+}
+
+// Start reading frames from the MJPEG stream.
+func (m *MJPEGClient) Start(ctx context.Context, errorsStream chan interface{}, push func(Packet), _ soicat.Camera) error {
+	fmt.Printf("capture.mjpeg.Start(): started\n")
+	m.begin = time.Now()
+
+	go func() {
+		for {
+			frame, err := m.nextFrame()
+			if err != nil {
+				m.stop(fmt.Errorf("capture.mjpeg.Start(): %v", err))
+				return
+			}
+
+			if len(frame) == 0 {
+				continue
+			}
+
+			if !m.send(ctx, push, frame) {
+				m.stop(ctx.Err())
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close the connection to the MJPEG stream.
+func (m *MJPEGClient) Close() error {
+	m.stop(errors.New("capture.mjpeg: closed"))
+	if m.response != nil {
+		return m.response.Body.Close()
+	}
+	return nil
+}
+
+// Implements the CameraSource interface for cameras that only serve a JPEG snapshot URL.
+// The snapshots are polled and recorded as a timelapse.
+type SnapshotClient struct {
+	*httpSource
+	Interval time.Duration
+}
+
+func NewSnapshotClient(url string, interval, timelapseFrameRate float64) *SnapshotClient {
+	if interval <= 0 {
+		interval = 1
+	}
+
+	if timelapseFrameRate <= 0 {
+		timelapseFrameRate = 10
+	}
+
+	s := &SnapshotClient{
+		httpSource: newHTTPSource(url),
+		Interval:   time.Duration(interval * float64(time.Second)),
+	}
+	s.Stream.FPS = timelapseFrameRate
+	return s
+}
+
+// Connect fetches a first snapshot to find out the resolution.
+func (s *SnapshotClient) Connect(ctx context.Context) error {
+	frame, err := s.fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(frame))
+	if err != nil {
+		return fmt.Errorf("unable to decode the snapshot: %v", err)
+	}
+
+	s.Stream = Stream{
+		Name:    "MJPEG",
+		URL:     s.URL,
+		IsVideo: true,
+		Width:   config.Width,
+		Height:  config.Height,
+		FPS:     s.Stream.FPS,
+	}
+
+	fmt.Printf("capture.snapshot.Connect(): %dx%d every %s\n", config.Width, config.Height, s.Interval)
+	return nil
+}
+
+func (s *SnapshotClient) fetch(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.Interval+5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	frame, err := io.ReadAll(io.LimitReader(resp.Body, maxJPEGFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(frame) > maxJPEGFrameSize {
+		return nil, fmt.Errorf("snapshot is larger than %d bytes", maxJPEGFrameSize)
+	}
+
+	return frame, nil
+}
+
+// Start polling snapshots. A failed snapshot ends the session so the supervisor reconnects.
+func (s *SnapshotClient) Start(ctx context.Context, errorsStream chan interface{}, push func(Packet), _ soicat.Camera) error {
+	fmt.Printf("capture.snapshot.Start(): started\n")
+	s.begin = time.Now()
+
+	go func() {
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				s.stop(ctx.Err())
+				return
+			case <-s.done:
+				return
+			case <-ticker.C:
+				// Paused cameras are not polled
+				if s.paused.Load() {
+					continue
+				}
+
+				frame, err := s.fetch(ctx)
+				if err != nil {
+					s.stop(fmt.Errorf("capture.snapshot.Start(): %v", err))
+					return
+				}
+
+				if !s.send(ctx, push, frame) {
+					s.stop(ctx.Err())
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops polling.
+func (s *SnapshotClient) Close() error {
+	s.stop(errors.New("capture.snapshot: closed"))
+	return nil
+}
+
+// decodeJPEGRaw decodes a JPEG frame into a grayscale image for motion detection.
+func decodeJPEGRaw(data []byte) (image.Gray, error) {
+	if len(data) == 0 {
+		return image.Gray{}, errors.New("capture.decodeJPEGRaw(): empty frame")
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return image.Gray{}, err
+	}
+
+	// Most cameras send YCbCr JPEGs: the luma plane is the grayscale image
+	if ycbcr, ok := img.(*image.YCbCr); ok {
+		pix := make([]uint8, len(ycbcr.Y))
+		copy(pix, ycbcr.Y)
+		return image.Gray{Pix: pix, Stride: ycbcr.YStride, Rect: ycbcr.Rect}, nil
+	}
+
+	gray := image.NewGray(img.Bounds())
+	draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+	return *gray, nil
+}
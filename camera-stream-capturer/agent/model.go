@@ -19,6 +19,8 @@ type Packet struct {
 	CompositionTime time.Duration // packet presentation time minus decode time for H264 B-Frame
 	Time            time.Duration // packet decode time
 	Data            []byte        // packet data
+	NTP             time.Time     // camera wall-clock time from the RTCP sender reports, zero until the first report
+	ArrivalTime     time.Time     // capturer wall-clock time when the packet was received
 }
 
 type Stream struct {
@@ -58,6 +60,15 @@ type Stream struct {
 	// For H265, this is the vps.
 	VPS []byte
 
+	// The sample rate of an audio stream.
+	SampleRate int
+
+	// The number of channels of an audio stream.
+	ChannelCount int
+
+	// For AAC, this is the audio specific config.
+	Config []byte
+
 	// IsBackChannel is true if this stream is a back channel.
 	IsBackChannel bool
 }
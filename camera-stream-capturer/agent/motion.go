@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/errorlog"
+)
+
+const (
+	// Only every nth pixel (in both directions) is compared to keep the diff cheap on large frames.
+	motionSampleStep = 4
+	// The minimum change in gray level for a pixel to count as changed.
+	motionPixelDelta = 25
+	// Triggers are rate limited while motion continues.
+	motionTriggerInterval = 1 * time.Second
+)
+
+// MotionDetector diffs consecutive grayscale frames within the camera's regions of interest.
+type MotionDetector struct {
+	threshold float64
+	regions   []Polygon
+	previous  []uint8
+	mask      []bool
+	bounds    image.Rectangle
+}
+
+func NewMotionDetector(settings CameraSettings) *MotionDetector {
+	return &MotionDetector{
+		threshold: settings.MotionThreshold,
+		regions:   settings.MotionRegions,
+	}
+}
+
+// Detect compares the frame with the previous one and returns the percentage of changed pixels
+// and whether it is above the camera's motion threshold.
+func (d *MotionDetector) Detect(img image.Gray) (float64, bool) {
+	bounds := img.Bounds()
+	if bounds != d.bounds {
+		// First frame or the resolution changed...start over
+		d.bounds = bounds
+		d.mask = d.buildMask(bounds)
+		d.previous = d.sample(img)
+		return 0, false
+	}
+
+	current := d.sample(img)
+	changed := 0
+	total := 0
+	for i := range current {
+		if !d.mask[i] {
+			continue
+		}
+
+		total++
+		delta := int(current[i]) - int(d.previous[i])
+		if delta > motionPixelDelta || delta < -motionPixelDelta {
+			changed++
+		}
+	}
+	d.previous = current
+
+	if total == 0 {
+		return 0, false
+	}
+
+	percentage := float64(changed) * 100 / float64(total)
+	return percentage, percentage >= d.threshold
+}
+
+func (d *MotionDetector) sample(img image.Gray) []uint8 {
+	bounds := img.Bounds()
+	samples := make([]uint8, 0, (bounds.Dx()/motionSampleStep+1)*(bounds.Dy()/motionSampleStep+1))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += motionSampleStep {
+		for x := bounds.Min.X; x < bounds.Max.X; x += motionSampleStep {
+			// The decoder's stride can be wider than the frame, so guard against short buffers
+			offset := img.PixOffset(x, y)
+			if offset >= len(img.Pix) {
+				samples = append(samples, 0)
+				continue
+			}
+			samples = append(samples, img.Pix[offset])
+		}
+	}
+	return samples
+}
+
+func (d *MotionDetector) buildMask(bounds image.Rectangle) []bool {
+	mask := []bool{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += motionSampleStep {
+		for x := bounds.Min.X; x < bounds.Max.X; x += motionSampleStep {
+			if len(d.regions) == 0 {
+				mask = append(mask, true)
+				continue
+			}
+
+			nx := float64(x-bounds.Min.X) / float64(bounds.Dx())
+			ny := float64(y-bounds.Min.Y) / float64(bounds.Dy())
+			inside := false
+			for _, region := range d.regions {
+				if region.Contains(nx, ny) {
+					inside = true
+					break
+				}
+			}
+			mask = append(mask, inside)
+		}
+	}
+	return mask
+}
+
+// DetectMotion sits between the camera source and the capture processor. It forwards every packet
+// downstream and decodes the video packets to look for motion. Whenever motion is above the camera's
+// threshold, it sends a trigger so the capture processor records.
+func DetectMotion(canxCtx context.Context,
+	source CameraSource,
+	settings CameraSettings,
+	errorsStream chan interface{},
+	packetsStream chan Packet,
+	motionPacketsStream chan Packet,
+	triggersStream chan time.Time,
+	capturer string,
+	camera soicat.Camera) {
+	detector := NewMotionDetector(settings)
+	lastTrigger := time.Time{}
+
+	for {
+		select {
+		case <-canxCtx.Done():
+			fmt.Printf("DetectMotion context is cancelled\n")
+			return
+		case pkt := <-packetsStream:
+			select {
+			case motionPacketsStream <- pkt:
+			case <-canxCtx.Done():
+				return
+			}
+
+			if !pkt.IsVideo {
+				continue
+			}
+
+			// Every video packet must go through the decoder because frames depend on each other
+			img, err := source.DecodePacketRaw(pkt)
+			if err != nil {
+				continue
+			}
+
+			percentage, motion := detector.Detect(img)
+			if !motion || time.Since(lastTrigger) < motionTriggerInterval {
+				continue
+			}
+
+			fmt.Printf("capturer %s - agent %s - motion detected: %.2f%%\n", capturer, camera.Name, percentage)
+			lastTrigger = time.Now()
+			select {
+			case triggersStream <- lastTrigger:
+			default:
+				reportError(errorsStream, errorlog.Errorf(errorlog.Other, "detectmotion: triggers stream is full, dropping a motion trigger"))
+			}
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
+)
+
+// Packet drop reasons
+const (
+	DropFrame = "frame" // a non key frame...and the rest of its GOP
+	DropAudio = "audio"
+	DropGOP   = "gop" // a whole GOP to make room for a key frame
+)
+
+var (
+	meter                 = otel.Meter("agent")
+	queuedPacketsCounter  metric.Int64Counter
+	droppedPacketsCounter metric.Int64Counter
+	latePacketsCounter    metric.Int64Counter
+)
+
+func init() {
+	var err error
+	queuedPacketsCounter, err = meter.Int64Counter("capturer_packets_queued",
+		metric.WithDescription("The number of camera packets queued for the agent's processors"),
+		metric.WithUnit("1"))
+	if err != nil {
+		fmt.Println("Failed to create queued packets counter")
+	}
+
+	droppedPacketsCounter, err = meter.Int64Counter("capturer_packets_dropped",
+		metric.WithDescription("The number of camera packets dropped because the agent's processors are behind"),
+		metric.WithUnit("1"))
+	if err != nil {
+		fmt.Println("Failed to create dropped packets counter")
+	}
+
+	latePacketsCounter, err = meter.Int64Counter("capturer_packets_late",
+		metric.WithDescription("The number of camera packets that waited longer than the late threshold in the queue"),
+		metric.WithUnit("1"))
+	if err != nil {
+		fmt.Println("Failed to create late packets counter")
+	}
+}
+
+// PacketQueue is a bounded packet queue between a camera source and the agent's processors. Pushing never
+// blocks so a slow processor (i.e. a slow disk or a stuck muxer) never stalls the camera reader and the
+// camera does not drop the capturer. When the queue is full, packets are dropped:
+//
+//  1. An incoming non key frame is dropped and so is the rest of its GOP since its frames reference it.
+//     Incoming audio is dropped.
+//  2. An incoming key frame makes room by dropping the oldest whole GOPs.
+//
+// Packets that waited longer than the late threshold are still delivered but counted as late.
+type PacketQueue struct {
+	capacity int
+	late     time.Duration
+	stats    *Stats
+	attrs    metric.MeasurementOption
+
+	mu        sync.Mutex
+	packets   []queuedPacket
+	brokenGOP bool
+	discarded bool
+	notify    chan struct{}
+}
+
+type queuedPacket struct {
+	pkt    Packet
+	queued time.Time
+}
+
+func newPacketQueue(stats *Stats, stream, capturer string, camera soicat.Camera) *PacketQueue {
+	return &PacketQueue{
+		capacity: packetQueueSize(),
+		late:     packetLateThreshold(),
+		stats:    stats,
+		attrs: metric.WithAttributes(
+			attribute.String("capturer", capturer),
+			attribute.String("camera", camera.Name),
+			attribute.String("stream", stream)),
+		packets: []queuedPacket{},
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// push queues the packet or drops packets if the queue is full. It never blocks.
+func (q *PacketQueue) push(pkt Packet) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Nothing forwards the queue anymore...the session is over
+	if q.discarded {
+		return
+	}
+
+	ctx := context.Background()
+	isVideo := pkt.IsVideo
+	isKeyFrame := pkt.IsVideo && pkt.IsKeyFrame
+
+	// The GOP lost a frame...its next frames cannot be decoded
+	if isKeyFrame {
+		q.brokenGOP = false
+	} else if isVideo && q.brokenGOP {
+		q.drop(ctx, DropFrame, 1)
+		return
+	}
+
+	if len(q.packets) >= q.capacity {
+		if !isKeyFrame {
+			reason := DropAudio
+			if isVideo {
+				reason = DropFrame
+				q.brokenGOP = true
+			}
+			q.drop(ctx, reason, 1)
+			return
+		}
+
+		// Drop the oldest GOPs: up to the next key frame or the whole queue
+		for len(q.packets) >= q.capacity {
+			next := len(q.packets)
+			for i := 1; i < len(q.packets); i++ {
+				if q.packets[i].pkt.IsVideo && q.packets[i].pkt.IsKeyFrame {
+					next = i
+					break
+				}
+			}
+
+			q.packets = q.packets[next:]
+			q.stats.packetsDequeued(next)
+			q.drop(ctx, DropGOP, next)
+		}
+	}
+
+	q.packets = append(q.packets, queuedPacket{pkt: pkt, queued: time.Now()})
+	queuedPacketsCounter.Add(ctx, 1, q.attrs)
+	q.stats.packetQueued()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// drop counts dropped packets. The caller must hold the lock.
+func (q *PacketQueue) drop(ctx context.Context, reason string, packets int) {
+	if packets <= 0 {
+		return
+	}
+
+	droppedPacketsCounter.Add(ctx, int64(packets), q.attrs, metric.WithAttributes(attribute.String("reason", reason)))
+	q.stats.packetsDropped(packets)
+}
+
+func (q *PacketQueue) pop() (queuedPacket, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.packets) == 0 {
+		return queuedPacket{}, false
+	}
+
+	qp := q.packets[0]
+	q.packets = q.packets[1:]
+	q.stats.packetsDequeued(1)
+	return qp, true
+}
+
+// discard empties the queue once it is no longer forwarded so the agent's stats do not count its packets
+// as waiting. Packets pushed afterwards are ignored. The agent's next session gets a new queue.
+func (q *PacketQueue) discard() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.stats.packetsDequeued(len(q.packets))
+	q.packets = []queuedPacket{}
+	q.discarded = true
+}
+
+// forward delivers the queued packets to the processors' packets stream, in order, until done is closed.
+// Packets queued after the session context is cancelled are dropped since the processors are gone.
+func (q *PacketQueue) forward(sessionCtx context.Context, done chan struct{}, packetsStream chan Packet) {
+	defer q.discard()
+
+	for {
+		qp, ok := q.pop()
+		if !ok {
+			select {
+			case <-done:
+				return
+			case <-q.notify:
+			}
+			continue
+		}
+
+		if time.Since(qp.queued) > q.late {
+			latePacketsCounter.Add(context.Background(), 1, q.attrs)
+			q.stats.packetLate()
+		}
+
+		select {
+		case packetsStream <- qp.pkt:
+		case <-sessionCtx.Done():
+			// Downstream processors are gone...drop the packet
+		case <-done:
+			return
+		}
+	}
+}
+
+// reportError hands an error to the error processor unless it is behind. Camera readers and the processors
+// between the camera and the capture processor (motion detector, health monitor, PTZ) must never block on it.
+func reportError(errorsStream chan interface{}, err error) {
+	select {
+	case errorsStream <- err:
+	default:
+		fmt.Printf("error processor is behind, dropping error: %v\n", err)
+	}
+}
+
+// The packet queue holds this many packets (video and audio) before it drops packets.
+func packetQueueSize() int {
+	size, err := strconv.Atoi(os.Getenv("CAPTURER_PACKET_QUEUE_SIZE"))
+	if err != nil || size <= 0 {
+		size = 500
+	}
+
+	return size
+}
+
+// A packet that waited longer than this in the packet queue is late.
+func packetLateThreshold() time.Duration {
+	ms, err := strconv.Atoi(os.Getenv("CAPTURER_PACKET_LATE_MS"))
+	if err != nil || ms <= 0 {
+		ms = 500
+	}
+
+	return time.Duration(ms) * time.Millisecond
+}
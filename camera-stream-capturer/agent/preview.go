@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/preview"
+)
+
+// clipPreview decodes the clip's key frames that the preview builder wants. H264/H265 key frames are decoded
+// by a decoder of its own so the motion detector's decoder is not disturbed. MJPEG frames are plain JPEGs.
+type clipPreview struct {
+	builder *preview.Builder
+	decoder *Decoder
+}
+
+func newClipPreview(codec string) (*clipPreview, error) {
+	p := &clipPreview{
+		builder: preview.NewBuilder(),
+	}
+
+	if codec == "H264" || codec == "H265" {
+		decoder, err := newDecoder(codec)
+		if err != nil {
+			return nil, err
+		}
+		p.decoder = decoder
+	}
+
+	return p, nil
+}
+
+// openPreview returns nil if the clip cannot have previews.
+func openPreview(codec string) *clipPreview {
+	p, err := newClipPreview(codec)
+	if err != nil {
+		fmt.Printf("capturestream - unable to create a preview decoder, the clip will have no previews: %v\n", err)
+		return nil
+	}
+
+	return p
+}
+
+func (p *clipPreview) write(pkt Packet) {
+	if !pkt.IsVideo || !pkt.IsKeyFrame || !p.builder.Wants() {
+		return
+	}
+
+	if p.decoder == nil {
+		img, err := jpeg.Decode(bytes.NewReader(pkt.Data))
+		if err == nil {
+			p.builder.Add(img)
+		}
+		return
+	}
+
+	// The decoder may hold the frame back until it gets the next key frame or it is drained
+	img, err := p.decoder.decode(pkt.Data)
+	if err == nil && !img.Bounds().Empty() {
+		p.builder.Add(&img)
+	}
+}
+
+// close saves the thumbnail and sprite sheet next to the clip and releases the decoder.
+func (p *clipPreview) close(clipFile string) error {
+	if p.decoder != nil {
+		p.decoder.drain(func(img image.YCbCr) {
+			p.builder.Add(&img)
+		})
+		p.decoder.Close()
+	}
+
+	return p.builder.Save(clipFile)
+}
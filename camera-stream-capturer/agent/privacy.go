@@ -0,0 +1,453 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"github.com/yapingcat/gomedia/go-mp4"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/errorlog"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/preview"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/spool"
+)
+
+// errSubStreamUnredacted is wrapped by the error returned when a clip is redacted but its sub-stream clip is not.
+var errSubStreamUnredacted = errors.New("sub-stream clip cannot be redacted")
+
+const (
+	redactedSuffix   = "_redacted.mp4"
+	unredactedSuffix = ".unredacted"
+
+	// Masked pixels are black
+	maskLuma   = 16
+	maskChroma = 128
+	// Faces are pixelated with blocks of this size
+	faceBlockSize = 16
+	// Faces are grown by this ratio (on every side) to cover the frames between two detections
+	faceMargin = 0.2
+)
+
+// redactRecordingClip replaces the clip and its sub-stream clip with their redacted copies before the clip leaves
+// the capturer: the privacy masks are blacked out and the faces are pixelated. The original clip is kept as
+// `<clip>_original.mp4` for the restricted storage and the previews are rebuilt from the redacted frames.
+// A clip that already has an original was redacted by a previous run.
+// An unredacted sub-stream clip must not leave the capturer either, so a sub-stream clip that cannot be redacted is
+// renamed `<sub-stream clip>.unredacted` and kept for inspection. The clip is still redacted and returned with an
+// error wrapping errSubStreamUnredacted: it is delivered without its sub-stream clip and the model invokers analyse it.
+func redactRecordingClip(settings PrivacySettings, recording models.RecordingClip) (models.RecordingClip, error) {
+	original := spool.OriginalFile(recording.LocalReference)
+	if _, err := os.Stat(original); err == nil {
+		return recording, nil
+	}
+
+	var subErr error
+	sub := spool.SubStreamFile(recording.LocalReference)
+	if _, err := os.Stat(sub); err == nil {
+		err = redactClip(settings, sub, redactedFile(sub), nil)
+		if err == nil {
+			err = os.Rename(redactedFile(sub), sub)
+		}
+		if err != nil {
+			_ = os.Remove(redactedFile(sub))
+			subErr = errorlog.Errorf(errorlog.Mux, "%w: %s is kept as %s: %v", errSubStreamUnredacted, sub, sub+unredactedSuffix, err)
+			if e := os.Rename(sub, sub+unredactedSuffix); e != nil {
+				// It must not be spooled with the clip
+				_ = os.Remove(sub)
+				subErr = errorlog.Errorf(errorlog.Mux, "%w: %s cannot be kept, so it is deleted: %v", errSubStreamUnredacted, sub, err)
+			}
+		}
+	}
+
+	redacted := redactedFile(recording.LocalReference)
+	builder := preview.NewBuilder()
+	err := redactClip(settings, recording.LocalReference, redacted, builder)
+	if err != nil {
+		_ = os.Remove(redacted)
+		return recording, err
+	}
+
+	err = os.Rename(recording.LocalReference, original)
+	if err != nil {
+		_ = os.Remove(redacted)
+		return recording, err
+	}
+
+	err = os.Rename(redacted, recording.LocalReference)
+	if err != nil {
+		_ = os.Rename(original, recording.LocalReference)
+		_ = os.Remove(redacted)
+		return recording, err
+	}
+
+	// The previews were made from the original frames
+	for _, file := range preview.Files(recording.LocalReference) {
+		err = os.Remove(file)
+		if err != nil {
+			return recording, fmt.Errorf("unable to remove the unredacted preview %s: %v", file, err)
+		}
+	}
+
+	// The previews are a convenience...the clip is sent without them if they fail
+	err = builder.Save(recording.LocalReference)
+	if err != nil {
+		fmt.Printf("privacy - unable to save the previews of %s: %v\n", recording.LocalReference, err)
+	}
+
+	return recording, subErr
+}
+
+// redactClip decodes the frames of an MP4 clip, redacts them and re-encodes them into another MP4 clip
+// at the clip's measured frame rate. Its key frames feed the preview builder if there is one.
+func redactClip(settings PrivacySettings, file, redacted string, builder *preview.Builder) error {
+	timing, err := sampleClipTiming(file, "")
+	if err != nil {
+		return err
+	}
+
+	frameRate := timing.FPS
+	if frameRate <= 0 {
+		frameRate = defaultMJPEGFrameRate
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	demuxer := mp4.CreateMp4Demuxer(f)
+	tracks, err := demuxer.ReadHead()
+	if err != nil {
+		return fmt.Errorf("unable to read the mp4 header: %v", err)
+	}
+
+	codec := ""
+	videoTrack := 0
+	for _, track := range tracks {
+		if track.Cid == mp4.MP4_CODEC_H264 {
+			codec = "H264"
+		} else if track.Cid == mp4.MP4_CODEC_H265 {
+			codec = "H265"
+		} else {
+			continue
+		}
+		videoTrack = track.TrackId
+		break
+	}
+
+	if codec == "" {
+		return fmt.Errorf("no H264 or H265 video track found in %s", file)
+	}
+
+	decoder, err := newDecoder(codec)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	r, err := newFrameRedactor(settings, file, redacted, frameRate, builder)
+	if err != nil {
+		return err
+	}
+	defer r.abort()
+
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if pkt.TrackId != videoTrack {
+			continue
+		}
+
+		au, err := h264.AnnexBUnmarshal(pkt.Data)
+		if err != nil {
+			return fmt.Errorf("unable to split frame at %dms: %v", pkt.Pts, err)
+		}
+
+		if codec == "H264" {
+			r.keyFrames = append(r.keyFrames, h264.IDRPresent(au))
+		} else {
+			r.keyFrames = append(r.keyFrames, h265.IsRandomAccess(au))
+		}
+
+		// The decoder may hold the frame back until it gets the next frames or it is drained
+		img, err := decoder.decode(pkt.Data)
+		if err != nil || img.Bounds().Empty() {
+			continue
+		}
+
+		err = r.redact(img)
+		if err != nil {
+			return err
+		}
+	}
+
+	var drainErr error
+	decoder.drain(func(img image.YCbCr) {
+		if drainErr == nil {
+			drainErr = r.redact(img)
+		}
+	})
+	if drainErr != nil {
+		return drainErr
+	}
+
+	return r.close()
+}
+
+// frameRedactor redacts decoded frames and pipes them to the encoder. The frames are copied out of the
+// decoder first since the decoder still needs them to decode the next frames.
+type frameRedactor struct {
+	settings  PrivacySettings
+	faces     FaceDetector
+	builder   *preview.Builder
+	encoder   *clipTranscoder
+	source    string
+	redacted  string
+	frameRate float64
+
+	bounds    image.Rectangle
+	frame     []byte
+	mask      []bool
+	detected  []image.Rectangle
+	frames    int
+	keyFrames []bool // in decoding order, a frame is assumed to come out of the decoder in the same order
+}
+
+func newFrameRedactor(settings PrivacySettings, source, redacted string, frameRate float64, builder *preview.Builder) (*frameRedactor, error) {
+	r := &frameRedactor{
+		settings:  settings,
+		builder:   builder,
+		source:    source,
+		redacted:  redacted,
+		frameRate: frameRate,
+	}
+
+	if settings.FaceDetector != "" {
+		faces, err := newFaceDetector(settings.FaceDetector)
+		if err != nil {
+			return nil, err
+		}
+		r.faces = faces
+	}
+
+	return r, nil
+}
+
+func (r *frameRedactor) redact(decoded image.YCbCr) error {
+	isKeyFrame := false
+	if len(r.keyFrames) > 0 {
+		isKeyFrame = r.keyFrames[0]
+		r.keyFrames = r.keyFrames[1:]
+	}
+
+	// The encoder starts with the first frame's size...frames of another size are dropped
+	if r.encoder == nil {
+		encoder, err := newFrameEncoder(r.redacted, r.source, decoded.Rect.Dx(), decoded.Rect.Dy(), r.frameRate)
+		if err != nil {
+			return err
+		}
+		r.encoder = encoder
+		r.bounds = decoded.Rect
+		r.mask = buildPrivacyMask(r.settings.Masks, r.bounds)
+	}
+	if decoded.Rect != r.bounds {
+		return nil
+	}
+
+	img := r.copyFrame(decoded)
+	maskFrame(img, r.mask)
+
+	if r.faces != nil {
+		if r.frames%faceDetectionFrames() == 0 {
+			faces, err := r.faces.DetectFaces(img)
+			if err != nil {
+				// A face that cannot be found cannot be blurred...the clip must not leave the capturer
+				return fmt.Errorf("face detection failed: %v", err)
+			}
+			r.detected = faces
+		}
+
+		for _, face := range r.detected {
+			pixelate(img, growRect(face, faceMargin).Intersect(img.Rect))
+		}
+	}
+	r.frames++
+
+	if r.builder != nil && isKeyFrame && r.builder.Wants() {
+		r.builder.Add(img)
+	}
+
+	return r.encoder.write(r.frame)
+}
+
+// copyFrame copies a decoded frame into the redactor's raw YUV 4:2:0 frame.
+func (r *frameRedactor) copyFrame(decoded image.YCbCr) *image.YCbCr {
+	w := r.bounds.Dx()
+	h := r.bounds.Dy()
+	cw := (w + 1) / 2
+	ch := (h + 1) / 2
+	if r.frame == nil {
+		r.frame = make([]byte, w*h+2*cw*ch)
+	}
+
+	img := &image.YCbCr{
+		Y:              r.frame[:w*h],
+		Cb:             r.frame[w*h : w*h+cw*ch],
+		Cr:             r.frame[w*h+cw*ch:],
+		YStride:        w,
+		CStride:        cw,
+		SubsampleRatio: image.YCbCrSubsampleRatio420,
+		Rect:           image.Rect(0, 0, w, h),
+	}
+
+	for y := 0; y < h; y++ {
+		copyRow(img.Y[y*w:(y+1)*w], decoded.Y, y*decoded.YStride)
+	}
+	for y := 0; y < ch; y++ {
+		copyRow(img.Cb[y*cw:(y+1)*cw], decoded.Cb, y*decoded.CStride)
+		copyRow(img.Cr[y*cw:(y+1)*cw], decoded.Cr, y*decoded.CStride)
+	}
+
+	return img
+}
+
+// abort stops the encoder if the clip could not be redacted.
+func (r *frameRedactor) abort() {
+	if r.encoder != nil {
+		_ = r.encoder.close()
+		r.encoder = nil
+	}
+}
+
+func (r *frameRedactor) close() error {
+	if r.encoder == nil {
+		return fmt.Errorf("no frame decoded from %s", r.source)
+	}
+
+	err := r.encoder.close()
+	r.encoder = nil
+	return err
+}
+
+// copyRow guards against planes that are shorter than their stride says.
+func copyRow(dst, src []byte, offset int) {
+	if offset >= len(src) {
+		return
+	}
+
+	copy(dst, src[offset:])
+}
+
+// buildPrivacyMask tells for every pixel of a frame whether it is in one of the masks.
+func buildPrivacyMask(masks []Polygon, bounds image.Rectangle) []bool {
+	if len(masks) == 0 {
+		return nil
+	}
+
+	mask := make([]bool, bounds.Dx()*bounds.Dy())
+	for y := 0; y < bounds.Dy(); y++ {
+		ny := (float64(y) + 0.5) / float64(bounds.Dy())
+		for x := 0; x < bounds.Dx(); x++ {
+			nx := (float64(x) + 0.5) / float64(bounds.Dx())
+			for _, polygon := range masks {
+				if polygon.Contains(nx, ny) {
+					mask[y*bounds.Dx()+x] = true
+					break
+				}
+			}
+		}
+	}
+
+	return mask
+}
+
+// maskFrame blacks the masked pixels out.
+func maskFrame(img *image.YCbCr, mask []bool) {
+	if mask == nil {
+		return
+	}
+
+	w := img.Rect.Dx()
+	for i, masked := range mask {
+		if !masked {
+			continue
+		}
+
+		x := i % w
+		y := i / w
+		img.Y[y*img.YStride+x] = maskLuma
+		img.Cb[img.COffset(x, y)] = maskChroma
+		img.Cr[img.COffset(x, y)] = maskChroma
+	}
+}
+
+// pixelate replaces every block of the rectangle with its average color. Unlike a blur, it cannot be undone.
+func pixelate(img *image.YCbCr, rect image.Rectangle) {
+	for by := rect.Min.Y; by < rect.Max.Y; by += faceBlockSize {
+		for bx := rect.Min.X; bx < rect.Max.X; bx += faceBlockSize {
+			block := image.Rect(bx, by, bx+faceBlockSize, by+faceBlockSize).Intersect(rect)
+
+			sumY, sumCb, sumCr, n := 0, 0, 0, 0
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				for x := block.Min.X; x < block.Max.X; x++ {
+					sumY += int(img.Y[img.YOffset(x, y)])
+					sumCb += int(img.Cb[img.COffset(x, y)])
+					sumCr += int(img.Cr[img.COffset(x, y)])
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				for x := block.Min.X; x < block.Max.X; x++ {
+					img.Y[img.YOffset(x, y)] = uint8(sumY / n)
+					img.Cb[img.COffset(x, y)] = uint8(sumCb / n)
+					img.Cr[img.COffset(x, y)] = uint8(sumCr / n)
+				}
+			}
+		}
+	}
+}
+
+func growRect(rect image.Rectangle, ratio float64) image.Rectangle {
+	dx := int(float64(rect.Dx()) * ratio)
+	dy := int(float64(rect.Dy()) * ratio)
+	return image.Rect(rect.Min.X-dx, rect.Min.Y-dy, rect.Max.X+dx, rect.Max.Y+dy)
+}
+
+// redactedFile is the clip being redacted: `<clip file without extension>_redacted.mp4`.
+func redactedFile(clipFile string) string {
+	return strings.TrimSuffix(clipFile, filepath.Ext(clipFile)) + redactedSuffix
+}
+
+func isRedactedFile(file string) bool {
+	return strings.HasSuffix(file, redactedSuffix)
+}
+
+// Faces are detected every nth frame, the frames in between blur the last faces found.
+func faceDetectionFrames() int {
+	frames, err := strconv.Atoi(os.Getenv("CAPTURER_FACE_DETECTION_FRAMES"))
+	if err != nil || frames <= 0 {
+		frames = 5
+	}
+
+	return frames
+}
@@ -0,0 +1,262 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/errorlog"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/onvif"
+)
+
+// PTZ commands carry their argument after the command name (i.e. `Preset Loading Dock`)
+const (
+	ptzPresetCommand   = "Preset"
+	ptzTourCommand     = "Tour"
+	ptzStopTourCommand = "StopTour"
+)
+
+// PresetCommand moves the camera to a preset (token or name) and holds it there before the tours resume.
+func PresetCommand(preset string) string {
+	return fmt.Sprintf("%s %s", ptzPresetCommand, preset)
+}
+
+// TourCommand starts a preset tour until it is stopped.
+func TourCommand(tour string) string {
+	return fmt.Sprintf("%s %s", ptzTourCommand, tour)
+}
+
+// StopTourCommand stops the running tour. A scheduled tour runs again in its next window.
+func StopTourCommand() string {
+	return ptzStopTourCommand
+}
+
+func isPTZCommand(cmd string) bool {
+	return cmd == ptzStopTourCommand || strings.HasPrefix(cmd, ptzPresetCommand+" ") || strings.HasPrefix(cmd, ptzTourCommand+" ")
+}
+
+// forwardPTZCommand hands a PTZ command to the PTZ processor without blocking the agent.
+func forwardPTZCommand(ptzStream chan string, errorsStream chan interface{}, capturer string, camera soicat.Camera, cmd string) {
+	if ptzStream == nil {
+		reportError(errorsStream, errorlog.Errorf(errorlog.Other, "capturer %s - agent %s - command %s ignored: the camera has no PTZ settings", capturer, camera.Name, cmd))
+		return
+	}
+
+	select {
+	case ptzStream <- cmd:
+	default:
+		reportError(errorsStream, errorlog.Errorf(errorlog.Other, "capturer %s - agent %s - command %s dropped: the PTZ processor is busy", capturer, camera.Name, cmd))
+	}
+}
+
+// runPTZ moves the camera as it is told by the PTZ commands and its preset tours. It does not depend
+// on the camera's video session, so the camera can be moved while it reconnects.
+func runPTZ(canxCtx context.Context, settings PTZSettings, errorsStream chan interface{}, ptzStream chan string, capturer string, camera soicat.Camera) {
+	client := onvif.NewClient(settings.XAddr, settings.Username, settings.Password, 5*time.Second)
+	ptz := ptzController{
+		client:   client,
+		settings: settings,
+		hold:     ptzHoldDuration(settings),
+	}
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-canxCtx.Done():
+			return
+		case cmd := <-ptzStream:
+			fmt.Printf("capturer %s - agent %s - ptz command %s\n", capturer, camera.Name, cmd)
+			err := ptz.command(canxCtx, cmd, time.Now())
+			if err != nil {
+				reportError(errorsStream, errorlog.Errorf(errorlog.Other, "capturer %s - agent %s - ptz command %s failed: %v", capturer, camera.Name, cmd, err))
+			}
+		case now := <-ticker.C:
+			err := ptz.tick(canxCtx, now)
+			if err != nil {
+				reportError(errorsStream, errorlog.Errorf(errorlog.Other, "capturer %s - agent %s - ptz tour %s failed: %v", capturer, camera.Name, ptz.tour.Name, err))
+			}
+		}
+	}
+}
+
+type ptzController struct {
+	client   *onvif.Client
+	settings PTZSettings
+	hold     time.Duration
+	profile  string
+	presets  []onvif.Preset
+
+	holdUntil time.Time
+	tour      *PTZTour
+	manual    bool   // the tour was started by a command
+	stopped   string // the scheduled tour stopped by a command until its window ends
+	step      int
+	nextStep  time.Time
+}
+
+func (p *ptzController) command(ctx context.Context, cmd string, now time.Time) error {
+	if cmd == ptzStopTourCommand {
+		if p.tour != nil && !p.manual {
+			p.stopped = p.tour.Name
+		}
+		p.tour = nil
+		p.manual = false
+		return nil
+	}
+
+	if tour, ok := strings.CutPrefix(cmd, ptzTourCommand+" "); ok {
+		for i := range p.settings.Tours {
+			if p.settings.Tours[i].Name == tour {
+				p.startTour(&p.settings.Tours[i], true)
+				p.holdUntil = time.Time{}
+				return nil
+			}
+		}
+		return fmt.Errorf("tour %s not found", tour)
+	}
+
+	preset, _ := strings.CutPrefix(cmd, ptzPresetCommand+" ")
+	err := p.gotoPreset(ctx, preset)
+	if err != nil {
+		return err
+	}
+
+	// The tour resumes where it was once the hold is over
+	p.holdUntil = now.Add(p.hold)
+	return nil
+}
+
+func (p *ptzController) tick(ctx context.Context, now time.Time) error {
+	if now.Before(p.holdUntil) {
+		return nil
+	}
+
+	if !p.manual {
+		tour := p.scheduledTour(now)
+		if tour == nil {
+			p.tour = nil
+			return nil
+		}
+		if p.tour == nil || p.tour.Name != tour.Name {
+			p.startTour(tour, false)
+		}
+	}
+
+	if p.tour == nil || len(p.tour.Steps) == 0 || now.Before(p.nextStep) {
+		return nil
+	}
+
+	step := p.tour.Steps[p.step%len(p.tour.Steps)]
+	p.step = (p.step + 1) % len(p.tour.Steps)
+	dwell := time.Duration(step.Dwell) * time.Second
+	if dwell <= 0 {
+		dwell = 10 * time.Second
+	}
+	p.nextStep = now.Add(dwell)
+
+	return p.gotoPreset(ctx, step.Preset)
+}
+
+func (p *ptzController) startTour(tour *PTZTour, manual bool) {
+	p.tour = tour
+	p.manual = manual
+	p.step = 0
+	p.nextStep = time.Time{}
+}
+
+// scheduledTour returns the first tour whose window includes now, unless it was stopped in this window.
+func (p *ptzController) scheduledTour(now time.Time) *PTZTour {
+	for i, tour := range p.settings.Tours {
+		if tour.Start == "" || tour.End == "" {
+			continue
+		}
+
+		if !inDailyWindow(now, tour.Start, tour.End) {
+			if p.stopped == tour.Name {
+				p.stopped = ""
+			}
+			continue
+		}
+
+		if p.stopped == tour.Name {
+			continue
+		}
+
+		return &p.settings.Tours[i]
+	}
+
+	return nil
+}
+
+// gotoPreset moves the camera to a preset token or name. The profile and presets are looked up once.
+func (p *ptzController) gotoPreset(ctx context.Context, preset string) error {
+	if p.profile == "" {
+		p.profile = p.settings.Profile
+		if p.profile == "" {
+			profile, err := p.client.PTZProfile(ctx)
+			if err != nil {
+				return err
+			}
+			p.profile = profile
+		}
+	}
+
+	if p.presets == nil {
+		presets, err := p.client.Presets(ctx, p.profile)
+		if err != nil {
+			return err
+		}
+		p.presets = presets
+	}
+
+	token := ""
+	for _, candidate := range p.presets {
+		if candidate.Token == preset || strings.EqualFold(candidate.Name, preset) {
+			token = candidate.Token
+			break
+		}
+	}
+
+	if token == "" {
+		// The presets may have changed in the camera
+		p.presets = nil
+		return fmt.Errorf("preset %s not found", preset)
+	}
+
+	return p.client.GotoPreset(ctx, p.profile, token)
+}
+
+// inDailyWindow tells if the time of day is in a `15:04` window. A window ending before it starts ends the next day.
+func inDailyWindow(now time.Time, start, end string) bool {
+	s, err := time.Parse("15:04", start)
+	if err != nil {
+		return false
+	}
+
+	e, err := time.Parse("15:04", end)
+	if err != nil {
+		return false
+	}
+
+	minutes := now.Hour()*60 + now.Minute()
+	startMinutes := s.Hour()*60 + s.Minute()
+	endMinutes := e.Hour()*60 + e.Minute()
+	if startMinutes <= endMinutes {
+		return minutes >= startMinutes && minutes < endMinutes
+	}
+
+	return minutes >= startMinutes || minutes < endMinutes
+}
+
+func ptzHoldDuration(settings PTZSettings) time.Duration {
+	if settings.HoldSeconds <= 0 {
+		return 300 * time.Second
+	}
+
+	return time.Duration(settings.HoldSeconds) * time.Second
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/errorlog"
+)
+
+// quarantineCommand is sent by the error processor to the agent's commands stream. It is not a control API command.
+const quarantineCommand = "Quarantine"
+
+// quarantinePolicy counts the camera's errors (connect, decode and mux) in a sliding window. Upload and publish
+// errors are the capturer's, not the camera's, so they are not counted. The camera is quarantined when the window
+// holds more errors than the threshold.
+type quarantinePolicy struct {
+	threshold int
+	window    time.Duration
+	errors    []time.Time
+}
+
+func newQuarantinePolicy() *quarantinePolicy {
+	return &quarantinePolicy{
+		threshold: quarantineThreshold(),
+		window:    quarantineWindow(),
+		errors:    []time.Time{},
+	}
+}
+
+// check counts an error of the type and returns whether the camera must be quarantined. The window starts
+// over once it does so a quarantined camera that is started again gets a clean slate.
+func (p *quarantinePolicy) check(typ string, now time.Time) bool {
+	if p.threshold == 0 || (typ != errorlog.Connect && typ != errorlog.Decode && typ != errorlog.Mux) {
+		return false
+	}
+
+	kept := p.errors[:0]
+	for _, t := range p.errors {
+		if now.Sub(t) < p.window {
+			kept = append(kept, t)
+		}
+	}
+	p.errors = append(kept, now)
+
+	if len(p.errors) <= p.threshold {
+		return false
+	}
+
+	p.errors = []time.Time{}
+	return true
+}
+
+// A camera with more errors than this in the quarantine window is quarantined. Zero disables quarantine.
+func quarantineThreshold() int {
+	threshold, err := strconv.Atoi(os.Getenv("CAPTURER_QUARANTINE_ERRORS"))
+	if err != nil || threshold < 0 {
+		threshold = 100
+	}
+
+	return threshold
+}
+
+// The camera's errors are counted over this window.
+func quarantineWindow() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("CAPTURER_QUARANTINE_WINDOW_SECONDS"))
+	if err != nil || seconds <= 0 {
+		seconds = 60
+	}
+
+	return time.Duration(seconds) * time.Second
+}
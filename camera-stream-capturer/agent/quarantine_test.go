@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/errorlog"
+)
+
+func TestQuarantinePolicy(t *testing.T) {
+	base := time.Now()
+	second := func(s int) time.Time {
+		return base.Add(time.Duration(s) * time.Second)
+	}
+
+	type report struct {
+		typ  string
+		at   time.Time
+		want bool
+	}
+
+	tests := []struct {
+		name      string
+		threshold int
+		reports   []report
+	}{
+		{
+			name:      "more errors than the threshold",
+			threshold: 2,
+			reports: []report{
+				{errorlog.Connect, second(0), false},
+				{errorlog.Decode, second(1), false},
+				{errorlog.Mux, second(2), true},
+			},
+		},
+		{
+			name:      "capturer errors are not counted",
+			threshold: 2,
+			reports: []report{
+				{errorlog.Connect, second(0), false},
+				{errorlog.Upload, second(1), false},
+				{errorlog.Publish, second(2), false},
+				{errorlog.Other, second(3), false},
+				{errorlog.Connect, second(4), false},
+				{errorlog.Connect, second(5), true},
+			},
+		},
+		{
+			name:      "errors out of the window are not counted",
+			threshold: 2,
+			reports: []report{
+				{errorlog.Connect, second(0), false},
+				{errorlog.Connect, second(30), false},
+				{errorlog.Connect, second(60), false},
+				{errorlog.Connect, second(70), true},
+			},
+		},
+		{
+			name:      "window starts over after a quarantine",
+			threshold: 1,
+			reports: []report{
+				{errorlog.Connect, second(0), false},
+				{errorlog.Connect, second(1), true},
+				{errorlog.Connect, second(2), false},
+				{errorlog.Connect, second(3), true},
+			},
+		},
+		{
+			name:      "zero threshold disables quarantine",
+			threshold: 0,
+			reports: []report{
+				{errorlog.Connect, second(0), false},
+				{errorlog.Connect, second(1), false},
+				{errorlog.Connect, second(2), false},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &quarantinePolicy{
+				threshold: tt.threshold,
+				window:    time.Minute,
+				errors:    []time.Time{},
+			}
+
+			for i, r := range tt.reports {
+				if got := policy.check(r.typ, r.at); got != r.want {
+					t.Errorf("report %d (%s): got %t, want %t", i+1, r.typ, got, r.want)
+				}
+			}
+		})
+	}
+}
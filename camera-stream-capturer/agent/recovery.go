@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+	"github.com/khaledhikmat/threat-detection-shared/service/config"
+	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/recovery"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/spool"
+)
+
+// recoverClips finalises the clips that a previous run left in the camera's recordings folder because it died
+// before closing them, and sends them to the recording stream so they are hashed and spooled like any other clip.
+// It runs when the agent starts, before it records, so every clip without a spool manifest is a partial clip.
+// A clip that cannot be finalised is renamed `<clip>.unrecoverable` and kept for inspection.
+// A clip whose redaction was interrupted is redacted again from its original. Partial renditions are made again.
+func recoverClips(configsvc config.IService, recordingStream chan models.RecordingClip, capturer string, camera soicat.Camera) {
+	files, err := filepath.Glob(fmt.Sprintf("%s/%s/*.mp4", configsvc.GetCapturer().RecordingsFolder, camera.Name))
+	if err != nil {
+		fmt.Printf("capturer %s - agent %s - unable to look for partial clips: %v\n", capturer, camera.Name, err)
+		return
+	}
+
+	partials, err := filepath.Glob(fmt.Sprintf("%s/%s/*%s", configsvc.GetCapturer().RecordingsFolder, camera.Name, partialRenditionExt))
+	if err == nil {
+		for _, file := range partials {
+			_ = os.Remove(file)
+		}
+	}
+
+	for _, file := range files {
+		// The redaction of the clip was interrupted
+		if isRedactedFile(file) {
+			_ = os.Remove(file)
+			continue
+		}
+
+		// The redaction was interrupted between the renames...the original is the clip again
+		if spool.IsOriginalFile(file) {
+			clipFile := spool.OriginalClipFile(file)
+			if _, err := os.Stat(clipFile); errors.Is(err, os.ErrNotExist) {
+				err = os.Rename(file, clipFile)
+				if err != nil {
+					fmt.Printf("capturer %s - agent %s - unable to restore original clip %s: %v\n", capturer, camera.Name, file, err)
+				}
+			}
+		}
+	}
+
+	files, err = filepath.Glob(fmt.Sprintf("%s/%s/*.mp4", configsvc.GetCapturer().RecordingsFolder, camera.Name))
+	if err != nil {
+		fmt.Printf("capturer %s - agent %s - unable to look for partial clips: %v\n", capturer, camera.Name, err)
+		return
+	}
+
+	for _, file := range files {
+		// Sub-stream clips, originals and renditions are recovered with their clip
+		if spool.Spooled(file) || spool.IsSubStreamFile(file) || spool.IsOriginalFile(file) || spool.IsRenditionFile(file) {
+			continue
+		}
+
+		// Only clips named after their begin time are ours
+		name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		unix, err := strconv.ParseInt(strings.Split(name, "_")[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+
+		recording, err := recovery.Finalize(file)
+		if errors.Is(err, recovery.ErrUnrecoverable) {
+			fmt.Printf("capturer %s - agent %s - clip %s cannot be recovered: %v\n", capturer, camera.Name, file, err)
+			err = os.Rename(file, file+".unrecoverable")
+			if err != nil {
+				fmt.Printf("unable to rename file: %s %v\n", file, err)
+			}
+			continue
+		}
+		if err != nil {
+			fmt.Printf("capturer %s - agent %s - unable to finalise clip %s: %v\n", capturer, camera.Name, file, err)
+			continue
+		}
+
+		fmt.Printf("capturer %s - agent %s - recovered clip %s - fragments: %d - frames: %d - truncated: %d bytes\n", capturer, camera.Name, file, recording.Fragments, recording.Frames, recording.Truncated)
+
+		// The sub-stream clip is a convenience...the clip is recovered without it
+		if _, err := os.Stat(spool.SubStreamFile(file)); err == nil {
+			_, err = recovery.Finalize(spool.SubStreamFile(file))
+			if err != nil {
+				fmt.Printf("capturer %s - agent %s - dropping sub-stream clip %s: %v\n", capturer, camera.Name, spool.SubStreamFile(file), err)
+				_ = os.Remove(spool.SubStreamFile(file))
+			}
+		}
+
+		clip, err := newRecordingClip(configsvc, capturer, camera, file, recording.Frames, time.Unix(unix, 0), info.ModTime())
+		if err != nil {
+			fmt.Printf("capturestream - unable to create a clip %v\n", err)
+		}
+		recordingStream <- clip
+	}
+}
@@ -0,0 +1,431 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/yapingcat/gomedia/go-mp4"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/spool"
+)
+
+// Transcoding codecs
+const (
+	TranscodePassthrough = "passthrough"
+	TranscodeH264        = "h264"
+)
+
+// A rendition is written to `<rendition file>.part` until it is complete.
+const partialRenditionExt = ".part"
+
+// TranscodingProfile describes a rendition of the clips. The `passthrough` rendition is the clip as recorded:
+// it is always stored since it is the evidence the chain of custody vouches for. The other renditions are
+// transcoded from it (i.e. for browsers that cannot play H265).
+type TranscodingProfile struct {
+	Name string `json:"name"`
+
+	// `passthrough` or `h264`.
+	Codec string `json:"codec"`
+
+	// H264 profile: `baseline`, `main` or `high`. If empty, `baseline`.
+	Profile string `json:"profile"`
+
+	// Frame height, the width keeps the aspect ratio. If 0 (or taller than the clip), the clip's height.
+	Height int `json:"height"`
+
+	// Bitrate in kbit/s. If 0, 2000.
+	Bitrate int `json:"bitrate"`
+
+	// Seconds between two key frames. If 0, 2.
+	KeyFrameSeconds float64 `json:"keyFrameSeconds"`
+}
+
+// Built-in transcoding profiles. More profiles are loaded from `CAPTURER_TRANSCODING_PROFILES_FILE`.
+var transcodingProfiles = map[string]TranscodingProfile{
+	spool.PassthroughRendition: {Name: spool.PassthroughRendition, Codec: TranscodePassthrough},
+	"h264-720p":                {Name: "h264-720p", Codec: TranscodeH264, Profile: "baseline", Height: 720, Bitrate: 2000},
+	"h264-480p":                {Name: "h264-480p", Codec: TranscodeH264, Profile: "baseline", Height: 480, Bitrate: 1000},
+}
+
+var h264Profiles = map[string]bool{
+	"baseline": true,
+	"main":     true,
+	"high":     true,
+}
+
+var loadProfilesOnce sync.Once
+var loadProfilesErr error
+
+// loadTranscodingProfiles adds the profiles of the JSON file at `CAPTURER_TRANSCODING_PROFILES_FILE`
+// (a list of profiles) to the built-in profiles. A profile of the file replaces a built-in profile of the same name.
+func loadTranscodingProfiles() error {
+	loadProfilesOnce.Do(func() {
+		file := os.Getenv("CAPTURER_TRANSCODING_PROFILES_FILE")
+		if file == "" {
+			return
+		}
+
+		b, err := os.ReadFile(file)
+		if err != nil {
+			loadProfilesErr = err
+			return
+		}
+
+		profiles := []TranscodingProfile{}
+		err = json.Unmarshal(b, &profiles)
+		if err != nil {
+			loadProfilesErr = fmt.Errorf("unable to decode the transcoding profiles: %v", err)
+			return
+		}
+
+		for _, profile := range profiles {
+			err = profile.validate()
+			if err != nil {
+				loadProfilesErr = fmt.Errorf("invalid transcoding profile %s: %v", profile.Name, err)
+				return
+			}
+			transcodingProfiles[profile.Name] = profile
+		}
+	})
+
+	return loadProfilesErr
+}
+
+func transcodingProfile(name string) (TranscodingProfile, error) {
+	err := loadTranscodingProfiles()
+	if err != nil {
+		return TranscodingProfile{}, err
+	}
+
+	profile, ok := transcodingProfiles[name]
+	if !ok {
+		return TranscodingProfile{}, fmt.Errorf("transcoding profile %s not supported", name)
+	}
+
+	return profile, nil
+}
+
+// cameraRenditions returns the transcoding profiles of the camera's renditions: the camera's renditions
+// or the capturer's renditions at `CAPTURER_RENDITIONS` (i.e. `h264-720p,h264-480p`).
+func cameraRenditions(settings CameraSettings) ([]TranscodingProfile, error) {
+	names := settings.Renditions
+	if names == nil && os.Getenv("CAPTURER_RENDITIONS") != "" {
+		names = strings.Split(os.Getenv("CAPTURER_RENDITIONS"), ",")
+	}
+
+	profiles := []TranscodingProfile{}
+	for _, name := range names {
+		profile, err := transcodingProfile(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+
+		// The clip is the passthrough rendition
+		if profile.Codec == TranscodePassthrough {
+			continue
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, nil
+}
+
+func (p TranscodingProfile) validate() error {
+	if p.Name == "" || strings.ContainsAny(p.Name, "/ ") {
+		return fmt.Errorf("name must not be empty nor contain `/` or spaces")
+	}
+
+	if p.Codec != TranscodePassthrough && p.Codec != TranscodeH264 {
+		return fmt.Errorf("codec %s not supported", p.Codec)
+	}
+
+	if p.Profile != "" && !h264Profiles[p.Profile] {
+		return fmt.Errorf("H264 profile %s not supported", p.Profile)
+	}
+
+	if p.Height < 0 || p.Bitrate < 0 || p.KeyFrameSeconds < 0 {
+		return fmt.Errorf("height, bitrate and key frame seconds must not be negative")
+	}
+
+	return nil
+}
+
+func (p TranscodingProfile) h264Profile() string {
+	if p.Profile == "" {
+		return "baseline"
+	}
+
+	return p.Profile
+}
+
+func (p TranscodingProfile) bitrate() int {
+	if p.Bitrate <= 0 {
+		return 2000
+	}
+
+	return p.Bitrate
+}
+
+func (p TranscodingProfile) keyFrameSeconds() float64 {
+	if p.KeyFrameSeconds <= 0 {
+		return 2
+	}
+
+	return p.KeyFrameSeconds
+}
+
+// transcodeRecordingClip makes the clip's renditions next to it: `<clip file without extension>_r-<profile>.mp4`.
+// A rendition that exists was made by a previous run. The renditions are a convenience...a rendition that
+// cannot be made is dropped and the clip is delivered without it...the returned error lists the dropped renditions.
+func transcodeRecordingClip(profiles []TranscodingProfile, recording models.RecordingClip) error {
+	errs := []error{}
+	for _, profile := range profiles {
+		rendition := spool.RenditionFile(recording.LocalReference, profile.Name)
+		if _, err := os.Stat(rendition); err == nil {
+			continue
+		}
+
+		partial := rendition + partialRenditionExt
+		err := transcodeClip(profile, recording.LocalReference, partial)
+		if err == nil {
+			err = os.Rename(partial, rendition)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("dropping rendition %s of %s: %v", profile.Name, recording.LocalReference, err))
+			_ = os.Remove(partial)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// transcodeClip decodes the video of an MP4 clip, scales and encodes it with the profile into another
+// MP4 clip at the clip's measured frame rate. The audio is copied as is.
+func transcodeClip(profile TranscodingProfile, file, rendition string) error {
+	timing, err := sampleClipTiming(file, "")
+	if err != nil {
+		return err
+	}
+
+	frameRate := timing.FPS
+	if frameRate <= 0 {
+		frameRate = defaultMJPEGFrameRate
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	demuxer := mp4.CreateMp4Demuxer(f)
+	tracks, err := demuxer.ReadHead()
+	if err != nil {
+		return fmt.Errorf("unable to read the mp4 header: %v", err)
+	}
+
+	codec := ""
+	videoTrack := 0
+	var audioTrack *mp4.TrackInfo
+	for i, track := range tracks {
+		switch track.Cid {
+		case mp4.MP4_CODEC_H264, mp4.MP4_CODEC_H265:
+			if codec != "" {
+				continue
+			}
+			codec = "H264"
+			if track.Cid == mp4.MP4_CODEC_H265 {
+				codec = "H265"
+			}
+			videoTrack = track.TrackId
+		case mp4.MP4_CODEC_AAC, mp4.MP4_CODEC_G711U, mp4.MP4_CODEC_G711A:
+			if audioTrack == nil {
+				audioTrack = &tracks[i]
+			}
+		}
+	}
+
+	if codec == "" {
+		return fmt.Errorf("no H264 or H265 video track found in %s", file)
+	}
+
+	decoder, err := newDecoder(codec)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	w := &renditionWriter{
+		profile:    profile,
+		file:       rendition,
+		frameRate:  frameRate,
+		audioTrack: audioTrack,
+	}
+	defer w.abort()
+
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if audioTrack != nil && pkt.TrackId == audioTrack.TrackId {
+			err = w.writeAudio(pkt)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if pkt.TrackId != videoTrack {
+			continue
+		}
+
+		// The decoder may hold the frame back until it gets the next frames or it is drained
+		img, err := decoder.decode(pkt.Data)
+		if err != nil || img.Bounds().Empty() {
+			continue
+		}
+
+		err = w.writeFrame(img)
+		if err != nil {
+			return err
+		}
+	}
+
+	var drainErr error
+	decoder.drain(func(img image.YCbCr) {
+		if drainErr == nil {
+			drainErr = w.writeFrame(img)
+		}
+	})
+	if drainErr != nil {
+		return drainErr
+	}
+
+	return w.close()
+}
+
+// renditionWriter encodes the decoded frames and muxes them with the clip's audio. The encoder and the muxer
+// start with the first frame's size...frames of another size are dropped.
+type renditionWriter struct {
+	profile    TranscodingProfile
+	file       string
+	frameRate  float64
+	audioTrack *mp4.TrackInfo
+
+	out       *os.File
+	muxer     *mp4.Movmuxer
+	encoder   *Encoder
+	videoID   uint32
+	audioID   uint32
+	srcWidth  int
+	srcHeight int
+}
+
+func (w *renditionWriter) writeFrame(img image.YCbCr) error {
+	if w.encoder == nil {
+		err := w.open(img.Rect.Dx(), img.Rect.Dy())
+		if err != nil {
+			return err
+		}
+	}
+	if img.Rect.Dx() != w.srcWidth || img.Rect.Dy() != w.srcHeight {
+		return nil
+	}
+
+	return w.encoder.encode(img, w.writePacket)
+}
+
+func (w *renditionWriter) open(srcWidth, srcHeight int) error {
+	encoder, err := newEncoder(w.profile, srcWidth, srcHeight, w.frameRate)
+	if err != nil {
+		return err
+	}
+	w.encoder = encoder
+	w.srcWidth = srcWidth
+	w.srcHeight = srcHeight
+
+	w.out, err = os.Create(w.file)
+	if err != nil {
+		return err
+	}
+
+	w.muxer, err = mp4.CreateMp4Muxer(w.out)
+	if err != nil {
+		return err
+	}
+
+	width, height := renditionSize(srcWidth, srcHeight, w.profile.Height)
+	w.videoID = w.muxer.AddVideoTrack(mp4.MP4_CODEC_H264, mp4.WithVideoWidth(uint32(width)), mp4.WithVideoHeight(uint32(height)))
+
+	if w.audioTrack != nil {
+		options := []mp4.TrackOption{
+			mp4.WithAudioChannelCount(w.audioTrack.ChannelCount),
+			mp4.WithAudioSampleRate(w.audioTrack.SampleRate),
+		}
+		if w.audioTrack.Cid != mp4.MP4_CODEC_AAC {
+			options = append(options, mp4.WithAudioSampleBits(8))
+		}
+		w.audioID = w.muxer.AddAudioTrack(w.audioTrack.Cid, options...)
+	}
+
+	return nil
+}
+
+func (w *renditionWriter) writePacket(pkt EncodedPacket) error {
+	return w.muxer.Write(w.videoID, pkt.Data, uint64(pkt.PTS), uint64(pkt.DTS))
+}
+
+// writeAudio copies an audio packet (ADTS framed if AAC) on the clip's timeline. Audio must not start before the video.
+func (w *renditionWriter) writeAudio(pkt *mp4.AVPacket) error {
+	if w.muxer == nil {
+		return nil
+	}
+
+	return w.muxer.Write(w.audioID, pkt.Data, pkt.Pts, pkt.Dts)
+}
+
+// abort frees the encoder and closes the file if the rendition could not be made.
+func (w *renditionWriter) abort() {
+	if w.encoder != nil {
+		w.encoder.Close()
+		w.encoder = nil
+	}
+	if w.out != nil {
+		w.out.Close()
+		w.out = nil
+	}
+}
+
+// close flushes the encoder and finalizes the MP4 file.
+func (w *renditionWriter) close() error {
+	if w.encoder == nil {
+		return fmt.Errorf("no frame decoded from the clip")
+	}
+
+	err := w.encoder.drain(w.writePacket)
+	if err != nil {
+		return err
+	}
+
+	err = w.muxer.WriteTrailer()
+	if err != nil {
+		return err
+	}
+
+	err = w.out.Close()
+	w.out = nil
+	return err
+}
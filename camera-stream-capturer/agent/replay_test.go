@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+	"github.com/khaledhikmat/threat-detection-shared/service/config"
+	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
+	"github.com/khaledhikmat/threat-detection-shared/service/storage"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/errorlog"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/live"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/replay"
+)
+
+const (
+	replaySample     = "../data/samples/1714533004_Camera1.mp4"
+	replayClipLength = 4 // seconds
+	replayClips      = 3
+)
+
+// replayConfig and replayStorage embed the shared services so the test only implements what the agent uses.
+type replayConfig struct {
+	config.IService
+	capturer config.Capturer
+}
+
+func (c replayConfig) GetCapturer() config.Capturer {
+	return c.capturer
+}
+
+func (c replayConfig) GetRuntimeMode() string {
+	return "replay"
+}
+
+type replayStorage struct {
+	storage.IService
+}
+
+func (replayStorage) StoreKeyValue(_ context.Context, _, _, _ string) error {
+	return nil
+}
+
+// TestStreamingReplay records the replayed sample in streaming mode and checks the clips with the replay checks.
+// The clips are cut on key frames once they reach the camera's max recording length, so every clip starts on a key
+// frame and is at most a GOP longer than the max recording length. The frames in every clip match the frames the
+// agent reported when it closed the clip.
+func TestStreamingReplay(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the sample is replayed in real time")
+	}
+
+	recording, err := replay.Load(replaySample, 25)
+	if err != nil {
+		t.Fatalf("unable to load the sample: %v", err)
+	}
+	if recording.KeyFrames == 0 || len(recording.Frames) == 0 {
+		t.Fatalf("the sample has no key frames")
+	}
+	frameInterval := recording.Duration / time.Duration(len(recording.Frames))
+	gop := recording.Duration / time.Duration(recording.KeyFrames)
+
+	// Make sure the agent does not pick up the developer's settings or quarantine the camera
+	t.Setenv("CAPTURER_SETTINGS_FOLDER", "")
+	t.Setenv("CAPTURER_QUARANTINE_ERRORS", "0")
+
+	server := replay.NewServer(freeAddress(t), recording, true)
+	runCtx, cancel := context.WithTimeout(context.Background(), time.Duration(replayClips+1)*(replayClipLength*time.Second+gop)+5*time.Second)
+	defer cancel()
+
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- server.Run(runCtx)
+	}()
+
+	folder := t.TempDir()
+	camera := soicat.Camera{
+		Name:               "Camera1",
+		RtspURL:            server.URL("camera1"),
+		MaxLengthRecording: replayClipLength,
+	}
+	err = os.MkdirAll(filepath.Join(folder, camera.Name), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configsvc := replayConfig{capturer: config.Capturer{RecordingsFolder: folder, AgentMode: "streaming"}}
+	storagesvc := replayStorage{}
+	errorLog := errorlog.NewErrorLog(nil, storagesvc, "replay")
+	stats := NewStats(camera.Name, "streaming", 1)
+
+	// Collect the recorded clips until the agent is stopped and the stream is idle (its last clip is closed)
+	recordingStream := make(chan models.RecordingClip, 10)
+	clipsDone := make(chan map[string]models.RecordingClip)
+	go func() {
+		clips := map[string]models.RecordingClip{}
+		for {
+			select {
+			case clip := <-recordingStream:
+				clips[clip.LocalReference] = clip
+			case <-runCtx.Done():
+				for {
+					select {
+					case clip := <-recordingStream:
+						clips[clip.LocalReference] = clip
+					case <-time.After(2 * time.Second):
+						clipsDone <- clips
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	err = runStreaming(runCtx, configsvc, storagesvc, nil, errorLog, defaultCameraSettings(), live.NewStreams(), stats, recordingStream, make(chan string, 10), "replay", camera)
+	if runCtx.Err() == nil {
+		t.Fatalf("the agent stopped before it was cancelled: %v", err)
+	}
+
+	clips := <-clipsDone
+	<-serverDone
+
+	// The last clip was cut short when the agent stopped, so only its key frame alignment is checked
+	minDuration := replayClipLength*time.Second - frameInterval
+	reports, failures := replay.Check(filepath.Join(folder, camera.Name), replay.Expectations{
+		MinClips:    replayClips,
+		MinFrames:   1,
+		MinDuration: minDuration,
+		MaxDuration: replayClipLength*time.Second + gop + frameInterval,
+	})
+	for _, failure := range failures {
+		t.Error(failure)
+	}
+
+	for i, report := range reports {
+		if i < len(reports)-1 && report.Frames < int(minDuration/frameInterval) {
+			t.Errorf("%s: %d frames, expected at least %d", report.Path, report.Frames, int(minDuration/frameInterval))
+		}
+
+		clip, ok := clips[report.Path]
+		if !ok {
+			t.Errorf("%s: was not sent to the recording stream", report.Path)
+			continue
+		}
+
+		if clip.Frames != report.Frames {
+			t.Errorf("%s: %d frames recorded, %d frames in the clip", report.Path, clip.Frames, report.Frames)
+		}
+
+		if report.KeyFrames == 0 {
+			t.Errorf("%s: no key frames", report.Path)
+		}
+	}
+}
+
+// freeAddress returns a local address that nothing listens on.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"time"
+)
+
+// A GOP (group of pictures) is a keyframe followed by all the packets that depend on it.
+// It is the smallest unit a clip can start from.
+type gop struct {
+	arrival time.Time
+	packets []Packet
+}
+
+// GOPBuffer is an in-memory ring buffer of complete GOPs. It keeps at least `duration`
+// worth of packets so a clip can be written starting before the moment recording was requested.
+// It is not safe for concurrent use; it is owned by the capture processor.
+type GOPBuffer struct {
+	duration time.Duration
+	gops     []gop
+}
+
+func NewGOPBuffer(duration time.Duration) *GOPBuffer {
+	return &GOPBuffer{
+		duration: duration,
+		gops:     []gop{},
+	}
+}
+
+// Push adds a packet to the buffer and evicts the GOPs that are no longer needed. GOPs are timed by the
+// arrival of their keyframe at the capturer, not by when they leave the packet queue.
+func (b *GOPBuffer) Push(pkt Packet) {
+	now := pkt.ArrivalTime
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	// A keyframe opens a new GOP
+	if pkt.IsVideo && pkt.IsKeyFrame {
+		b.gops = append(b.gops, gop{
+			arrival: now,
+			packets: []Packet{pkt},
+		})
+	} else if len(b.gops) > 0 {
+		b.gops[len(b.gops)-1].packets = append(b.gops[len(b.gops)-1].packets, pkt)
+	}
+	// Packets that arrive before the first keyframe cannot be decoded, so they are dropped
+
+	// Evict the oldest GOP only if the next one still starts before the buffer's window
+	for len(b.gops) > 1 && !b.gops[1].arrival.After(now.Add(-b.duration)) {
+		b.gops[0] = gop{}
+		b.gops = b.gops[1:]
+	}
+}
+
+// Since returns the buffered packets starting from the latest keyframe that arrived at or before `t`.
+// If all buffered GOPs are newer than `t`, the packets start from the oldest keyframe.
+func (b *GOPBuffer) Since(t time.Time) []Packet {
+	start := 0
+	for i, g := range b.gops {
+		if g.arrival.After(t) {
+			break
+		}
+		start = i
+	}
+
+	packets := []Packet{}
+	for _, g := range b.gops[start:] {
+		packets = append(packets, g.packets...)
+	}
+
+	return packets
+}
+
+// Duration returns the pre-event window the buffer is configured to keep.
+func (b *GOPBuffer) Duration() time.Duration {
+	return b.duration
+}
+
+// Reset drops all buffered packets.
+func (b *GOPBuffer) Reset() {
+	b.gops = []gop{}
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+// gopPackets returns a GOP of a keyframe and two inter frames that arrive `at` after `base`, 300ms apart.
+func gopPackets(base time.Time, at time.Duration) []Packet {
+	packets := []Packet{}
+	for i := 0; i < 3; i++ {
+		offset := at + time.Duration(i)*300*time.Millisecond
+		packets = append(packets, Packet{
+			IsVideo:     true,
+			IsKeyFrame:  i == 0,
+			Time:        offset,
+			ArrivalTime: base.Add(offset),
+		})
+	}
+	return packets
+}
+
+// times returns the decode times of the packets so they can be compared.
+func times(packets []Packet) []time.Duration {
+	t := []time.Duration{}
+	for _, pkt := range packets {
+		t = append(t, pkt.Time)
+	}
+	return t
+}
+
+func TestGOPBufferDropsPacketsBeforeKeyframe(t *testing.T) {
+	base := time.Now()
+	buffer := NewGOPBuffer(2 * time.Second)
+
+	buffer.Push(Packet{IsVideo: true, Time: 0, ArrivalTime: base})
+	buffer.Push(Packet{IsAudio: true, Time: 100 * time.Millisecond, ArrivalTime: base.Add(100 * time.Millisecond)})
+	if got := buffer.Since(base); len(got) != 0 {
+		t.Fatalf("got %d packets before the first keyframe, want none", len(got))
+	}
+
+	for _, pkt := range gopPackets(base, time.Second) {
+		buffer.Push(pkt)
+	}
+	if got := buffer.Since(base); got[0].Time != time.Second || !got[0].IsKeyFrame {
+		t.Errorf("got first packet at %v, want the keyframe at 1s", got[0].Time)
+	}
+}
+
+func TestGOPBuffer(t *testing.T) {
+	base := time.Now()
+	buffer := NewGOPBuffer(2 * time.Second)
+
+	// GOPs start every second from 0s to 4s, the last packet arrives at 4.6s
+	for at := time.Duration(0); at <= 4*time.Second; at += time.Second {
+		for _, pkt := range gopPackets(base, at) {
+			buffer.Push(pkt)
+		}
+	}
+
+	ms := time.Millisecond
+	tests := []struct {
+		name  string
+		since time.Time
+		want  []time.Duration
+	}{
+		{
+			// The window starts at 2.6s: the GOP at 2s covers it, the older GOPs were evicted
+			name:  "before the oldest kept GOP",
+			since: base,
+			want:  []time.Duration{2000 * ms, 2300 * ms, 2600 * ms, 3000 * ms, 3300 * ms, 3600 * ms, 4000 * ms, 4300 * ms, 4600 * ms},
+		},
+		{
+			name:  "at a keyframe",
+			since: base.Add(3 * time.Second),
+			want:  []time.Duration{3000 * ms, 3300 * ms, 3600 * ms, 4000 * ms, 4300 * ms, 4600 * ms},
+		},
+		{
+			name:  "within a GOP",
+			since: base.Add(3500 * ms),
+			want:  []time.Duration{3000 * ms, 3300 * ms, 3600 * ms, 4000 * ms, 4300 * ms, 4600 * ms},
+		},
+		{
+			name:  "after the last keyframe",
+			since: base.Add(10 * time.Second),
+			want:  []time.Duration{4000 * ms, 4300 * ms, 4600 * ms},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := times(buffer.Since(tt.since))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	buffer.Reset()
+	if got := buffer.Since(base); len(got) != 0 {
+		t.Errorf("got %d packets after reset, want none", len(got))
+	}
+}
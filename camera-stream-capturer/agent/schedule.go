@@ -0,0 +1,192 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // the schedules' time zones do not depend on the host's zoneinfo
+)
+
+// Schedule recording modes
+const (
+	ScheduleContinuous = "continuous"
+	ScheduleMotion     = "motion"
+	ScheduleOff        = "off"
+)
+
+// Schedule days besides `mon` ~ `sun`
+const (
+	scheduleWeekdays = "weekdays"
+	scheduleWeekends = "weekends"
+	scheduleHolidays = "holidays"
+)
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule modes are session modes: continuous windows stream and motion windows record motion only.
+var scheduleModes = map[string]string{
+	ScheduleContinuous: "streaming",
+	ScheduleMotion:     "motion",
+	ScheduleOff:        ScheduleOff,
+}
+
+// sessionMode returns the mode the camera's session runs in at a time: `streaming`, `triggered`, `motion`
+// or `off` if the camera must not be recorded. Without a schedule, it is the capturer's agent mode.
+func sessionMode(settings CameraSettings, agentMode string, now time.Time) string {
+	if settings.Schedule == nil {
+		return agentMode
+	}
+
+	mode := settings.Schedule.modeAt(now)
+	if mode == "" {
+		return agentMode
+	}
+
+	return scheduleModes[mode]
+}
+
+// modeAt returns the schedule mode at a time or empty if the default mode is the capturer's agent mode.
+func (s *ScheduleSettings) modeAt(now time.Time) string {
+	location := time.Local
+	if s.location != nil {
+		location = s.location
+	}
+	local := now.In(location)
+
+	for _, window := range s.Windows {
+		if s.inWindow(window, local) {
+			return window.Mode
+		}
+	}
+
+	return s.Default
+}
+
+func (s *ScheduleSettings) inWindow(window ScheduleWindow, local time.Time) bool {
+	start, _ := dailyMinutes(window.Start)
+	end, _ := dailyMinutes(window.End)
+	minutes := local.Hour()*60 + local.Minute()
+
+	if start == end {
+		return s.onDays(window.Days, local)
+	}
+
+	if start < end {
+		return minutes >= start && minutes < end && s.onDays(window.Days, local)
+	}
+
+	// The window started the day before
+	if minutes < end {
+		return s.onDays(window.Days, local.AddDate(0, 0, -1))
+	}
+
+	return minutes >= start && s.onDays(window.Days, local)
+}
+
+// onDays tells if a date is one of the window's days. Holidays are only `holidays`.
+func (s *ScheduleSettings) onDays(days []string, date time.Time) bool {
+	if len(days) == 0 {
+		return true
+	}
+
+	holiday := s.isHoliday(date)
+	for _, day := range days {
+		switch strings.ToLower(day) {
+		case scheduleHolidays:
+			if holiday {
+				return true
+			}
+		case scheduleWeekdays:
+			if !holiday && date.Weekday() != time.Saturday && date.Weekday() != time.Sunday {
+				return true
+			}
+		case scheduleWeekends:
+			if !holiday && (date.Weekday() == time.Saturday || date.Weekday() == time.Sunday) {
+				return true
+			}
+		default:
+			if !holiday && scheduleDays[strings.ToLower(day)] == date.Weekday() {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (s *ScheduleSettings) isHoliday(date time.Time) bool {
+	day := date.Format("2006-01-02")
+	for _, holiday := range s.Holidays {
+		if holiday == day {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validate checks the schedule and loads its time zone.
+func (s *ScheduleSettings) validate() error {
+	if s.TimeZone != "" {
+		location, err := time.LoadLocation(s.TimeZone)
+		if err != nil {
+			return fmt.Errorf("time zone %s: %v", s.TimeZone, err)
+		}
+		s.location = location
+	}
+
+	if _, ok := scheduleModes[s.Default]; s.Default != "" && !ok {
+		return fmt.Errorf("default mode %s not supported", s.Default)
+	}
+
+	for _, holiday := range s.Holidays {
+		if _, err := time.Parse("2006-01-02", holiday); err != nil {
+			return fmt.Errorf("holiday %s is not a date", holiday)
+		}
+	}
+
+	for i, window := range s.Windows {
+		if _, ok := scheduleModes[window.Mode]; !ok {
+			return fmt.Errorf("window %d mode %s not supported", i+1, window.Mode)
+		}
+
+		if _, err := dailyMinutes(window.Start); err != nil {
+			return fmt.Errorf("window %d start %s is not a `15:04` time", i+1, window.Start)
+		}
+
+		if _, err := dailyMinutes(window.End); err != nil {
+			return fmt.Errorf("window %d end %s is not a `15:04` time", i+1, window.End)
+		}
+
+		for _, day := range window.Days {
+			day = strings.ToLower(day)
+			if _, ok := scheduleDays[day]; !ok && day != scheduleWeekdays && day != scheduleWeekends && day != scheduleHolidays {
+				return fmt.Errorf("window %d day %s not supported", i+1, day)
+			}
+		}
+	}
+
+	return nil
+}
+
+// dailyMinutes returns the minutes since midnight of a `15:04` time. Empty is midnight.
+func dailyMinutes(t string) (int, error) {
+	if t == "" {
+		return 0, nil
+	}
+
+	parsed, err := time.Parse("15:04", t)
+	if err != nil {
+		return 0, err
+	}
+
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionMode(t *testing.T) {
+	schedule := &ScheduleSettings{
+		TimeZone: "America/Chicago",
+		Holidays: []string{"2024-12-25", "2024-12-27"},
+		Default:  ScheduleOff,
+		Windows: []ScheduleWindow{
+			{Days: []string{"holidays"}, Start: "00:00", End: "00:00", Mode: ScheduleContinuous},
+			{Days: []string{"fri"}, Start: "22:00", End: "06:00", Mode: ScheduleContinuous},
+			{Days: []string{"weekdays"}, Start: "08:00", End: "18:00", Mode: ScheduleMotion},
+		},
+	}
+	if err := schedule.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	chicago, _ := time.LoadLocation("America/Chicago")
+	at := func(date string) time.Time {
+		local, err := time.ParseInLocation("2006-01-02 15:04", date, chicago)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return local
+	}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want string
+	}{
+		{"weekday window", at("2024-12-24 10:00"), "motion"},
+		{"weekday window end", at("2024-12-24 18:00"), ScheduleOff},
+		{"outside the windows", at("2024-12-24 20:00"), ScheduleOff},
+		{"overnight window before midnight", at("2024-12-20 23:00"), "streaming"},
+		{"overnight window after midnight", at("2024-12-21 05:59"), "streaming"},
+		{"overnight window end", at("2024-12-21 06:00"), ScheduleOff},
+		{"overnight window on the wrong day", at("2024-12-19 23:00"), ScheduleOff},
+		{"overnight window started the day before", at("2024-12-20 02:00"), ScheduleOff},
+		{"holiday replaces weekdays", at("2024-12-25 10:00"), "streaming"},
+		{"holiday all day", at("2024-12-25 03:00"), "streaming"},
+		{"overnight window after a holiday", at("2024-12-28 02:00"), ScheduleOff},
+		{"schedule time zone", time.Date(2024, 12, 21, 4, 30, 0, 0, time.UTC), "streaming"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sessionMode(CameraSettings{Schedule: schedule}, "triggered", tt.now)
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionModeWithoutSchedule(t *testing.T) {
+	if got := sessionMode(CameraSettings{}, "triggered", time.Now()); got != "triggered" {
+		t.Errorf("got %s, want the agent mode", got)
+	}
+
+	schedule := &ScheduleSettings{
+		Windows: []ScheduleWindow{{Start: "00:00", End: "00:00", Mode: ScheduleMotion, Days: []string{"holidays"}}},
+	}
+	if got := sessionMode(CameraSettings{Schedule: schedule}, "triggered", time.Now()); got != "triggered" {
+		t.Errorf("got %s outside the windows without a default, want the agent mode", got)
+	}
+}
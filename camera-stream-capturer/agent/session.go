@@ -0,0 +1,395 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+	"github.com/khaledhikmat/threat-detection-shared/service/config"
+	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
+	"github.com/khaledhikmat/threat-detection-shared/service/storage"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/errorlog"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/live"
+)
+
+// Camera states published by the agent supervisor
+const (
+	CameraConnecting = "connecting"
+	CameraStreaming  = "streaming"
+	CameraStalled    = "stalled"
+	CameraFailed     = "failed"
+	CameraStopped    = "stopped"
+	CameraOff        = "off" // not recorded by schedule
+
+	// Stopped by the quarantine policy until started again
+	CameraQuarantined = "quarantined"
+)
+
+// DaprClient reads the cameras' last states so a quarantine survives a restart. It is nil outside the DAPR runtime.
+var DaprClient dapr.Client
+
+const (
+	reconnectMinBackoff = 1 * time.Second
+	reconnectMaxBackoff = 60 * time.Second
+)
+
+var (
+	errSessionStalled   = errors.New("no packets received")
+	errSessionStopped   = errors.New("session stopped")
+	errSessionRestarted = errors.New("session restarted")
+	errScheduleChanged  = errors.New("schedule changed")
+	errScheduleOff      = errors.New("off by schedule")
+
+	errSessionQuarantined = errors.New("session quarantined")
+)
+
+// runSession connects to the camera, streams it until the connection fails, stalls, is stopped, restarted
+// or quarantined by a command, its schedule moves to another mode or the context is cancelled. PTZ commands are handed to the PTZ processor.
+// It returns whether the session made it to streaming so the supervisor can reset its backoff.
+func runSession(canxCtx context.Context,
+	configsvc config.IService,
+	storagesvc storage.IService,
+	settings CameraSettings,
+	liveStreams *live.Streams,
+	stats *Stats,
+	errorsStream chan interface{},
+	recordingStream chan models.RecordingClip,
+	commandsStream chan string,
+	ptzStream chan string,
+	mode string,
+	capturer string,
+	camera soicat.Camera) (bool, error) {
+
+	// Everything started by this session stops with it
+	sessionCtx, cancel := context.WithCancel(canxCtx)
+
+	// The packet queues forward until the camera sources are closed
+	queuesDone := make(chan struct{})
+	defer close(queuesDone)
+
+	// The session's goroutines send to the errors stream, so the session ends once they are all done
+	// (after the camera sources are closed) and the agent can close the errors stream after its sessions
+	var senders sync.WaitGroup
+	defer senders.Wait()
+
+	source, err := NewCameraSource(camera, settings)
+	if err != nil {
+		cancel()
+		return false, err
+	}
+	defer source.Close()
+	defer cancel()
+
+	err = source.Connect(sessionCtx)
+	if err != nil {
+		return false, fmt.Errorf("error connecting to %s stream: %v", cameraSourceName(camera, settings), err)
+	}
+
+	fmt.Printf("capturer.agent - opened %s stream: %s\n", cameraSourceName(camera, settings), camera.RtspURL)
+
+	// Get the video streams from the camera.
+	videoStreams, err := source.GetVideoStreams()
+	if err != nil || len(videoStreams) == 0 {
+		return false, fmt.Errorf("no video stream found, might be the wrong codec (we only support H264, H265 and MJPEG for the moment)")
+	}
+
+	// Get the video stream from the camera.
+	videoStream := videoStreams[0]
+
+	// Override config values with the video stream information
+	camera.CaptureWidth = videoStream.Width
+	camera.CaptureHeight = videoStream.Height
+
+	// Get all the streams so clips can include audio
+	streams, err := source.GetStreams()
+	if err != nil {
+		return false, fmt.Errorf("unable to get streams: %v", err)
+	}
+
+	// Repackage the video into a live stream while it is watched
+	hls := liveStreams.Open(camera.Name, videoStream.Name)
+	defer liveStreams.Close(camera.Name, hls)
+
+	// Forward the H264 RTP packets to WebRTC viewers, only the RTSP client has them
+	if rtspSource, ok := source.(*Golibrtsp); ok {
+		rtc, err := liveStreams.OpenWebRTC(camera.Name, videoStream.Name, videoStream.SPS, videoStream.PPS)
+		if err != nil {
+			reportError(errorsStream, errorlog.Errorf(errorlog.Other, "capturer %s - agent %s mode %s - unable to open the webrtc stream: %v", capturer, camera.Name, mode, err))
+		} else if rtc != nil {
+			rtspSource.VideoRTPForwarder = rtc.WriteRTP
+			defer liveStreams.CloseWebRTC(camera.Name, rtc)
+		}
+	}
+
+	// Hand the camera packets to a bounded queue while tracking the last packet time. The source calls push from
+	// its reader, so push never blocks: the queue drops packets if the processors are behind.
+	packetsStream := make(chan Packet, 10)
+	queue := newPacketQueue(stats, "main", capturer, camera)
+	go queue.forward(sessionCtx, queuesDone, packetsStream)
+	lastPacket := atomic.Int64{}
+	lastPacket.Store(time.Now().UnixNano())
+	firstPacket := atomic.Bool{}
+
+	// Key frames are tapped for the camera health monitor, it skips them while busy
+	var healthPacketsStream chan Packet
+	if healthInterval() > 0 {
+		healthPacketsStream = make(chan Packet, 1)
+	}
+
+	// The live stream has a queue of its own so a slow repackager never holds the processors up
+	var hlsQueue *PacketQueue
+	if hls != nil {
+		hlsQueue = newPacketQueue(stats, "hls", capturer, camera)
+		hlsPacketsStream := make(chan Packet, 10)
+		go hlsQueue.forward(sessionCtx, queuesDone, hlsPacketsStream)
+		go func() {
+			for {
+				select {
+				case <-queuesDone:
+					return
+				case pkt := <-hlsPacketsStream:
+					err := hls.WritePacket(pkt.Data, pkt.Time, pkt.IsKeyFrame)
+					if err != nil {
+						fmt.Printf("capturer %s - agent %s - live stream packet dropped: %v\n", capturer, camera.Name, err)
+					}
+				}
+			}
+		}()
+	}
+
+	push := func(pkt Packet) {
+		lastPacket.Store(time.Now().UnixNano())
+		firstPacket.Store(true)
+		stats.packet(pkt)
+		if hlsQueue != nil && pkt.IsVideo {
+			hlsQueue.push(pkt)
+		}
+		if healthPacketsStream != nil && pkt.IsVideo && pkt.IsKeyFrame {
+			select {
+			case healthPacketsStream <- pkt:
+			default:
+			}
+		}
+		queue.push(pkt)
+	}
+
+	// Detect connection failures
+	waitStream := make(chan error, 1)
+	startStream := make(chan error, 1)
+	senders.Add(1)
+	go func() {
+		defer senders.Done()
+		err := source.Start(sessionCtx, errorsStream, push, camera)
+		if err != nil {
+			startStream <- err
+			return
+		}
+
+		waitStream <- source.Wait()
+	}()
+
+	// Create a triggers stream to request recordings in triggered and motion modes
+	triggersStream := make(chan time.Time, 10)
+
+	// In motion mode, packets go through the motion detector before they reach the capture processor
+	capturePacketsStream := packetsStream
+	if mode == "motion" {
+		capturePacketsStream = make(chan Packet, 10)
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			DetectMotion(sessionCtx, source, settings, errorsStream, packetsStream, capturePacketsStream, triggersStream, capturer, camera)
+		}()
+	}
+
+	// Watch the camera for tampering, blackout, blur and frozen pictures
+	healthStream := make(chan string, 10)
+	if healthPacketsStream != nil {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			MonitorHealth(sessionCtx, storagesvc, settings, errorsStream, healthPacketsStream, healthStream, triggersStream, mode, capturer, camera)
+		}()
+	}
+
+	// Record the camera's sub-stream alongside the main stream for the model invokers
+	var subPacketsStream chan Packet
+	var subStreams []Stream
+	sub := openSubStream(sessionCtx, queuesDone, &senders, settings, stats, errorsStream, capturer, camera)
+	if sub != nil {
+		defer sub.source.Close()
+		subPacketsStream = sub.packets
+		subStreams = sub.streams
+	}
+
+	// Capture stream and write mp4 clips to destination (i.e. disk, S3, etc).
+	senders.Add(1)
+	go func() {
+		defer senders.Done()
+		if mode == "triggered" || mode == "motion" {
+			CaptureTriggered(sessionCtx, configsvc, storagesvc, errorsStream, capturePacketsStream, subPacketsStream, healthStream, triggersStream, streams, subStreams, recordingStream, capturer, camera)
+			return
+		}
+
+		CaptureStream(sessionCtx, configsvc, storagesvc, errorsStream, capturePacketsStream, subPacketsStream, healthStream, streams, subStreams, recordingStream, capturer, camera)
+	}()
+
+	stallTimeout := stallDuration()
+	streamed := false
+	paused := false
+	stats.setPaused(false)
+	healthTicker := time.NewTicker(1 * time.Second)
+	defer healthTicker.Stop()
+	periodicTicker := time.NewTicker(20 * time.Second)
+	defer periodicTicker.Stop()
+
+	// Wait for cancellation, failure, command or periodic timer
+	for {
+		select {
+		case <-canxCtx.Done():
+			return streamed, canxCtx.Err()
+		case err := <-startStream:
+			return streamed, fmt.Errorf("starting the camera source failed: %v", err)
+		case err := <-waitStream:
+			return streamed, fmt.Errorf("camera connection closed: %v", err)
+		case <-healthTicker.C:
+			stats.measure()
+			if !streamed && firstPacket.Load() {
+				streamed = true
+				publishCameraState(canxCtx, storagesvc, stats, capturer, camera, CameraStreaming)
+			}
+
+			// A paused stream does not send packets
+			if !paused && time.Since(time.Unix(0, lastPacket.Load())) > stallTimeout {
+				return streamed, errSessionStalled
+			}
+
+			if sessionMode(settings, configsvc.GetCapturer().AgentMode, time.Now()) != mode {
+				return streamed, errScheduleChanged
+			}
+		case cmd := <-commandsStream:
+			fmt.Printf("capturer %s - agent %s mode %s - command %s\n", capturer, camera.Name, mode, cmd)
+			if isPTZCommand(cmd) {
+				forwardPTZCommand(ptzStream, errorsStream, capturer, camera, cmd)
+			} else if cmd == "Start" {
+				fmt.Printf("capturer %s - agent %s mode %s - start command processor...already started\n", capturer, camera.Name, mode)
+			} else if cmd == "Stop" {
+				fmt.Printf("capturer %s - agent %s mode %s - stop command processor\n", capturer, camera.Name, mode)
+				return streamed, errSessionStopped
+			} else if cmd == "Restart" {
+				fmt.Printf("capturer %s - agent %s mode %s - restart command processor\n", capturer, camera.Name, mode)
+				return streamed, errSessionRestarted
+			} else if cmd == quarantineCommand {
+				fmt.Printf("capturer %s - agent %s mode %s - quarantine command processor\n", capturer, camera.Name, mode)
+				return streamed, errSessionQuarantined
+			} else if cmd == "Pause" {
+				fmt.Printf("capturer %s - agent %s mode %s - pause command processor\n", capturer, camera.Name, mode)
+				err := source.Pause()
+				if err == nil && sub != nil {
+					err = sub.source.Pause()
+				}
+				if err != nil {
+					reportError(errorsStream, errorlog.Errorf(errorlog.Connect, "capturer %s - agent %s mode %s - pausing the camera source failed: %v", capturer, camera.Name, mode, err))
+				} else {
+					paused = true
+					stats.setPaused(true)
+				}
+			} else if cmd == "Resume" {
+				fmt.Printf("capturer %s - agent %s mode %s - resume command processor\n", capturer, camera.Name, mode)
+				err := source.Resume()
+				if err == nil && sub != nil {
+					err = sub.source.Resume()
+				}
+				if err != nil {
+					reportError(errorsStream, errorlog.Errorf(errorlog.Connect, "capturer %s - agent %s mode %s - resuming the camera source failed: %v", capturer, camera.Name, mode, err))
+				} else {
+					paused = false
+					stats.setPaused(false)
+					lastPacket.Store(time.Now().UnixNano())
+				}
+			} else if cmd == "Record" {
+				fmt.Printf("capturer %s - agent %s mode %s - record command processor\n", capturer, camera.Name, mode)
+				// Streaming mode records continuously, so only triggered and motion modes need to be told
+				if mode == "triggered" || mode == "motion" {
+					select {
+					case triggersStream <- time.Now():
+					default:
+						reportError(errorsStream, errorlog.Errorf(errorlog.Other, "capturer %s - agent %s mode %s - triggers stream is full, dropping the record command", capturer, camera.Name, mode))
+					}
+				}
+			}
+		case <-periodicTicker.C:
+			fmt.Printf("capturer %s - agent %s mode %s - timeout....perform periodic tasks...\n", capturer, camera.Name, mode)
+		}
+	}
+}
+
+// A session is stalled if no packets arrive for this long.
+func stallDuration() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("CAPTURER_STALL_SECONDS"))
+	if err != nil || seconds <= 0 {
+		seconds = 10
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// reconnectBackoff doubles the backoff with every attempt up to a max and picks a random
+// duration between half and all of it so agents do not reconnect in lockstep.
+func reconnectBackoff(attempt int) time.Duration {
+	backoff := reconnectMaxBackoff
+	if attempt < 16 {
+		backoff = reconnectMinBackoff << attempt
+	}
+	if backoff > reconnectMaxBackoff {
+		backoff = reconnectMaxBackoff
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// Camera states are stored in key/value storage where the key = camera_state_capturer_camera
+// and the value = ts_state. The last state is also stored under camera_state_camera so whichever
+// capturer takes the camera next restores its quarantine.
+func publishCameraState(canxCtx context.Context, storagesvc storage.IService, stats *Stats, capturer string, camera soicat.Camera, state string) {
+	fmt.Printf("capturer %s - agent %s - camera state: %s\n", capturer, camera.Name, state)
+	stats.setState(state)
+	value := fmt.Sprintf("%s_%s", time.Now().UTC().Format("2006-01-02 15:04:05"), state)
+	for _, key := range []string{fmt.Sprintf("%s_%s_%s", "camera_state", capturer, camera.Name), cameraStateKey(camera)} {
+		err := storagesvc.StoreKeyValue(canxCtx, models.ThreatDetectionStateStore, key, value)
+		if err != nil {
+			fmt.Printf("capturer %s - agent %s - unable to publish camera state %s: %v\n", capturer, camera.Name, state, err)
+		}
+	}
+}
+
+// cameraQuarantined returns whether the camera's last state is quarantined. Without a DAPR client, the
+// last state cannot be read and the camera starts out of quarantine.
+func cameraQuarantined(canxCtx context.Context, capturer string, camera soicat.Camera) bool {
+	if DaprClient == nil {
+		return false
+	}
+
+	item, err := DaprClient.GetState(canxCtx, models.ThreatDetectionStateStore, cameraStateKey(camera), nil)
+	if err != nil {
+		fmt.Printf("capturer %s - agent %s - unable to read the camera state: %v\n", capturer, camera.Name, err)
+		return false
+	}
+
+	return item != nil && strings.HasSuffix(string(item.Value), "_"+CameraQuarantined)
+}
+
+func cameraStateKey(camera soicat.Camera) string {
+	return fmt.Sprintf("%s_%s", "camera_state", camera.Name)
+}
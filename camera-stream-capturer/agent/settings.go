@@ -0,0 +1,297 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
+)
+
+// CameraSettings carries the per-camera agent settings that are not part of the soicat camera catalogue.
+// The catalogue's camera model belongs to the shared module, so the motion regions, sub-stream, schedule and
+// the other settings cannot be added to it here. They are loaded from `<CAPTURER_SETTINGS_FOLDER>/<camera name>.json`
+// instead and validated when the agent starts: a file with unknown fields or invalid settings stops the agent.
+// A camera without a settings file gets the default settings.
+type CameraSettings struct {
+	// Percentage (0 ~ 100) of changed pixels in the motion regions that counts as motion.
+	MotionThreshold float64 `json:"motionThreshold"`
+
+	// Regions of interest for motion detection. If empty, the whole frame is analysed.
+	MotionRegions []Polygon `json:"motionRegions"`
+
+	// The camera source: `rtsp`, `mjpeg` or `snapshot`. If empty, it is inferred from the camera URL.
+	Source string `json:"source"`
+
+	// Frame rate of an MJPEG stream. If 0, it is measured when connecting.
+	FrameRate float64 `json:"frameRate"`
+
+	// Seconds between two snapshots of a snapshot camera.
+	SnapshotInterval float64 `json:"snapshotInterval"`
+
+	// Frame rate of the timelapse clips of a snapshot camera: every snapshot is a frame.
+	TimelapseFrameRate float64 `json:"timelapseFrameRate"`
+
+	// URL of the camera's low-resolution sub-stream. If set, it is recorded alongside the main stream
+	// (the camera URL) and the model invokers analyse it instead of the main stream.
+	SubStreamURL string `json:"subStreamUrl"`
+
+	// ONVIF PTZ of the camera. If nil, the camera cannot be moved.
+	PTZ *PTZSettings `json:"ptz"`
+
+	// Recording schedule of the camera. If nil, the camera records around the clock in the capturer's agent mode.
+	Schedule *ScheduleSettings `json:"schedule"`
+
+	// Privacy redaction of the camera's clips. If nil, the clips leave the capturer as recorded.
+	Privacy *PrivacySettings `json:"privacy"`
+
+	// Transcoding profiles of the camera's clip renditions (i.e. `h264-720p`). If nil, the capturer's renditions.
+	Renditions []string `json:"renditions"`
+}
+
+// PrivacySettings tells the agent what to redact from the camera's clips before they leave the capturer.
+type PrivacySettings struct {
+	// Static regions blacked out of every frame (i.e. neighbouring windows).
+	Masks []Polygon `json:"masks"`
+
+	// The face detector whose faces are pixelated (i.e. `http`). If empty, faces are not blurred.
+	FaceDetector string `json:"faceDetector"`
+}
+
+// PTZSettings tells the agent how to reach the camera's ONVIF PTZ service and which preset tours to run.
+type PTZSettings struct {
+	// The camera's ONVIF device service URL (i.e. `http://camera/onvif/device_service`).
+	XAddr    string `json:"xaddr"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// The media profile to move. If empty, the first profile with a PTZ configuration.
+	Profile string `json:"profile"`
+
+	// Seconds a preset requested by a command (i.e. an alert) is held before the tours resume.
+	HoldSeconds int `json:"holdSeconds"`
+
+	Tours []PTZTour `json:"tours"`
+}
+
+// PTZTour moves the camera through presets in a loop. A tour with a daily window runs in its window
+// (capturer time). A tour without a window only runs when it is started by a command.
+type PTZTour struct {
+	Name  string    `json:"name"`
+	Start string    `json:"start"` // i.e. `22:00`
+	End   string    `json:"end"`   // i.e. `06:00`, the window ends the next day if before the start
+	Steps []PTZStep `json:"steps"`
+}
+
+// PTZStep is a preset (token or name) and the seconds the camera stays there.
+type PTZStep struct {
+	Preset string `json:"preset"`
+	Dwell  int    `json:"dwell"`
+}
+
+// ScheduleSettings tells the agent how to record throughout the week. The first window that includes
+// the time decides the recording mode, the default mode applies outside the windows.
+type ScheduleSettings struct {
+	// IANA time zone of the windows and holidays (i.e. `America/Chicago`). If empty, capturer time.
+	TimeZone string `json:"timeZone"`
+
+	// Holiday dates (i.e. `2024-12-25`). Holidays only match windows for `holidays` or for every day.
+	Holidays []string `json:"holidays"`
+
+	// Mode outside the windows: `continuous`, `motion` or `off`. If empty, the capturer's agent mode.
+	Default string `json:"default"`
+
+	Windows []ScheduleWindow `json:"windows"`
+
+	location *time.Location
+}
+
+// ScheduleWindow is a daily window and its recording mode. A window ending before it starts ends the next day
+// and belongs to the day it starts. A window without start and end lasts the whole day.
+type ScheduleWindow struct {
+	// `mon` ~ `sun`, `weekdays`, `weekends` or `holidays`. If empty, every day.
+	Days  []string `json:"days"`
+	Start string   `json:"start"` // i.e. `08:00`
+	End   string   `json:"end"`   // i.e. `18:00`
+	Mode  string   `json:"mode"`  // `continuous`, `motion` or `off`
+}
+
+// Point is a position in a frame using normalized coordinates (0 ~ 1) so it does not depend on the capture resolution.
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Polygon is a named closed shape in a frame.
+type Polygon struct {
+	Name   string  `json:"name"`
+	Points []Point `json:"points"`
+}
+
+func defaultCameraSettings() CameraSettings {
+	return CameraSettings{
+		MotionThreshold:    2,
+		MotionRegions:      []Polygon{},
+		Source:             "",
+		FrameRate:          0,
+		SnapshotInterval:   1,
+		TimelapseFrameRate: 10,
+		SubStreamURL:       "",
+		PTZ:                nil,
+		Schedule:           nil,
+		Privacy:            nil,
+		Renditions:         nil,
+	}
+}
+
+// LoadCameraSettings reads the camera's settings file if there is one.
+func LoadCameraSettings(camera soicat.Camera) (CameraSettings, error) {
+	settings := defaultCameraSettings()
+
+	folder := os.Getenv("CAPTURER_SETTINGS_FOLDER")
+	if folder == "" {
+		return settings, nil
+	}
+
+	b, err := os.ReadFile(fmt.Sprintf("%s/%s.json", folder, camera.Name))
+	if errors.Is(err, os.ErrNotExist) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+
+	// A misspelled setting is an error rather than a silently ignored setting
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&settings)
+	if err != nil {
+		return settings, fmt.Errorf("unable to decode camera %s settings: %v", camera.Name, err)
+	}
+
+	err = settings.validate(camera)
+	if err != nil {
+		return settings, fmt.Errorf("invalid camera %s settings: %v", camera.Name, err)
+	}
+
+	return settings, nil
+}
+
+// validate checks the settings the camera catalogue would have checked if it carried them.
+func (s *CameraSettings) validate(camera soicat.Camera) error {
+	if s.MotionThreshold < 0 || s.MotionThreshold > 100 {
+		return fmt.Errorf("motion threshold %v is not a percentage", s.MotionThreshold)
+	}
+
+	for _, region := range s.MotionRegions {
+		err := region.validate()
+		if err != nil {
+			return fmt.Errorf("motion region %s: %v", region.Name, err)
+		}
+	}
+
+	if _, ok := cameraSources[s.Source]; s.Source != "" && !ok {
+		return fmt.Errorf("source %s not supported", s.Source)
+	}
+
+	if s.FrameRate < 0 || s.SnapshotInterval < 0 || s.TimelapseFrameRate < 0 {
+		return fmt.Errorf("frame rates and snapshot interval cannot be negative")
+	}
+
+	if s.SubStreamURL != "" {
+		u, err := url.Parse(s.SubStreamURL)
+		if err != nil || (u.Scheme != "rtsp" && u.Scheme != "rtsps") || u.Host == "" {
+			return fmt.Errorf("sub-stream url %s is not an RTSP url", s.SubStreamURL)
+		}
+
+		if s.SubStreamURL == camera.RtspURL {
+			return fmt.Errorf("sub-stream url is the camera url")
+		}
+	}
+
+	if s.PTZ != nil {
+		if s.PTZ.XAddr == "" {
+			return fmt.Errorf("ptz xaddr is missing")
+		}
+
+		for _, tour := range s.PTZ.Tours {
+			if tour.Name == "" || len(tour.Steps) == 0 {
+				return fmt.Errorf("ptz tours need a name and steps")
+			}
+
+			if (tour.Start == "") != (tour.End == "") {
+				return fmt.Errorf("ptz tour %s needs both a start and an end", tour.Name)
+			}
+
+			if tour.Start != "" {
+				_, startErr := dailyMinutes(tour.Start)
+				_, endErr := dailyMinutes(tour.End)
+				if startErr != nil || endErr != nil {
+					return fmt.Errorf("ptz tour %s window is not a `15:04` window", tour.Name)
+				}
+			}
+		}
+	}
+
+	// A broken schedule must not record when it should not
+	if s.Schedule != nil {
+		err := s.Schedule.validate()
+		if err != nil {
+			return fmt.Errorf("schedule: %v", err)
+		}
+	}
+
+	if s.Privacy != nil {
+		for _, mask := range s.Privacy.Masks {
+			err := mask.validate()
+			if err != nil {
+				return fmt.Errorf("privacy mask %s: %v", mask.Name, err)
+			}
+		}
+
+		// Clips must not leave the capturer unredacted because of a typo
+		if _, ok := faceDetectors[s.Privacy.FaceDetector]; s.Privacy.FaceDetector != "" && !ok {
+			return fmt.Errorf("face detector %s not supported", s.Privacy.FaceDetector)
+		}
+	}
+
+	if _, err := cameraRenditions(*s); err != nil {
+		return fmt.Errorf("renditions: %v", err)
+	}
+
+	return nil
+}
+
+// validate checks that the polygon is a shape in normalized coordinates.
+func (p Polygon) validate() error {
+	if len(p.Points) < 3 {
+		return fmt.Errorf("a polygon needs at least 3 points")
+	}
+
+	for _, point := range p.Points {
+		if point.X < 0 || point.X > 1 || point.Y < 0 || point.Y > 1 {
+			return fmt.Errorf("point (%v, %v) is not normalized", point.X, point.Y)
+		}
+	}
+
+	return nil
+}
+
+// Contains uses ray casting to determine if a point (normalized) is inside the polygon.
+func (p Polygon) Contains(x, y float64) bool {
+	inside := false
+	n := len(p.Points)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		pi := p.Points[i]
+		pj := p.Points[j]
+		if (pi.Y > y) != (pj.Y > y) &&
+			x < (pj.X-pi.X)*(y-pi.Y)/(pj.Y-pi.Y)+pi.X {
+			inside = !inside
+		}
+	}
+	return inside
+}
@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
+)
+
+// Camera sources
+const (
+	SourceRTSP     = "rtsp"
+	SourceMJPEG    = "mjpeg"
+	SourceSnapshot = "snapshot"
+)
+
+var cameraSources = map[string]func(camera soicat.Camera, settings CameraSettings) CameraSource{
+	SourceRTSP: func(camera soicat.Camera, _ CameraSettings) CameraSource {
+		return NewRTSPClient(camera.RtspURL)
+	},
+	SourceMJPEG: func(camera soicat.Camera, settings CameraSettings) CameraSource {
+		return NewMJPEGClient(camera.RtspURL, settings.FrameRate)
+	},
+	SourceSnapshot: func(camera soicat.Camera, settings CameraSettings) CameraSource {
+		return NewSnapshotClient(camera.RtspURL, settings.SnapshotInterval, settings.TimelapseFrameRate)
+	},
+}
+
+// NewCameraSource creates the camera source selected by the camera's settings.
+// The camera catalogue only has one URL per camera, so the camera URL is used regardless of the source.
+func NewCameraSource(camera soicat.Camera, settings CameraSettings) (CameraSource, error) {
+	name := cameraSourceName(camera, settings)
+	fn, ok := cameraSources[name]
+	if !ok {
+		return nil, fmt.Errorf("camera source %s not supported", name)
+	}
+
+	return fn(camera, settings), nil
+}
+
+// If the source is not set, HTTP URLs are MJPEG streams and everything else is RTSP.
+func cameraSourceName(camera soicat.Camera, settings CameraSettings) string {
+	if settings.Source != "" {
+		return settings.Source
+	}
+
+	url := strings.ToLower(camera.RtspURL)
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		return SourceMJPEG
+	}
+
+	return SourceRTSP
+}
@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Stats are the live statistics of an agent. The agent's processors update them
+// and the capturer's control API reads them.
+type Stats struct {
+	mu sync.Mutex
+
+	camera       string
+	mode         string
+	fencingToken int64
+	state        string
+	paused       bool
+	fps          float64
+	bitrate      float64
+	lastKeyFrame time.Time
+	clips        int
+	errors       int
+	lastError    string
+
+	// Packet queue counters
+	queueDepth     int64
+	queuedPackets  int64
+	droppedPackets int64
+	latePackets    int64
+
+	// Counters since the last measurement
+	frames   int
+	bytes    int
+	measured time.Time
+}
+
+// StatsSnapshot is a copy of an agent's stats at a point in time.
+type StatsSnapshot struct {
+	Camera       string    `json:"camera"`
+	Mode         string    `json:"mode"`
+	FencingToken int64     `json:"fencingToken"`
+	State        string    `json:"state"`
+	Paused       bool      `json:"paused"`
+	FPS          float64   `json:"fps"`
+	Bitrate      float64   `json:"bitrate"` // bits per second
+	LastKeyFrame time.Time `json:"lastKeyFrame"`
+	Clips        int       `json:"clips"`
+	Errors       int       `json:"errors"`
+	LastError    string    `json:"lastError"`
+	Queued       int64     `json:"queued"`      // packets waiting in the queues for the processors
+	QueuedTotal  int64     `json:"queuedTotal"` // packets queued for the processors since the agent started
+	Dropped      int64     `json:"dropped"`     // packets dropped because the processors are behind
+	Late         int64     `json:"late"`        // packets delivered late to the processors
+}
+
+func NewStats(camera, mode string, fencingToken int64) *Stats {
+	return &Stats{
+		camera:       camera,
+		mode:         mode,
+		fencingToken: fencingToken,
+		state:        CameraConnecting,
+		measured:     time.Now(),
+	}
+}
+
+func (s *Stats) Snapshot() StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return StatsSnapshot{
+		Camera:       s.camera,
+		Mode:         s.mode,
+		FencingToken: s.fencingToken,
+		State:        s.state,
+		Paused:       s.paused,
+		FPS:          s.fps,
+		Bitrate:      s.bitrate,
+		LastKeyFrame: s.lastKeyFrame,
+		Clips:        s.clips,
+		Errors:       s.errors,
+		LastError:    s.lastError,
+		Queued:       s.queueDepth,
+		QueuedTotal:  s.queuedPackets,
+		Dropped:      s.droppedPackets,
+		Late:         s.latePackets,
+	}
+}
+
+func (s *Stats) packet(pkt Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bytes += len(pkt.Data)
+	if !pkt.IsVideo {
+		return
+	}
+
+	s.frames++
+	if pkt.IsKeyFrame {
+		s.lastKeyFrame = time.Now()
+	}
+}
+
+// measure turns the counters since the last measurement into rates.
+func (s *Stats) measure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elapsed := time.Since(s.measured).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	s.fps = float64(s.frames) / elapsed
+	s.bitrate = float64(s.bytes*8) / elapsed
+	s.frames = 0
+	s.bytes = 0
+	s.measured = time.Now()
+}
+
+func (s *Stats) setState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state = state
+	if state != CameraStreaming {
+		s.fps = 0
+		s.bitrate = 0
+	}
+}
+
+// setMode sets the mode of the agent's current session which its schedule may change.
+func (s *Stats) setMode(mode string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mode = mode
+}
+
+func (s *Stats) setPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.paused = paused
+}
+
+func (s *Stats) clip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clips++
+}
+
+func (s *Stats) error(err interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.errors++
+	s.lastError = fmt.Sprintf("%v", err)
+}
+
+func (s *Stats) packetQueued() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queueDepth++
+	s.queuedPackets++
+}
+
+// packetsDequeued counts packets that left a queue: delivered, dropped to make room or discarded with the queue.
+func (s *Stats) packetsDequeued(packets int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queueDepth -= int64(packets)
+}
+
+func (s *Stats) packetsDropped(packets int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.droppedPackets += int64(packets)
+}
+
+func (s *Stats) packetLate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latePackets++
+}
@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"context"
+	"sync"
+
+	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/errorlog"
+)
+
+// subStream is a camera's low-resolution stream. It is recorded alongside the main stream into sub-stream
+// clips (video only) that the model invokers analyse instead of the main clips, which stay the evidence.
+type subStream struct {
+	source  CameraSource
+	camera  soicat.Camera
+	streams []Stream
+	packets chan Packet
+}
+
+// openSubStream connects to the camera's sub-stream if its settings declare one. The main stream is recorded
+// without it if it cannot be opened. The source pushes its packets into a packet queue of their own, forwarded
+// until queuesDone is closed, so the source callbacks never block. Its goroutine that reports errors is one of the session's senders.
+func openSubStream(sessionCtx context.Context,
+	queuesDone chan struct{},
+	senders *sync.WaitGroup,
+	settings CameraSettings,
+	stats *Stats,
+	errorsStream chan interface{},
+	capturer string,
+	camera soicat.Camera) *subStream {
+	if settings.SubStreamURL == "" {
+		return nil
+	}
+
+	// The sub-stream source is inferred from its URL
+	subCamera := camera
+	subCamera.RtspURL = settings.SubStreamURL
+	subSettings := settings
+	subSettings.Source = ""
+
+	source, err := NewCameraSource(subCamera, subSettings)
+	if err != nil {
+		errorsStream <- errorlog.Errorf(errorlog.Connect, "capturer %s - agent %s - unable to create the sub-stream source: %v", capturer, camera.Name, err)
+		return nil
+	}
+
+	err = source.Connect(sessionCtx)
+	if err != nil {
+		source.Close()
+		errorsStream <- errorlog.Errorf(errorlog.Connect, "capturer %s - agent %s - unable to connect to the sub-stream, recording the main stream only: %v", capturer, camera.Name, err)
+		return nil
+	}
+
+	videoStreams, err := source.GetVideoStreams()
+	if err != nil || len(videoStreams) == 0 {
+		source.Close()
+		errorsStream <- errorlog.Errorf(errorlog.Connect, "capturer %s - agent %s - no video in the sub-stream, recording the main stream only", capturer, camera.Name)
+		return nil
+	}
+
+	subCamera.CaptureWidth = videoStreams[0].Width
+	subCamera.CaptureHeight = videoStreams[0].Height
+
+	s := &subStream{
+		source:  source,
+		camera:  subCamera,
+		streams: videoStreams[:1],
+		packets: make(chan Packet, 10),
+	}
+
+	queue := newPacketQueue(stats, "sub", capturer, camera)
+	go queue.forward(sessionCtx, queuesDone, s.packets)
+	push := func(pkt Packet) {
+		if pkt.IsVideo {
+			queue.push(pkt)
+		}
+	}
+
+	// A failing sub-stream does not end the session...its clips stop until the next session
+	senders.Add(1)
+	go func() {
+		defer senders.Done()
+		err := source.Start(sessionCtx, errorsStream, push, subCamera)
+		if err == nil {
+			err = source.Wait()
+		}
+		if sessionCtx.Err() == nil {
+			errorsStream <- errorlog.Errorf(errorlog.Connect, "capturer %s - agent %s - sub-stream ended: %v", capturer, camera.Name, err)
+		}
+	}()
+
+	return s
+}
@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/yapingcat/gomedia/go-mp4"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+	"github.com/khaledhikmat/threat-detection-shared/service/storage"
+)
+
+// Clip clocks
+const (
+	ClockCamera   = "camera"   // the camera's wall-clock from its RTCP sender reports
+	ClockCapturer = "capturer" // the capturer's wall-clock when the packets were received
+)
+
+// ClipTiming is the measured media time of a recorded clip. It is stored in key/value storage under
+// `timing_<clip id>` so events can be correlated across cameras on real capture times.
+// WARNING: Must match the clip timing of the media API
+type ClipTiming struct {
+	ClipID        string    `json:"clipId"`
+	Camera        string    `json:"camera"`
+	Clock         string    `json:"clock"`
+	BeginTime     time.Time `json:"beginTime"`
+	EndTime       time.Time `json:"endTime"`
+	Duration      int64     `json:"duration"` // milliseconds
+	Frames        int       `json:"frames"`
+	FPS           float64   `json:"fps"`
+	DroppedFrames int       `json:"droppedFrames"`
+}
+
+// clipClock times a clip's video frames on their RTP timestamps. The clip is anchored to the camera's
+// wall-clock (RTCP sender reports) as soon as a frame has one, otherwise to the frames' arrival time.
+type clipClock struct {
+	frames    int
+	firstTime time.Duration
+	lastTime  time.Duration
+	begin     time.Time
+	clock     string
+	intervals []time.Duration
+}
+
+func (c *clipClock) add(pkt Packet) {
+	if !pkt.IsVideo {
+		return
+	}
+
+	if c.frames == 0 {
+		c.firstTime = pkt.Time
+		c.lastTime = pkt.Time
+		c.begin = pkt.ArrivalTime
+		c.clock = ClockCapturer
+		if c.begin.IsZero() {
+			c.begin = time.Now()
+		}
+	} else if pkt.Time > c.lastTime {
+		// Frames out of order (i.e. B-frames) are not intervals
+		c.intervals = append(c.intervals, pkt.Time-c.lastTime)
+		c.lastTime = pkt.Time
+	}
+	c.frames++
+
+	// The first sender report may only arrive a few seconds into the stream
+	if c.clock != ClockCamera && !pkt.NTP.IsZero() {
+		c.begin = pkt.NTP.Add(c.firstTime - pkt.Time)
+		c.clock = ClockCamera
+	}
+}
+
+// interval is the median interval between frames: the nominal frame duration.
+func (c *clipClock) interval() time.Duration {
+	if len(c.intervals) == 0 {
+		return 0
+	}
+
+	sorted := append([]time.Duration{}, c.intervals...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+// timing measures the clip once it is closed. A gap of more than one and a half frame durations between
+// two frames counts the frames that fit in it as dropped.
+func (c *clipClock) timing(camera string) ClipTiming {
+	interval := c.interval()
+	dropped := 0
+	if interval > 0 {
+		for _, i := range c.intervals {
+			if i > interval*3/2 {
+				dropped += int(math.Round(float64(i)/float64(interval))) - 1
+			}
+		}
+	}
+
+	// The last frame lasts a frame duration
+	duration := c.lastTime - c.firstTime + interval
+	fps := 0.0
+	if duration > 0 {
+		fps = float64(c.frames) / duration.Seconds()
+	}
+
+	return ClipTiming{
+		Camera:        camera,
+		Clock:         c.clock,
+		BeginTime:     c.begin,
+		EndTime:       c.begin.Add(duration),
+		Duration:      duration.Milliseconds(),
+		Frames:        c.frames,
+		FPS:           math.Round(fps*100) / 100,
+		DroppedFrames: dropped,
+	}
+}
+
+// sampleClipTiming times the video frames of an MP4 sample as if it was recorded until now.
+func sampleClipTiming(file, camera string) (ClipTiming, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return ClipTiming{}, err
+	}
+	defer f.Close()
+
+	demuxer := mp4.CreateMp4Demuxer(f)
+	_, err = demuxer.ReadHead()
+	if err != nil {
+		return ClipTiming{}, err
+	}
+
+	clock := clipClock{}
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return ClipTiming{}, err
+		}
+
+		if pkt.Cid == mp4.MP4_CODEC_H264 || pkt.Cid == mp4.MP4_CODEC_H265 {
+			clock.add(Packet{IsVideo: true, Time: time.Duration(pkt.Dts) * time.Millisecond})
+		}
+	}
+
+	if clock.frames == 0 {
+		return ClipTiming{}, fmt.Errorf("no video frames in %s", file)
+	}
+
+	timing := clock.timing(camera)
+	timing.EndTime = time.Now()
+	timing.BeginTime = timing.EndTime.Add(-time.Duration(timing.Duration) * time.Millisecond)
+	return timing, nil
+}
+
+// storeClipTiming keeps the clip's timing in key/value storage.
+func storeClipTiming(storagesvc storage.IService, timing ClipTiming) error {
+	b, err := json.Marshal(timing)
+	if err != nil {
+		return err
+	}
+
+	// The agent may be stopping, so do not tie the timing to its context
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return storagesvc.StoreKeyValue(ctx, models.ThreatDetectionStateStore, fmt.Sprintf("timing_%s", timing.ClipID), string(b))
+}
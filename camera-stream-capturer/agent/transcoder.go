@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// clipTranscoder pipes JPEG frames to FFmpeg which encodes them into an H264 MP4 clip.
+// The frames are encoded at the video stream's frame rate: the MJPEG stream's rate or,
+// for snapshot cameras, the timelapse rate.
+type clipTranscoder struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+}
+
+func newClipTranscoder(fullName string, streams []Stream) (*clipTranscoder, error) {
+	// A fragment per key frame keeps the clip playable if FFmpeg is killed
+	movflags := "+faststart"
+	if fragmentedMP4() {
+		movflags = "+frag_keyframe+empty_moov+default_base_moof"
+	}
+
+	frameRate := float64(defaultMJPEGFrameRate)
+	for _, stream := range streams {
+		if stream.IsVideo && stream.FPS > 0 {
+			frameRate = stream.FPS
+			break
+		}
+	}
+
+	t := &clipTranscoder{}
+	t.cmd = exec.Command(ffmpegPath(),
+		"-hide_banner",
+		"-loglevel", "error",
+		"-f", "image2pipe",
+		"-c:v", "mjpeg",
+		"-framerate", strconv.FormatFloat(frameRate, 'f', 3, 64),
+		"-i", "pipe:0",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-pix_fmt", "yuv420p",
+		// Odd dimensions are not supported by yuv420p
+		"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2",
+		"-movflags", movflags,
+		"-y", fullName)
+	t.cmd.Stderr = &t.stderr
+
+	var err error
+	t.stdin, err = t.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start ffmpeg: %v", err)
+	}
+
+	return t, nil
+}
+
+// newFrameEncoder pipes raw YUV 4:2:0 frames to FFmpeg which encodes them into an H264 MP4 clip at the frame rate.
+// The audio of the source clip, if any, is copied into the clip as is.
+func newFrameEncoder(fullName, audioSource string, width, height int, frameRate float64) (*clipTranscoder, error) {
+	t := &clipTranscoder{}
+	t.cmd = exec.Command(ffmpegPath(),
+		"-hide_banner",
+		"-loglevel", "error",
+		"-f", "rawvideo",
+		"-pix_fmt", "yuv420p",
+		"-video_size", fmt.Sprintf("%dx%d", width, height),
+		"-framerate", strconv.FormatFloat(frameRate, 'f', 3, 64),
+		"-i", "pipe:0",
+		"-i", audioSource,
+		"-map", "0:v:0",
+		"-map", "1:a?",
+		"-c:a", "copy",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-pix_fmt", "yuv420p",
+		// Odd dimensions are not supported by yuv420p
+		"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2",
+		"-movflags", "+faststart",
+		"-y", fullName)
+	t.cmd.Stderr = &t.stderr
+
+	var err error
+	t.stdin, err = t.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start ffmpeg: %v", err)
+	}
+
+	return t, nil
+}
+
+func (t *clipTranscoder) write(frame []byte) error {
+	_, err := t.stdin.Write(frame)
+	return err
+}
+
+// close flushes the frames and waits until FFmpeg has finalized the clip.
+func (t *clipTranscoder) close() error {
+	t.stdin.Close()
+	err := t.cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %v %s", err, t.stderr.String())
+	}
+
+	return nil
+}
+
+func ffmpegPath() string {
+	path := os.Getenv("CAPTURER_FFMPEG_PATH")
+	if path == "" {
+		path = "ffmpeg"
+	}
+
+	return path
+}
@@ -7,32 +7,41 @@ import (
 	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
 )
 
-// RTSPClient is a interface that abstracts the RTSP client implementation.
-type RTSPClient interface {
-	// Connect to the RTSP server.
+// CameraSource is an interface that abstracts the camera protocol (i.e. RTSP, MJPEG over HTTP, JPEG snapshots).
+// The agent's session and processors only deal with camera sources.
+type CameraSource interface {
+	// Connect to the camera.
 	Connect(ctx context.Context) error
 
-	// Start the RTSP client, and start reading packets.
-	Start(ctx context.Context, errorsStream chan interface{}, packetsStream chan Packet, camera soicat.Camera) error
-
-	// Decode a packet into a image.
-	DecodePacket(pkt Packet) (image.YCbCr, error)
+	// Start the camera source, and start reading packets. Every packet is handed to push, which must never block.
+	Start(ctx context.Context, errorsStream chan interface{}, push func(Packet), camera soicat.Camera) error
 
 	// Decode a packet into a image.
 	DecodePacketRaw(pkt Packet) (image.Gray, error)
 
-	// Pause the recordinhg/play to the RTSP server.
+	// Pause the recordinhg/play from the camera.
 	Pause() error
 
-	// Resume the recordinhg/play to the RTSP server.
+	// Resume the recordinhg/play from the camera.
 	Resume() error
 
-	// Close the connection to the RTSP server.
+	// Wait until the connection to the camera is closed or fails.
+	Wait() error
+
+	// Close the connection to the camera.
 	Close() error
 
-	// Get a list of streams from the RTSP server.
+	// Get a list of streams from the camera.
 	GetStreams() ([]Stream, error)
 
-	// Get a list of video streams from the RTSP server.
+	// Get a list of video streams from the camera.
 	GetVideoStreams() ([]Stream, error)
 }
+
+// RTSPClient is a interface that abstracts the RTSP client implementation.
+type RTSPClient interface {
+	CameraSource
+
+	// Decode a packet into a image.
+	DecodePacket(pkt Packet) (image.YCbCr, error)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/onvif"
+)
+
+// discover is a companion command of the capturer to onboard ONVIF cameras:
+//
+//	discover scan -subnet 192.168.1.0/24 -username admin -password secret -output cameras.json
+//	discover scan -subnet 192.168.1.0/24 -settings-folder ./settings -register
+//	discover presets -xaddr http://192.168.1.20/onvif/device_service -username admin -password secret
+var commandProcs = map[string]func(ctx context.Context, args []string) error{
+	"scan":    scanProc,
+	"presets": presetsProc,
+}
+
+func main() {
+	canxCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: discover scan|presets [flags]")
+		os.Exit(2)
+	}
+
+	fn, ok := commandProcs[os.Args[1]]
+	if !ok {
+		fmt.Printf("Command %s not supported\n", os.Args[1])
+		os.Exit(2)
+	}
+
+	err := fn(canxCtx, os.Args[2:])
+	if err != nil {
+		fmt.Printf("discover %s failed: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func scanProc(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	subnets := flags.String("subnet", "", "comma-separated subnets to probe (i.e. 192.168.1.0/24) in addition to the local network segment")
+	timeout := flags.Duration("timeout", 3*time.Second, "time to wait for the devices to answer and for every device request")
+	username := flags.String("username", os.Getenv("ONVIF_USERNAME"), "ONVIF username (default ONVIF_USERNAME)")
+	password := flags.String("password", os.Getenv("ONVIF_PASSWORD"), "ONVIF password (default ONVIF_PASSWORD)")
+	capturer := flags.String("capturer", "", "capturer of the proposed cameras, any capturer can grab them if empty")
+	maxLength := flags.Int64("max-length", 20, "maximum recording length of the proposed cameras in seconds")
+	output := flags.String("output", "", "file to write the proposed cameras to (default stdout)")
+	settingsFolder := flags.String("settings-folder", "", "folder to write the proposed camera settings to (i.e. CAPTURER_SETTINGS_FOLDER)")
+	register := flags.Bool("register", false, "register the proposed cameras that are not in the catalogue")
+	_ = flags.Parse(args)
+
+	targets := []string{}
+	for _, subnet := range strings.Split(*subnets, ",") {
+		if strings.TrimSpace(subnet) == "" {
+			continue
+		}
+
+		hosts, err := onvif.Hosts(strings.TrimSpace(subnet))
+		if err != nil {
+			return err
+		}
+		targets = append(targets, hosts...)
+	}
+
+	fmt.Fprintf(os.Stderr, "probing the local network segment and %d hosts...\n", len(targets))
+	devices, err := onvif.Probe(ctx, targets, *timeout)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "found %d devices\n", len(devices))
+
+	proposals := []onvif.Proposal{}
+	names := map[string]bool{}
+	for _, device := range devices {
+		proposal, err := onvif.Propose(ctx, device, *username, *password, *timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "SKIP %s %s: %v\n", device.Host, device.Hardware(), err)
+			continue
+		}
+
+		// Several devices may advertise the same name
+		if names[proposal.Camera.Name] {
+			proposal.Camera.Name = fmt.Sprintf("%s-%s", proposal.Camera.Name, strings.ReplaceAll(device.Host, ".", "-"))
+		}
+		names[proposal.Camera.Name] = true
+
+		proposal.Camera.Capturer = *capturer
+		proposal.Camera.MaxLengthRecording = *maxLength
+		proposals = append(proposals, proposal)
+
+		fmt.Fprintf(os.Stderr, "FOUND %s - %s %s - %s %dx%d @ %.2f fps - sub-stream: %t\n",
+			proposal.Camera.Name, proposal.Manufacturer, proposal.Model, proposal.Codec, proposal.Camera.CaptureWidth, proposal.Camera.CaptureHeight, proposal.FrameRate, proposal.SubStreamURL != "")
+	}
+
+	b, err := json.MarshalIndent(proposals, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		fmt.Println(string(b))
+	} else {
+		err = os.WriteFile(*output, b, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *settingsFolder != "" {
+		err = writeSettings(*settingsFolder, proposals)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *register {
+		return registerCameras(proposals)
+	}
+
+	return nil
+}
+
+// presetsProc lists the PTZ presets of a camera to configure its tours and the alert rules.
+func presetsProc(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("presets", flag.ExitOnError)
+	xaddr := flags.String("xaddr", "", "the camera's ONVIF device service URL")
+	username := flags.String("username", os.Getenv("ONVIF_USERNAME"), "ONVIF username (default ONVIF_USERNAME)")
+	password := flags.String("password", os.Getenv("ONVIF_PASSWORD"), "ONVIF password (default ONVIF_PASSWORD)")
+	profile := flags.String("profile", "", "the PTZ media profile (default the first profile with a PTZ configuration)")
+	timeout := flags.Duration("timeout", 5*time.Second, "time to wait for every device request")
+	_ = flags.Parse(args)
+
+	if *xaddr == "" {
+		return fmt.Errorf("-xaddr is required")
+	}
+
+	client := onvif.NewClient(*xaddr, *username, *password, *timeout)
+	if *profile == "" {
+		p, err := client.PTZProfile(ctx)
+		if err != nil {
+			return err
+		}
+		*profile = p
+	}
+
+	presets, err := client.Presets(ctx, *profile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("profile %s - %d presets\n", *profile, len(presets))
+	for _, preset := range presets {
+		fmt.Printf("%s\t%s\n", preset.Token, preset.Name)
+	}
+
+	return nil
+}
+
+// writeSettings writes the settings of the proposed cameras that have a sub-stream. Existing settings files
+// are left alone since they may have been tuned.
+func writeSettings(folder string, proposals []onvif.Proposal) error {
+	err := os.MkdirAll(folder, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	for _, proposal := range proposals {
+		if proposal.SubStreamURL == "" {
+			continue
+		}
+
+		file := fmt.Sprintf("%s/%s.json", folder, proposal.Camera.Name)
+		if _, err := os.Stat(file); err == nil {
+			fmt.Fprintf(os.Stderr, "KEEP %s\n", file)
+			continue
+		}
+
+		// The capturer rejects settings files with unknown fields, so a mismatch stops the camera's agent at start
+		b, err := json.MarshalIndent(map[string]string{"subStreamUrl": proposal.SubStreamURL}, "", "    ")
+		if err != nil {
+			return err
+		}
+
+		err = os.WriteFile(file, b, 0600)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "WROTE %s\n", file)
+	}
+
+	return nil
+}
+
+// registerCameras adds the proposed cameras to the catalogue unless a camera with the same name or URL is there.
+func registerCameras(proposals []onvif.Proposal) error {
+	// The catalogue is configured like the capturer's
+	_ = godotenv.Load()
+
+	soicatSvc := soicat.New()
+	cameras, err := soicatSvc.Cameras()
+	if err != nil {
+		return err
+	}
+
+	registered := map[string]bool{}
+	for _, camera := range cameras {
+		registered[camera.Name] = true
+		registered[camera.RtspURL] = true
+	}
+
+	for _, proposal := range proposals {
+		if registered[proposal.Camera.Name] || registered[proposal.Camera.RtspURL] {
+			fmt.Fprintf(os.Stderr, "EXISTS %s\n", proposal.Camera.Name)
+			continue
+		}
+
+		err = soicatSvc.UpdateCamera(proposal.Camera)
+		if err != nil {
+			return fmt.Errorf("unable to register camera %s: %v", proposal.Camera.Name, err)
+		}
+		fmt.Fprintf(os.Stderr, "REGISTERED %s\n", proposal.Camera.Name)
+	}
+
+	return nil
+}
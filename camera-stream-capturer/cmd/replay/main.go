@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/replay"
+)
+
+// replay is a companion command of the capturer to test it against real RTSP packets:
+//
+//	replay serve -file ./data/samples/1714533004_Camera1.mp4 -address :8554
+//	replay check -folder ./data/recordings/Camera1 -min-clips 2 -min-duration 10s
+var commandProcs = map[string]func(ctx context.Context, args []string) error{
+	"serve": serveProc,
+	"check": checkProc,
+}
+
+func main() {
+	canxCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: replay serve|check [flags]")
+		os.Exit(2)
+	}
+
+	fn, ok := commandProcs[os.Args[1]]
+	if !ok {
+		fmt.Printf("Command %s not supported\n", os.Args[1])
+		os.Exit(2)
+	}
+
+	err := fn(canxCtx, os.Args[2:])
+	if err != nil {
+		fmt.Printf("replay %s failed: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func serveProc(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	file := flags.String("file", "", "MP4 or raw H264/H265 file to serve")
+	address := flags.String("address", ":8554", "RTSP address")
+	fps := flags.Float64("fps", 25, "frame rate of raw H264/H265 files")
+	loop := flags.Bool("loop", true, "restart the file when it ends")
+	_ = flags.Parse(args)
+
+	if *file == "" {
+		return fmt.Errorf("-file is required")
+	}
+
+	recording, err := replay.Load(*file, *fps)
+	if err != nil {
+		return err
+	}
+
+	err = replay.NewServer(*address, recording, *loop).Run(ctx)
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return err
+}
+
+func checkProc(_ context.Context, args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	folder := flags.String("folder", "", "folder of the recorded clips")
+	minClips := flags.Int("min-clips", 1, "minimum number of clips")
+	minFrames := flags.Int("min-frames", 1, "minimum number of frames per clip")
+	minDuration := flags.Duration("min-duration", 0, "minimum duration of every clip but the last")
+	maxDuration := flags.Duration("max-duration", 0, "maximum duration of every clip")
+	_ = flags.Parse(args)
+
+	if *folder == "" {
+		return fmt.Errorf("-folder is required")
+	}
+
+	reports, failures := replay.Check(*folder, replay.Expectations{
+		MinClips:    *minClips,
+		MinFrames:   *minFrames,
+		MinDuration: *minDuration,
+		MaxDuration: *maxDuration,
+	})
+
+	for _, report := range reports {
+		fmt.Printf("%s - %s - frames: %d - key frames: %d - starts on key frame: %t - duration: %s\n",
+			report.Path, report.Codec, report.Frames, report.KeyFrames, report.StartsOnKeyFrame, report.Duration.Round(time.Millisecond))
+	}
+
+	for _, failure := range failures {
+		fmt.Printf("FAIL %v\n", failure)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d assertions failed", len(failures))
+	}
+
+	fmt.Printf("OK %d clips\n", len(reports))
+	return nil
+}
@@ -0,0 +1,233 @@
+package errorlog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+	"github.com/khaledhikmat/threat-detection-shared/service/storage"
+)
+
+// Agent error types
+const (
+	Connect = "connect" // the camera (or its sub-stream) cannot be reached or its session ended
+	Decode  = "decode"  // the camera's packets cannot be depacketized or decoded
+	Mux     = "mux"     // the clips cannot be recorded
+	Upload  = "upload"  // the clips cannot be stored
+	Publish = "publish" // the clips cannot be published
+	Other   = "other"
+)
+
+// The most recent entries of a camera are kept in its index.
+const maxRecentEntries = 100
+
+// Error is an agent error of a type.
+type Error struct {
+	Type string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errorf formats an agent error of the type.
+func Errorf(typ, format string, a ...interface{}) error {
+	return &Error{Type: typ, Err: fmt.Errorf(format, a...)}
+}
+
+// TypeOf returns the type of an agent error. Errors without a type are `other` errors.
+func TypeOf(err interface{}) string {
+	e, ok := err.(error)
+	if !ok {
+		return Other
+	}
+
+	var agentErr *Error
+	if errors.As(e, &agentErr) {
+		return agentErr.Type
+	}
+
+	return Other
+}
+
+// Entry is an agent error as it is stored.
+// WARNING: Must match the agent errors of the media API
+type Entry struct {
+	Capturer string    `json:"capturer"`
+	Camera   string    `json:"camera"`
+	Type     string    `json:"type"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+// ErrorLog stores the agents' errors in key/value storage where the key = agent_error_capturer_camera_ts
+// (unix nanoseconds) and the value = the JSON entry. The most recent entries of a camera, newest first, are
+// also kept under `agent_errors_<camera>` so they can be queried whichever capturer holds the camera.
+// The new entries are merged into the indexes at most once per second. With a DAPR client, an index is
+// written with its etag so the entries another capturer merged in the meantime are kept.
+type ErrorLog struct {
+	DaprClient dapr.Client
+	StorageSvc storage.IService
+	Capturer   string
+
+	mu      sync.Mutex
+	pending map[string][]Entry // the entries not merged yet keyed by camera, newest first
+	recent  map[string][]Entry // the indexes keyed by camera when there is no DAPR client
+}
+
+func NewErrorLog(client dapr.Client, storagesvc storage.IService, capturer string) *ErrorLog {
+	return &ErrorLog{
+		DaprClient: client,
+		StorageSvc: storagesvc,
+		Capturer:   capturer,
+		pending:    map[string][]Entry{},
+		recent:     map[string][]Entry{},
+	}
+}
+
+// Record stores a camera's error and queues it for the camera's index.
+func (l *ErrorLog) Record(ctx context.Context, camera string, err interface{}) Entry {
+	entry := Entry{
+		Capturer: l.Capturer,
+		Camera:   camera,
+		Type:     TypeOf(err),
+		Message:  fmt.Sprintf("%v", err),
+		Time:     time.Now().UTC(),
+	}
+
+	b, e := json.Marshal(entry)
+	if e == nil {
+		e = l.StorageSvc.StoreKeyValue(ctx, models.ThreatDetectionStateStore, fmt.Sprintf("agent_error_%s_%s_%d", l.Capturer, camera, entry.Time.UnixNano()), string(b))
+	}
+	if e != nil {
+		fmt.Printf("error log - unable to store %s error of agent %s: %v\n", entry.Type, camera, e)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pending[camera] = merge([]Entry{entry}, l.pending[camera])
+	return entry
+}
+
+// Run merges the new entries into the indexes every second until the context is cancelled.
+func (l *ErrorLog) Run(canxCtx context.Context) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-canxCtx.Done():
+			// The agents may still be stopping, so do not tie the last write to the context
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			l.flush(flushCtx)
+			cancel()
+			fmt.Printf("error log context cancelled\n")
+			return
+		case <-ticker.C:
+			l.flush(canxCtx)
+		}
+	}
+}
+
+// flush merges the pending entries into the indexes. The entries of an index that cannot be written are
+// merged on the next flush.
+func (l *ErrorLog) flush(ctx context.Context) {
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = map[string][]Entry{}
+	l.mu.Unlock()
+
+	for camera, entries := range pending {
+		err := l.write(ctx, camera, entries)
+		if err != nil {
+			fmt.Printf("error log - unable to store the errors of agent %s: %v\n", camera, err)
+			l.mu.Lock()
+			l.pending[camera] = merge(l.pending[camera], entries)
+			l.mu.Unlock()
+		}
+	}
+}
+
+// write merges the entries into the camera's index. With a DAPR client, the index is read and written with
+// its etag, and merged again if another capturer wrote it in the meantime. Without it, the index only holds
+// the entries of this capturer.
+func (l *ErrorLog) write(ctx context.Context, camera string, entries []Entry) error {
+	if l.DaprClient == nil {
+		recent := merge(entries, l.recent[camera])
+		b, err := json.Marshal(recent)
+		if err != nil {
+			return err
+		}
+
+		err = l.StorageSvc.StoreKeyValue(ctx, models.ThreatDetectionStateStore, indexKey(camera), string(b))
+		if err != nil {
+			return err
+		}
+
+		l.recent[camera] = recent
+		return nil
+	}
+
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		item, e := l.DaprClient.GetState(ctx, models.ThreatDetectionStateStore, indexKey(camera), nil)
+		if e != nil {
+			return e
+		}
+
+		recent := []Entry{}
+		if len(item.Value) > 0 {
+			e = json.Unmarshal(item.Value, &recent)
+			if e != nil {
+				fmt.Printf("error log - unable to decode the errors of agent %s, starting over: %v\n", camera, e)
+				recent = []Entry{}
+			}
+		}
+
+		b, e := json.Marshal(merge(entries, recent))
+		if e != nil {
+			return e
+		}
+
+		// Another capturer wrote the index in the meantime...merge again on top of its entries. The sidecar
+		// reports an etag mismatch as aborted, any other failure is the store's and is not retried.
+		err = l.DaprClient.SaveStateWithETag(ctx, models.ThreatDetectionStateStore, indexKey(camera), b, item.Etag, nil, dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+		if status.Code(err) != codes.Aborted {
+			return err
+		}
+	}
+
+	return err
+}
+
+// merge returns the most recent entries of both lists, newest first.
+func merge(entries, recent []Entry) []Entry {
+	merged := append(append([]Entry{}, entries...), recent...)
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Time.After(merged[j].Time)
+	})
+	if len(merged) > maxRecentEntries {
+		merged = merged[:maxRecentEntries]
+	}
+
+	return merged
+}
+
+func indexKey(camera string) string {
+	return fmt.Sprintf("agent_errors_%s", camera)
+}
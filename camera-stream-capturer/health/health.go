@@ -0,0 +1,322 @@
+package health
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+// Camera health conditions
+const (
+	Blackout = "blackout" // the picture is black (i.e. no signal, lights out)
+	Covered  = "covered"  // the picture is uniform (i.e. lens covered or spray-painted)
+	Moved    = "moved"    // the scene changed all at once (i.e. camera turned away)
+	Blurred  = "blurred"  // the picture lost its sharpness (i.e. defocused or smeared lens)
+	Frozen   = "frozen"   // the picture does not change at all (i.e. stuck encoder)
+
+	// The agent's error rate went over the quarantine threshold...raised by the agent, not by the detector
+	Quarantined = "quarantined"
+)
+
+// ModelInvoker is the model invoker of the camera health alerts.
+const ModelInvoker = "camera-health"
+
+// Camera health alerts are tagged `camera-health:<condition>`
+const tagPrefix = ModelInvoker + ":"
+
+// Every condition has a clip type of its own, after the models' metadata (0) and alerts (1).
+var clipTypes = map[string]int{
+	Blackout:    2,
+	Covered:     3,
+	Moved:       4,
+	Blurred:     5,
+	Frozen:      6,
+	Quarantined: 7,
+}
+
+const (
+	// Frames are analysed on a grid of this size whatever their resolution.
+	gridWidth  = 320
+	gridHeight = 180
+	// The scene is compared on blocks of grid cells.
+	blockSize = 20
+
+	blackoutMaxLuma     = 16   // mean gray level of a black picture
+	uniformMaxDeviation = 8    // standard deviation of a uniform picture
+	blurRatio           = 0.35 // sharpness below this ratio of the camera's usual sharpness is blurred
+	sceneMinCorrelation = 0.5  // scenes less correlated than this are different scenes
+	frozenMaxDelta      = 0.25 // mean gray level change between two frames of a frozen picture
+	// The usual sharpness and scene are learned from the first healthy frames.
+	learningFrames = 10
+	learningRate   = 0.05
+)
+
+// ClipType returns the clip type of a condition's alerts.
+func ClipType(condition string) int {
+	return clipTypes[condition]
+}
+
+// Tag returns the clip tag of a condition.
+func Tag(condition string) string {
+	return tagPrefix + condition
+}
+
+// Conditions returns the conditions tagged on a clip.
+func Conditions(tags []string) []string {
+	conditions := []string{}
+	for _, tag := range tags {
+		if condition, ok := strings.CutPrefix(tag, tagPrefix); ok {
+			conditions = append(conditions, condition)
+		}
+	}
+
+	return conditions
+}
+
+// Detector analyses a camera's frames one at a time. A condition starts once it is seen on `checks`
+// consecutive frames (twice as many for frozen pictures) and stops on the first frame without it.
+// Ignored conditions are never raised (i.e. a PTZ camera is moved on purpose).
+type Detector struct {
+	checks    int
+	ignored   map[string]bool
+	streaks   map[string]int
+	active    map[string]bool
+	previous  []float64
+	scene     []float64
+	sharpness float64
+	learned   int
+}
+
+func NewDetector(checks int, ignored ...string) *Detector {
+	if checks <= 0 {
+		checks = 1
+	}
+
+	d := &Detector{
+		checks:  checks,
+		ignored: map[string]bool{},
+		streaks: map[string]int{},
+		active:  map[string]bool{},
+	}
+	for _, condition := range ignored {
+		d.ignored[condition] = true
+	}
+
+	return d
+}
+
+// Check analyses a frame and returns the conditions that started and stopped with it.
+func (d *Detector) Check(img image.Gray) ([]string, []string) {
+	grid := sample(img)
+	if grid == nil {
+		return nil, nil
+	}
+
+	mean, deviation := stats(grid)
+	seen := map[string]bool{}
+	if mean < blackoutMaxLuma && deviation < uniformMaxDeviation {
+		seen[Blackout] = true
+	} else if deviation < uniformMaxDeviation {
+		seen[Covered] = true
+	}
+
+	// Frozen pictures are exactly the same, live pictures always have some sensor noise
+	if d.previous != nil && meanDelta(grid, d.previous) < frozenMaxDelta && !seen[Blackout] && !seen[Covered] {
+		seen[Frozen] = true
+	}
+	d.previous = grid
+
+	// Sharpness and scene are meaningless on uniform pictures. Both are relative to the picture's contrast
+	// so dimmer lights do not look like a blurred picture or a different scene.
+	scene := blocks(grid, mean, deviation)
+	sharpness := laplacian(grid) / math.Max(deviation, 1)
+	if !seen[Blackout] && !seen[Covered] {
+		if d.learned >= learningFrames {
+			if sharpness < d.sharpness*blurRatio {
+				seen[Blurred] = true
+			}
+			if !d.ignored[Moved] && correlation(scene, d.scene) < sceneMinCorrelation {
+				seen[Moved] = true
+			}
+		}
+
+		// Follow slow changes (i.e. daylight) but not the conditions themselves
+		if !seen[Blurred] && !seen[Moved] {
+			d.learn(scene, sharpness)
+		}
+	}
+
+	started := []string{}
+	stopped := []string{}
+	for _, condition := range []string{Blackout, Covered, Moved, Blurred, Frozen} {
+		if !seen[condition] || d.ignored[condition] {
+			d.streaks[condition] = 0
+			if d.active[condition] {
+				d.active[condition] = false
+				stopped = append(stopped, condition)
+			}
+			continue
+		}
+
+		d.streaks[condition]++
+		checks := d.checks
+		if condition == Frozen {
+			checks *= 2
+		}
+		if !d.active[condition] && d.streaks[condition] >= checks {
+			d.active[condition] = true
+			started = append(started, condition)
+		}
+	}
+
+	// A moved camera stays moved...its new scene is the one to watch from now on
+	if d.active[Moved] {
+		d.scene = scene
+		d.sharpness = sharpness
+	}
+
+	return started, stopped
+}
+
+// Active returns the conditions in progress.
+func (d *Detector) Active() []string {
+	active := []string{}
+	for _, condition := range []string{Blackout, Covered, Moved, Blurred, Frozen} {
+		if d.active[condition] {
+			active = append(active, condition)
+		}
+	}
+
+	return active
+}
+
+func (d *Detector) learn(scene []float64, sharpness float64) {
+	if d.scene == nil {
+		d.scene = scene
+		d.sharpness = sharpness
+		d.learned = 1
+		return
+	}
+
+	rate := learningRate
+	if d.learned < learningFrames {
+		rate = 1 / float64(d.learned+1)
+	}
+	d.learned++
+
+	for i := range d.scene {
+		d.scene[i] += (scene[i] - d.scene[i]) * rate
+	}
+	d.sharpness += (sharpness - d.sharpness) * rate
+}
+
+// sample resizes the frame to the analysis grid (nearest neighbour).
+func sample(img image.Gray) []float64 {
+	bounds := img.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return nil
+	}
+
+	grid := make([]float64, gridWidth*gridHeight)
+	for gy := 0; gy < gridHeight; gy++ {
+		y := bounds.Min.Y + gy*bounds.Dy()/gridHeight
+		for gx := 0; gx < gridWidth; gx++ {
+			x := bounds.Min.X + gx*bounds.Dx()/gridWidth
+			// The decoder's stride can be wider than the frame, so guard against short buffers
+			offset := img.PixOffset(x, y)
+			if offset < len(img.Pix) {
+				grid[gy*gridWidth+gx] = float64(img.Pix[offset])
+			}
+		}
+	}
+
+	return grid
+}
+
+func stats(grid []float64) (float64, float64) {
+	sum := 0.0
+	for _, v := range grid {
+		sum += v
+	}
+	mean := sum / float64(len(grid))
+
+	variance := 0.0
+	for _, v := range grid {
+		variance += (v - mean) * (v - mean)
+	}
+
+	return mean, math.Sqrt(variance / float64(len(grid)))
+}
+
+func meanDelta(a, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += math.Abs(a[i] - b[i])
+	}
+
+	return sum / float64(len(a))
+}
+
+// laplacian is the mean absolute Laplacian of the grid: the sharper the picture, the higher.
+func laplacian(grid []float64) float64 {
+	sum := 0.0
+	for y := 1; y < gridHeight-1; y++ {
+		for x := 1; x < gridWidth-1; x++ {
+			i := y*gridWidth + x
+			sum += math.Abs(4*grid[i] - grid[i-1] - grid[i+1] - grid[i-gridWidth] - grid[i+gridWidth])
+		}
+	}
+
+	return sum / float64((gridWidth-2)*(gridHeight-2))
+}
+
+// blocks is the normalized mean of every block: the scene's layout regardless of its brightness and contrast.
+func blocks(grid []float64, mean, deviation float64) []float64 {
+	if deviation == 0 {
+		deviation = 1
+	}
+
+	columns := gridWidth / blockSize
+	rows := gridHeight / blockSize
+	scene := make([]float64, columns*rows)
+	for y := 0; y < rows*blockSize; y++ {
+		for x := 0; x < columns*blockSize; x++ {
+			scene[(y/blockSize)*columns+x/blockSize] += grid[y*gridWidth+x]
+		}
+	}
+
+	for i := range scene {
+		scene[i] = (scene[i]/float64(blockSize*blockSize) - mean) / deviation
+	}
+
+	return scene
+}
+
+// correlation is the Pearson correlation of two scenes: 1 for the same layout, 0 or less for unrelated ones.
+func correlation(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 1
+	}
+
+	meanA, deviationA := stats(a)
+	meanB, deviationB := stats(b)
+	if deviationA == 0 || deviationB == 0 {
+		return 1
+	}
+
+	sum := 0.0
+	for i := range a {
+		sum += (a[i] - meanA) * (b[i] - meanB)
+	}
+
+	return sum / float64(len(a)) / (deviationA * deviationB)
+}
+
+// String describes the conditions for logs and key/value storage.
+func String(conditions []string) string {
+	if len(conditions) == 0 {
+		return "healthy"
+	}
+
+	return strings.Join(conditions, ",")
+}
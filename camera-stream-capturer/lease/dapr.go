@@ -0,0 +1,47 @@
+package lease
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+)
+
+// daprStore keeps the leases in the DAPR state store and relies on its etags (first-write concurrency)
+// for the conditional writes.
+type daprStore struct {
+	Client dapr.Client
+}
+
+func NewDaprLeases(client dapr.Client, owner string, ttl time.Duration) IService {
+	return newService(&daprStore{
+		Client: client,
+	}, owner, ttl)
+}
+
+func (s *daprStore) Get(ctx context.Context, key string) ([]byte, string, error) {
+	item, err := s.Client.GetState(ctx, models.ThreatDetectionStateStore, key, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return item.Value, item.Etag, nil
+}
+
+func (s *daprStore) CompareAndSwap(ctx context.Context, key string, value []byte, etag string) error {
+	err := s.Client.SaveStateWithETag(ctx, models.ThreatDetectionStateStore, key, value, etag, nil, dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+	// The sidecar reports an etag mismatch as aborted...any other failure is the store's, not a lost race
+	if status.Code(err) == codes.Aborted {
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write lease %s: %v", key, err)
+	}
+
+	return nil
+}
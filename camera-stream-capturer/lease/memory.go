@@ -0,0 +1,45 @@
+package lease
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps the leases in memory. It only protects cameras within a single capturer
+// and is used when there is no shared store with conditional writes (i.e. AWS runtime mode).
+type memoryStore struct {
+	mu      sync.Mutex
+	values  map[string][]byte
+	etags   map[string]string
+	version int64
+}
+
+func NewMemoryLeases(owner string, ttl time.Duration) IService {
+	return newService(&memoryStore{
+		values: map[string][]byte{},
+		etags:  map[string]string{},
+	}, owner, ttl)
+}
+
+func (s *memoryStore) Get(_ context.Context, key string) ([]byte, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.values[key], s.etags[key], nil
+}
+
+func (s *memoryStore) CompareAndSwap(_ context.Context, key string, value []byte, etag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.etags[key] != etag {
+		return ErrConflict
+	}
+
+	s.version++
+	s.values[key] = value
+	s.etags[key] = strconv.FormatInt(s.version, 10)
+	return nil
+}
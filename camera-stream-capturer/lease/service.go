@@ -0,0 +1,205 @@
+package lease
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type leaseService struct {
+	Store IStore
+	Owner string
+	TTL   time.Duration
+
+	mu     sync.Mutex
+	leases map[string]Lease
+}
+
+func newService(store IStore, owner string, ttl time.Duration) IService {
+	return &leaseService{
+		Store:  store,
+		Owner:  owner,
+		TTL:    ttl,
+		leases: map[string]Lease{},
+	}
+}
+
+func (svc *leaseService) Acquire(ctx context.Context, camera string) (Lease, bool, error) {
+	current, etag, err := svc.read(ctx, camera)
+	if err != nil {
+		return Lease{}, false, err
+	}
+
+	now := time.Now()
+	if current.Held(now) && current.Owner != svc.Owner {
+		return current, false, nil
+	}
+
+	next := Lease{
+		Camera:  camera,
+		Owner:   svc.Owner,
+		Token:   current.Token,
+		Expires: now.Add(svc.TTL),
+	}
+
+	// The token only moves forward when the camera changes hands
+	if current.Owner != svc.Owner || !current.Held(now) {
+		next.Token++
+	}
+
+	err = svc.write(ctx, next, etag)
+	if errors.Is(err, ErrConflict) {
+		return current, false, nil
+	}
+	if err != nil {
+		return Lease{}, false, err
+	}
+
+	svc.mu.Lock()
+	svc.leases[camera] = next
+	svc.mu.Unlock()
+
+	return next, true, nil
+}
+
+func (svc *leaseService) Renew(ctx context.Context) ([]string, error) {
+	lost := []string{}
+	errs := []error{}
+
+	for _, held := range svc.held() {
+		current, etag, err := svc.read(ctx, held.Camera)
+		if err != nil {
+			// The store is unreachable...keep the lease until it expires
+			errs = append(errs, fmt.Errorf("lease %s - unable to renew: %v", held.Camera, err))
+			if !held.Held(time.Now()) {
+				lost = append(lost, svc.forget(held))
+			}
+			continue
+		}
+
+		if current.Owner != svc.Owner || current.Token != held.Token {
+			lost = append(lost, svc.forget(held))
+			continue
+		}
+
+		next := held
+		next.Expires = time.Now().Add(svc.TTL)
+		err = svc.write(ctx, next, etag)
+		if errors.Is(err, ErrConflict) {
+			lost = append(lost, svc.forget(held))
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("lease %s - unable to renew: %v", held.Camera, err))
+			if !held.Held(time.Now()) {
+				lost = append(lost, svc.forget(held))
+			}
+			continue
+		}
+
+		svc.mu.Lock()
+		svc.leases[held.Camera] = next
+		svc.mu.Unlock()
+	}
+
+	return lost, errors.Join(errs...)
+}
+
+func (svc *leaseService) Release(ctx context.Context, camera string) error {
+	svc.mu.Lock()
+	held, ok := svc.leases[camera]
+	delete(svc.leases, camera)
+	svc.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	current, etag, err := svc.read(ctx, camera)
+	if err != nil {
+		return err
+	}
+
+	// Someone else already has it
+	if current.Owner != svc.Owner || current.Token != held.Token {
+		return nil
+	}
+
+	// Keep the token so the next owner gets a higher one
+	released := current
+	released.Owner = ""
+	released.Expires = time.Now()
+	return svc.write(ctx, released, etag)
+}
+
+func (svc *leaseService) Valid(lease Lease) bool {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	held, ok := svc.leases[lease.Camera]
+	return ok && held.Token == lease.Token && held.Held(time.Now())
+}
+
+func (svc *leaseService) Count() int {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	return len(svc.leases)
+}
+
+func (svc *leaseService) held() []Lease {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	leases := []Lease{}
+	for _, l := range svc.leases {
+		leases = append(leases, l)
+	}
+	return leases
+}
+
+func (svc *leaseService) forget(lease Lease) string {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if held, ok := svc.leases[lease.Camera]; ok && held.Token == lease.Token {
+		delete(svc.leases, lease.Camera)
+	}
+	return lease.Camera
+}
+
+func (svc *leaseService) read(ctx context.Context, camera string) (Lease, string, error) {
+	lease := Lease{Camera: camera}
+
+	b, etag, err := svc.Store.Get(ctx, key(camera))
+	if err != nil {
+		return lease, "", err
+	}
+
+	if len(b) == 0 {
+		return lease, etag, nil
+	}
+
+	err = json.Unmarshal(b, &lease)
+	if err != nil {
+		return lease, "", fmt.Errorf("unable to decode lease %s: %v", camera, err)
+	}
+
+	return lease, etag, nil
+}
+
+func (svc *leaseService) write(ctx context.Context, lease Lease, etag string) error {
+	b, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	return svc.Store.CompareAndSwap(ctx, key(lease.Camera), b, etag)
+}
+
+func key(camera string) string {
+	return fmt.Sprintf("%s_%s", "lease", camera)
+}
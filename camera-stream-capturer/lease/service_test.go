@@ -0,0 +1,182 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		values: map[string][]byte{},
+		etags:  map[string]string{},
+	}
+}
+
+// failingStore fails the reads or loses the conditional writes of the store it wraps.
+type failingStore struct {
+	IStore
+	readErr  error
+	conflict bool
+}
+
+func (s *failingStore) Get(ctx context.Context, key string) ([]byte, string, error) {
+	if s.readErr != nil {
+		return nil, "", s.readErr
+	}
+	return s.IStore.Get(ctx, key)
+}
+
+func (s *failingStore) CompareAndSwap(ctx context.Context, key string, value []byte, etag string) error {
+	if s.conflict {
+		return ErrConflict
+	}
+	return s.IStore.CompareAndSwap(ctx, key, value, etag)
+}
+
+func TestMemoryStoreCompareAndSwap(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+
+	if err := store.CompareAndSwap(ctx, "k", []byte("1"), ""); err != nil {
+		t.Fatalf("first write: %v", err)
+	}
+	_, etag, _ := store.Get(ctx, "k")
+
+	if err := store.CompareAndSwap(ctx, "k", []byte("2"), ""); !errors.Is(err, ErrConflict) {
+		t.Errorf("write of an existing key with an empty etag: got %v, want a conflict", err)
+	}
+
+	if err := store.CompareAndSwap(ctx, "k", []byte("2"), etag); err != nil {
+		t.Fatalf("write with the current etag: %v", err)
+	}
+
+	if err := store.CompareAndSwap(ctx, "k", []byte("3"), etag); !errors.Is(err, ErrConflict) {
+		t.Errorf("write with a stale etag: got %v, want a conflict", err)
+	}
+
+	value, _, _ := store.Get(ctx, "k")
+	if string(value) != "2" {
+		t.Errorf("got %s, want the value of the last successful write", value)
+	}
+}
+
+func TestLeaseChangesHands(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	a := newService(store, "a", time.Minute)
+	b := newService(store, "b", time.Minute)
+
+	first, ok, err := a.Acquire(ctx, "cam")
+	if err != nil || !ok || first.Token != 1 {
+		t.Fatalf("a acquire: got %+v %t %v, want token 1", first, ok, err)
+	}
+
+	current, ok, err := b.Acquire(ctx, "cam")
+	if err != nil || ok || current.Owner != "a" {
+		t.Fatalf("b acquire of a held lease: got %+v %t %v, want a's lease", current, ok, err)
+	}
+
+	again, ok, err := a.Acquire(ctx, "cam")
+	if err != nil || !ok || again.Token != first.Token {
+		t.Fatalf("a acquire again: got %+v %t %v, want the same token", again, ok, err)
+	}
+
+	if err := a.Release(ctx, "cam"); err != nil {
+		t.Fatalf("a release: %v", err)
+	}
+	if a.Valid(first) || a.Count() != 0 {
+		t.Errorf("a still holds a released lease")
+	}
+
+	second, ok, err := b.Acquire(ctx, "cam")
+	if err != nil || !ok || second.Token != first.Token+1 {
+		t.Fatalf("b acquire of a released lease: got %+v %t %v, want token %d", second, ok, err, first.Token+1)
+	}
+	if !b.Valid(second) {
+		t.Errorf("b does not hold its lease")
+	}
+}
+
+func TestLeaseExpires(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	a := newService(store, "a", 20*time.Millisecond)
+	b := newService(store, "b", time.Minute)
+
+	first, ok, err := a.Acquire(ctx, "cam")
+	if err != nil || !ok {
+		t.Fatalf("a acquire: got %t %v", ok, err)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if a.Valid(first) {
+		t.Errorf("a holds an expired lease")
+	}
+
+	second, ok, err := b.Acquire(ctx, "cam")
+	if err != nil || !ok || second.Token != first.Token+1 {
+		t.Fatalf("b acquire of an expired lease: got %+v %t %v, want token %d", second, ok, err, first.Token+1)
+	}
+
+	// a's renewal sees the new owner and gives the camera up
+	lost, err := a.Renew(ctx)
+	if err != nil || len(lost) != 1 || lost[0] != "cam" {
+		t.Fatalf("a renew: got %v %v, want cam lost", lost, err)
+	}
+
+	// a's release must not free b's lease
+	if err := a.Release(ctx, "cam"); err != nil {
+		t.Fatalf("a release: %v", err)
+	}
+	if lost, err := b.Renew(ctx); err != nil || len(lost) != 0 {
+		t.Errorf("b renew: got %v %v, want nothing lost", lost, err)
+	}
+}
+
+func TestLeaseConflict(t *testing.T) {
+	ctx := context.Background()
+	store := &failingStore{IStore: newMemoryStore()}
+	a := newService(store, "a", time.Minute)
+
+	// Another capturer wins the race
+	store.conflict = true
+	if _, ok, err := a.Acquire(ctx, "cam"); err != nil || ok {
+		t.Fatalf("acquire that loses the race: got %t %v, want not acquired without error", ok, err)
+	}
+
+	store.conflict = false
+	if _, ok, err := a.Acquire(ctx, "cam"); err != nil || !ok {
+		t.Fatalf("acquire: got %t %v", ok, err)
+	}
+
+	store.conflict = true
+	lost, err := a.Renew(ctx)
+	if err != nil || len(lost) != 1 {
+		t.Errorf("renew that loses the race: got %v %v, want cam lost", lost, err)
+	}
+}
+
+func TestLeaseKeptWhileStoreIsUnreachable(t *testing.T) {
+	ctx := context.Background()
+	store := &failingStore{IStore: newMemoryStore()}
+	a := newService(store, "a", 30*time.Millisecond)
+
+	held, ok, err := a.Acquire(ctx, "cam")
+	if err != nil || !ok {
+		t.Fatalf("acquire: got %t %v", ok, err)
+	}
+
+	store.readErr = errors.New("store is down")
+	lost, err := a.Renew(ctx)
+	if err == nil || len(lost) != 0 || !a.Valid(held) {
+		t.Errorf("renew before expiry: got %v %v, want an error and the lease kept", lost, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	lost, err = a.Renew(ctx)
+	if err == nil || len(lost) != 1 || a.Count() != 0 {
+		t.Errorf("renew after expiry: got %v %v, want an error and the lease lost", lost, err)
+	}
+}
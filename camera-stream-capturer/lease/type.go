@@ -0,0 +1,53 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrConflict is returned by a store when a conditional write loses the race.
+var ErrConflict = errors.New("lease was modified by another capturer")
+
+// Lease grants a capturer the exclusive right to record a camera until it expires.
+// The token increases every time the camera changes hands, so stale owners can be fenced off.
+type Lease struct {
+	Camera  string    `json:"camera"`
+	Owner   string    `json:"owner"`
+	Token   int64     `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// Held returns whether the lease is still held at the given time.
+func (l Lease) Held(now time.Time) bool {
+	return l.Owner != "" && now.Before(l.Expires)
+}
+
+// IStore is a key/value store that supports conditional writes.
+type IStore interface {
+	// Get returns the value and the etag of a key. A missing key returns an empty value and etag.
+	Get(ctx context.Context, key string) ([]byte, string, error)
+
+	// CompareAndSwap writes the value only if the key's etag has not changed since it was read.
+	// An empty etag means the key must not exist. It returns ErrConflict if the key has changed.
+	CompareAndSwap(ctx context.Context, key string, value []byte, etag string) error
+}
+
+// IService manages the camera leases of a capturer.
+type IService interface {
+	// Acquire takes the camera's lease if it is free, expired or already held by this capturer.
+	Acquire(ctx context.Context, camera string) (Lease, bool, error)
+
+	// Renew extends all the leases held by this capturer and returns the cameras whose leases were lost.
+	// A lease that cannot be renewed because the store is unreachable is kept until it expires and its error is returned.
+	Renew(ctx context.Context) ([]string, error)
+
+	// Release gives the camera's lease up so another capturer can take it right away.
+	Release(ctx context.Context, camera string) error
+
+	// Valid returns whether the lease is still held by this capturer with the same token.
+	Valid(lease Lease) bool
+
+	// Count returns the number of leases held by this capturer.
+	Count() int
+}
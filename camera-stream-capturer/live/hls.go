@@ -0,0 +1,598 @@
+package live
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4/seekablebuffer"
+)
+
+const (
+	timeScale = 90000
+
+	// A muxer that is not requested for this long stops muxing and drops its segments
+	idleTimeout = 30 * time.Second
+
+	// Kept for the parts of the latest segments only
+	partSegments = 2
+)
+
+var (
+	ErrStreamNotFound = errors.New("live stream not found")
+	errNotReady       = errors.New("live stream is starting")
+)
+
+// HLSMuxer repackages a camera's H264/H265 packets into fMP4 HLS segments kept in memory with their playlist.
+// In low-latency mode, segments are made of parts which are advertised (and can be requested) before the
+// segment completes, and playlist requests can block until a given part is available (LL-HLS).
+// The muxer only works while it is watched: it starts on the first request and stops when it is idle.
+type HLSMuxer struct {
+	Codec          string // H264 or H265
+	SegmentTarget  time.Duration
+	SegmentCount   int
+	LowLatency     bool
+	PartTarget     time.Duration
+	RequestTimeout time.Duration
+
+	mu          sync.Mutex
+	lastRequest time.Time
+	init        []byte
+	startDTS    time.Duration
+	pending     *sample
+	segments    []*segment // completed segments, oldest first
+	current     *segment
+	currentPart *part
+	nextSegment uint64
+	nextPart    uint64
+	changed     chan struct{} // closed and replaced whenever a part completes
+}
+
+type sample struct {
+	dts        time.Duration
+	au         [][]byte
+	isKeyFrame bool
+}
+
+type segment struct {
+	id       uint64
+	duration time.Duration
+	parts    []*part
+	data     []byte
+}
+
+type part struct {
+	id          uint64
+	index       int // in its segment
+	startDTS    time.Duration
+	duration    time.Duration
+	independent bool
+	samples     []*fmp4.PartSample
+	data        []byte
+}
+
+func NewHLSMuxer(codec string) *HLSMuxer {
+	return &HLSMuxer{
+		Codec:          codec,
+		SegmentTarget:  segmentTarget(),
+		SegmentCount:   segmentCount(),
+		LowLatency:     lowLatency(),
+		PartTarget:     partTarget(),
+		RequestTimeout: 3 * segmentTarget(),
+		changed:        make(chan struct{}),
+	}
+}
+
+// WritePacket adds a video access unit (Annex-B) to the stream. Packets are dropped while nobody watches.
+func (m *HLSMuxer) WritePacket(data []byte, dts time.Duration, isKeyFrame bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if time.Since(m.lastRequest) > idleTimeout {
+		if m.init != nil {
+			m.reset()
+		}
+		return nil
+	}
+
+	// The first start code is sometimes stripped
+	if !bytes.HasPrefix(data, []byte{0x00, 0x00, 0x01}) && !bytes.HasPrefix(data, []byte{0x00, 0x00, 0x00, 0x01}) {
+		data = append([]byte{0x00, 0x00, 0x00, 0x01}, data...)
+	}
+
+	au, err := h264.AnnexBUnmarshal(data)
+	if err != nil {
+		return err
+	}
+
+	// Wait for a key frame that carries the parameter sets
+	if m.init == nil {
+		if !isKeyFrame {
+			return nil
+		}
+
+		err = m.initialize(au)
+		if err != nil {
+			return err
+		}
+		m.startDTS = dts
+	}
+
+	s := &sample{
+		dts:        dts - m.startDTS,
+		au:         au,
+		isKeyFrame: isKeyFrame,
+	}
+
+	// A sample's duration is only known when the next one arrives
+	if m.pending != nil {
+		duration := s.dts - m.pending.dts
+		if duration <= 0 {
+			// Out of order or duplicated...drop it
+			return nil
+		}
+
+		err = m.appendSample(m.pending, duration)
+		if err != nil {
+			return err
+		}
+	}
+	m.pending = s
+
+	return nil
+}
+
+// Handle serves the playlist (`index.m3u8`), the init section (`init.mp4`), segments (`seg<N>.mp4`)
+// and parts (`part<N>.mp4`).
+func (m *HLSMuxer) Handle(w http.ResponseWriter, r *http.Request, file string) {
+	m.mu.Lock()
+	m.lastRequest = time.Now()
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), m.RequestTimeout)
+	defer cancel()
+
+	switch {
+	case file == "index.m3u8":
+		playlist, err := m.playlist(ctx, r.URL.Query().Get("_HLS_msn"), r.URL.Query().Get("_HLS_part"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = w.Write(playlist)
+	case file == "init.mp4":
+		m.serve(ctx, w, func() ([]byte, bool) {
+			return m.init, true
+		})
+	case strings.HasPrefix(file, "seg") && strings.HasSuffix(file, ".mp4"):
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(file, "seg"), ".mp4"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m.serve(ctx, w, func() ([]byte, bool) {
+			return m.segmentData(id), id+1 >= m.nextSegment
+		})
+	case strings.HasPrefix(file, "part") && strings.HasSuffix(file, ".mp4"):
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(file, "part"), ".mp4"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The preload hint points at the next part...wait for it
+		m.serve(ctx, w, func() ([]byte, bool) {
+			return m.partData(id), id >= m.nextPartID()
+		})
+	default:
+		http.Error(w, fmt.Sprintf("%s not found", file), http.StatusNotFound)
+	}
+}
+
+// serve waits until the data is available or the request times out. The data func returns the data
+// if it is available and whether it can still become available (it is called with the lock held).
+func (m *HLSMuxer) serve(ctx context.Context, w http.ResponseWriter, data func() ([]byte, bool)) {
+	for {
+		m.mu.Lock()
+		b, coming := data()
+		changed := m.changed
+		m.mu.Unlock()
+
+		if b != nil {
+			w.Header().Set("Content-Type", "video/mp4")
+			_, _ = w.Write(b)
+			return
+		}
+
+		if !coming {
+			http.Error(w, "not available", http.StatusNotFound)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			http.Error(w, "not available", http.StatusNotFound)
+			return
+		case <-changed:
+		}
+	}
+}
+
+// playlist blocks until the stream has a segment and, when requested (`_HLS_msn` and `_HLS_part`), until
+// the given segment (and part) is available.
+func (m *HLSMuxer) playlist(ctx context.Context, msnQuery, partQuery string) ([]byte, error) {
+	msn, errMSN := strconv.ParseUint(msnQuery, 10, 64)
+	partIndex, errPart := strconv.Atoi(partQuery)
+	blocking := m.LowLatency && errMSN == nil
+
+	for {
+		m.mu.Lock()
+		ready := len(m.segments) > 0
+		if ready && blocking {
+			ready = m.hasPart(msn, partIndex, errPart == nil)
+		}
+		if ready {
+			b := m.marshalPlaylist()
+			m.mu.Unlock()
+			return b, nil
+		}
+		changed := m.changed
+		m.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, errNotReady
+		case <-changed:
+		}
+	}
+}
+
+func (m *HLSMuxer) initialize(au [][]byte) error {
+	var codec fmp4.Codec
+	var vps, sps, pps []byte
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		if m.Codec == "H265" {
+			switch h265.NALUType((nalu[0] >> 1) & 0x3F) {
+			case h265.NALUType_VPS_NUT:
+				vps = nalu
+			case h265.NALUType_SPS_NUT:
+				sps = nalu
+			case h265.NALUType_PPS_NUT:
+				pps = nalu
+			}
+			continue
+		}
+
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeSPS:
+			sps = nalu
+		case h264.NALUTypePPS:
+			pps = nalu
+		}
+	}
+
+	if m.Codec == "H265" {
+		if vps == nil || sps == nil || pps == nil {
+			return fmt.Errorf("the key frame has no parameter sets")
+		}
+		codec = &fmp4.CodecH265{VPS: vps, SPS: sps, PPS: pps}
+	} else {
+		if sps == nil || pps == nil {
+			return fmt.Errorf("the key frame has no parameter sets")
+		}
+		codec = &fmp4.CodecH264{SPS: sps, PPS: pps}
+	}
+
+	init := fmp4.Init{
+		Tracks: []*fmp4.InitTrack{{
+			ID:        1,
+			TimeScale: timeScale,
+			Codec:     codec,
+		}},
+	}
+
+	var buf seekablebuffer.Buffer
+	err := init.Marshal(&buf)
+	if err != nil {
+		return err
+	}
+
+	m.init = buf.Bytes()
+	return nil
+}
+
+// appendSample cuts a new segment on a key frame once the current one is long enough and,
+// in low-latency mode, a new part once the current one is long enough.
+func (m *HLSMuxer) appendSample(s *sample, duration time.Duration) error {
+	if s.isKeyFrame && (m.current == nil || m.currentDuration() >= m.SegmentTarget) {
+		err := m.completeSegment()
+		if err != nil {
+			return err
+		}
+
+		m.current = &segment{
+			id: m.nextSegment,
+		}
+		m.nextSegment++
+	}
+
+	// Nothing to do until the first key frame
+	if m.current == nil {
+		return nil
+	}
+
+	if m.LowLatency && m.currentPart != nil && m.currentPart.duration >= m.PartTarget {
+		err := m.completePart()
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.currentPart == nil {
+		m.currentPart = &part{
+			id:          m.nextPart,
+			index:       len(m.current.parts),
+			startDTS:    s.dts,
+			independent: s.isKeyFrame,
+		}
+		m.nextPart++
+	}
+
+	ps, err := fmp4.NewPartSampleH26x(0, s.isKeyFrame, s.au)
+	if err != nil {
+		return err
+	}
+	ps.Duration = uint32(duration * timeScale / time.Second)
+
+	m.currentPart.samples = append(m.currentPart.samples, ps)
+	m.currentPart.duration += duration
+	return nil
+}
+
+// currentDuration includes the part being muxed. The caller must hold the lock.
+func (m *HLSMuxer) currentDuration() time.Duration {
+	duration := m.current.duration
+	if m.currentPart != nil {
+		duration += m.currentPart.duration
+	}
+	return duration
+}
+
+func (m *HLSMuxer) completePart() error {
+	p := m.currentPart
+	if p == nil {
+		return nil
+	}
+	m.currentPart = nil
+
+	fp := fmp4.Part{
+		SequenceNumber: uint32(p.id),
+		Tracks: []*fmp4.PartTrack{{
+			ID:       1,
+			BaseTime: uint64(p.startDTS * timeScale / time.Second),
+			Samples:  p.samples,
+		}},
+	}
+
+	var buf seekablebuffer.Buffer
+	err := fp.Marshal(&buf)
+	if err != nil {
+		return err
+	}
+
+	p.data = buf.Bytes()
+	p.samples = nil
+	m.current.parts = append(m.current.parts, p)
+	m.current.duration += p.duration
+	m.notify()
+	return nil
+}
+
+func (m *HLSMuxer) completeSegment() error {
+	if m.current == nil {
+		return nil
+	}
+
+	err := m.completePart()
+	if err != nil {
+		return err
+	}
+
+	data := []byte{}
+	for _, p := range m.current.parts {
+		data = append(data, p.data...)
+	}
+	m.current.data = data
+	if !m.LowLatency {
+		// Parts are only requested in low-latency mode
+		m.current.parts = nil
+	}
+
+	m.segments = append(m.segments, m.current)
+	if len(m.segments) > m.SegmentCount {
+		m.segments = m.segments[len(m.segments)-m.SegmentCount:]
+	}
+	m.current = nil
+	m.notify()
+	return nil
+}
+
+func (m *HLSMuxer) reset() {
+	m.init = nil
+	m.pending = nil
+	m.segments = nil
+	m.current = nil
+	m.currentPart = nil
+	m.notify()
+}
+
+func (m *HLSMuxer) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// hasPart returns whether the segment (or the segment's part) is available. The caller must hold the lock.
+func (m *HLSMuxer) hasPart(msn uint64, partIndex int, withPart bool) bool {
+	if m.nextSegment == 0 {
+		return false
+	}
+
+	// Completed segments
+	if len(m.segments) > 0 && msn <= m.segments[len(m.segments)-1].id {
+		return true
+	}
+
+	if m.current == nil || msn != m.current.id {
+		return false
+	}
+
+	return withPart && partIndex < len(m.current.parts)
+}
+
+// The caller must hold the lock.
+func (m *HLSMuxer) segmentData(id uint64) []byte {
+	for _, s := range m.segments {
+		if s.id == id {
+			return s.data
+		}
+	}
+	return nil
+}
+
+// The caller must hold the lock.
+func (m *HLSMuxer) partData(id uint64) []byte {
+	segments := append([]*segment{}, m.segments...)
+	if m.current != nil {
+		segments = append(segments, m.current)
+	}
+
+	for _, s := range segments {
+		for _, p := range s.parts {
+			if p.id == id {
+				return p.data
+			}
+		}
+	}
+	return nil
+}
+
+// marshalPlaylist writes the media playlist. The caller must hold the lock.
+func (m *HLSMuxer) marshalPlaylist() []byte {
+	var b strings.Builder
+
+	targetDuration := m.SegmentTarget
+	for _, s := range m.segments {
+		if s.duration > targetDuration {
+			targetDuration = s.duration
+		}
+	}
+
+	version := 7
+	if m.LowLatency {
+		version = 9
+	}
+
+	b.WriteString("#EXTM3U\n")
+	b.WriteString(fmt.Sprintf("#EXT-X-VERSION:%d\n", version))
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	b.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration.Seconds()))))
+	if m.LowLatency {
+		partTarget := m.PartTarget
+		for _, s := range m.segments {
+			for _, p := range s.parts {
+				if p.duration > partTarget {
+					partTarget = p.duration
+				}
+			}
+		}
+
+		b.WriteString(fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.5f\n", 3*partTarget.Seconds()))
+		b.WriteString(fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%.5f\n", partTarget.Seconds()))
+	}
+	b.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", m.segments[0].id))
+	b.WriteString("#EXT-X-MAP:URI=\"init.mp4\"\n")
+
+	for i, s := range m.segments {
+		if m.LowLatency && i >= len(m.segments)-partSegments {
+			writeParts(&b, s.parts)
+		}
+		b.WriteString(fmt.Sprintf("#EXTINF:%.5f,\nseg%d.mp4\n", s.duration.Seconds(), s.id))
+	}
+
+	if m.LowLatency {
+		if m.current != nil {
+			writeParts(&b, m.current.parts)
+		}
+		b.WriteString(fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.mp4\"\n", m.nextPartID()))
+	}
+
+	return []byte(b.String())
+}
+
+// nextPartID is the part being muxed or the next one. The caller must hold the lock.
+func (m *HLSMuxer) nextPartID() uint64 {
+	if m.currentPart != nil {
+		return m.currentPart.id
+	}
+	return m.nextPart
+}
+
+func writeParts(b *strings.Builder, parts []*part) {
+	for _, p := range parts {
+		independent := ""
+		if p.independent {
+			independent = ",INDEPENDENT=YES"
+		}
+		b.WriteString(fmt.Sprintf("#EXT-X-PART:DURATION=%.5f,URI=\"part%d.mp4\"%s\n", p.duration.Seconds(), p.id, independent))
+	}
+}
+
+func segmentTarget() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("CAPTURER_HLS_SEGMENT_SECONDS"))
+	if err != nil || seconds <= 0 {
+		seconds = 2
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+func segmentCount() int {
+	count, err := strconv.Atoi(os.Getenv("CAPTURER_HLS_SEGMENTS"))
+	if err != nil || count < 3 {
+		count = 7
+	}
+
+	return count
+}
+
+func lowLatency() bool {
+	return os.Getenv("CAPTURER_HLS_LOW_LATENCY") == "true"
+}
+
+func partTarget() time.Duration {
+	ms, err := strconv.Atoi(os.Getenv("CAPTURER_HLS_PART_MS"))
+	if err != nil || ms <= 0 {
+		ms = 200
+	}
+
+	return time.Duration(ms) * time.Millisecond
+}
@@ -0,0 +1,116 @@
+package live
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Streams keeps the live streams of every camera that is streaming: HLS for H264 and H265 and WebRTC for H264.
+type Streams struct {
+	mu     sync.Mutex
+	muxers map[string]*HLSMuxer
+	rtcs   map[string]*WebRTCStream
+}
+
+func NewStreams() *Streams {
+	return &Streams{
+		muxers: map[string]*HLSMuxer{},
+		rtcs:   map[string]*WebRTCStream{},
+	}
+}
+
+// Open creates the camera's live stream for a camera session. It returns nil for codecs HLS does not carry.
+func (s *Streams) Open(camera, codec string) *HLSMuxer {
+	if codec != "H264" && codec != "H265" {
+		return nil
+	}
+
+	muxer := NewHLSMuxer(codec)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.muxers[camera] = muxer
+	return muxer
+}
+
+// Close removes the camera's live stream unless a newer session replaced it.
+func (s *Streams) Close(camera string, muxer *HLSMuxer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.muxers[camera] == muxer {
+		delete(s.muxers, camera)
+	}
+}
+
+// OpenWebRTC creates the camera's WebRTC stream for a camera session. It returns nil for codecs other than H264.
+func (s *Streams) OpenWebRTC(camera, codec string, sps, pps []byte) (*WebRTCStream, error) {
+	if codec != "H264" {
+		return nil, nil
+	}
+
+	rtc, err := NewWebRTCStream(sps, pps)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rtcs[camera] = rtc
+	return rtc, nil
+}
+
+// CloseWebRTC disconnects the viewers and removes the camera's WebRTC stream unless a newer session replaced it.
+func (s *Streams) CloseWebRTC(camera string, rtc *WebRTCStream) {
+	if rtc == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.rtcs[camera] == rtc {
+		delete(s.rtcs, camera)
+	}
+	s.mu.Unlock()
+
+	rtc.Close()
+}
+
+// Watch adds a WebRTC viewer to the camera's stream. It returns the viewer's id and the SDP answer.
+func (s *Streams) Watch(camera, offer string) (string, string, error) {
+	s.mu.Lock()
+	rtc, ok := s.rtcs[camera]
+	s.mu.Unlock()
+
+	if !ok {
+		return "", "", ErrStreamNotFound
+	}
+
+	return rtc.AddViewer(offer)
+}
+
+// Unwatch disconnects a WebRTC viewer from the camera's stream.
+func (s *Streams) Unwatch(camera, id string) error {
+	s.mu.Lock()
+	rtc, ok := s.rtcs[camera]
+	s.mu.Unlock()
+
+	if !ok {
+		return ErrStreamNotFound
+	}
+
+	return rtc.RemoveViewer(id)
+}
+
+// Handle serves a file of the camera's live stream.
+func (s *Streams) Handle(w http.ResponseWriter, r *http.Request, camera, file string) error {
+	s.mu.Lock()
+	muxer, ok := s.muxers[camera]
+	s.mu.Unlock()
+
+	if !ok {
+		return ErrStreamNotFound
+	}
+
+	muxer.Handle(w, r, file)
+	return nil
+}
@@ -0,0 +1,327 @@
+package live
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	ErrViewerNotFound = errors.New("viewer not found")
+	ErrTooManyViewers = errors.New("too many viewers")
+)
+
+// WebRTCStream forwards a camera's H264 RTP packets to WebRTC viewers as they arrive, without transcoding.
+// A viewer starts on the next key frame: the parameter sets are sent ahead of it if the camera only
+// sends them out of band. Every viewer has its own track so its packets are numbered continuously.
+type WebRTCStream struct {
+	MaxViewers int
+
+	mu         sync.RWMutex
+	api        *webrtc.API
+	config     webrtc.Configuration
+	capability webrtc.RTPCodecCapability
+	sps        []byte
+	pps        []byte
+	viewers    map[string]*viewer
+}
+
+type viewer struct {
+	pc       *webrtc.PeerConnection
+	track    *webrtc.TrackLocalStaticRTP
+	started  bool
+	sequence uint16
+}
+
+func NewWebRTCStream(sps, pps []byte) (*WebRTCStream, error) {
+	settings := webrtc.SettingEngine{}
+	if ips := natIPs(); len(ips) > 0 {
+		settings.SetNAT1To1IPs(ips, webrtc.ICECandidateTypeHost)
+	}
+
+	capability := h264Capability(sps)
+	mediaEngine := &webrtc.MediaEngine{}
+	err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: capability,
+		PayloadType:        102,
+	}, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebRTCStream{
+		MaxViewers: maxViewers(),
+		api:        webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settings)),
+		config: webrtc.Configuration{
+			ICEServers: iceServers(),
+		},
+		capability: capability,
+		sps:        sps,
+		pps:        pps,
+		viewers:    map[string]*viewer{},
+	}, nil
+}
+
+// AddViewer answers a viewer's SDP offer (WHEP). ICE candidates are gathered before answering
+// so no trickle is needed. It returns the viewer's id and the SDP answer.
+func (s *WebRTCStream) AddViewer(offer string) (string, string, error) {
+	s.mu.RLock()
+	count := len(s.viewers)
+	s.mu.RUnlock()
+	if count >= s.MaxViewers {
+		return "", "", ErrTooManyViewers
+	}
+
+	pc, err := s.api.NewPeerConnection(s.config)
+	if err != nil {
+		return "", "", err
+	}
+
+	track, err := webrtc.NewTrackLocalStaticRTP(s.capability, "video", "camera")
+	if err != nil {
+		pc.Close()
+		return "", "", err
+	}
+
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		pc.Close()
+		return "", "", err
+	}
+
+	// Read the viewer's RTCP so the interceptors keep working
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	id := uuid.NewString()
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateDisconnected {
+			_ = s.RemoveViewer(id)
+		}
+	})
+
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		pc.Close()
+		return "", "", fmt.Errorf("invalid offer: %v", err)
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		pc.Close()
+		return "", "", err
+	}
+
+	gathered := webrtc.GatheringCompletePromise(pc)
+	err = pc.SetLocalDescription(answer)
+	if err != nil {
+		pc.Close()
+		return "", "", err
+	}
+	<-gathered
+
+	s.mu.Lock()
+	s.viewers[id] = &viewer{
+		pc:    pc,
+		track: track,
+	}
+	s.mu.Unlock()
+
+	return id, pc.LocalDescription().SDP, nil
+}
+
+// RemoveViewer closes a viewer's connection.
+func (s *WebRTCStream) RemoveViewer(id string) error {
+	s.mu.Lock()
+	v, ok := s.viewers[id]
+	delete(s.viewers, id)
+	s.mu.Unlock()
+
+	if !ok {
+		return ErrViewerNotFound
+	}
+
+	return v.pc.Close()
+}
+
+// Close closes all the viewers' connections.
+func (s *WebRTCStream) Close() {
+	s.mu.Lock()
+	viewers := s.viewers
+	s.viewers = map[string]*viewer{}
+	s.mu.Unlock()
+
+	for _, v := range viewers {
+		_ = v.pc.Close()
+	}
+}
+
+// WriteRTP forwards a camera RTP packet to the viewers. It is called by the RTSP client for every
+// video packet, so it must not keep the packet.
+func (s *WebRTCStream) WriteRTP(pkt *rtp.Packet) {
+	if len(pkt.Payload) == 0 {
+		return
+	}
+
+	startsKeyFrame, carriesParams := s.inspect(pkt.Payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.viewers {
+		if !v.started {
+			if !startsKeyFrame {
+				continue
+			}
+			v.started = true
+
+			// Send the parameter sets ahead of the key frame
+			if !carriesParams && s.sps != nil && s.pps != nil {
+				params := &rtp.Packet{
+					Header: rtp.Header{
+						Version:   2,
+						Timestamp: pkt.Timestamp,
+					},
+					Payload: stapA(s.sps, s.pps),
+				}
+				v.write(params)
+			}
+		}
+
+		out := *pkt
+		v.write(&out)
+	}
+}
+
+func (v *viewer) write(pkt *rtp.Packet) {
+	pkt.SequenceNumber = v.sequence
+	v.sequence++
+	_ = v.track.WriteRTP(pkt)
+}
+
+// inspect returns whether the RTP payload starts an IDR frame and whether it carries the parameter sets
+// (which are kept for the next viewers).
+func (s *WebRTCStream) inspect(payload []byte) (bool, bool) {
+	typ := h264.NALUType(payload[0] & 0x1F)
+	switch typ {
+	case h264.NALUTypeIDR:
+		return true, false
+	case h264.NALUTypeSPS, h264.NALUTypePPS:
+		s.keepParams(payload)
+		return false, false
+	case h264.NALUTypeFUA:
+		// Start bit and the fragmented NALU type
+		return len(payload) > 1 && payload[1]&0x80 != 0 && h264.NALUType(payload[1]&0x1F) == h264.NALUTypeIDR, false
+	case h264.NALUTypeSTAPA:
+		idr, params := false, false
+		for pos := 1; pos+2 <= len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[pos:]))
+			pos += 2
+			if size == 0 || pos+size > len(payload) {
+				break
+			}
+
+			nalu := payload[pos : pos+size]
+			switch h264.NALUType(nalu[0] & 0x1F) {
+			case h264.NALUTypeIDR:
+				idr = true
+			case h264.NALUTypeSPS, h264.NALUTypePPS:
+				params = true
+				s.keepParams(nalu)
+			}
+			pos += size
+		}
+		return idr || params, params
+	}
+
+	return false, false
+}
+
+func (s *WebRTCStream) keepParams(nalu []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if h264.NALUType(nalu[0]&0x1F) == h264.NALUTypeSPS {
+		s.sps = append([]byte{}, nalu...)
+	} else {
+		s.pps = append([]byte{}, nalu...)
+	}
+}
+
+// stapA aggregates NALUs in a single RTP payload (RFC 6184).
+func stapA(nalus ...[]byte) []byte {
+	payload := []byte{byte(h264.NALUTypeSTAPA)}
+	for _, nalu := range nalus {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(nalu)))
+		payload = append(payload, nalu...)
+	}
+
+	// The highest NRI of the aggregated NALUs
+	for _, nalu := range nalus {
+		if nalu[0]&0x60 > payload[0]&0x60 {
+			payload[0] = payload[0]&^0x60 | nalu[0]&0x60
+		}
+	}
+
+	return payload
+}
+
+// h264Capability negotiates the camera's profile (from its SPS) or the constrained baseline profile.
+func h264Capability(sps []byte) webrtc.RTPCodecCapability {
+	profile := "42e01f"
+	if len(sps) >= 4 {
+		profile = fmt.Sprintf("%02x%02x%02x", sps[1], sps[2], sps[3])
+	}
+
+	return webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile,
+	}
+}
+
+func iceServers() []webrtc.ICEServer {
+	servers := []webrtc.ICEServer{}
+	for _, url := range strings.Split(os.Getenv("CAPTURER_WEBRTC_ICE_SERVERS"), ",") {
+		if strings.TrimSpace(url) != "" {
+			servers = append(servers, webrtc.ICEServer{URLs: []string{strings.TrimSpace(url)}})
+		}
+	}
+
+	return servers
+}
+
+func natIPs() []string {
+	ips := []string{}
+	for _, ip := range strings.Split(os.Getenv("CAPTURER_WEBRTC_NAT_IPS"), ",") {
+		if strings.TrimSpace(ip) != "" {
+			ips = append(ips, strings.TrimSpace(ip))
+		}
+	}
+
+	return ips
+}
+
+func maxViewers() int {
+	count, err := strconv.Atoi(os.Getenv("CAPTURER_WEBRTC_MAX_VIEWERS"))
+	if err != nil || count <= 0 {
+		count = 10
+	}
+
+	return count
+}
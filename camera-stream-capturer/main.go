@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	dapr "github.com/dapr/go-sdk/client"
@@ -19,11 +22,13 @@ import (
 	otelprovider "github.com/khaledhikmat/threat-detection-shared/telemetry/provider"
 
 	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/agent"
-)
-
-var (
-	activeAgents  = 0 //TODO: Needs an atomic counter
-	agentCommands map[string]chan string
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/errorlog"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/lease"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/live"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/replay"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/server"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/spool"
+	"github.com/khaledhikmat/threat-detection/custody"
 )
 
 var daprClient dapr.Client
@@ -39,10 +44,10 @@ var modeProcs = map[string]func(ctx context.Context, capturer string) error{
 }
 
 var recordingsTopic = models.RecordingsTopic
+var alertsTopic = models.AlertsTopic
 
 func main() {
 	capturerName := "capturer1" // TODO: read from the pod
-	agentCommands = map[string]chan string{}
 
 	rootCanx := context.Background()
 	canxCtx, _ := signal.NotifyContext(rootCanx, os.Interrupt)
@@ -128,10 +133,63 @@ func awsModeProc(ctx context.Context, capturer string) error {
 	fmt.Printf("**** Created a topic %s\n", rt)
 	recordingsTopic = rt
 
+	// Camera health alerts go to the model invokers' alerts topic
+	at, err := pubsubSvc.CreateTopic(ctx, models.AlertsTopic)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("**** Created a topic %s\n", at)
+	alertsTopic = at
+
 	return runProc(ctx, capturer)
 }
 
 func runProc(canxCtx context.Context, capturerName string) error {
+	leases := newLeases(capturerName)
+	agents := newAgents()
+
+	// The agents restore the quarantines from the cameras' last states
+	agent.DaprClient = daprClient
+
+	// Run the error log to keep the agents' most recent errors queryable
+	errorLog := errorlog.NewErrorLog(daprClient, storageSvc, capturerName)
+	go errorLog.Run(canxCtx)
+
+	// Run the spool processor to upload and publish the recorded clips, including the ones left by a previous run
+	custodyLog, err := custody.NewCustodyLog(daprClient, storageSvc, capturerName)
+	if err != nil {
+		return err
+	}
+	spooler := spool.New(configSvc, storageSvc, pubsubSvc, custodyLog, errorLog, recordingsTopic, alertsTopic, spoolQuota())
+	go spooler.Run(canxCtx)
+
+	// In replay mode, every camera streams the replay file from the built-in RTSP server
+	replayServer, err := newReplayServer()
+	if err != nil {
+		return err
+	}
+
+	if replayServer != nil {
+		go func() {
+			err := replayServer.Run(canxCtx)
+			if err != nil && canxCtx.Err() == nil {
+				fmt.Printf("capturer %s replay server error: %v\n", capturerName, err)
+			}
+		}()
+	}
+
+	// Run the control API so agents can be listed and commanded and their live streams watched
+	liveStreams := live.NewStreams()
+	server.AgentsService = agents
+	server.LiveService = liveStreams
+	go func() {
+		err := server.Run(canxCtx, os.Getenv("APP_PORT"))
+		if err != nil && canxCtx.Err() == nil {
+			fmt.Printf("capturer %s control API error: %v\n", capturerName, err)
+		}
+	}()
+
 	// Run a discovery processor to grab camera agents
 	go func() {
 		for {
@@ -141,35 +199,68 @@ func runProc(canxCtx context.Context, capturerName string) error {
 				return
 			case <-time.After(time.Duration(10 * time.Second)): // TODO: Need a backoff time
 				fmt.Printf("capturer %s discovery processor timeout to grab camera agents....\n", capturerName)
-				agents, err := agents(capturerName)
+				cameras, err := discover(capturerName)
 				if err != nil {
 					fmt.Printf("capturer %s discovery processor error: %v\n", capturerName, err)
 					continue
 				}
 
-				for _, c := range agents {
-					if activeAgents < configSvc.GetCapturer().MaxCameras {
-						err = soicatSvc.UpdateCamera(c) //TODO: not enough ...we might run into a race condition
-						if err != nil {
-							fmt.Printf("capturer %s discovery processor error: %v\n", capturerName, err)
-							continue
-						}
+				for _, c := range cameras {
+					if agents.count() >= configSvc.GetCapturer().MaxCameras {
+						break
+					}
 
-						// Create a commands channels for agent
-						agentCommands[c.Name] = make(chan string)
+					if agents.running(c.Name) {
+						continue
+					}
 
-						go func() {
-							fmt.Printf("capturer %s discovery processor agent %s - starting....\n", capturerName, c.Name)
-							defer close(agentCommands[c.Name])
+					// Only one capturer can hold a camera's lease
+					l, ok, err := leases.Acquire(canxCtx, c.Name)
+					if err != nil {
+						fmt.Printf("capturer %s discovery processor agent %s - lease error: %v\n", capturerName, c.Name, err)
+						continue
+					}
 
-							agentErr := agent.Run(canxCtx, configSvc, storageSvc, pubsubSvc, recordingsTopic, agentCommands[c.Name], capturerName, c)
-							if agentErr != nil {
-								fmt.Printf("capturer %s discovery processor agent: %s - start error: %v\n", capturerName, c.Name, agentErr)
+					if !ok {
+						fmt.Printf("capturer %s discovery processor agent %s - leased by %s\n", capturerName, c.Name, l.Owner)
+						continue
+					}
+
+					c.Capturer = capturerName
+					err = soicatSvc.UpdateCamera(c)
+					if err != nil {
+						fmt.Printf("capturer %s discovery processor error: %v\n", capturerName, err)
+						_ = leases.Release(canxCtx, c.Name)
+						continue
+					}
+
+					// The catalogue keeps the camera's real URL
+					if replayServer != nil {
+						c.RtspURL = replayServer.URL(c.Name)
+					}
+
+					agentCtx, agentCancel := context.WithCancel(canxCtx)
+					stats := agent.NewStats(c.Name, configSvc.GetCapturer().AgentMode, l.Token)
+					commands := agents.start(c.Name, agentCancel, stats)
+
+					go func() {
+						fmt.Printf("capturer %s discovery processor agent %s - starting with fencing token %d....\n", capturerName, c.Name, l.Token)
+						defer agents.stop(c.Name)
+						defer func() {
+							// Release the lease so another capturer can take the camera right away
+							releaseCtx, releaseCancel := context.WithTimeout(context.Background(), 5*time.Second)
+							defer releaseCancel()
+							err := leases.Release(releaseCtx, c.Name)
+							if err != nil {
+								fmt.Printf("capturer %s discovery processor agent: %s - lease release error: %v\n", capturerName, c.Name, err)
 							}
 						}()
 
-						activeAgents++
-					}
+						agentErr := agent.Run(agentCtx, configSvc, storageSvc, spooler, errorLog, leases, l, liveStreams, stats, commands, capturerName, c)
+						if agentErr != nil {
+							fmt.Printf("capturer %s discovery processor agent: %s - start error: %v\n", capturerName, c.Name, agentErr)
+						}
+					}()
 				}
 			}
 		}
@@ -180,17 +271,27 @@ func runProc(canxCtx context.Context, capturerName string) error {
 		select {
 		case <-canxCtx.Done():
 			fmt.Println("context cancelled...")
-			// Wait until downstream processors are done
+			// Wait until downstream processors are done and their leases are released
 			fmt.Println("wait for 5 seconds until downstream processors are cancelled...")
 			time.Sleep(5 * time.Second)
 			return nil
 		case <-time.After(time.Duration(20 * time.Second)):
 			fmt.Printf("capturer %s heartbeat processor timeout to send heartbeat....\n", capturerName)
+			// Renew the leases and stop the agents whose leases were lost
+			lost, err := leases.Renew(canxCtx)
+			if err != nil {
+				fmt.Printf("capturer %s heartbeat processor - error: %v\n", capturerName, err)
+			}
+			for _, camera := range lost {
+				fmt.Printf("capturer %s heartbeat processor - lost the lease of agent %s...stopping it\n", capturerName, camera)
+				agents.cancel(camera)
+			}
+
 			// Send a heartbeat signal
-			err := storageSvc.StoreKeyValue(canxCtx,
+			err = storageSvc.StoreKeyValue(canxCtx,
 				models.ThreatDetectionStateStore,
 				fmt.Sprintf("%s_%s", "heartbeat", capturerName),
-				fmt.Sprintf("%s_%d", time.Now().UTC().Format("2006-01-02 15:04:05"), activeAgents))
+				fmt.Sprintf("%s_%d", time.Now().UTC().Format("2006-01-02 15:04:05"), agents.count()))
 			if err != nil {
 				fmt.Printf("capturer %s heartbeat processor - error: %v\n", capturerName, err)
 			}
@@ -198,36 +299,195 @@ func runProc(canxCtx context.Context, capturerName string) error {
 	}
 }
 
-func agents(capturerName string) ([]soicat.Camera, error) {
-	agents := []soicat.Camera{}
+// discover returns the cameras this capturer may grab: its own cameras first, then
+// the cameras whose capturer is dead or missing. Their leases decide who actually gets them.
+func discover(capturerName string) ([]soicat.Camera, error) {
+	own := []soicat.Camera{}
+	orphans := []soicat.Camera{}
 
 	cameras, err := soicatSvc.Cameras()
 	if err != nil {
-		return agents, err
+		return own, err
 	}
 
 	capturers, err := capturerSvc.Capturers()
 	if err != nil {
-		return agents, err
+		return own, err
 	}
 
 	for _, camera := range cameras {
-		// If the camera capturer is the same as this capturer, break
 		if camera.Capturer == capturerName {
+			own = append(own, camera)
 			continue
 		}
 
 		// Locate the camera's capturer to see if in the list of alive capturers
+		alive := false
 		for _, capturer := range capturers {
 			if capturer.Name == camera.Capturer {
-				continue
+				alive = true
+				break
 			}
 		}
 
-		// The camera's capturer is dead or missing, grab it
-		camera.Capturer = capturerName
-		agents = append(agents, camera)
+		// The camera's capturer is dead or missing, try to grab it
+		if !alive {
+			orphans = append(orphans, camera)
+		}
+	}
+
+	return append(own, orphans...), nil
+}
+
+// The lease TTL must be longer than the heartbeat so leases are renewed before they expire.
+func leaseDuration() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("CAPTURER_LEASE_SECONDS"))
+	if err != nil || seconds <= 20 {
+		seconds = 60
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// The spool quota caps the disk space of the clips waiting to be uploaded.
+func spoolQuota() int64 {
+	mb, err := strconv.Atoi(os.Getenv("CAPTURER_SPOOL_QUOTA_MB"))
+	if err != nil || mb <= 0 {
+		mb = 2048
+	}
+
+	return int64(mb) * 1024 * 1024
+}
+
+// newReplayServer loads the replay file if the capturer runs in replay mode.
+func newReplayServer() (*replay.Server, error) {
+	file := os.Getenv("CAPTURER_REPLAY_FILE")
+	if file == "" {
+		return nil, nil
+	}
+
+	fps, err := strconv.ParseFloat(os.Getenv("CAPTURER_REPLAY_FPS"), 64)
+	if err != nil || fps <= 0 {
+		fps = 25
+	}
+
+	address := os.Getenv("CAPTURER_REPLAY_ADDRESS")
+	if address == "" {
+		address = ":8554"
+	}
+
+	recording, err := replay.Load(file, fps)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load replay file %s: %v", file, err)
+	}
+
+	return replay.NewServer(address, recording, true), nil
+}
+
+func newLeases(capturerName string) lease.IService {
+	if daprClient != nil {
+		return lease.NewDaprLeases(daprClient, capturerName, leaseDuration())
+	}
+
+	// WARNING: There is no shared store with conditional writes in AWS runtime mode yet
+	fmt.Printf("capturer %s - leases are kept in memory and do not protect cameras from other capturers\n", capturerName)
+	return lease.NewMemoryLeases(capturerName, leaseDuration())
+}
+
+// runningAgents tracks the agents of this capturer. The discovery and heartbeat processors,
+// the control API and the agents themselves access it concurrently.
+type runningAgents struct {
+	mu       sync.Mutex
+	commands map[string]chan string
+	cancels  map[string]context.CancelFunc
+	stats    map[string]*agent.Stats
+}
+
+func newAgents() *runningAgents {
+	return &runningAgents{
+		commands: map[string]chan string{},
+		cancels:  map[string]context.CancelFunc{},
+		stats:    map[string]*agent.Stats{},
+	}
+}
+
+func (a *runningAgents) start(camera string, cancel context.CancelFunc, stats *agent.Stats) chan string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Create a commands channels for agent
+	commands := make(chan string)
+	a.commands[camera] = commands
+	a.cancels[camera] = cancel
+	a.stats[camera] = stats
+	return commands
+}
+
+func (a *runningAgents) stop(camera string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if cancel, ok := a.cancels[camera]; ok {
+		cancel()
 	}
+	delete(a.commands, camera)
+	delete(a.cancels, camera)
+	delete(a.stats, camera)
+}
+
+func (a *runningAgents) cancel(camera string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if cancel, ok := a.cancels[camera]; ok {
+		cancel()
+	}
+}
+
+func (a *runningAgents) running(camera string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, ok := a.cancels[camera]
+	return ok
+}
+
+func (a *runningAgents) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	return agents, err
+	return len(a.cancels)
+}
+
+func (a *runningAgents) Stats() []agent.StatsSnapshot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	snapshots := []agent.StatsSnapshot{}
+	for _, stats := range a.stats {
+		snapshots = append(snapshots, stats.Snapshot())
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Camera < snapshots[j].Camera
+	})
+	return snapshots
+}
+
+func (a *runningAgents) Command(camera, cmd string) error {
+	a.mu.Lock()
+	commands, ok := a.commands[camera]
+	a.mu.Unlock()
+
+	if !ok {
+		return server.ErrAgentNotFound
+	}
+
+	// The agent picks up commands between its other tasks
+	select {
+	case commands <- cmd:
+		return nil
+	case <-time.After(5 * time.Second):
+		return server.ErrAgentBusy
+	}
 }
@@ -0,0 +1,120 @@
+package onvif
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection-shared/service/soicat"
+)
+
+// Camera names are used in folders, keys and URLs
+var cameraNamePattern = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Proposal is a catalogue entry proposed for a discovered camera. The camera records its highest
+// resolution H264/H265 profile. Its lowest resolution profile, if any, is proposed as its sub-stream.
+type Proposal struct {
+	Camera       soicat.Camera `json:"camera"`
+	SubStreamURL string        `json:"subStreamUrl"`
+	Codec        string        `json:"codec"`
+	FrameRate    float64       `json:"frameRate"`
+	Manufacturer string        `json:"manufacturer"`
+	Model        string        `json:"model"`
+	SerialNumber string        `json:"serialNumber"`
+	XAddr        string        `json:"xaddr"`
+	Profiles     []Profile     `json:"profiles"`
+}
+
+// Propose queries a discovered device's profiles and stream URIs and proposes its catalogue entry.
+// The credentials are added to the stream URLs since the capturer passes them to the camera as is.
+func Propose(ctx context.Context, device Device, username, password string, timeout time.Duration) (Proposal, error) {
+	proposal := Proposal{}
+	if len(device.XAddrs) == 0 {
+		return proposal, fmt.Errorf("device %s has no service address", device.Host)
+	}
+
+	client := NewClient(device.XAddrs[0], username, password, timeout)
+	proposal.XAddr = client.XAddr
+
+	info, err := client.DeviceInformation(ctx)
+	if err != nil {
+		// Not all devices allow it...the profiles are what matters
+		fmt.Printf("onvif - %s - unable to get the device information: %v\n", client.XAddr, err)
+	}
+	proposal.Manufacturer = info.Manufacturer
+	proposal.Model = info.Model
+	proposal.SerialNumber = info.SerialNumber
+
+	profiles, err := client.Profiles(ctx)
+	if err != nil {
+		return proposal, err
+	}
+
+	for i := range profiles {
+		profiles[i].StreamURI = withCredentials(profiles[i].StreamURI, username, password)
+	}
+	proposal.Profiles = profiles
+
+	var main, sub *Profile
+	for i, p := range profiles {
+		// The capturer records H264 and H265 over RTSP
+		if p.Encoding != "H264" && p.Encoding != "H265" {
+			continue
+		}
+
+		if main == nil || p.Width*p.Height > main.Width*main.Height {
+			main = &profiles[i]
+		}
+		if sub == nil || p.Width*p.Height < sub.Width*sub.Height {
+			sub = &profiles[i]
+		}
+	}
+
+	if main == nil {
+		return proposal, fmt.Errorf("device %s has no H264 or H265 profile", client.XAddr)
+	}
+
+	if sub != nil && sub.Width*sub.Height < main.Width*main.Height {
+		proposal.SubStreamURL = sub.StreamURI
+	}
+
+	proposal.Codec = main.Encoding
+	proposal.FrameRate = main.FrameRate
+	proposal.Camera = soicat.Camera{
+		ID:            strings.TrimPrefix(device.Endpoint, "urn:uuid:"),
+		Name:          cameraName(device),
+		RtspURL:       main.StreamURI,
+		CaptureWidth:  main.Width,
+		CaptureHeight: main.Height,
+		Location:      device.scope("location"),
+	}
+
+	return proposal, nil
+}
+
+// cameraName is the device name advertised in its scopes or its address.
+func cameraName(device Device) string {
+	name := strings.Trim(cameraNamePattern.ReplaceAllString(device.Name(), "-"), "-")
+	if name == "" {
+		name = fmt.Sprintf("camera-%s", strings.Trim(cameraNamePattern.ReplaceAllString(device.Host, "-"), "-"))
+	}
+
+	return name
+}
+
+func withCredentials(uri, username, password string) string {
+	if username == "" {
+		return uri
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil || u.User != nil {
+		return uri
+	}
+
+	u.User = url.UserPassword(username, password)
+	return u.String()
+}
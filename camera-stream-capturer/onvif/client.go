@@ -0,0 +1,270 @@
+package onvif
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	deviceNamespace = "http://www.onvif.org/ver10/device/wsdl"
+	mediaNamespace  = "http://www.onvif.org/ver10/media/wsdl"
+	schemaNamespace = "http://www.onvif.org/ver10/schema"
+)
+
+// Client calls the device, media and PTZ services of an ONVIF device. Requests are authenticated with a
+// WS-Security username token if a username is set. The digest includes the request time, so the device
+// clock is read first and the requests are sent in device time.
+type Client struct {
+	XAddr      string
+	Username   string
+	Password   string
+	HTTPClient *http.Client
+
+	mediaXAddr string
+	ptzXAddr   string
+	clockSkew  time.Duration
+	clockRead  bool
+}
+
+func NewClient(xaddr, username, password string, timeout time.Duration) *Client {
+	return &Client{
+		XAddr:      xaddr,
+		Username:   username,
+		Password:   password,
+		HTTPClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// DeviceInformation is the device's identity.
+type DeviceInformation struct {
+	Manufacturer    string `xml:"Manufacturer"`
+	Model           string `xml:"Model"`
+	FirmwareVersion string `xml:"FirmwareVersion"`
+	SerialNumber    string `xml:"SerialNumber"`
+	HardwareID      string `xml:"HardwareId"`
+}
+
+// Profile is a media profile: a video encoder configuration that the device streams.
+type Profile struct {
+	Token     string  `json:"token"`
+	Name      string  `json:"name"`
+	Encoding  string  `json:"encoding"` // H264, H265, JPEG or MPEG4
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	FrameRate float64 `json:"frameRate"`
+	StreamURI string  `json:"streamUri"`
+}
+
+// DeviceInformation returns the device's manufacturer, model and serial number.
+func (c *Client) DeviceInformation(ctx context.Context) (DeviceInformation, error) {
+	response := struct {
+		Info DeviceInformation `xml:"Body>GetDeviceInformationResponse"`
+	}{}
+
+	err := c.call(ctx, c.XAddr, fmt.Sprintf(`<GetDeviceInformation xmlns="%s"/>`, deviceNamespace), &response)
+	return response.Info, err
+}
+
+// Profiles returns the device's media profiles with their stream URIs (RTSP over RTP unicast).
+// A profile without a video encoder configuration (i.e. audio only) is skipped.
+func (c *Client) Profiles(ctx context.Context) ([]Profile, error) {
+	mediaXAddr, err := c.media(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	response := struct {
+		Profiles []struct {
+			Token   string `xml:"token,attr"`
+			Name    string `xml:"Name"`
+			Encoder *struct {
+				Encoding  string  `xml:"Encoding"`
+				Width     int     `xml:"Resolution>Width"`
+				Height    int     `xml:"Resolution>Height"`
+				FrameRate float64 `xml:"RateControl>FrameRateLimit"`
+			} `xml:"VideoEncoderConfiguration"`
+		} `xml:"Body>GetProfilesResponse>Profiles"`
+	}{}
+
+	err = c.call(ctx, mediaXAddr, fmt.Sprintf(`<GetProfiles xmlns="%s"/>`, mediaNamespace), &response)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := []Profile{}
+	for _, p := range response.Profiles {
+		if p.Encoder == nil {
+			continue
+		}
+
+		uri, err := c.streamURI(ctx, mediaXAddr, p.Token)
+		if err != nil {
+			fmt.Printf("onvif - %s - unable to get the stream URI of profile %s: %v\n", c.XAddr, p.Name, err)
+			continue
+		}
+
+		profiles = append(profiles, Profile{
+			Token:     p.Token,
+			Name:      p.Name,
+			Encoding:  strings.ToUpper(p.Encoder.Encoding),
+			Width:     p.Encoder.Width,
+			Height:    p.Encoder.Height,
+			FrameRate: p.Encoder.FrameRate,
+			StreamURI: uri,
+		})
+	}
+
+	return profiles, nil
+}
+
+func (c *Client) streamURI(ctx context.Context, mediaXAddr, token string) (string, error) {
+	response := struct {
+		URI string `xml:"Body>GetStreamUriResponse>MediaUri>Uri"`
+	}{}
+
+	body := fmt.Sprintf(`<GetStreamUri xmlns="%s"><StreamSetup><Stream xmlns="%s">RTP-Unicast</Stream><Transport xmlns="%s"><Protocol>RTSP</Protocol></Transport></StreamSetup><ProfileToken>%s</ProfileToken></GetStreamUri>`,
+		mediaNamespace, schemaNamespace, schemaNamespace, escape(token))
+	err := c.call(ctx, mediaXAddr, body, &response)
+	if err != nil {
+		return "", err
+	}
+
+	if response.URI == "" {
+		return "", fmt.Errorf("no stream URI")
+	}
+
+	return strings.TrimSpace(response.URI), nil
+}
+
+// media returns the URL of the device's media service.
+func (c *Client) media(ctx context.Context) (string, error) {
+	if c.mediaXAddr != "" {
+		return c.mediaXAddr, nil
+	}
+
+	response := struct {
+		XAddr string `xml:"Body>GetCapabilitiesResponse>Capabilities>Media>XAddr"`
+	}{}
+
+	err := c.call(ctx, c.XAddr, fmt.Sprintf(`<GetCapabilities xmlns="%s"><Category>Media</Category></GetCapabilities>`, deviceNamespace), &response)
+	if err != nil {
+		return "", err
+	}
+
+	if response.XAddr == "" {
+		return "", fmt.Errorf("device %s has no media service", c.XAddr)
+	}
+
+	c.mediaXAddr = strings.TrimSpace(response.XAddr)
+	return c.mediaXAddr, nil
+}
+
+// readClock measures the skew between the device clock and ours. The request is not authenticated.
+func (c *Client) readClock(ctx context.Context) {
+	c.clockRead = true
+
+	response := struct {
+		Year   int `xml:"Body>GetSystemDateAndTimeResponse>SystemDateAndTime>UTCDateTime>Date>Year"`
+		Month  int `xml:"Body>GetSystemDateAndTimeResponse>SystemDateAndTime>UTCDateTime>Date>Month"`
+		Day    int `xml:"Body>GetSystemDateAndTimeResponse>SystemDateAndTime>UTCDateTime>Date>Day"`
+		Hour   int `xml:"Body>GetSystemDateAndTimeResponse>SystemDateAndTime>UTCDateTime>Time>Hour"`
+		Minute int `xml:"Body>GetSystemDateAndTimeResponse>SystemDateAndTime>UTCDateTime>Time>Minute"`
+		Second int `xml:"Body>GetSystemDateAndTimeResponse>SystemDateAndTime>UTCDateTime>Time>Second"`
+	}{}
+
+	err := c.post(ctx, c.XAddr, envelope("", fmt.Sprintf(`<GetSystemDateAndTime xmlns="%s"/>`, deviceNamespace)), &response)
+	if err != nil || response.Year == 0 {
+		fmt.Printf("onvif - %s - unable to read the device clock...assuming it is on time: %v\n", c.XAddr, err)
+		return
+	}
+
+	deviceTime := time.Date(response.Year, time.Month(response.Month), response.Day, response.Hour, response.Minute, response.Second, 0, time.UTC)
+	c.clockSkew = time.Until(deviceTime)
+}
+
+func (c *Client) call(ctx context.Context, xaddr, body string, out interface{}) error {
+	header := ""
+	if c.Username != "" {
+		if !c.clockRead {
+			c.readClock(ctx)
+		}
+		header = c.securityHeader(time.Now().Add(c.clockSkew))
+	}
+
+	return c.post(ctx, xaddr, envelope(header, body), out)
+}
+
+func (c *Client) post(ctx context.Context, xaddr, payload string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", xaddr, bytes.NewBufferString(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml; charset=utf-8")
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	// SOAP faults come back with an error status
+	fault := struct {
+		Code   string `xml:"Body>Fault>Code>Subcode>Value"`
+		Reason string `xml:"Body>Fault>Reason>Text"`
+	}{}
+	if xml.Unmarshal(b, &fault) == nil && (fault.Reason != "" || fault.Code != "") {
+		return fmt.Errorf("%s fault: %s %s", xaddr, strings.TrimSpace(fault.Code), strings.TrimSpace(fault.Reason))
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", xaddr, res.Status)
+	}
+
+	return xml.Unmarshal(b, out)
+}
+
+// securityHeader is a WS-Security username token with a password digest:
+// Base64(SHA-1(nonce + created + password)).
+func (c *Client) securityHeader(now time.Time) string {
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	created := now.UTC().Format("2006-01-02T15:04:05.000Z")
+
+	h := sha1.New()
+	h.Write(nonce)
+	h.Write([]byte(created))
+	h.Write([]byte(c.Password))
+	digest := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	return fmt.Sprintf(`<Security s:mustUnderstand="1" xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">`+
+		`<UsernameToken><Username>%s</Username>`+
+		`<Password Type="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordDigest">%s</Password>`+
+		`<Nonce EncodingType="http://docs.oasis-open.org/wss/2004/01/oasis-200401-soap-message-security-1.0#Base64Binary">%s</Nonce>`+
+		`<Created xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd">%s</Created>`+
+		`</UsernameToken></Security>`,
+		escape(c.Username), digest, base64.StdEncoding.EncodeToString(nonce), created)
+}
+
+func envelope(header, body string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?><s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Header>%s</s:Header><s:Body>%s</s:Body></s:Envelope>`, header, body)
+}
+
+func escape(s string) string {
+	b := bytes.Buffer{}
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
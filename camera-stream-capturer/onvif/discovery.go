@@ -0,0 +1,184 @@
+package onvif
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WS-Discovery multicast group and port
+const wsDiscoveryAddress = "239.255.255.250:3702"
+
+// Probe for ONVIF video devices only (i.e. cameras and encoders, not NVRs or access controllers)
+const probeTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<e:Envelope xmlns:e="http://www.w3.org/2003/05/soap-envelope" xmlns:w="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:dn="http://www.onvif.org/ver10/network/wsdl">
+<e:Header>
+<w:MessageID>uuid:%s</w:MessageID>
+<w:To e:mustUnderstand="true">urn:schemas-xmlsoap-org:ws:2005:04:discovery</w:To>
+<w:Action e:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</w:Action>
+</e:Header>
+<e:Body>
+<d:Probe><d:Types>dn:NetworkVideoTransmitter</d:Types></d:Probe>
+</e:Body>
+</e:Envelope>`
+
+// Device is an ONVIF device that answered a WS-Discovery probe.
+type Device struct {
+	Endpoint string   // the device's endpoint reference (i.e. `urn:uuid:...`)
+	XAddrs   []string // the device service URLs
+	Scopes   []string
+	Host     string // the address the answer came from
+}
+
+type probeMatches struct {
+	Matches []struct {
+		Endpoint string `xml:"EndpointReference>Address"`
+		Scopes   string `xml:"Scopes"`
+		XAddrs   string `xml:"XAddrs"`
+	} `xml:"Body>ProbeMatches>ProbeMatch"`
+}
+
+// Probe sends a WS-Discovery probe to the multicast group, which only reaches the local network segment,
+// and to port 3702 of every target host so devices on routed subnets are found too. It collects the
+// answers until the timeout. A device answering several times is listed once.
+func Probe(ctx context.Context, targets []string, timeout time.Duration) ([]Device, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	probe := []byte(fmt.Sprintf(probeTemplate, uuid.New().String()))
+	addresses := append([]string{wsDiscoveryAddress}, targets...)
+	for _, address := range addresses {
+		if !strings.Contains(address, ":") {
+			address = net.JoinHostPort(address, "3702")
+		}
+
+		addr, err := net.ResolveUDPAddr("udp4", address)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = conn.WriteToUDP(probe, addr)
+		if err != nil {
+			fmt.Printf("onvif - unable to probe %s: %v\n", address, err)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	err = conn.SetReadDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := []Device{}
+	seen := map[string]bool{}
+	buf := make([]byte, 64*1024)
+	for ctx.Err() == nil {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return devices, err
+		}
+
+		matches := probeMatches{}
+		err = xml.Unmarshal(buf[:n], &matches)
+		if err != nil {
+			fmt.Printf("onvif - ignoring an invalid answer from %s: %v\n", from, err)
+			continue
+		}
+
+		for _, match := range matches.Matches {
+			key := match.Endpoint
+			if key == "" {
+				key = match.XAddrs
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			devices = append(devices, Device{
+				Endpoint: match.Endpoint,
+				XAddrs:   strings.Fields(match.XAddrs),
+				Scopes:   strings.Fields(match.Scopes),
+				Host:     from.IP.String(),
+			})
+		}
+	}
+
+	return devices, nil
+}
+
+// Hosts lists the host addresses of an IPv4 subnet (i.e. `192.168.1.0/24`) without its network
+// and broadcast addresses. Subnets larger than a /16 are refused.
+func Hosts(cidr string) ([]string, error) {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("subnet %s is not IPv4", cidr)
+	}
+
+	ones, bits := network.Mask.Size()
+	if bits-ones > 16 {
+		return nil, fmt.Errorf("subnet %s is too large", cidr)
+	}
+
+	hosts := []string{}
+	first := network.IP.To4()
+	size := 1 << (bits - ones)
+	for i := 0; i < size; i++ {
+		// Single host and point-to-point subnets have no network and broadcast addresses
+		if size > 2 && (i == 0 || i == size-1) {
+			continue
+		}
+
+		n := uint32(first[0])<<24 | uint32(first[1])<<16 | uint32(first[2])<<8 | uint32(first[3])
+		n += uint32(i)
+		hosts = append(hosts, net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).String())
+	}
+
+	return hosts, nil
+}
+
+// Name returns the device name advertised in its scopes (i.e. `onvif://www.onvif.org/name/Lobby`) if any.
+func (d Device) Name() string {
+	return d.scope("name")
+}
+
+// Hardware returns the device hardware advertised in its scopes (i.e. `onvif://www.onvif.org/hardware/P3245`) if any.
+func (d Device) Hardware() string {
+	return d.scope("hardware")
+}
+
+func (d Device) scope(name string) string {
+	prefix := fmt.Sprintf("onvif://www.onvif.org/%s/", name)
+	for _, scope := range d.Scopes {
+		if strings.HasPrefix(scope, prefix) {
+			value, err := url.PathUnescape(strings.TrimPrefix(scope, prefix))
+			if err != nil {
+				return strings.TrimPrefix(scope, prefix)
+			}
+			return value
+		}
+	}
+
+	return ""
+}
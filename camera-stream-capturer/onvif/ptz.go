@@ -0,0 +1,108 @@
+package onvif
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const ptzNamespace = "http://www.onvif.org/ver20/ptz/wsdl"
+
+// Preset is a PTZ position saved in the camera.
+type Preset struct {
+	Token string `json:"token"`
+	Name  string `json:"name"`
+}
+
+// PTZProfile returns the token of the first media profile with a PTZ configuration.
+func (c *Client) PTZProfile(ctx context.Context) (string, error) {
+	mediaXAddr, err := c.media(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	response := struct {
+		Profiles []struct {
+			Token string    `xml:"token,attr"`
+			PTZ   *struct{} `xml:"PTZConfiguration"`
+		} `xml:"Body>GetProfilesResponse>Profiles"`
+	}{}
+
+	err = c.call(ctx, mediaXAddr, fmt.Sprintf(`<GetProfiles xmlns="%s"/>`, mediaNamespace), &response)
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range response.Profiles {
+		if p.PTZ != nil {
+			return p.Token, nil
+		}
+	}
+
+	return "", fmt.Errorf("device %s has no PTZ profile", c.XAddr)
+}
+
+// Presets returns the presets of a PTZ profile.
+func (c *Client) Presets(ctx context.Context, profile string) ([]Preset, error) {
+	ptzXAddr, err := c.ptz(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	response := struct {
+		Presets []struct {
+			Token string `xml:"token,attr"`
+			Name  string `xml:"Name"`
+		} `xml:"Body>GetPresetsResponse>Preset"`
+	}{}
+
+	err = c.call(ctx, ptzXAddr, fmt.Sprintf(`<GetPresets xmlns="%s"><ProfileToken>%s</ProfileToken></GetPresets>`, ptzNamespace, escape(profile)), &response)
+	if err != nil {
+		return nil, err
+	}
+
+	presets := []Preset{}
+	for _, p := range response.Presets {
+		presets = append(presets, Preset{
+			Token: p.Token,
+			Name:  strings.TrimSpace(p.Name),
+		})
+	}
+
+	return presets, nil
+}
+
+// GotoPreset moves the camera to a preset at its default speed. It returns once the move is requested,
+// not when the camera gets there.
+func (c *Client) GotoPreset(ctx context.Context, profile, preset string) error {
+	ptzXAddr, err := c.ptz(ctx)
+	if err != nil {
+		return err
+	}
+
+	response := struct{}{}
+	return c.call(ctx, ptzXAddr, fmt.Sprintf(`<GotoPreset xmlns="%s"><ProfileToken>%s</ProfileToken><PresetToken>%s</PresetToken></GotoPreset>`, ptzNamespace, escape(profile), escape(preset)), &response)
+}
+
+// ptz returns the URL of the device's PTZ service.
+func (c *Client) ptz(ctx context.Context) (string, error) {
+	if c.ptzXAddr != "" {
+		return c.ptzXAddr, nil
+	}
+
+	response := struct {
+		XAddr string `xml:"Body>GetCapabilitiesResponse>Capabilities>PTZ>XAddr"`
+	}{}
+
+	err := c.call(ctx, c.XAddr, fmt.Sprintf(`<GetCapabilities xmlns="%s"><Category>PTZ</Category></GetCapabilities>`, deviceNamespace), &response)
+	if err != nil {
+		return "", err
+	}
+
+	if response.XAddr == "" {
+		return "", fmt.Errorf("device %s has no PTZ service", c.XAddr)
+	}
+
+	c.ptzXAddr = strings.TrimSpace(response.XAddr)
+	return c.ptzXAddr, nil
+}
@@ -0,0 +1,183 @@
+package preview
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	thumbnailExt = ".jpg"
+	spriteSuffix = "_sprite.jpg"
+
+	spriteTileWidth = 160
+	spriteColumns   = 5
+	spriteMaxTiles  = 50
+	jpegQuality     = 80
+)
+
+// ThumbnailFile returns the thumbnail file of a clip: `<clip file without extension>.jpg`.
+func ThumbnailFile(clipFile string) string {
+	return strings.TrimSuffix(clipFile, filepath.Ext(clipFile)) + thumbnailExt
+}
+
+// SpriteFile returns the sprite sheet file of a clip: `<clip file without extension>_sprite.jpg`.
+func SpriteFile(clipFile string) string {
+	return strings.TrimSuffix(clipFile, filepath.Ext(clipFile)) + spriteSuffix
+}
+
+// Files returns the preview files of a clip that exist on disk.
+func Files(clipFile string) []string {
+	files := []string{}
+	for _, file := range []string{ThumbnailFile(clipFile), SpriteFile(clipFile)} {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// Builder collects the key frames of a clip while it is recorded: the first one is the clip's thumbnail
+// and, if a sprite interval is set, every Nth one is a tile of the clip's sprite sheet.
+type Builder struct {
+	ThumbnailWidth int
+	SpriteInterval int // every Nth key frame, 0 means no sprite sheet
+
+	keyFrames int
+	thumbnail image.Image
+	tiles     []image.Image
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		ThumbnailWidth: thumbnailWidth(),
+		SpriteInterval: spriteInterval(),
+	}
+}
+
+// Wants counts a key frame and returns whether it must be decoded and added.
+func (b *Builder) Wants() bool {
+	n := b.keyFrames
+	b.keyFrames++
+
+	if n == 0 {
+		return true
+	}
+
+	return b.SpriteInterval > 0 && n%b.SpriteInterval == 0 && len(b.tiles) < spriteMaxTiles
+}
+
+// Add scales a decoded key frame down. Frames are added in the order they are decoded.
+func (b *Builder) Add(img image.Image) {
+	if img == nil || img.Bounds().Empty() {
+		return
+	}
+
+	if b.thumbnail == nil {
+		b.thumbnail = scale(img, b.ThumbnailWidth)
+	}
+
+	if b.SpriteInterval > 0 && len(b.tiles) < spriteMaxTiles {
+		b.tiles = append(b.tiles, scale(img, spriteTileWidth))
+	}
+}
+
+// Save writes the thumbnail and the sprite sheet next to the clip. Nothing is written if no key frame was decoded.
+func (b *Builder) Save(clipFile string) error {
+	if b.thumbnail == nil {
+		return fmt.Errorf("no key frame decoded for %s", clipFile)
+	}
+
+	err := writeJPEG(ThumbnailFile(clipFile), b.thumbnail)
+	if err != nil {
+		return err
+	}
+
+	if len(b.tiles) == 0 {
+		return nil
+	}
+
+	return writeJPEG(SpriteFile(clipFile), b.sheet())
+}
+
+// sheet lays the tiles out left to right, top to bottom.
+func (b *Builder) sheet() image.Image {
+	tile := b.tiles[0].Bounds()
+	columns := spriteColumns
+	if len(b.tiles) < columns {
+		columns = len(b.tiles)
+	}
+	rows := (len(b.tiles) + columns - 1) / columns
+
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*tile.Dx(), rows*tile.Dy()))
+	for i, t := range b.tiles {
+		at := image.Pt((i%columns)*tile.Dx(), (i/columns)*tile.Dy())
+		draw.Draw(sheet, image.Rectangle{Min: at, Max: at.Add(tile.Size())}, t, t.Bounds().Min, draw.Src)
+	}
+
+	return sheet
+}
+
+// scale resizes an image to a width keeping its aspect ratio (nearest neighbour is good enough for previews).
+// The scaled image is a copy so the source can be reused by the decoder.
+func scale(img image.Image, width int) image.Image {
+	src := img.Bounds()
+	if width <= 0 || width > src.Dx() {
+		width = src.Dx()
+	}
+	height := src.Dy() * width / src.Dx()
+	if height == 0 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy := src.Min.Y + y*src.Dy()/height
+		for x := 0; x < width; x++ {
+			sx := src.Min.X + x*src.Dx()/width
+			dst.Set(x, y, img.At(sx, sy))
+		}
+	}
+
+	return dst
+}
+
+// writeJPEG writes to a temporary file first so a crash never leaves a partial preview.
+func writeJPEG(file string, img image.Image) error {
+	f, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	err = jpeg.Encode(f, img, &jpeg.Options{Quality: jpegQuality})
+	f.Close()
+	if err != nil {
+		os.Remove(file + ".tmp")
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+func thumbnailWidth() int {
+	width, err := strconv.Atoi(os.Getenv("CAPTURER_THUMBNAIL_WIDTH"))
+	if err != nil || width <= 0 {
+		width = 320
+	}
+
+	return width
+}
+
+func spriteInterval() int {
+	interval, err := strconv.Atoi(os.Getenv("CAPTURER_SPRITE_INTERVAL"))
+	if err != nil || interval < 0 {
+		interval = 0
+	}
+
+	return interval
+}
@@ -0,0 +1,326 @@
+package recovery
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrUnrecoverable = errors.New("recording cannot be recovered")
+
+// Recording describes a recording once it is finalised.
+type Recording struct {
+	Fragmented bool
+	Fragments  int
+	Frames     int   // video samples
+	Truncated  int64 // bytes cut after the last complete fragment
+}
+
+type box struct {
+	typ    string
+	offset int64
+	size   int64
+}
+
+func (b box) end() int64 {
+	return b.offset + b.size
+}
+
+// Finalize makes a recording left behind by a process that died mid-clip playable.
+// A fragmented MP4 (ftyp, moov, then a moof/mdat pair per GOP) is cut after its last complete fragment.
+// A plain MP4 is only complete once its trailer (moov) is written: without it, there is no sample index
+// and the recording cannot be recovered.
+func Finalize(file string) (Recording, error) {
+	recording := Recording{}
+
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return recording, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return recording, err
+	}
+
+	boxes, err := readBoxes(f, 0, info.Size())
+	if err != nil {
+		return recording, err
+	}
+
+	var moov *box
+	for i := range boxes {
+		if boxes[i].typ == "moov" {
+			moov = &boxes[i]
+			break
+		}
+	}
+
+	if moov == nil {
+		return recording, fmt.Errorf("%w: no moov box", ErrUnrecoverable)
+	}
+
+	videoTrack, fragmented, frames, err := readMoov(f, *moov)
+	if err != nil {
+		return recording, err
+	}
+
+	// A plain MP4 with its moov is complete
+	if !fragmented {
+		recording.Frames = frames
+		return recording, nil
+	}
+
+	// Keep the fragments whose moof and mdat are both complete
+	recording.Fragmented = true
+	end := moov.end()
+	for i := 0; i < len(boxes); i++ {
+		if boxes[i].typ != "moof" {
+			continue
+		}
+
+		if i+1 >= len(boxes) || boxes[i+1].typ != "mdat" {
+			break
+		}
+
+		samples, err := readMoof(f, boxes[i], videoTrack)
+		if err != nil {
+			return recording, err
+		}
+
+		recording.Fragments++
+		recording.Frames += samples
+		end = boxes[i+1].end()
+		i++
+	}
+
+	if recording.Fragments == 0 {
+		return recording, fmt.Errorf("%w: no complete fragment", ErrUnrecoverable)
+	}
+
+	// The random access index (mfra) is optional...it is kept only if it is complete
+	for _, b := range boxes {
+		if b.typ == "mfra" && b.offset == end {
+			end = b.end()
+		}
+	}
+
+	if end < info.Size() {
+		recording.Truncated = info.Size() - end
+		err = f.Truncate(end)
+		if err != nil {
+			return recording, err
+		}
+	}
+
+	return recording, f.Sync()
+}
+
+// readBoxes returns the complete boxes between two offsets. It stops at the first box that is cut short.
+func readBoxes(r io.ReaderAt, offset, end int64) ([]box, error) {
+	boxes := []box{}
+	header := make([]byte, 16)
+	for offset+8 <= end {
+		_, err := r.ReadAt(header[:8], offset)
+		if err != nil {
+			return nil, err
+		}
+
+		b := box{
+			typ:    string(header[4:8]),
+			offset: offset,
+			size:   int64(binary.BigEndian.Uint32(header[0:4])),
+		}
+
+		switch b.size {
+		case 0:
+			// The box extends to the end...its size was never written
+			b.size = end - offset
+		case 1:
+			if offset+16 > end {
+				return boxes, nil
+			}
+			_, err := r.ReadAt(header[8:16], offset+8)
+			if err != nil {
+				return nil, err
+			}
+			b.size = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+
+		if b.size < 8 || b.end() > end {
+			return boxes, nil
+		}
+
+		boxes = append(boxes, b)
+		offset = b.end()
+	}
+
+	return boxes, nil
+}
+
+// children returns the boxes inside a container box.
+func children(r io.ReaderAt, parent box) ([]box, error) {
+	return readBoxes(r, parent.offset+8, parent.end())
+}
+
+func child(r io.ReaderAt, parent box, typ string) (box, bool, error) {
+	boxes, err := children(r, parent)
+	if err != nil {
+		return box{}, false, err
+	}
+
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true, nil
+		}
+	}
+
+	return box{}, false, nil
+}
+
+// path returns the box at the end of a path of nested container boxes.
+func path(r io.ReaderAt, parent box, types ...string) (box, bool, error) {
+	b := parent
+	for _, typ := range types {
+		var ok bool
+		var err error
+		b, ok, err = child(r, b, typ)
+		if err != nil || !ok {
+			return b, ok, err
+		}
+	}
+
+	return b, true, nil
+}
+
+// field reads a 32-bit field of a full box at an offset from the end of the box's version and flags.
+func field(r io.ReaderAt, b box, offset int64) (uint32, error) {
+	buf := make([]byte, 4)
+	if b.offset+12+offset+4 > b.end() {
+		return 0, fmt.Errorf("%s box is too short", b.typ)
+	}
+
+	_, err := r.ReadAt(buf, b.offset+12+offset)
+	return binary.BigEndian.Uint32(buf), err
+}
+
+// readMoov returns the video track id, whether the recording is fragmented (mvex) and,
+// if it is not, the number of video samples.
+func readMoov(r io.ReaderAt, moov box) (uint32, bool, int, error) {
+	boxes, err := children(r, moov)
+	if err != nil {
+		return 0, false, 0, err
+	}
+
+	videoTrack := uint32(0)
+	fragmented := false
+	frames := 0
+	for _, b := range boxes {
+		if b.typ == "mvex" {
+			fragmented = true
+			continue
+		}
+
+		if b.typ != "trak" {
+			continue
+		}
+
+		hdlr, ok, err := path(r, b, "mdia", "hdlr")
+		if err != nil {
+			return 0, false, 0, err
+		}
+		if !ok {
+			continue
+		}
+
+		// pre_defined then handler_type
+		handler, err := field(r, hdlr, 4)
+		if err != nil {
+			return 0, false, 0, err
+		}
+		if handler != binary.BigEndian.Uint32([]byte("vide")) {
+			continue
+		}
+
+		tkhd, ok, err := child(r, b, "tkhd")
+		if err != nil {
+			return 0, false, 0, err
+		}
+		if !ok {
+			continue
+		}
+
+		// creation and modification times are 64-bit in version 1
+		version := make([]byte, 1)
+		_, err = r.ReadAt(version, tkhd.offset+8)
+		if err != nil {
+			return 0, false, 0, err
+		}
+		offset := int64(8)
+		if version[0] == 1 {
+			offset = 16
+		}
+		videoTrack, err = field(r, tkhd, offset)
+		if err != nil {
+			return 0, false, 0, err
+		}
+
+		// sample_size then sample_count
+		stsz, ok, err := path(r, b, "mdia", "minf", "stbl", "stsz")
+		if err != nil {
+			return 0, false, 0, err
+		}
+		if ok {
+			count, err := field(r, stsz, 4)
+			if err != nil {
+				return 0, false, 0, err
+			}
+			frames = int(count)
+		}
+	}
+
+	return videoTrack, fragmented, frames, nil
+}
+
+// readMoof returns the number of samples of a track in a fragment.
+func readMoof(r io.ReaderAt, moof box, track uint32) (int, error) {
+	trafs, err := children(r, moof)
+	if err != nil {
+		return 0, err
+	}
+
+	samples := 0
+	for _, traf := range trafs {
+		if traf.typ != "traf" {
+			continue
+		}
+
+		boxes, err := children(r, traf)
+		if err != nil {
+			return 0, err
+		}
+
+		id := uint32(0)
+		for _, b := range boxes {
+			switch b.typ {
+			case "tfhd":
+				id, err = field(r, b, 0)
+			case "trun":
+				if id != track {
+					continue
+				}
+				var count uint32
+				count, err = field(r, b, 0)
+				samples += int(count)
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return samples, nil
+}
@@ -0,0 +1,161 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"github.com/yapingcat/gomedia/go-mp4"
+)
+
+// ClipReport describes the video track of a recorded clip.
+type ClipReport struct {
+	Path             string
+	Codec            string
+	Frames           int
+	KeyFrames        int
+	StartsOnKeyFrame bool
+	Duration         time.Duration
+}
+
+// Expectations are the assertions made on recorded clips.
+type Expectations struct {
+	MinClips    int
+	MinFrames   int
+	MinDuration time.Duration
+	MaxDuration time.Duration
+}
+
+// Inspect demuxes a recorded clip and reports its frames, key frames and duration.
+func Inspect(path string) (ClipReport, error) {
+	report := ClipReport{
+		Path: path,
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return report, err
+	}
+	defer f.Close()
+
+	demuxer := mp4.CreateMp4Demuxer(f)
+	tracks, err := demuxer.ReadHead()
+	if err != nil {
+		return report, fmt.Errorf("unable to read the mp4 header: %v", err)
+	}
+
+	videoTrack := 0
+	for _, track := range tracks {
+		if track.Cid == mp4.MP4_CODEC_H264 {
+			report.Codec = "H264"
+		} else if track.Cid == mp4.MP4_CODEC_H265 {
+			report.Codec = "H265"
+		} else {
+			continue
+		}
+		videoTrack = track.TrackId
+		break
+	}
+
+	if report.Codec == "" {
+		return report, fmt.Errorf("no H264 or H265 video track found")
+	}
+
+	first := uint64(0)
+	last := uint64(0)
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+
+		if pkt.TrackId != videoTrack {
+			continue
+		}
+
+		au, err := h264.AnnexBUnmarshal(pkt.Data)
+		if err != nil {
+			return report, fmt.Errorf("unable to split frame at %dms: %v", pkt.Pts, err)
+		}
+
+		keyFrame := false
+		if report.Codec == "H264" {
+			keyFrame = h264.IDRPresent(au)
+		} else {
+			keyFrame = h265.IsRandomAccess(au)
+		}
+
+		if report.Frames == 0 {
+			report.StartsOnKeyFrame = keyFrame
+			first = pkt.Pts
+		}
+
+		if keyFrame {
+			report.KeyFrames++
+		}
+
+		report.Frames++
+		last = pkt.Pts
+	}
+
+	report.Duration = time.Duration(last-first) * time.Millisecond
+	return report, nil
+}
+
+// Check inspects the clips of a folder (oldest first) and returns the failed assertions.
+// Every clip must start on a key frame so it plays on its own and nothing is lost between clips.
+// The last clip can be shorter than the minimum duration: it was cut short when recording stopped.
+func Check(folder string, expect Expectations) ([]ClipReport, []error) {
+	reports := []ClipReport{}
+	failures := []error{}
+
+	paths, err := filepath.Glob(filepath.Join(folder, "*.mp4"))
+	if err != nil {
+		return reports, []error{err}
+	}
+	sort.Strings(paths)
+
+	for i, path := range paths {
+		report, err := Inspect(path)
+		reports = append(reports, report)
+		if err != nil {
+			failures = append(failures, fmt.Errorf("%s: %v", path, err))
+			continue
+		}
+
+		if report.Frames == 0 {
+			failures = append(failures, fmt.Errorf("%s: no video frames", path))
+			continue
+		}
+
+		if !report.StartsOnKeyFrame {
+			failures = append(failures, fmt.Errorf("%s: does not start on a key frame", path))
+		}
+
+		if expect.MinFrames > 0 && report.Frames < expect.MinFrames {
+			failures = append(failures, fmt.Errorf("%s: %d frames, expected at least %d", path, report.Frames, expect.MinFrames))
+		}
+
+		if expect.MinDuration > 0 && report.Duration < expect.MinDuration && i < len(paths)-1 {
+			failures = append(failures, fmt.Errorf("%s: %s long, expected at least %s", path, report.Duration, expect.MinDuration))
+		}
+
+		if expect.MaxDuration > 0 && report.Duration > expect.MaxDuration {
+			failures = append(failures, fmt.Errorf("%s: %s long, expected at most %s", path, report.Duration, expect.MaxDuration))
+		}
+	}
+
+	if len(paths) < expect.MinClips {
+		failures = append(failures, fmt.Errorf("%s: %d clips, expected at least %d", folder, len(paths), expect.MinClips))
+	}
+
+	return reports, failures
+}
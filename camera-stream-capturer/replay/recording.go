@@ -0,0 +1,408 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"github.com/yapingcat/gomedia/go-mp4"
+)
+
+// Frame is a video access unit of a recording.
+type Frame struct {
+	AU         [][]byte
+	PTS        time.Duration
+	IsKeyFrame bool
+}
+
+// Recording is a video file loaded in memory so it can be replayed over and over.
+type Recording struct {
+	Codec     string // H264 or H265
+	VPS       []byte
+	SPS       []byte
+	PPS       []byte
+	Frames    []Frame
+	Duration  time.Duration
+	KeyFrames int
+}
+
+// Load reads the video track of an MP4 file or a raw Annex-B H264/H265 file (`.h264`, `.264`, `.h265`, `.265`).
+// Raw files carry no timing, so their frames are timed at the given frame rate.
+func Load(path string, frameRate float64) (*Recording, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".mp4", ".m4v", ".mov":
+		return loadMP4(path)
+	case ".h264", ".264":
+		return loadAnnexB(path, "H264", frameRate)
+	case ".h265", ".265", ".hevc":
+		return loadAnnexB(path, "H265", frameRate)
+	}
+
+	return nil, fmt.Errorf("unsupported replay file %s: only MP4 and raw H264/H265 files are supported", path)
+}
+
+func loadMP4(path string) (*Recording, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	demuxer := mp4.CreateMp4Demuxer(bytes.NewReader(b))
+	tracks, err := demuxer.ReadHead()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the mp4 header: %v", err)
+	}
+
+	var recording *Recording
+	videoTrack := 0
+	for _, track := range tracks {
+		if track.Cid == mp4.MP4_CODEC_H264 {
+			recording = &Recording{Codec: "H264"}
+		} else if track.Cid == mp4.MP4_CODEC_H265 {
+			recording = &Recording{Codec: "H265"}
+		} else {
+			continue
+		}
+		videoTrack = track.TrackId
+		break
+	}
+
+	if recording == nil {
+		return nil, fmt.Errorf("no H264 or H265 video track found in %s", path)
+	}
+
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if pkt.TrackId != videoTrack {
+			continue
+		}
+
+		au, err := h264.AnnexBUnmarshal(pkt.Data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to split frame at %dms: %v", pkt.Pts, err)
+		}
+
+		recording.add(au, time.Duration(pkt.Pts)*time.Millisecond)
+	}
+
+	// The demuxer does not add the parameter sets of the sample description to frames that carry some of their own
+	vps, sps, pps := sampleParameterSets(b)
+	if recording.VPS == nil {
+		recording.VPS = vps
+	}
+	if recording.SPS == nil {
+		recording.SPS = sps
+	}
+	if recording.PPS == nil {
+		recording.PPS = pps
+	}
+
+	return recording, recording.finalize(0)
+}
+
+// sampleParameterSets walks the MP4 boxes down to the video sample description (avcC or hvcC) and returns its parameter sets.
+func sampleParameterSets(b []byte) ([]byte, []byte, []byte) {
+	var vps, sps, pps []byte
+	var walk func(b []byte)
+	walk = func(b []byte) {
+		for len(b) >= 8 {
+			size := int(binary.BigEndian.Uint32(b))
+			if size < 8 || size > len(b) {
+				return
+			}
+			typ := string(b[4:8])
+			payload := b[8:size]
+			b = b[size:]
+
+			switch typ {
+			case "moov", "trak", "mdia", "minf", "stbl":
+				walk(payload)
+			case "stsd":
+				// Full box header and entry count
+				if len(payload) > 8 {
+					walk(payload[8:])
+				}
+			case "avc1", "avc3", "hvc1", "hev1":
+				// Visual sample entry fields
+				if len(payload) > 78 {
+					walk(payload[78:])
+				}
+			case "avcC":
+				sps, pps = avcCParameterSets(payload)
+			case "hvcC":
+				vps, sps, pps = hvcCParameterSets(payload)
+			}
+		}
+	}
+	walk(b)
+
+	return vps, sps, pps
+}
+
+func avcCParameterSets(b []byte) ([]byte, []byte) {
+	var sps, pps []byte
+	if len(b) < 6 {
+		return sps, pps
+	}
+
+	pos := 5
+	for _, kind := range []string{"sps", "pps"} {
+		if pos >= len(b) {
+			break
+		}
+
+		count := int(b[pos])
+		if kind == "sps" {
+			count &= 0x1F
+		}
+		pos++
+
+		for i := 0; i < count && pos+2 <= len(b); i++ {
+			size := int(binary.BigEndian.Uint16(b[pos:]))
+			pos += 2
+			if pos+size > len(b) {
+				return sps, pps
+			}
+
+			if kind == "sps" && sps == nil {
+				sps = b[pos : pos+size]
+			} else if kind == "pps" && pps == nil {
+				pps = b[pos : pos+size]
+			}
+			pos += size
+		}
+	}
+
+	return sps, pps
+}
+
+func hvcCParameterSets(b []byte) ([]byte, []byte, []byte) {
+	var vps, sps, pps []byte
+	if len(b) < 23 {
+		return vps, sps, pps
+	}
+
+	arrays := int(b[22])
+	pos := 23
+	for i := 0; i < arrays && pos+3 <= len(b); i++ {
+		typ := h265.NALUType(b[pos] & 0x3F)
+		count := int(binary.BigEndian.Uint16(b[pos+1:]))
+		pos += 3
+
+		for j := 0; j < count && pos+2 <= len(b); j++ {
+			size := int(binary.BigEndian.Uint16(b[pos:]))
+			pos += 2
+			if pos+size > len(b) {
+				return vps, sps, pps
+			}
+
+			nalu := b[pos : pos+size]
+			switch {
+			case typ == h265.NALUType_VPS_NUT && vps == nil:
+				vps = nalu
+			case typ == h265.NALUType_SPS_NUT && sps == nil:
+				sps = nalu
+			case typ == h265.NALUType_PPS_NUT && pps == nil:
+				pps = nalu
+			}
+			pos += size
+		}
+	}
+
+	return vps, sps, pps
+}
+
+func loadAnnexB(path string, codec string, frameRate float64) (*Recording, error) {
+	if frameRate <= 0 {
+		frameRate = 25
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	nalus, err := h264.AnnexBUnmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+
+	recording := &Recording{Codec: codec}
+	interval := time.Duration(float64(time.Second) / frameRate)
+
+	// A new access unit starts with an AUD or parameter sets after a slice, or with the first slice of a picture
+	au := [][]byte{}
+	slices := false
+	for _, nalu := range nalus {
+		if len(nalu) < 3 {
+			continue
+		}
+
+		starts, isSlice := accessUnitBoundary(codec, nalu)
+		if slices && (starts || (isSlice && firstSliceInPicture(codec, nalu))) {
+			recording.add(au, time.Duration(len(recording.Frames))*interval)
+			au = [][]byte{}
+			slices = false
+		}
+
+		au = append(au, nalu)
+		if isSlice {
+			slices = true
+		}
+	}
+
+	if slices {
+		recording.add(au, time.Duration(len(recording.Frames))*interval)
+	}
+
+	return recording, recording.finalize(interval)
+}
+
+// accessUnitBoundary returns whether the NALU can only start an access unit and whether it is a slice.
+func accessUnitBoundary(codec string, nalu []byte) (bool, bool) {
+	if codec == "H264" {
+		typ := h264.NALUType(nalu[0] & 0x1F)
+		switch typ {
+		case h264.NALUTypeAccessUnitDelimiter, h264.NALUTypeSPS, h264.NALUTypePPS, h264.NALUTypeSEI:
+			return true, false
+		case h264.NALUTypeNonIDR, h264.NALUTypeIDR:
+			return false, true
+		}
+		return false, false
+	}
+
+	typ := h265.NALUType((nalu[0] >> 1) & 0x3F)
+	switch {
+	case typ == h265.NALUType_AUD_NUT, typ == h265.NALUType_VPS_NUT, typ == h265.NALUType_SPS_NUT,
+		typ == h265.NALUType_PPS_NUT, typ == h265.NALUType_PREFIX_SEI_NUT:
+		return true, false
+	case typ < 32:
+		return false, true
+	}
+	return false, false
+}
+
+// The first slice of a picture has first_mb_in_slice = 0 (H264) or first_slice_segment_in_pic_flag = 1 (H265).
+func firstSliceInPicture(codec string, nalu []byte) bool {
+	if codec == "H264" {
+		return nalu[1]&0x80 != 0
+	}
+	return nalu[2]&0x80 != 0
+}
+
+func (r *Recording) withParameterSets(au [][]byte) [][]byte {
+	params := [][]byte{r.SPS, r.PPS}
+	if r.Codec == "H265" {
+		params = [][]byte{r.VPS, r.SPS, r.PPS}
+	}
+
+	nalus := [][]byte{}
+	for _, nalu := range au {
+		if r.isParameterSet(nalu) {
+			continue
+		}
+		nalus = append(nalus, nalu)
+	}
+
+	return append(params, nalus...)
+}
+
+func (r *Recording) isParameterSet(nalu []byte) bool {
+	if r.Codec == "H264" {
+		typ := h264.NALUType(nalu[0] & 0x1F)
+		return typ == h264.NALUTypeSPS || typ == h264.NALUTypePPS
+	}
+
+	typ := h265.NALUType((nalu[0] >> 1) & 0x3F)
+	return typ == h265.NALUType_VPS_NUT || typ == h265.NALUType_SPS_NUT || typ == h265.NALUType_PPS_NUT
+}
+
+func (r *Recording) add(au [][]byte, pts time.Duration) {
+	frame := Frame{
+		PTS: pts,
+	}
+
+	// Keep the parameter sets for the session description, the access units keep them as well
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		if r.Codec == "H264" {
+			switch h264.NALUType(nalu[0] & 0x1F) {
+			case h264.NALUTypeSPS:
+				r.SPS = nalu
+			case h264.NALUTypePPS:
+				r.PPS = nalu
+			}
+		} else {
+			switch h265.NALUType((nalu[0] >> 1) & 0x3F) {
+			case h265.NALUType_VPS_NUT:
+				r.VPS = nalu
+			case h265.NALUType_SPS_NUT:
+				r.SPS = nalu
+			case h265.NALUType_PPS_NUT:
+				r.PPS = nalu
+			}
+		}
+
+		frame.AU = append(frame.AU, nalu)
+	}
+
+	if r.Codec == "H264" {
+		frame.IsKeyFrame = h264.IDRPresent(frame.AU)
+	} else {
+		frame.IsKeyFrame = h265.IsRandomAccess(frame.AU)
+	}
+
+	if frame.IsKeyFrame {
+		r.KeyFrames++
+	}
+
+	r.Frames = append(r.Frames, frame)
+}
+
+// finalize checks the recording can be replayed and computes its duration: the last frame lasts one frame interval.
+func (r *Recording) finalize(interval time.Duration) error {
+	if len(r.Frames) == 0 {
+		return fmt.Errorf("the recording has no video frames")
+	}
+
+	if !r.Frames[0].IsKeyFrame {
+		return fmt.Errorf("the recording does not start with a key frame")
+	}
+
+	if r.SPS == nil || r.PPS == nil || (r.Codec == "H265" && r.VPS == nil) {
+		return fmt.Errorf("the recording has no parameter sets")
+	}
+
+	// Every key frame carries the parameter sets so clips cut anywhere can be decoded
+	for i, frame := range r.Frames {
+		if frame.IsKeyFrame {
+			r.Frames[i].AU = r.withParameterSets(frame.AU)
+		}
+	}
+
+	last := r.Frames[len(r.Frames)-1].PTS
+	if interval == 0 && len(r.Frames) > 1 {
+		interval = last / time.Duration(len(r.Frames)-1)
+	}
+	r.Duration = last + interval
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/pion/rtp"
+)
+
+// Server serves a recording over RTSP in real time as if it came from a camera. Every path serves the
+// same stream, so several cameras (i.e. `rtsp://localhost:8554/<camera>`) can point at one server.
+// When looping, the recording restarts right after its last frame with continuous timestamps.
+type Server struct {
+	Address   string
+	Recording *Recording
+	Loop      bool
+
+	mu     sync.Mutex
+	server *gortsplib.Server
+	stream *gortsplib.ServerStream
+	media  *description.Media
+}
+
+func NewServer(address string, recording *Recording, loop bool) *Server {
+	return &Server{
+		Address:   address,
+		Recording: recording,
+		Loop:      loop,
+	}
+}
+
+// URL returns the RTSP URL of a path on this server.
+func (s *Server) URL(path string) string {
+	host, port, err := net.SplitHostPort(s.Address)
+	if err != nil {
+		return fmt.Sprintf("rtsp://%s/%s", s.Address, path)
+	}
+
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+
+	return fmt.Sprintf("rtsp://%s/%s", net.JoinHostPort(host, port), path)
+}
+
+// Run serves the recording until the context is cancelled or the recording ends (if not looping).
+func (s *Server) Run(ctx context.Context) error {
+	var forma format.Format
+	if s.Recording.Codec == "H264" {
+		forma = &format.H264{
+			PayloadTyp:        96,
+			SPS:               s.Recording.SPS,
+			PPS:               s.Recording.PPS,
+			PacketizationMode: 1,
+		}
+	} else {
+		forma = &format.H265{
+			PayloadTyp: 96,
+			VPS:        s.Recording.VPS,
+			SPS:        s.Recording.SPS,
+			PPS:        s.Recording.PPS,
+		}
+	}
+
+	s.media = &description.Media{
+		Type:    description.MediaTypeVideo,
+		Formats: []format.Format{forma},
+	}
+
+	s.mu.Lock()
+	s.server = &gortsplib.Server{
+		Handler:     s,
+		RTSPAddress: s.Address,
+	}
+
+	err := s.server.Start()
+	if err != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("unable to start the replay server: %v", err)
+	}
+	defer s.server.Close()
+
+	s.stream = gortsplib.NewServerStream(s.server, &description.Session{Medias: []*description.Media{s.media}})
+	defer s.stream.Close()
+	s.mu.Unlock()
+
+	fmt.Printf("replay - serving %d %s frames (%d key frames, %s) on %s\n",
+		len(s.Recording.Frames), s.Recording.Codec, s.Recording.KeyFrames, s.Recording.Duration, s.URL("<camera>"))
+
+	playDone := make(chan error, 1)
+	go func() {
+		playDone <- s.play(ctx, forma)
+	}()
+
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- s.server.Wait()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-playDone:
+		return err
+	case err := <-serverDone:
+		return err
+	}
+}
+
+// play writes the frames at their presentation time. Frames are packetized once per loop.
+func (s *Server) play(ctx context.Context, forma format.Format) error {
+	type encoder interface {
+		Encode(au [][]byte) ([]*rtp.Packet, error)
+	}
+
+	var enc encoder
+	if h264Forma, ok := forma.(*format.H264); ok {
+		e, err := h264Forma.CreateEncoder()
+		if err != nil {
+			return err
+		}
+		enc = e
+	} else {
+		e, err := forma.(*format.H265).CreateEncoder()
+		if err != nil {
+			return err
+		}
+		enc = e
+	}
+
+	start := time.Now()
+	offset := time.Duration(0)
+	for loop := 0; ; loop++ {
+		for _, frame := range s.Recording.Frames {
+			pts := offset + frame.PTS
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Until(start.Add(pts))):
+			}
+
+			pkts, err := enc.Encode(frame.AU)
+			if err != nil {
+				return fmt.Errorf("unable to encode frame at %s: %v", frame.PTS, err)
+			}
+
+			ntp := start.Add(pts)
+			for _, pkt := range pkts {
+				pkt.Timestamp = uint32(int64(pts) * int64(forma.ClockRate()) / int64(time.Second))
+				err := s.stream.WritePacketRTPWithNTP(s.media, pkt, ntp)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if !s.Loop {
+			fmt.Printf("replay - recording ended\n")
+			return nil
+		}
+
+		offset += s.Recording.Duration
+		fmt.Printf("replay - loop %d ended...restarting\n", loop+1)
+	}
+}
+
+// called when receiving a DESCRIBE request.
+func (s *Server) OnDescribe(_ *gortsplib.ServerHandlerOnDescribeCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &base.Response{
+		StatusCode: base.StatusOK,
+	}, s.stream, nil
+}
+
+// called when receiving a SETUP request.
+func (s *Server) OnSetup(_ *gortsplib.ServerHandlerOnSetupCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &base.Response{
+		StatusCode: base.StatusOK,
+	}, s.stream, nil
+}
+
+// called when receiving a PLAY request.
+func (s *Server) OnPlay(_ *gortsplib.ServerHandlerOnPlayCtx) (*base.Response, error) {
+	return &base.Response{
+		StatusCode: base.StatusOK,
+	}, nil
+}
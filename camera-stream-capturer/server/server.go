@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/agent"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/live"
+)
+
+// Injected services
+var AgentsService IAgents
+var LiveService ILive
+
+// Commands that can be sent to an agent, keyed by their route name
+var agentCommands = map[string]string{
+	"start":   "Start",
+	"stop":    "Stop",
+	"restart": "Restart",
+	"pause":   "Pause",
+	"resume":  "Resume",
+	"record":  "Record",
+}
+
+// Run serves the capturer's control API until the context is cancelled.
+// Every request must carry the `CAPTURER_API_KEY` as a bearer token.
+func Run(canxCtx context.Context, port string) error {
+	apiKey := os.Getenv("CAPTURER_API_KEY")
+	if apiKey == "" {
+		return fmt.Errorf("%s env var is required to start the control API", "CAPTURER_API_KEY")
+	}
+
+	//=========================
+	// ROUTES
+	//=========================
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /agents", listAgents)
+	mux.HandleFunc("GET /agents/{camera}", getAgent)
+	mux.HandleFunc("POST /agents/{camera}/{command}", commandAgent)
+	mux.HandleFunc("POST /agents/{camera}/presets/{preset}", gotoPreset)
+	mux.HandleFunc("POST /agents/{camera}/tours/{tour}", startTour)
+	mux.HandleFunc("DELETE /agents/{camera}/tours", stopTour)
+	mux.HandleFunc("GET /live/{camera}/{file}", liveStream)
+	mux.HandleFunc("POST /whep/{camera}", watchStream)
+	mux.HandleFunc("DELETE /whep/{camera}/{id}", unwatchStream)
+
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           authenticated(apiKey, mux),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Println("Server start error...exiting", err)
+		}
+	}()
+
+	// Wait
+	<-canxCtx.Done()
+	fmt.Println("Server context cancelled...existing!!!")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = srv.Shutdown(shutdownCtx)
+	return canxCtx.Err()
+}
+
+func authenticated(apiKey string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(apiKey)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func listAgents(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, AgentsService.Stats())
+}
+
+func getAgent(w http.ResponseWriter, r *http.Request) {
+	for _, stats := range AgentsService.Stats() {
+		if stats.Camera == r.PathValue("camera") {
+			writeJSON(w, http.StatusOK, stats)
+			return
+		}
+	}
+
+	writeError(w, http.StatusNotFound, ErrAgentNotFound)
+}
+
+func commandAgent(w http.ResponseWriter, r *http.Request) {
+	cmd, ok := agentCommands[r.PathValue("command")]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("command %s not supported", r.PathValue("command")))
+		return
+	}
+
+	// Streaming mode records continuously and a camera that is off by schedule is not recorded, so triggered and
+	// motion modes record on demand and files mode produces a clip from its samples on demand
+	if cmd == "Record" {
+		for _, stats := range AgentsService.Stats() {
+			if stats.Camera == r.PathValue("camera") && (stats.Mode == "streaming" || stats.Mode == agent.ScheduleOff) {
+				writeError(w, http.StatusConflict, fmt.Errorf("%w: %s %s", ErrAgentMode, cmd, stats.Mode))
+				return
+			}
+		}
+	}
+
+	sendCommand(w, r.PathValue("camera"), cmd)
+}
+
+// gotoPreset moves a PTZ camera to a preset (token or name).
+func gotoPreset(w http.ResponseWriter, r *http.Request) {
+	sendCommand(w, r.PathValue("camera"), agent.PresetCommand(r.PathValue("preset")))
+}
+
+// startTour starts one of a PTZ camera's preset tours until it is stopped.
+func startTour(w http.ResponseWriter, r *http.Request) {
+	sendCommand(w, r.PathValue("camera"), agent.TourCommand(r.PathValue("tour")))
+}
+
+func stopTour(w http.ResponseWriter, r *http.Request) {
+	sendCommand(w, r.PathValue("camera"), agent.StopTourCommand())
+}
+
+func sendCommand(w http.ResponseWriter, camera, cmd string) {
+	err := AgentsService.Command(camera, cmd)
+	if errors.Is(err, ErrAgentNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if errors.Is(err, ErrAgentBusy) {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"camera":  camera,
+		"command": cmd,
+	})
+}
+
+func liveStream(w http.ResponseWriter, r *http.Request) {
+	err := LiveService.Handle(w, r, r.PathValue("camera"), r.PathValue("file"))
+	if errors.Is(err, live.ErrStreamNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+}
+
+// watchStream implements WHEP: the body is the viewer's SDP offer and the response is the SDP answer.
+// The viewer's resource (to disconnect) is in the Location header.
+func watchStream(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/sdp" {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("content type must be application/sdp"))
+		return
+	}
+
+	offer, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id, answer, err := LiveService.Watch(r.PathValue("camera"), string(offer))
+	if errors.Is(err, live.ErrStreamNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if errors.Is(err, live.ErrTooManyViewers) {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", fmt.Sprintf("/whep/%s/%s", r.PathValue("camera"), id))
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write([]byte(answer))
+}
+
+func unwatchStream(w http.ResponseWriter, r *http.Request) {
+	err := LiveService.Unwatch(r.PathValue("camera"), r.PathValue("id"))
+	if errors.Is(err, live.ErrStreamNotFound) || errors.Is(err, live.ErrViewerNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{
+		"error": err.Error(),
+	})
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/agent"
+)
+
+var (
+	ErrAgentNotFound = errors.New("agent not found")
+	ErrAgentBusy     = errors.New("agent is busy")
+	ErrAgentMode     = errors.New("command is not supported in the agent's mode")
+)
+
+// IAgents gives the control API access to the capturer's running agents.
+type IAgents interface {
+	// Stats returns the live stats of all the running agents.
+	Stats() []agent.StatsSnapshot
+
+	// Command sends a command (i.e. Start, Stop, Pause, Resume, Restart, Record or a PTZ command) to a camera's agent.
+	Command(camera, cmd string) error
+}
+
+// ILive gives the control API access to the cameras' live streams.
+type ILive interface {
+	// Handle serves a file (playlist, init section, segment or part) of a camera's HLS live stream.
+	Handle(w http.ResponseWriter, r *http.Request, camera, file string) error
+
+	// Watch answers a WebRTC viewer's SDP offer for a camera. It returns the viewer's id and the SDP answer.
+	Watch(camera, offer string) (string, string, error)
+
+	// Unwatch disconnects a camera's WebRTC viewer.
+	Unwatch(camera, id string) error
+}
@@ -0,0 +1,739 @@
+package spool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+	"github.com/khaledhikmat/threat-detection-shared/service/config"
+	"github.com/khaledhikmat/threat-detection-shared/service/pubsub"
+	"github.com/khaledhikmat/threat-detection-shared/service/storage"
+
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/errorlog"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/health"
+	"github.com/khaledhikmat/threat-detection/camera-stream-capturer/preview"
+	"github.com/khaledhikmat/threat-detection/custody"
+)
+
+const (
+	manifestExt     = ".json"
+	subStreamSuffix = "_sub.mp4"
+	originalSuffix  = "_original.mp4"
+	renditionInfix  = "_r-"
+
+	// The unredacted originals are stored as the clips of a restricted camera so they get a bucket of their own
+	restrictedCameraSuffix = "-restricted"
+
+	// PassthroughRendition is the clip itself...the other renditions are transcoded from it
+	PassthroughRendition = "passthrough"
+
+	retryMinBackoff = 2 * time.Second
+	retryMaxBackoff = 5 * time.Minute
+)
+
+// Manifest tracks a spooled clip until it is uploaded and published.
+// It is stored next to the clip as `<clip file>.json` so pending clips survive restarts.
+// The size includes the clip's previews, sub-stream clip, unredacted original and renditions.
+type Manifest struct {
+	Clip              models.RecordingClip `json:"clip"`
+	FencingToken      int64                `json:"fencingToken"`
+	ClipHash          string               `json:"clipHash"`      // SHA-256 of the clip when it was captured
+	SubStreamHash     string               `json:"subStreamHash"` // SHA-256 of the sub-stream clip if any
+	OriginalHash      string               `json:"originalHash"`  // SHA-256 of the unredacted original if any
+	Captured          bool                 `json:"captured"`      // the chain of custody is started
+	SubStreamCaptured bool                 `json:"subStreamCaptured"`
+	OriginalCaptured  bool                 `json:"originalCaptured"`
+	Size              int64                `json:"size"`
+	Attempts          int                  `json:"attempts"`
+	NextAttempt       time.Time            `json:"nextAttempt"`
+	Uploaded          bool                 `json:"uploaded"`
+	OriginalUploaded  bool                 `json:"originalUploaded"`
+	Alerted           bool                 `json:"alerted"`
+	LastError         string               `json:"lastError"`
+}
+
+// Spool is a durable on-disk queue of recorded clips. A clip is only published to the recordings topic
+// after it is uploaded, and its local file is only deleted after it is published. Failed uploads are retried
+// with an exponential backoff. If the spool exceeds its quota, the oldest clips are evicted.
+// Clips tagged with camera health conditions also raise camera health alerts on the alerts topic.
+// Failed attempts are recorded in the error log as upload or publish errors of the clip's camera.
+// A manifest is only changed under the lock and the clip being delivered is never evicted.
+type Spool struct {
+	ConfigSvc       config.IService
+	StorageSvc      storage.IService
+	PubsubSvc       pubsub.IService
+	RecordingsTopic string
+	AlertsTopic     string
+	Quota           int64 // bytes
+	CustodyLog      *custody.CustodyLog
+	ErrorLog        *errorlog.ErrorLog
+
+	mu        sync.Mutex
+	manifests map[string]*Manifest // keyed by manifest file
+	inflight  string               // the manifest file being delivered
+	notify    chan struct{}
+}
+
+func New(configsvc config.IService, storagesvc storage.IService, pubsubsvc pubsub.IService, custodyLog *custody.CustodyLog, errorLog *errorlog.ErrorLog, recordingsTopic, alertsTopic string, quota int64) *Spool {
+	return &Spool{
+		ConfigSvc:       configsvc,
+		StorageSvc:      storagesvc,
+		PubsubSvc:       pubsubsvc,
+		CustodyLog:      custodyLog,
+		ErrorLog:        errorLog,
+		RecordingsTopic: recordingsTopic,
+		AlertsTopic:     alertsTopic,
+		Quota:           quota,
+		manifests:       map[string]*Manifest{},
+		notify:          make(chan struct{}, 1),
+	}
+}
+
+// Add writes the clip's manifest and queues it for upload.
+func (s *Spool) Add(clip models.RecordingClip, fencingToken int64, clipHash string) error {
+	info, err := os.Stat(clip.LocalReference)
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	for _, file := range sidecars(clip.LocalReference) {
+		if sidecarInfo, err := os.Stat(file); err == nil {
+			size += sidecarInfo.Size()
+		}
+	}
+
+	// The hashes of the sub-stream clip and the original go into the clip's chain of custody when it is delivered
+	subStreamHash := ""
+	if b, err := os.ReadFile(SubStreamFile(clip.LocalReference)); err == nil {
+		subStreamHash = custody.ClipHash(b)
+	}
+
+	originalHash := ""
+	if b, err := os.ReadFile(OriginalFile(clip.LocalReference)); err == nil {
+		originalHash = custody.ClipHash(b)
+	}
+
+	manifest := &Manifest{
+		Clip:          clip,
+		FencingToken:  fencingToken,
+		ClipHash:      clipHash,
+		SubStreamHash: subStreamHash,
+		OriginalHash:  originalHash,
+		Size:          size,
+		NextAttempt:   time.Now(),
+	}
+
+	err = writeManifest(manifestFile(clip.LocalReference), manifest)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.manifests[manifestFile(clip.LocalReference)] = manifest
+	s.mu.Unlock()
+
+	s.evict()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run recovers the pending clips left by a previous run and uploads the spooled clips until the context is cancelled.
+func (s *Spool) Run(canxCtx context.Context) {
+	s.recover()
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-canxCtx.Done():
+			fmt.Printf("spool processor context cancelled...%d clips pending\n", s.Pending())
+			return
+		case <-s.notify:
+			s.process(canxCtx)
+		case <-ticker.C:
+			s.process(canxCtx)
+		}
+	}
+}
+
+// Pending returns the number of clips waiting to be uploaded or published.
+func (s *Spool) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.manifests)
+}
+
+// process uploads and publishes the clips that are due, oldest first.
+func (s *Spool) process(canxCtx context.Context) {
+	for _, file := range s.due() {
+		if canxCtx.Err() != nil {
+			return
+		}
+
+		s.mu.Lock()
+		manifest, ok := s.manifests[file]
+		if ok {
+			s.inflight = file
+		}
+		s.mu.Unlock()
+		if !ok {
+			// Evicted in the meantime
+			continue
+		}
+
+		err := s.deliver(canxCtx, file, manifest)
+		if err != nil {
+			attempts, nextAttempt := 0, time.Time{}
+			s.update(file, manifest, func(m *Manifest) {
+				m.Attempts++
+				m.NextAttempt = time.Now().Add(retryBackoff(m.Attempts))
+				m.LastError = err.Error()
+				attempts, nextAttempt = m.Attempts, m.NextAttempt
+			})
+			s.release()
+			clip := s.clip(manifest)
+			fmt.Printf("spool processor clip %s - attempt %d failed, retrying at %s: %v\n", clip.LocalReference, attempts, nextAttempt.Format("15:04:05"), err)
+			s.ErrorLog.Record(canxCtx, clip.Camera, err)
+			continue
+		}
+
+		s.remove(file)
+		s.release()
+	}
+}
+
+// deliver uploads the clip if it is not uploaded yet and publishes it. It works on a copy of the manifest
+// and records its progress with update.
+func (s *Spool) deliver(canxCtx context.Context, file string, manifest *Manifest) error {
+	s.mu.Lock()
+	progress := *manifest
+	s.mu.Unlock()
+	recording := progress.Clip
+
+	// The consumers reject a clip without a chain of custody, so it is started before the clip is uploaded
+	// and a clip whose chain cannot be started is retried like a failed upload
+	err := s.startCustody(canxCtx, file, manifest, progress)
+	if err != nil {
+		return err
+	}
+
+	if !progress.Uploaded {
+		// Upload to Cloud Storage i.e. S3, Azure Storage, etc
+		url, err := s.StorageSvc.StoreRecordingClip(canxCtx, recording)
+		if err != nil {
+			return errorlog.Errorf(errorlog.Upload, "unable to store recording clip in %s: %v", s.ConfigSvc.GetRuntimeMode(), err)
+		}
+		if url == "" {
+			return errorlog.Errorf(errorlog.Upload, "storing recording clip in %s returned an empty reference", s.ConfigSvc.GetRuntimeMode())
+		}
+
+		recording.CloudReference = url
+		recording.StorageProvider = s.ConfigSvc.GetRuntimeMode()
+		fmt.Printf("Uploaded %s to %s => %s\n", recording.LocalReference, s.ConfigSvc.GetRuntimeMode(), url)
+
+		s.deliverPreviews(canxCtx, recording)
+		s.deliverSubStream(canxCtx, recording)
+		s.deliverRenditions(canxCtx, recording)
+
+		// Remember the upload so a publish failure does not upload the clip again
+		s.update(file, manifest, func(m *Manifest) {
+			m.Uploaded = true
+			m.Clip = recording
+		})
+	}
+
+	// The unredacted original must be stored before the redacted clip is published
+	if !progress.OriginalUploaded {
+		if _, err := os.Stat(OriginalFile(recording.LocalReference)); err == nil {
+			err = s.deliverOriginal(canxCtx, recording)
+			if err != nil {
+				return err
+			}
+
+			s.update(file, manifest, func(m *Manifest) {
+				m.OriginalUploaded = true
+			})
+		}
+	}
+
+	if !progress.Alerted && len(health.Conditions(recording.Tags)) > 0 {
+		err := s.publishHealthAlerts(canxCtx, recording)
+		if err != nil {
+			return err
+		}
+
+		// Remember the alerts so a publish failure does not raise them again
+		s.update(file, manifest, func(m *Manifest) {
+			m.Alerted = true
+		})
+	}
+
+	// Publish event
+	fmt.Printf("Publishing %s recording clip\n", recording.CloudReference)
+	recording.PublishTime = time.Now()
+	err = s.PubsubSvc.PublishRecordingClip(canxCtx, models.ThreatDetectionPubSub, s.RecordingsTopic, recording)
+	if err != nil {
+		return errorlog.Errorf(errorlog.Publish, "unable to publish event: %v", err)
+	}
+
+	return nil
+}
+
+// startCustody starts the clip's chain of custody with its capture, then adds its sub-stream clip and its
+// unredacted original. Every entry is remembered so a retry does not append it again.
+func (s *Spool) startCustody(canxCtx context.Context, file string, manifest *Manifest, progress Manifest) error {
+	clipID := progress.Clip.ID
+	if !progress.Captured {
+		_, err := s.CustodyLog.AppendCapture(canxCtx, clipID, custody.CustodyCaptured, progress.ClipHash, progress.FencingToken)
+		if err != nil {
+			return errorlog.Errorf(errorlog.Publish, "unable to start the chain of custody: %v", err)
+		}
+
+		s.update(file, manifest, func(m *Manifest) {
+			m.Captured = true
+		})
+	}
+
+	// The model invokers verify the sub-stream clip against the hash in the clip's chain of custody
+	if progress.SubStreamHash != "" && !progress.SubStreamCaptured {
+		_, err := s.CustodyLog.Append(canxCtx, clipID, custody.CustodySubStreamCaptured, progress.SubStreamHash)
+		if err != nil {
+			return errorlog.Errorf(errorlog.Publish, "unable to add the sub-stream clip to the chain of custody: %v", err)
+		}
+
+		s.update(file, manifest, func(m *Manifest) {
+			m.SubStreamCaptured = true
+		})
+	}
+
+	// The clip is redacted...its chain of custody also vouches for the unredacted original
+	if progress.OriginalHash != "" && !progress.OriginalCaptured {
+		_, err := s.CustodyLog.Append(canxCtx, clipID, custody.CustodyOriginalCaptured, progress.OriginalHash)
+		if err != nil {
+			return errorlog.Errorf(errorlog.Publish, "unable to add the original clip to the chain of custody: %v", err)
+		}
+
+		s.update(file, manifest, func(m *Manifest) {
+			m.OriginalCaptured = true
+		})
+	}
+
+	return nil
+}
+
+// publishHealthAlerts publishes a camera health alert for every camera health condition the clip is tagged with.
+// The alerts look like the model invokers' alerts: the model invoker is `camera-health` and every condition
+// has a clip type of its own.
+func (s *Spool) publishHealthAlerts(canxCtx context.Context, recording models.RecordingClip) error {
+	for _, condition := range health.Conditions(recording.Tags) {
+		err := s.publishHealthAlert(canxCtx, recording, condition)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PublishHealthAlert publishes a camera health alert for a condition the agent raises without a clip (i.e. quarantine).
+// The alert has no cloud reference: the alert notifiers notify it without a clip.
+func (s *Spool) PublishHealthAlert(canxCtx context.Context, alert models.RecordingClip, condition string) error {
+	return s.publishHealthAlert(canxCtx, alert, condition)
+}
+
+func (s *Spool) publishHealthAlert(canxCtx context.Context, recording models.RecordingClip, condition string) error {
+	alert := recording
+	alert.ModelInvoker = health.ModelInvoker
+	alert.ClipType = health.ClipType(condition)
+	alert.Tags = []string{condition}
+	alert.TagsCount = 1
+	alert.AlertsCount = 1
+	alert.PublishTime = time.Now()
+
+	fmt.Printf("Publishing %s camera health alert: %s\n", recording.CloudReference, condition)
+	err := s.PubsubSvc.PublishRecordingClip(canxCtx, models.ThreatDetectionPubSub, s.AlertsTopic, alert)
+	if err != nil {
+		return errorlog.Errorf(errorlog.Publish, "unable to publish camera health alert %s: %v", condition, err)
+	}
+
+	return nil
+}
+
+// deliverPreviews uploads the clip's previews next to it. Consumers find them by their name: the clip's
+// cloud reference with `.jpg` (thumbnail) or `_sprite.jpg` (sprite sheet) instead of `.mp4`.
+// A failed preview upload is not retried...the clip is delivered without it.
+func (s *Spool) deliverPreviews(canxCtx context.Context, recording models.RecordingClip) {
+	for _, file := range preview.Files(recording.LocalReference) {
+		expected := preview.SpriteFile(recording.CloudReference)
+		if file == preview.ThumbnailFile(recording.LocalReference) {
+			expected = preview.ThumbnailFile(recording.CloudReference)
+		}
+
+		previewClip := recording
+		previewClip.LocalReference = file
+		url, err := s.StorageSvc.StoreRecordingClip(canxCtx, previewClip)
+		if err != nil {
+			fmt.Printf("spool processor clip %s - unable to upload preview %s: %v\n", recording.LocalReference, file, err)
+			continue
+		}
+
+		if url != expected {
+			fmt.Printf("spool processor clip %s - preview %s uploaded to %s instead of %s\n", recording.LocalReference, file, url, expected)
+		}
+	}
+}
+
+// deliverSubStream uploads the clip's sub-stream clip next to it: the clip's cloud reference with `_sub.mp4`
+// instead of `.mp4`. A failed upload is not retried...the model invokers analyse the clip instead.
+func (s *Spool) deliverSubStream(canxCtx context.Context, recording models.RecordingClip) {
+	file := SubStreamFile(recording.LocalReference)
+	if _, err := os.Stat(file); err != nil {
+		return
+	}
+
+	subClip := recording
+	subClip.LocalReference = file
+	url, err := s.StorageSvc.StoreRecordingClip(canxCtx, subClip)
+	if err != nil {
+		fmt.Printf("spool processor clip %s - unable to upload sub-stream clip %s: %v\n", recording.LocalReference, file, err)
+		return
+	}
+
+	if expected := SubStreamFile(recording.CloudReference); url != expected {
+		fmt.Printf("spool processor clip %s - sub-stream clip %s uploaded to %s instead of %s\n", recording.LocalReference, file, url, expected)
+	}
+}
+
+// Rendition is a rendition of a clip and its cloud reference.
+type Rendition struct {
+	Profile   string `json:"profile"`
+	Reference string `json:"reference"`
+}
+
+// deliverRenditions uploads the clip's renditions next to it: the clip's cloud reference with `_r-<profile>.mp4`
+// instead of `.mp4`. Their references are stored in key/value storage where the key = renditions_clipid and
+// the value = the JSON renditions, the passthrough rendition (the clip) first. A failed upload is not
+// retried...the clip is delivered without the rendition.
+func (s *Spool) deliverRenditions(canxCtx context.Context, recording models.RecordingClip) {
+	files := RenditionFiles(recording.LocalReference)
+	if len(files) == 0 {
+		return
+	}
+
+	renditions := []Rendition{{Profile: PassthroughRendition, Reference: recording.CloudReference}}
+	for _, file := range files {
+		renditionClip := recording
+		renditionClip.LocalReference = file
+		url, err := s.StorageSvc.StoreRecordingClip(canxCtx, renditionClip)
+		if err != nil {
+			fmt.Printf("spool processor clip %s - unable to upload rendition %s: %v\n", recording.LocalReference, file, err)
+			continue
+		}
+
+		profile := RenditionProfile(file)
+		if expected := RenditionFile(recording.CloudReference, profile); url != expected {
+			fmt.Printf("spool processor clip %s - rendition %s uploaded to %s instead of %s\n", recording.LocalReference, file, url, expected)
+		}
+		renditions = append(renditions, Rendition{Profile: profile, Reference: url})
+	}
+
+	b, err := json.Marshal(renditions)
+	if err != nil {
+		fmt.Printf("spool processor clip %s - unable to encode the renditions: %v\n", recording.LocalReference, err)
+		return
+	}
+
+	err = s.StorageSvc.StoreKeyValue(canxCtx, models.ThreatDetectionStateStore, fmt.Sprintf("renditions_%s", recording.ID), string(b))
+	if err != nil {
+		fmt.Printf("spool processor clip %s - unable to store the renditions' references: %v\n", recording.LocalReference, err)
+	}
+}
+
+// deliverOriginal uploads the unredacted original of a redacted clip to the restricted storage: the clips of
+// the `<camera>-restricted` camera. Its reference is stored in key/value storage where the key = original_clipid
+// and the value = the original's reference, for the people allowed to see it.
+func (s *Spool) deliverOriginal(canxCtx context.Context, recording models.RecordingClip) error {
+	originalClip := recording
+	originalClip.LocalReference = OriginalFile(recording.LocalReference)
+	originalClip.Camera = recording.Camera + restrictedCameraSuffix
+	url, err := s.StorageSvc.StoreRecordingClip(canxCtx, originalClip)
+	if err != nil {
+		return errorlog.Errorf(errorlog.Upload, "unable to store the original clip in %s: %v", s.ConfigSvc.GetRuntimeMode(), err)
+	}
+	fmt.Printf("Uploaded original %s to %s => %s\n", originalClip.LocalReference, s.ConfigSvc.GetRuntimeMode(), url)
+
+	err = s.StorageSvc.StoreKeyValue(canxCtx, models.ThreatDetectionStateStore, fmt.Sprintf("original_%s", recording.ID), url)
+	if err != nil {
+		fmt.Printf("spool processor clip %s - unable to store the original's reference: %v\n", recording.LocalReference, err)
+	}
+
+	return nil
+}
+
+// update changes the manifest under the lock and writes it. A manifest that was evicted in the meantime is not written back.
+func (s *Spool) update(file string, manifest *Manifest, change func(m *Manifest)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	change(manifest)
+	if s.manifests[file] != manifest {
+		return
+	}
+
+	err := writeManifest(file, manifest)
+	if err != nil {
+		fmt.Printf("spool processor clip %s - unable to update manifest: %v\n", manifest.Clip.LocalReference, err)
+	}
+}
+
+// clip returns the manifest's clip under the lock.
+func (s *Spool) clip(manifest *Manifest) models.RecordingClip {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return manifest.Clip
+}
+
+// release marks the end of a delivery so its clip can be evicted again.
+func (s *Spool) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inflight = ""
+}
+
+// remove deletes a delivered (or evicted) clip, its previews, its sub-stream clip, its original, its renditions and its manifest.
+func (s *Spool) remove(file string) {
+	s.mu.Lock()
+	manifest, ok := s.manifests[file]
+	delete(s.manifests, file)
+	s.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	// Delete local files
+	fmt.Printf("Deleting %s from local\n", manifest.Clip.LocalReference)
+	for _, local := range append([]string{manifest.Clip.LocalReference}, sidecars(manifest.Clip.LocalReference)...) {
+		err := os.Remove(local)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("unable to remove file: %s %v\n", local, err)
+		}
+	}
+
+	err := os.Remove(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("unable to remove file: %s %v\n", file, err)
+	}
+}
+
+// evict removes the oldest clips until the spool is within its quota. The newest clip and the clip being delivered
+// are always kept.
+func (s *Spool) evict() {
+	s.mu.Lock()
+	files := s.sorted()
+	total := int64(0)
+	for _, file := range files {
+		total += s.manifests[file].Size
+	}
+	s.mu.Unlock()
+
+	for i := 0; total > s.Quota && i < len(files)-1; i++ {
+		s.mu.Lock()
+		manifest, ok := s.manifests[files[i]]
+		inflight := files[i] == s.inflight
+		s.mu.Unlock()
+		if !ok || inflight {
+			continue
+		}
+
+		fmt.Printf("spool processor clip %s - evicted to stay within the %d bytes quota\n", manifest.Clip.LocalReference, s.Quota)
+		total -= manifest.Size
+		s.remove(files[i])
+	}
+}
+
+// due returns the manifest files whose next attempt is due, oldest first.
+func (s *Spool) due() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []string{}
+	now := time.Now()
+	for _, file := range s.sorted() {
+		if !s.manifests[file].NextAttempt.After(now) {
+			due = append(due, file)
+		}
+	}
+	return due
+}
+
+// sorted returns the manifest files, oldest clip first. The caller must hold the lock.
+func (s *Spool) sorted() []string {
+	files := []string{}
+	for file := range s.manifests {
+		files = append(files, file)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return s.manifests[files[i]].Clip.RecordingBeginTime.Before(s.manifests[files[j]].Clip.RecordingBeginTime)
+	})
+	return files
+}
+
+// recover loads the manifests left in the recordings folder by a previous run.
+func (s *Spool) recover() {
+	files, err := filepath.Glob(fmt.Sprintf("%s/*/*%s", s.ConfigSvc.GetCapturer().RecordingsFolder, manifestExt))
+	if err != nil {
+		fmt.Printf("spool processor - unable to look for pending clips: %v\n", err)
+		return
+	}
+
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Printf("spool processor - unable to read manifest %s: %v\n", file, err)
+			continue
+		}
+
+		manifest := &Manifest{}
+		err = json.Unmarshal(b, manifest)
+		if err != nil {
+			fmt.Printf("spool processor - unable to decode manifest %s: %v\n", file, err)
+			continue
+		}
+
+		// The clip is gone...nothing to upload
+		if _, err := os.Stat(manifest.Clip.LocalReference); err != nil {
+			fmt.Printf("spool processor - clip %s is missing, dropping its manifest\n", manifest.Clip.LocalReference)
+			_ = os.Remove(file)
+			continue
+		}
+
+		// Retry right away
+		manifest.NextAttempt = time.Now()
+
+		s.mu.Lock()
+		s.manifests[file] = manifest
+		s.mu.Unlock()
+	}
+
+	fmt.Printf("spool processor - recovered %d pending clips\n", len(s.manifests))
+	s.evict()
+}
+
+// SubStreamFile returns the sub-stream clip of a clip: `<clip file without extension>_sub.mp4`.
+func SubStreamFile(clipFile string) string {
+	return strings.TrimSuffix(clipFile, filepath.Ext(clipFile)) + subStreamSuffix
+}
+
+// IsSubStreamFile returns whether a file is a sub-stream clip.
+func IsSubStreamFile(file string) bool {
+	return strings.HasSuffix(file, subStreamSuffix)
+}
+
+// OriginalFile returns the unredacted original of a redacted clip: `<clip file without extension>_original.mp4`.
+func OriginalFile(clipFile string) string {
+	return strings.TrimSuffix(clipFile, filepath.Ext(clipFile)) + originalSuffix
+}
+
+// OriginalClipFile returns the clip of an unredacted original.
+func OriginalClipFile(originalFile string) string {
+	return strings.TrimSuffix(originalFile, originalSuffix) + ".mp4"
+}
+
+// IsOriginalFile returns whether a file is the unredacted original of a clip.
+func IsOriginalFile(file string) bool {
+	return strings.HasSuffix(file, originalSuffix)
+}
+
+// RenditionFile returns a rendition of a clip: `<clip file without extension>_r-<profile>.mp4`.
+func RenditionFile(clipFile, profile string) string {
+	return strings.TrimSuffix(clipFile, filepath.Ext(clipFile)) + renditionInfix + profile + ".mp4"
+}
+
+// RenditionFiles returns the renditions of a clip that exist on disk.
+func RenditionFiles(clipFile string) []string {
+	files, err := filepath.Glob(RenditionFile(clipFile, "*"))
+	if err != nil {
+		return []string{}
+	}
+	return files
+}
+
+// RenditionProfile returns the transcoding profile of a rendition.
+func RenditionProfile(renditionFile string) string {
+	name := strings.TrimSuffix(renditionFile, filepath.Ext(renditionFile))
+	return name[strings.LastIndex(name, renditionInfix)+len(renditionInfix):]
+}
+
+// IsRenditionFile returns whether a file is a rendition of a clip.
+func IsRenditionFile(file string) bool {
+	return strings.Contains(filepath.Base(file), renditionInfix)
+}
+
+// sidecars returns the files that travel with a clip and exist on disk: its previews, its sub-stream clip,
+// its unredacted original and its renditions.
+func sidecars(clipFile string) []string {
+	files := preview.Files(clipFile)
+	for _, file := range []string{SubStreamFile(clipFile), OriginalFile(clipFile)} {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	return append(files, RenditionFiles(clipFile)...)
+}
+
+// Spooled returns whether a clip was handed over to the spool (by this run or a previous one).
+func Spooled(clipFile string) bool {
+	_, err := os.Stat(manifestFile(clipFile))
+	return err == nil
+}
+
+func manifestFile(clipFile string) string {
+	return clipFile + manifestExt
+}
+
+// writeManifest writes to a temporary file first so a crash never leaves a partial manifest.
+func writeManifest(file string, manifest *Manifest) error {
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(file+".tmp", b, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+// retryBackoff doubles the backoff with every attempt up to a max.
+func retryBackoff(attempt int) time.Duration {
+	if attempt >= 16 {
+		return retryMaxBackoff
+	}
+
+	backoff := retryMinBackoff << attempt
+	if backoff > retryMaxBackoff {
+		backoff = retryMaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,143 @@
+package spool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+)
+
+// spoolClip writes a clip of `size` bytes that began `begin` seconds after the epoch.
+func spoolClip(t *testing.T, dir string, begin int64, size int) models.RecordingClip {
+	t.Helper()
+
+	file := filepath.Join(dir, fmt.Sprintf("%d.mp4", begin))
+	if err := os.WriteFile(file, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return models.RecordingClip{
+		ID:                 fmt.Sprintf("%d", begin),
+		LocalReference:     file,
+		RecordingBeginTime: time.Unix(begin, 0),
+	}
+}
+
+// exists tells which of the clips are still on disk with their manifests.
+func exists(clips ...models.RecordingClip) []bool {
+	kept := []bool{}
+	for _, clip := range clips {
+		_, err := os.Stat(clip.LocalReference)
+		kept = append(kept, err == nil && Spooled(clip.LocalReference))
+	}
+	return kept
+}
+
+func TestSpoolEvictsOldestClips(t *testing.T) {
+	dir := t.TempDir()
+	s := New(nil, nil, nil, nil, nil, "", "", 250)
+
+	clips := []models.RecordingClip{}
+	for begin := int64(1); begin <= 4; begin++ {
+		clip := spoolClip(t, dir, begin, 100)
+		if err := s.Add(clip, 1, ""); err != nil {
+			t.Fatal(err)
+		}
+		clips = append(clips, clip)
+	}
+
+	want := []bool{false, false, true, true}
+	if got := exists(clips...); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v kept, want %v", got, want)
+	}
+	if s.Pending() != 2 {
+		t.Errorf("got %d pending clips, want 2", s.Pending())
+	}
+}
+
+func TestSpoolKeepsClipBeingDelivered(t *testing.T) {
+	dir := t.TempDir()
+	s := New(nil, nil, nil, nil, nil, "", "", 250)
+
+	oldest := spoolClip(t, dir, 1, 100)
+	if err := s.Add(oldest, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+	s.inflight = manifestFile(oldest.LocalReference)
+
+	second := spoolClip(t, dir, 2, 100)
+	third := spoolClip(t, dir, 3, 100)
+	for _, clip := range []models.RecordingClip{second, third} {
+		if err := s.Add(clip, 1, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []bool{true, false, true}
+	if got := exists(oldest, second, third); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v kept, want %v", got, want)
+	}
+
+	// Once the delivery is over the clip can be evicted again
+	s.release()
+	fourth := spoolClip(t, dir, 4, 100)
+	if err := s.Add(fourth, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	want = []bool{false, true, true}
+	if got := exists(oldest, third, fourth); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("after release: got %v kept, want %v", got, want)
+	}
+}
+
+func TestSpoolKeepsNewestClip(t *testing.T) {
+	dir := t.TempDir()
+	s := New(nil, nil, nil, nil, nil, "", "", 250)
+
+	older := spoolClip(t, dir, 1, 100)
+	if err := s.Add(older, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The newest clip is over the quota on its own and must still be kept
+	newest := spoolClip(t, dir, 2, 300)
+	if err := s.Add(newest, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []bool{false, true}
+	if got := exists(older, newest); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v kept, want %v", got, want)
+	}
+}
+
+func TestSpoolCountsAndEvictsSidecars(t *testing.T) {
+	dir := t.TempDir()
+	s := New(nil, nil, nil, nil, nil, "", "", 250)
+
+	// The clip is small but its sub-stream clip takes it over the quota with the next clip
+	oldest := spoolClip(t, dir, 1, 50)
+	if err := os.WriteFile(SubStreamFile(oldest.LocalReference), make([]byte, 150), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(oldest, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	newest := spoolClip(t, dir, 2, 100)
+	if err := s.Add(newest, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []bool{false, true}
+	if got := exists(oldest, newest); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v kept, want %v", got, want)
+	}
+	if _, err := os.Stat(SubStreamFile(oldest.LocalReference)); err == nil {
+		t.Errorf("the evicted clip's sub-stream clip is still on disk")
+	}
+}
@@ -0,0 +1,383 @@
+package custody
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+	"github.com/khaledhikmat/threat-detection-shared/service/storage"
+)
+
+// Custody actions
+const (
+	CustodyCaptured = "captured"
+	CustodyVerified = "verified"
+	CustodyTampered = "tampered"
+	CustodyAnalysed = "analysed" // a model analysed the clip (or its sub-stream clip) with this hash
+
+	// The clip's sub-stream clip, its hash is recorded in the clip's chain of custody
+	CustodySubStreamCaptured = "captured-substream"
+	CustodySubStreamVerified = "verified-substream"
+	CustodySubStreamTampered = "tampered-substream"
+
+	// The unredacted original of a redacted clip, its hash is recorded in the clip's chain of custody
+	CustodyOriginalCaptured = "captured-original"
+)
+
+// The capturer records a camera's sub-stream next to the clip (i.e. `1715000000_sub.mp4`).
+const subStreamSuffix = "_sub.mp4"
+
+// ErrNoSigningKey is returned when the custody signing key is not configured. Entries signed with an empty key
+// prove nothing, so the services must not start without it.
+var ErrNoSigningKey = errors.New("CUSTODY_SIGNING_KEY env var is required to sign the chains of custody")
+
+// CustodyEntry records who did what to a clip and when. Each entry is chained to the previous entry
+// of the clip's chain of custody and signed, so any change to the chain is evident.
+type CustodyEntry struct {
+	ClipID   string `json:"clipId"`
+	Actor    string `json:"actor"`
+	Action   string `json:"action"`
+	ClipHash string `json:"clipHash"` // SHA-256 of the clip as seen by the actor
+	// The fencing token of the capturer's camera lease when the clip was captured
+	FencingToken int64     `json:"fencingToken,omitempty"`
+	Time         time.Time `json:"time"`
+	Prev         string    `json:"prev"`
+	Hash         string    `json:"hash"`
+	Signature    string    `json:"signature"` // HMAC-SHA256 of the hash with the custody signing key
+}
+
+// CustodyLog appends entries to the clips' chains of custody. A chain is kept in the DAPR state store under
+// `custody_<clip id>` and every append is conditional on its etag so services appending at the same time never
+// lose entries. Without a DAPR client (i.e. AWS runtime mode), entries are not chained and clips are not verified.
+// Every entry is also stored in key/value storage under `custody_<clip id>_<entry hash>`.
+// All the services share this package so they sign, chain and verify the entries the same way.
+//
+// The entries are signed with one key shared by all the services (HMAC), so the chain only makes tampering
+// evident to whoever does not hold the key. It does not prove which service wrote an entry: any service can
+// sign any entry, including a `captured` entry. The actor of an entry is what its writer claims.
+type CustodyLog struct {
+	DaprClient dapr.Client
+	StorageSvc storage.IService
+	Actor      string
+	SigningKey []byte
+}
+
+// NewCustodyLog returns the actor's custody log signed with `CUSTODY_SIGNING_KEY`. It is an error if the key is empty.
+func NewCustodyLog(client dapr.Client, storagesvc storage.IService, actor string) (*CustodyLog, error) {
+	signingKey := os.Getenv("CUSTODY_SIGNING_KEY")
+	if signingKey == "" {
+		return nil, ErrNoSigningKey
+	}
+
+	return &CustodyLog{
+		DaprClient: client,
+		StorageSvc: storagesvc,
+		Actor:      actor,
+		SigningKey: []byte(signingKey),
+	}, nil
+}
+
+// Append adds a signed entry to the end of the clip's chain of custody.
+func (l *CustodyLog) Append(ctx context.Context, clipID, action, clipHash string) (CustodyEntry, error) {
+	return l.AppendCapture(ctx, clipID, action, clipHash, 0)
+}
+
+// AppendCapture adds a signed entry to the end of the clip's chain of custody with the fencing token the capturer
+// held when it captured the clip.
+func (l *CustodyLog) AppendCapture(ctx context.Context, clipID, action, clipHash string, fencingToken int64) (CustodyEntry, error) {
+	entry := CustodyEntry{
+		ClipID:       clipID,
+		Actor:        l.Actor,
+		Action:       action,
+		ClipHash:     clipHash,
+		FencingToken: fencingToken,
+		Time:         time.Now().UTC(),
+	}
+
+	if l.DaprClient != nil {
+		var err error
+		for attempt := 0; attempt < 5; attempt++ {
+			item, e := l.DaprClient.GetState(ctx, models.ThreatDetectionStateStore, custodyKey(clipID), nil)
+			if e != nil {
+				return entry, e
+			}
+
+			chain := []CustodyEntry{}
+			if len(item.Value) > 0 {
+				e = json.Unmarshal(item.Value, &chain)
+				if e != nil {
+					return entry, fmt.Errorf("unable to decode the chain of custody of clip %s: %v", clipID, e)
+				}
+			}
+
+			entry.Prev = ""
+			if len(chain) > 0 {
+				entry.Prev = chain[len(chain)-1].Hash
+			}
+			entry.Hash = custodyEntryHash(entry)
+			entry.Signature = custodySignature(entry.Hash, l.SigningKey)
+
+			b, e := json.Marshal(append(chain, entry))
+			if e != nil {
+				return entry, e
+			}
+
+			// Another service appended in the meantime...try again on top of its entry. The sidecar reports an etag
+			// mismatch as aborted, any other failure is the store's and is not retried.
+			err = l.DaprClient.SaveStateWithETag(ctx, models.ThreatDetectionStateStore, custodyKey(clipID), b, item.Etag, nil, dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+			if status.Code(err) != codes.Aborted {
+				break
+			}
+		}
+
+		if err != nil {
+			return entry, fmt.Errorf("unable to append to the chain of custody of clip %s: %v", clipID, err)
+		}
+	} else {
+		entry.Hash = custodyEntryHash(entry)
+		entry.Signature = custodySignature(entry.Hash, l.SigningKey)
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return entry, err
+	}
+
+	err = l.StorageSvc.StoreKeyValue(ctx, models.ThreatDetectionStateStore, fmt.Sprintf("%s_%s", custodyKey(clipID), entry.Hash), string(b))
+	if err != nil {
+		fmt.Printf("custody log - unable to store entry %s of clip %s: %v\n", entry.Hash, clipID, err)
+	}
+
+	return entry, nil
+}
+
+// RetrieveVerifiedClip retrieves the clip from storage and verifies its SHA-256 against the hash of the signed
+// `captured` entry that starts the clip's chain of custody. The outcome is appended to the clip's chain of custody.
+// A tampered clip or a clip without a capture hash is an error. Without a DAPR client (i.e. AWS runtime mode), there
+// is no chain to verify against and the clip is retrieved unverified.
+func (l *CustodyLog) RetrieveVerifiedClip(ctx context.Context, clip models.RecordingClip) ([]byte, error) {
+	if l.DaprClient == nil {
+		fmt.Printf("custody log - clip %s is not verified: the chain of custody requires the DAPR state store\n", clip.ID)
+		return l.StorageSvc.RetrieveRecordingClip(ctx, clip)
+	}
+
+	expected, err := l.CapturedHash(ctx, clip)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := l.StorageSvc.RetrieveRecordingClip(ctx, clip)
+	if err != nil {
+		return b, err
+	}
+
+	actual := ClipHash(b)
+	if expected != actual {
+		_, e := l.Append(ctx, clip.ID, CustodyTampered, actual)
+		if e != nil {
+			fmt.Printf("custody log - unable to append to the chain of custody of clip %s: %v\n", clip.ID, e)
+		}
+		return b, fmt.Errorf("clip %s was modified since capture: expected sha256 %s, got %s", clip.ID, expected, actual)
+	}
+
+	_, err = l.Append(ctx, clip.ID, CustodyVerified, actual)
+	if err != nil {
+		fmt.Printf("custody log - unable to append to the chain of custody of clip %s: %v\n", clip.ID, err)
+	}
+
+	return b, nil
+}
+
+// RetrieveAnalysisClip retrieves the clip the models analyse: the camera's low-resolution sub-stream clip if
+// the capturer recorded one, otherwise the verified clip itself. The sub-stream clip is verified against the
+// hash the capturer appended to the clip's signed chain of custody. A tampered sub-stream clip is an error.
+// The clip is returned with the references of the retrieved clip.
+func (l *CustodyLog) RetrieveAnalysisClip(ctx context.Context, clip models.RecordingClip) (models.RecordingClip, []byte, error) {
+	if l.DaprClient == nil {
+		b, err := l.RetrieveVerifiedClip(ctx, clip)
+		return clip, b, err
+	}
+
+	chain, err := l.VerifiedChain(ctx, clip.ID)
+	if err != nil {
+		return clip, nil, err
+	}
+
+	expected := ""
+	for _, entry := range chain {
+		if entry.Action == CustodySubStreamCaptured {
+			expected = entry.ClipHash
+		}
+	}
+
+	// The capturer did not record a sub-stream for this clip
+	if expected == "" {
+		b, err := l.RetrieveVerifiedClip(ctx, clip)
+		return clip, b, err
+	}
+
+	subClip := clip
+	subClip.CloudReference = SubStreamReference(clip.CloudReference)
+	subClip.LocalReference = SubStreamReference(clip.LocalReference)
+	b, err := l.StorageSvc.RetrieveRecordingClip(ctx, subClip)
+	if err != nil {
+		fmt.Printf("custody log - unable to retrieve the sub-stream clip of clip %s...using the clip: %v\n", clip.ID, err)
+		b, err = l.RetrieveVerifiedClip(ctx, clip)
+		return clip, b, err
+	}
+
+	actual := ClipHash(b)
+	if expected != actual {
+		_, e := l.Append(ctx, clip.ID, CustodySubStreamTampered, actual)
+		if e != nil {
+			fmt.Printf("custody log - unable to append to the chain of custody of clip %s: %v\n", clip.ID, e)
+		}
+		return subClip, b, fmt.Errorf("sub-stream clip of clip %s was modified since capture: expected sha256 %s, got %s", clip.ID, expected, actual)
+	}
+
+	_, err = l.Append(ctx, clip.ID, CustodySubStreamVerified, actual)
+	if err != nil {
+		fmt.Printf("custody log - unable to append to the chain of custody of clip %s: %v\n", clip.ID, err)
+	}
+
+	return subClip, b, nil
+}
+
+// CapturedHash returns the clip's SHA-256 as captured: the hash of the signed `captured` entry that starts the
+// clip's chain of custody. It is an error if the clip has no capture hash.
+func (l *CustodyLog) CapturedHash(ctx context.Context, clip models.RecordingClip) (string, error) {
+	chain, err := l.VerifiedChain(ctx, clip.ID)
+	if err != nil {
+		return "", err
+	}
+
+	if len(chain) == 0 || chain[0].Action != CustodyCaptured || chain[0].ClipHash == "" {
+		return "", fmt.Errorf("clip %s has no capture hash to verify against", clip.ID)
+	}
+
+	return chain[0].ClipHash, nil
+}
+
+// VerifiedChain returns the clip's chain of custody after checking it with VerifyCustodyChain.
+func (l *CustodyLog) VerifiedChain(ctx context.Context, clipID string) ([]CustodyEntry, error) {
+	chain, err := l.Chain(ctx, clipID)
+	if err != nil {
+		return chain, err
+	}
+
+	err = VerifyCustodyChain(chain, l.SigningKey)
+	if err != nil {
+		return chain, fmt.Errorf("the chain of custody of clip %s is broken: %v", clipID, err)
+	}
+
+	return chain, nil
+}
+
+// Chain returns the clip's chain of custody.
+func (l *CustodyLog) Chain(ctx context.Context, clipID string) ([]CustodyEntry, error) {
+	chain := []CustodyEntry{}
+	if l.DaprClient == nil {
+		return chain, fmt.Errorf("the chain of custody requires the DAPR state store")
+	}
+
+	item, err := l.DaprClient.GetState(ctx, models.ThreatDetectionStateStore, custodyKey(clipID), nil)
+	if err != nil {
+		return chain, err
+	}
+
+	if len(item.Value) == 0 {
+		return chain, nil
+	}
+
+	err = json.Unmarshal(item.Value, &chain)
+	return chain, err
+}
+
+// VerifyCustodyChain checks that every entry is linked to the previous one, that its hash matches its content
+// and that it is signed with the signing key.
+func VerifyCustodyChain(chain []CustodyEntry, signingKey []byte) error {
+	prev := ""
+	for i, entry := range chain {
+		if entry.Prev != prev {
+			return fmt.Errorf("entry %d (%s by %s) is not linked to the previous entry", i, entry.Action, entry.Actor)
+		}
+
+		if custodyEntryHash(entry) != entry.Hash {
+			return fmt.Errorf("entry %d (%s by %s) was modified", i, entry.Action, entry.Actor)
+		}
+
+		if !hmac.Equal([]byte(custodySignature(entry.Hash, signingKey)), []byte(entry.Signature)) {
+			return fmt.Errorf("entry %d (%s by %s) has an invalid signature", i, entry.Action, entry.Actor)
+		}
+
+		prev = entry.Hash
+	}
+
+	return nil
+}
+
+// ClipHash returns the hex SHA-256 of a clip.
+func ClipHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// SubStreamReference returns the reference of a clip's sub-stream clip.
+func SubStreamReference(reference string) string {
+	if reference == "" {
+		return ""
+	}
+
+	return strings.TrimSuffix(reference, filepath.Ext(reference)) + subStreamSuffix
+}
+
+// HasSubStream tells if the capturer recorded a sub-stream clip for the clip.
+func HasSubStream(chain []CustodyEntry) bool {
+	for _, entry := range chain {
+		if entry.Action == CustodySubStreamCaptured {
+			return true
+		}
+	}
+
+	return false
+}
+
+func custodyKey(clipID string) string {
+	return fmt.Sprintf("%s_%s", "custody", clipID)
+}
+
+func custodyEntryHash(entry CustodyEntry) string {
+	content := fmt.Sprintf("%s|%s|%s|%s|%s|%s",
+		entry.ClipID,
+		entry.Actor,
+		entry.Action,
+		entry.ClipHash,
+		entry.Time.UTC().Format(time.RFC3339Nano),
+		entry.Prev)
+	// Only the capture entries carry a fencing token...the other entries hash as they always did
+	if entry.FencingToken != 0 {
+		content = fmt.Sprintf("%s|%d", content, entry.FencingToken)
+	}
+
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func custodySignature(hash string, signingKey []byte) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
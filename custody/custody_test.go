@@ -0,0 +1,149 @@
+package custody
+
+import (
+	"testing"
+	"time"
+)
+
+var testSigningKey = []byte("test-signing-key")
+
+// signedChain returns a chain of custody for a clip captured, verified and analysed a second apart.
+func signedChain() []CustodyEntry {
+	base := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+	entries := []CustodyEntry{
+		{ClipID: "clip", Actor: "capturer", Action: CustodyCaptured, ClipHash: ClipHash([]byte("clip")), FencingToken: 3},
+		{ClipID: "clip", Actor: "media-api", Action: CustodyVerified, ClipHash: ClipHash([]byte("clip"))},
+		{ClipID: "clip", Actor: "model-invoker", Action: CustodyAnalysed, ClipHash: ClipHash([]byte("clip"))},
+	}
+
+	prev := ""
+	for i := range entries {
+		entries[i].Time = base.Add(time.Duration(i) * time.Second)
+		entries[i].Prev = prev
+		entries[i].Hash = custodyEntryHash(entries[i])
+		entries[i].Signature = custodySignature(entries[i].Hash, testSigningKey)
+		prev = entries[i].Hash
+	}
+
+	return entries
+}
+
+func TestVerifyCustodyChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func([]CustodyEntry) []CustodyEntry
+		key    []byte
+		valid  bool
+	}{
+		{
+			name:   "untouched chain",
+			tamper: func(c []CustodyEntry) []CustodyEntry { return c },
+			valid:  true,
+		},
+		{
+			name:   "empty chain",
+			tamper: func(c []CustodyEntry) []CustodyEntry { return c[:0] },
+			valid:  true,
+		},
+		{
+			name: "clip hash replaced",
+			tamper: func(c []CustodyEntry) []CustodyEntry {
+				c[0].ClipHash = ClipHash([]byte("other clip"))
+				return c
+			},
+		},
+		{
+			name: "fencing token replaced",
+			tamper: func(c []CustodyEntry) []CustodyEntry {
+				c[0].FencingToken = 4
+				return c
+			},
+		},
+		{
+			name: "entry removed",
+			tamper: func(c []CustodyEntry) []CustodyEntry {
+				return append(c[:1], c[2:]...)
+			},
+		},
+		{
+			name: "entries reordered",
+			tamper: func(c []CustodyEntry) []CustodyEntry {
+				c[1], c[2] = c[2], c[1]
+				return c
+			},
+		},
+		{
+			name: "entry rehashed without the key",
+			tamper: func(c []CustodyEntry) []CustodyEntry {
+				c[2].Actor = "someone"
+				c[2].Hash = custodyEntryHash(c[2])
+				return c
+			},
+		},
+		{
+			name:   "other signing key",
+			tamper: func(c []CustodyEntry) []CustodyEntry { return c },
+			key:    []byte("other-signing-key"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := testSigningKey
+			if tt.key != nil {
+				key = tt.key
+			}
+
+			err := VerifyCustodyChain(tt.tamper(signedChain()), key)
+			if tt.valid && err != nil {
+				t.Errorf("got %v, want a valid chain", err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("got a valid chain, want an error")
+			}
+		})
+	}
+}
+
+func TestCustodyEntryHashWithoutFencingToken(t *testing.T) {
+	// Entries without a fencing token hash as they did before the token was added
+	entry := signedChain()[1]
+	entry.FencingToken = 0
+	before := entry.Hash
+
+	if got := custodyEntryHash(entry); got != before {
+		t.Errorf("got %s, want %s", got, before)
+	}
+
+	entry.FencingToken = 1
+	if got := custodyEntryHash(entry); got == before {
+		t.Errorf("a fencing token does not change the hash")
+	}
+}
+
+func TestSubStream(t *testing.T) {
+	tests := []struct {
+		reference string
+		want      string
+	}{
+		{"", ""},
+		{"1715000000.mp4", "1715000000_sub.mp4"},
+		{"https://bucket/camera1/1715000000.mp4", "https://bucket/camera1/1715000000_sub.mp4"},
+	}
+
+	for _, tt := range tests {
+		if got := SubStreamReference(tt.reference); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.reference, got, tt.want)
+		}
+	}
+
+	chain := signedChain()
+	if HasSubStream(chain) {
+		t.Errorf("chain without a sub-stream entry has a sub-stream")
+	}
+
+	chain = append(chain, CustodyEntry{Action: CustodySubStreamCaptured})
+	if !HasSubStream(chain) {
+		t.Errorf("chain with a sub-stream entry has no sub-stream")
+	}
+}
@@ -7,11 +7,14 @@ import (
 	"os/signal"
 	"time"
 
+	dapr "github.com/dapr/go-sdk/client"
 	"github.com/joho/godotenv"
 
 	"github.com/khaledhikmat/threat-detection-shared/service/config"
 	"github.com/khaledhikmat/threat-detection-shared/service/persistence"
+	"github.com/khaledhikmat/threat-detection-shared/service/storage"
 	otelprovider "github.com/khaledhikmat/threat-detection-shared/telemetry/provider"
+	"github.com/khaledhikmat/threat-detection/custody"
 	"github.com/khaledhikmat/threat-detection/media-api/server"
 )
 
@@ -53,10 +56,32 @@ func main() {
 	}()
 
 	persistenceSvc := persistence.New(configSvc)
+	storageSvc := storage.NewAwsStorage(configSvc)
+
+	// The chains of custody are kept in the DAPR state store
+	// Without a DAPR sidecar, clips can still be verified against their capture hash
+	var daprClient dapr.Client
+	if configSvc.GetRuntimeMode() == "dapr" {
+		daprClient, err = dapr.NewClient()
+		if err != nil {
+			fmt.Println("Failed to start dapr client", err)
+			return
+		}
+		defer daprClient.Close()
+	}
 
 	// Inject into server
 	server.ConfigService = configSvc
 	server.PersistenceService = persistenceSvc
+	server.StorageService = storageSvc
+	server.CustodyService, err = custody.NewCustodyLog(daprClient, storageSvc, "media-api")
+	if err != nil {
+		fmt.Println("Failed to start the custody log", err)
+		return
+	}
+	server.TimingService = server.NewClipTimings(daprClient)
+	server.RenditionService = server.NewClipRenditions(daprClient)
+	server.AgentErrorService = server.NewAgentErrors(daprClient)
 
 	port := os.Getenv("APP_PORT")
 	args := os.Args[1:]
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+)
+
+// AgentError is an error of a capturer's camera agent (connect, decode, mux, upload, publish or other).
+// WARNING: Must match the agent errors of the capturer
+type AgentError struct {
+	Capturer string    `json:"capturer"`
+	Camera   string    `json:"camera"`
+	Type     string    `json:"type"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+// AgentErrors reads the cameras' most recent agent errors from the DAPR state store where the capturers keep
+// them under `agent_errors_<camera>`, newest first. Without a DAPR client (i.e. AWS runtime mode), cameras have no errors.
+type AgentErrors struct {
+	DaprClient dapr.Client
+}
+
+func NewAgentErrors(client dapr.Client) *AgentErrors {
+	return &AgentErrors{
+		DaprClient: client,
+	}
+}
+
+// Errors returns the camera's most recent agent errors, newest first. An empty capturer or type matches any.
+func (e *AgentErrors) Errors(ctx context.Context, camera, capturer, typ string) ([]AgentError, error) {
+	matched := []AgentError{}
+	if e.DaprClient == nil {
+		return matched, nil
+	}
+
+	item, err := e.DaprClient.GetState(ctx, models.ThreatDetectionStateStore, fmt.Sprintf("agent_errors_%s", camera), nil)
+	if err != nil {
+		return matched, err
+	}
+
+	if item == nil || len(item.Value) == 0 {
+		return matched, nil
+	}
+
+	all := []AgentError{}
+	err = json.Unmarshal(item.Value, &all)
+	if err != nil {
+		return matched, fmt.Errorf("unable to decode the agent errors of camera %s: %v", camera, err)
+	}
+
+	for _, agentErr := range all {
+		if (capturer == "" || agentErr.Capturer == capturer) && (typ == "" || agentErr.Type == typ) {
+			matched = append(matched, agentErr)
+		}
+	}
+
+	return matched, nil
+}
@@ -4,8 +4,13 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+
+	"github.com/khaledhikmat/threat-detection/custody"
 )
 
 func homeRoutes(_ context.Context, r *gin.Engine) {
@@ -141,7 +146,7 @@ func homeRoutes(_ context.Context, r *gin.Engine) {
 
 	r.GET("/clip", func(c *gin.Context) {
 		invocationsCounter.Add(c.Request.Context(), 1)
-		_, span := tracer.Start(c.Request.Context(), "clip-route")
+		ctx, span := tracer.Start(c.Request.Context(), "clip-route")
 		defer span.End()
 
 		fmt.Printf("***** 🎥 clip id: %s\n", c.Query("id"))
@@ -166,10 +171,153 @@ func homeRoutes(_ context.Context, r *gin.Engine) {
 		}
 
 		fmt.Printf("***** 🎥 clip id return: %s\n", clip.ID)
+
+		// The clip's capture time as measured by the capturer...the clip is shown without it if it fails
+		timing, err := TimingService.Timing(ctx, capturedClipID(clip))
+		if err != nil {
+			span.RecordError(err)
+		}
+
+		// The clip's renditions play where the clip does not (i.e. H265)...the clip is shown without them if they fail
+		renditions, err := RenditionService.Renditions(ctx, capturedClipID(clip))
+		if err != nil {
+			span.RecordError(err)
+		}
+
 		c.HTML(200, target, gin.H{
-			"Tab":   "Home",
-			"Error": "",
-			"Clip":  clip,
+			"Tab":        "Home",
+			"Error":      "",
+			"Clip":       clip,
+			"Timing":     timing,
+			"Renditions": renditions,
+		})
+	})
+
+	r.GET("/clip/custody", func(c *gin.Context) {
+		invocationsCounter.Add(c.Request.Context(), 1)
+		ctx, span := tracer.Start(c.Request.Context(), "clip-custody-route")
+		defer span.End()
+
+		target := "clip-custody.html"
+		if c.Query("id") == "" {
+			c.HTML(200, target, gin.H{
+				"Error": "Clip id is missing!",
+			})
+			span.RecordError(fmt.Errorf("clip id is missing"))
+			return
+		}
+
+		clip, err := PersistenceService.RetrieveClipByID(c.Query("id"))
+		if err != nil {
+			c.HTML(200, target, gin.H{
+				"Error": err.Error(),
+			})
+			span.RecordError(err)
+			return
+		}
+
+		clipID := capturedClipID(clip)
+
+		// Verify the chain of custody is intact and starts with the capture of this clip
+		captureHash := ""
+		chainError := ""
+		chain, err := CustodyService.Chain(ctx, clipID)
+		if err != nil {
+			chainError = err.Error()
+			span.RecordError(err)
+		} else if len(chain) == 0 {
+			chainError = "clip has no chain of custody"
+		} else if e := custody.VerifyCustodyChain(chain, CustodyService.SigningKey); e != nil {
+			chainError = e.Error()
+		} else if chain[0].Action != custody.CustodyCaptured || chain[0].ClipHash == "" {
+			chainError = "chain of custody does not start with the capture of this clip"
+		} else {
+			captureHash = chain[0].ClipHash
+		}
+
+		// Verify the stored clip against the hash recorded at capture
+		storedHash := ""
+		clipError := ""
+		b, err := StorageService.RetrieveRecordingClip(ctx, clip)
+		if err != nil {
+			clipError = err.Error()
+			span.RecordError(err)
+		} else {
+			storedHash = custody.ClipHash(b)
+			if captureHash == "" {
+				clipError = "clip has no capture hash to verify against"
+			} else if captureHash != storedHash {
+				clipError = "clip was modified since capture"
+			}
+		}
+
+		verified := clipError == "" && chainError == ""
+		if c.Query("format") == "json" {
+			c.JSON(200, gin.H{
+				"clipId":      clipID,
+				"verified":    verified,
+				"captureHash": captureHash,
+				"storedHash":  storedHash,
+				"clipError":   clipError,
+				"chainError":  chainError,
+				"chain":       chain,
+			})
+			return
+		}
+
+		c.HTML(200, target, gin.H{
+			"Error":       "",
+			"ClipID":      clipID,
+			"Verified":    verified,
+			"CaptureHash": captureHash,
+			"StoredHash":  storedHash,
+			"ClipError":   clipError,
+			"ChainError":  chainError,
+			"Chain":       chain,
+		})
+	})
+
+	r.GET("/camera/errors", func(c *gin.Context) {
+		invocationsCounter.Add(c.Request.Context(), 1)
+		ctx, span := tracer.Start(c.Request.Context(), "camera-errors-route")
+		defer span.End()
+
+		target := "camera-errors.html"
+		if c.Query("camera") == "" {
+			c.HTML(200, target, gin.H{
+				"Error": "Camera is missing!",
+			})
+			span.RecordError(fmt.Errorf("camera is missing"))
+			return
+		}
+
+		// The camera's most recent agent errors, optionally of a capturer and of a type (i.e. decode)
+		agentErrors, err := AgentErrorService.Errors(ctx, c.Query("camera"), c.Query("capturer"), c.Query("type"))
+		if err != nil {
+			span.RecordError(err)
+		}
+
+		if c.Query("format") == "json" {
+			if err != nil {
+				c.JSON(500, gin.H{
+					"error": err.Error(),
+				})
+				return
+			}
+
+			c.JSON(200, agentErrors)
+			return
+		}
+
+		errorMessage := ""
+		if err != nil {
+			errorMessage = err.Error()
+		}
+
+		c.HTML(200, target, gin.H{
+			"Error":  errorMessage,
+			"Camera": c.Query("camera"),
+			"Errors": agentErrors,
 		})
 	})
 
@@ -180,3 +328,9 @@ func homeRoutes(_ context.Context, r *gin.Engine) {
 		c.Redirect(303, fmt.Sprintf("/clips?t=%s&p=%s&s=%s", c.Query("t"), c.Query("p"), c.Query("s")))
 	})
 }
+
+// capturedClipID returns the id the capturer gave the clip: the media indexer suffixes it with the model invoker
+// and the clip type.
+func capturedClipID(clip models.RecordingClip) string {
+	return strings.TrimSuffix(clip.ID, fmt.Sprintf("-%s-%d", clip.ModelInvoker, clip.ClipType))
+}
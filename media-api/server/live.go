@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrCapturerNotFound is returned for a capturer that is not in `CAPTURER_API_URLS`.
+var ErrCapturerNotFound = errors.New("capturer not found")
+
+// The capturer names its WebRTC viewers with UUIDs
+var viewerIDPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// liveRoutes serves the live pages and proxies the live streams to the capturers listed in `CAPTURER_API_URLS`.
+// The capturers' control API key is sent along, so the routes require the `LIVE_USERNAME` and `LIVE_PASSWORD`
+// basic authentication credentials. Without capturers, live streaming is disabled.
+func liveRoutes(_ context.Context, r *gin.Engine) error {
+	capturers, err := capturerURLs()
+	if err != nil {
+		return err
+	}
+
+	if len(capturers) == 0 {
+		fmt.Println("CAPTURER_API_URLS env var is not set...live streaming is disabled")
+		return nil
+	}
+
+	username := os.Getenv("LIVE_USERNAME")
+	password := os.Getenv("LIVE_PASSWORD")
+	if username == "" || password == "" {
+		return fmt.Errorf("%s and %s env vars are required to serve live streams", "LIVE_USERNAME", "LIVE_PASSWORD")
+	}
+
+	live := r.Group("/", gin.BasicAuth(gin.Accounts{username: password}))
+
+	//=========================
+	// PAGES
+	//=========================
+	live.GET("/live", func(c *gin.Context) {
+		invocationsCounter.Add(c.Request.Context(), 1)
+		_, span := tracer.Start(c.Request.Context(), "live-route")
+		defer span.End()
+
+		target := "live.html"
+		liveError := ""
+		if c.Query("camera") == "" || c.Query("capturer") == "" {
+			liveError = "Camera or capturer is missing!"
+			span.RecordError(fmt.Errorf("camera or capturer is missing"))
+		}
+
+		c.HTML(200, target, gin.H{
+			"Tab":       "Live",
+			"LiveError": liveError,
+			"Camera":    c.Query("camera"),
+			"Capturer":  c.Query("capturer"),
+		})
+	})
+
+	live.GET("/watch", func(c *gin.Context) {
+		invocationsCounter.Add(c.Request.Context(), 1)
+		_, span := tracer.Start(c.Request.Context(), "watch-route")
+		defer span.End()
+
+		target := "watch.html"
+		watchError := ""
+		if c.Query("camera") == "" || c.Query("capturer") == "" {
+			watchError = "Camera or capturer is missing!"
+			span.RecordError(fmt.Errorf("camera or capturer is missing"))
+		}
+
+		c.HTML(200, target, gin.H{
+			"Tab":        "Live",
+			"WatchError": watchError,
+			"Camera":     c.Query("camera"),
+			"Capturer":   c.Query("capturer"),
+		})
+	})
+
+	//=========================
+	// STREAMS
+	//=========================
+	// The HLS files are proxied to the capturer that streams the camera
+	live.GET("/live/:capturer/:camera/:file", func(c *gin.Context) {
+		invocationsCounter.Add(c.Request.Context(), 1)
+		_, span := tracer.Start(c.Request.Context(), "live-stream-route")
+		defer span.End()
+
+		target, ok := capturers[c.Param("capturer")]
+		if !ok {
+			span.RecordError(ErrCapturerNotFound)
+			c.String(http.StatusNotFound, ErrCapturerNotFound.Error())
+			return
+		}
+
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(target)
+				pr.Out.URL.Path = fmt.Sprintf("%s/live/%s/%s", strings.TrimSuffix(target.Path, "/"), url.PathEscape(c.Param("camera")), url.PathEscape(c.Param("file")))
+				pr.Out.URL.RawPath = ""
+				pr.Out.Header.Set("Authorization", "Bearer "+os.Getenv("CAPTURER_API_KEY"))
+			},
+			ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+				span.RecordError(err)
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		}
+		proxy.ServeHTTP(c.Writer, c.Request)
+	})
+
+	// WebRTC signalling (WHEP) is proxied to the capturer that streams the camera
+	live.POST("/whep/:capturer/:camera", func(c *gin.Context) {
+		invocationsCounter.Add(c.Request.Context(), 1)
+		_, span := tracer.Start(c.Request.Context(), "whep-offer-route")
+		defer span.End()
+
+		whepProxy(c, capturers, func(err error) { span.RecordError(err) }, "")
+	})
+
+	live.DELETE("/whep/:capturer/:camera/:id", func(c *gin.Context) {
+		invocationsCounter.Add(c.Request.Context(), 1)
+		_, span := tracer.Start(c.Request.Context(), "whep-hangup-route")
+		defer span.End()
+
+		if !viewerIDPattern.MatchString(c.Param("id")) {
+			span.RecordError(fmt.Errorf("invalid viewer %s", c.Param("id")))
+			c.String(http.StatusBadRequest, "invalid viewer")
+			return
+		}
+
+		whepProxy(c, capturers, func(err error) { span.RecordError(err) }, c.Param("id"))
+	})
+
+	return nil
+}
+
+// whepProxy forwards a WHEP request to the capturer and rewrites the viewer's resource (`Location`)
+// to the media API's `/whep/<capturer>/<camera>/<id>`. A resource that is not a viewer of the camera is a bad gateway.
+func whepProxy(c *gin.Context, capturers map[string]*url.URL, recordError func(err error), id string) {
+	target, ok := capturers[c.Param("capturer")]
+	if !ok {
+		recordError(ErrCapturerNotFound)
+		c.String(http.StatusNotFound, ErrCapturerNotFound.Error())
+		return
+	}
+
+	path := fmt.Sprintf("%s/whep/%s", strings.TrimSuffix(target.Path, "/"), url.PathEscape(c.Param("camera")))
+	if id != "" {
+		path += "/" + url.PathEscape(id)
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.URL.Path = path
+			pr.Out.URL.RawPath = ""
+			pr.Out.Header.Set("Authorization", "Bearer "+os.Getenv("CAPTURER_API_KEY"))
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			location := resp.Header.Get("Location")
+			if location == "" {
+				return nil
+			}
+
+			// The capturer answers with `/whep/<camera>/<id>`
+			viewer := strings.TrimPrefix(location, fmt.Sprintf("/whep/%s/", url.PathEscape(c.Param("camera"))))
+			if viewer == location || !viewerIDPattern.MatchString(viewer) {
+				return fmt.Errorf("capturer %s answered with an invalid viewer resource %q", c.Param("capturer"), location)
+			}
+
+			resp.Header.Set("Location", fmt.Sprintf("/whep/%s/%s/%s", url.PathEscape(c.Param("capturer")), url.PathEscape(c.Param("camera")), viewer))
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			recordError(err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// capturerURLs returns the control API URLs of the capturers keyed by their names. They are listed in
+// `CAPTURER_API_URLS` as comma-separated `<capturer>=<url>` pairs (i.e. `capturer1=http://10.0.0.5:8080`).
+func capturerURLs() (map[string]*url.URL, error) {
+	capturers := map[string]*url.URL{}
+	for _, pair := range strings.Split(os.Getenv("CAPTURER_API_URLS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, apiURL, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return capturers, fmt.Errorf("invalid capturer %q in CAPTURER_API_URLS, expected <capturer>=<url>", pair)
+		}
+
+		u, err := url.Parse(apiURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return capturers, fmt.Errorf("invalid URL of capturer %s in CAPTURER_API_URLS: %q", name, apiURL)
+		}
+
+		capturers[name] = u
+	}
+
+	return capturers, nil
+}
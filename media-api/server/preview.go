@@ -0,0 +1,25 @@
+package server
+
+import (
+	"path"
+	"strings"
+)
+
+// The capturer uploads the clip's thumbnail and sprite sheet next to the clip:
+// `<clip>.jpg` and `<clip>_sprite.jpg` instead of `<clip>.mp4`.
+
+func ThumbnailReference(cloudReference string) string {
+	return previewReference(cloudReference, ".jpg")
+}
+
+func SpriteReference(cloudReference string) string {
+	return previewReference(cloudReference, "_sprite.jpg")
+}
+
+func previewReference(cloudReference, suffix string) string {
+	if cloudReference == "" {
+		return ""
+	}
+
+	return strings.TrimSuffix(cloudReference, path.Ext(cloudReference)) + suffix
+}
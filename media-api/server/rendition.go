@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	dapr "github.com/dapr/go-sdk/client"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+)
+
+// ClipRendition is a rendition of a clip transcoded by the capturer (i.e. H264 baseline 720p for browsers).
+// WARNING: Must match the rendition of the capturer
+type ClipRendition struct {
+	Profile   string `json:"profile"`
+	Reference string `json:"reference"`
+}
+
+// ClipRenditions reads the clips' renditions from the DAPR state store where the capturers keep them under
+// `renditions_<clip id>`. Without a DAPR client (i.e. AWS runtime mode), clips have no renditions.
+type ClipRenditions struct {
+	DaprClient dapr.Client
+}
+
+func NewClipRenditions(client dapr.Client) *ClipRenditions {
+	return &ClipRenditions{
+		DaprClient: client,
+	}
+}
+
+// Renditions returns the clip's renditions, the passthrough rendition first, or nil if it has none.
+func (r *ClipRenditions) Renditions(ctx context.Context, clipID string) ([]ClipRendition, error) {
+	if r.DaprClient == nil {
+		return nil, nil
+	}
+
+	item, err := r.DaprClient.GetState(ctx, models.ThreatDetectionStateStore, fmt.Sprintf("renditions_%s", clipID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil || len(item.Value) == 0 {
+		return nil, nil
+	}
+
+	renditions := []ClipRendition{}
+	err = json.Unmarshal(item.Value, &renditions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode the renditions of clip %s: %v", clipID, err)
+	}
+
+	return renditions, nil
+}
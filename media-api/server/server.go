@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"fmt"
+	"html/template"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -12,6 +13,9 @@ import (
 
 	"github.com/khaledhikmat/threat-detection-shared/service/config"
 	"github.com/khaledhikmat/threat-detection-shared/service/persistence"
+	"github.com/khaledhikmat/threat-detection-shared/service/storage"
+
+	"github.com/khaledhikmat/threat-detection/custody"
 )
 
 var (
@@ -37,6 +41,11 @@ func init() {
 // Injected DAPR client and other services
 var ConfigService config.IService
 var PersistenceService persistence.IService
+var StorageService storage.IService
+var CustodyService *custody.CustodyLog
+var TimingService *ClipTimings
+var RenditionService *ClipRenditions
+var AgentErrorService *AgentErrors
 
 type ginWithContext func(ctx context.Context) error
 
@@ -53,6 +62,10 @@ func Run(canxCtx context.Context, port string) error {
 	r.Use(cors.New(config))
 
 	// Set function map if any...
+	r.SetFuncMap(template.FuncMap{
+		"thumbnail": ThumbnailReference,
+		"sprite":    SpriteReference,
+	})
 
 	// Link up templates and static files
 	r.LoadHTMLGlob("./templates/**/*")
@@ -63,6 +76,14 @@ func Run(canxCtx context.Context, port string) error {
 	//=========================
 	homeRoutes(canxCtx, r)
 
+	//=========================
+	// Setup Live ROUTES
+	//=========================
+	err := liveRoutes(canxCtx, r)
+	if err != nil {
+		return err
+	}
+
 	f := cancellableGin(canxCtx, r, port)
 	return f(canxCtx)
 }
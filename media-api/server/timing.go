@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+)
+
+// ClipTiming is the media time the capturer measured for a clip. The clock is `camera` when the clip is
+// anchored to the camera's wall-clock (RTCP sender reports) or `capturer` when it is anchored to the time
+// the capturer received the frames.
+// WARNING: Must match the clip timing of the capturer
+type ClipTiming struct {
+	ClipID        string    `json:"clipId"`
+	Camera        string    `json:"camera"`
+	Clock         string    `json:"clock"`
+	BeginTime     time.Time `json:"beginTime"`
+	EndTime       time.Time `json:"endTime"`
+	Duration      int64     `json:"duration"` // milliseconds
+	Frames        int       `json:"frames"`
+	FPS           float64   `json:"fps"`
+	DroppedFrames int       `json:"droppedFrames"`
+}
+
+// ClipTimings reads the clips' timings from the DAPR state store where the capturers keep them under
+// `timing_<clip id>`. Without a DAPR client (i.e. AWS runtime mode), clips have no timing.
+type ClipTimings struct {
+	DaprClient dapr.Client
+}
+
+func NewClipTimings(client dapr.Client) *ClipTimings {
+	return &ClipTimings{
+		DaprClient: client,
+	}
+}
+
+// Timing returns the clip's timing or nil if it has none.
+func (t *ClipTimings) Timing(ctx context.Context, clipID string) (*ClipTiming, error) {
+	if t.DaprClient == nil {
+		return nil, nil
+	}
+
+	item, err := t.DaprClient.GetState(ctx, models.ThreatDetectionStateStore, fmt.Sprintf("timing_%s", clipID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil || len(item.Value) == 0 {
+		return nil, nil
+	}
+
+	timing := &ClipTiming{}
+	err = json.Unmarshal(item.Value, timing)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode the timing of clip %s: %v", clipID, err)
+	}
+
+	return timing, nil
+}
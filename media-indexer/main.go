@@ -23,7 +23,10 @@ import (
 	"github.com/khaledhikmat/threat-detection-shared/service/config"
 	"github.com/khaledhikmat/threat-detection-shared/service/persistence"
 	"github.com/khaledhikmat/threat-detection-shared/service/pubsub"
+	"github.com/khaledhikmat/threat-detection-shared/service/storage"
 	otelprovider "github.com/khaledhikmat/threat-detection-shared/telemetry/provider"
+
+	"github.com/khaledhikmat/threat-detection/custody"
 )
 
 var metadataTopicSubscription = &common.Subscription{
@@ -35,6 +38,8 @@ var metadataTopicSubscription = &common.Subscription{
 var configSvc config.IService
 var pubsubSvc pubsub.IService
 var persistenceSvc persistence.IService
+var storageSvc storage.IService
+var custodyLog *custody.CustodyLog
 
 var metadataTopic = models.MetadataTopic
 
@@ -109,6 +114,14 @@ func daprModeProc(_ context.Context) error {
 	}
 	defer c.Close()
 
+	// WARNING I am using AWS storage while in DAPR runtime mode because I can store to S3
+	storageSvc = storage.NewAwsStorage(configSvc)
+	custodyLog, err = custody.NewCustodyLog(c, storageSvc, fmt.Sprintf("media-indexer-%s", configSvc.GetSupportedMediaIndexType()))
+	if err != nil {
+		fmt.Println("Failed to start the custody log", err)
+		return err
+	}
+
 	// Create a DAPR service using the app port
 	s := daprd.NewService(":" + os.Getenv("APP_PORT"))
 	fmt.Printf("Media Indexer - DAPR Service for %s created!\n", configSvc.GetSupportedMediaIndexType())
@@ -142,6 +155,13 @@ func daprIndexerHandler(ctx context.Context, e *common.TopicEvent) (bool, error)
 
 func awsModeProc(ctx context.Context) error {
 	pubsubSvc = pubsub.NewAwsPubsub(configSvc)
+	storageSvc = storage.NewAwsStorage(configSvc)
+	var err error
+	custodyLog, err = custody.NewCustodyLog(nil, storageSvc, fmt.Sprintf("media-indexer-%s", configSvc.GetSupportedMediaIndexType()))
+	if err != nil {
+		fmt.Println("Failed to start the custody log", err)
+		return err
+	}
 
 	// Create a topic for my metadata if it does not exist
 	// There could be some competition here, but we will ignore it for now
@@ -200,6 +220,13 @@ func processRecordingClip(ctx context.Context, evt models.RecordingClip) error {
 
 	fmt.Printf("Processing the clip because our supported index type [%s] is needed\n", configSvc.GetSupportedMediaIndexType())
 
+	// Only index clips that were not modified since capture
+	_, err := custodyLog.RetrieveVerifiedClip(ctx, evt)
+	if err != nil {
+		fmt.Printf("Failed to verify the clip %s: %v\n", evt.ID, err)
+		return err
+	}
+
 	// Before we do send off the clip to the media indexer:
 	// Modify the ID to include the model invoker and the type
 	// Record the index time and the duration times
@@ -215,7 +242,7 @@ func processRecordingClip(ctx context.Context, evt models.RecordingClip) error {
 		return fmt.Errorf("Index processor %s not supported", configSvc.GetSupportedMediaIndexType())
 	}
 
-	err := fn(ctx, evt)
+	err = fn(ctx, evt)
 	if err != nil {
 		fmt.Printf("Index processor returned an error %s\n", err.Error())
 		return err
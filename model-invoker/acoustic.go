@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/yapingcat/gomedia/go-mp4"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+)
+
+// audioTrack is the audio track extracted from a recording clip.
+type audioTrack struct {
+	Codec      string   `json:"codec"` // AAC, PCMU or PCMA
+	SampleRate int      `json:"sampleRate"`
+	Channels   int      `json:"channels"`
+	Frames     [][]byte `json:"frames"`
+	Pts        []uint64 `json:"pts"` // milliseconds
+}
+
+// acousticEvent is an acoustic event found in a clip's audio track.
+type acousticEvent struct {
+	Label      string  `json:"label"`
+	Confidence float64 `json:"confidence"`
+	Offset     int64   `json:"offset"` // milliseconds from the start of the clip
+}
+
+// acousticClassifier classifies the audio track of a clip into acoustic events.
+type acousticClassifier interface {
+	Classify(ctx context.Context, clip models.RecordingClip, track audioTrack) ([]acousticEvent, error)
+}
+
+var acousticClassifiers = map[string]acousticClassifier{
+	"stub": stubClassifier{},
+	"api":  apiClassifier{},
+}
+
+// The acoustic classifier is selected by AUDIO_CLASSIFIER. If it is not set, the API is used
+// when there is one, otherwise the local stub.
+func acousticClassifierName() string {
+	if os.Getenv("AUDIO_CLASSIFIER") != "" {
+		return os.Getenv("AUDIO_CLASSIFIER")
+	}
+
+	if os.Getenv("INVOKER_API") != "" {
+		return "api"
+	}
+
+	return "stub"
+}
+
+// extractAudioTrack demuxes the first audio track from an MP4 clip. It returns nil if the clip has no audio.
+func extractAudioTrack(clip []byte) (*audioTrack, error) {
+	demuxer := mp4.CreateMp4Demuxer(bytes.NewReader(clip))
+	infos, err := demuxer.ReadHead()
+	if err != nil {
+		return nil, err
+	}
+
+	var track *audioTrack
+	trackID := 0
+	for _, info := range infos {
+		codec := ""
+		switch info.Cid {
+		case mp4.MP4_CODEC_AAC:
+			codec = "AAC"
+		case mp4.MP4_CODEC_G711U:
+			codec = "PCMU"
+		case mp4.MP4_CODEC_G711A:
+			codec = "PCMA"
+		default:
+			continue
+		}
+
+		trackID = info.TrackId
+		track = &audioTrack{
+			Codec:      codec,
+			SampleRate: int(info.SampleRate),
+			Channels:   int(info.ChannelCount),
+			Frames:     [][]byte{},
+			Pts:        []uint64{},
+		}
+		break
+	}
+
+	if track == nil {
+		return nil, nil
+	}
+
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if pkt.TrackId != trackID {
+			continue
+		}
+
+		track.Frames = append(track.Frames, pkt.Data)
+		track.Pts = append(track.Pts, pkt.Pts)
+	}
+
+	return track, nil
+}
+
+//=========================
+// STUB
+//=========================
+
+const (
+	// An impulse much louder than the background that fades quickly sounds like a gunshot
+	stubGunshotRatio = 8.0
+	// A loud burst that lasts longer sounds like breaking glass
+	stubGlassBreakRatio    = 4.0
+	stubGlassBreakDuration = 300 // milliseconds
+)
+
+// stubClassifier is a deterministic stand-in for an acoustic model, meant for tests and demos. It compares the
+// level of every frame against the track's background level, so the same clip always produces the same events.
+// G711 frames are decoded to PCM and their level is their mean energy. AAC is not decoded: the level of an AAC
+// frame is the size of its access unit in bytes. That only follows the encoder's bitrate, not the loudness, so
+// on AAC the stub flags bursts of bits (i.e. a sudden complex sound) and is no acoustic detector.
+type stubClassifier struct{}
+
+func (stubClassifier) Classify(_ context.Context, _ models.RecordingClip, track audioTrack) ([]acousticEvent, error) {
+	envelope, offsets := loudnessEnvelope(track)
+	if len(envelope) == 0 {
+		return []acousticEvent{}, nil
+	}
+
+	// The background level is the median loudness
+	sorted := append([]float64{}, envelope...)
+	sort.Float64s(sorted)
+	background := sorted[len(sorted)/2]
+	if background <= 0 {
+		background = 1
+	}
+
+	events := []acousticEvent{}
+	for i := 0; i < len(envelope); i++ {
+		ratio := envelope[i] / background
+		if ratio < stubGlassBreakRatio {
+			continue
+		}
+
+		// Measure how long the burst lasts
+		j := i
+		for j+1 < len(envelope) && envelope[j+1]/background >= stubGlassBreakRatio {
+			j++
+		}
+		duration := offsets[j] - offsets[i]
+
+		if ratio >= stubGunshotRatio && duration < stubGlassBreakDuration {
+			events = append(events, acousticEvent{
+				Label:      "gunshot",
+				Confidence: confidence(ratio, stubGunshotRatio),
+				Offset:     offsets[i],
+			})
+		} else if duration >= stubGlassBreakDuration {
+			events = append(events, acousticEvent{
+				Label:      "glass-break",
+				Confidence: confidence(ratio, stubGlassBreakRatio),
+				Offset:     offsets[i],
+			})
+		}
+
+		// Skip the rest of the burst
+		i = j
+	}
+
+	return events, nil
+}
+
+func confidence(ratio, threshold float64) float64 {
+	c := 0.5 + (ratio-threshold)/(2*threshold)
+	if c > 1 {
+		return 1
+	}
+	return c
+}
+
+// loudnessEnvelope returns one level per frame (the mean energy of G711 frames, the size of AAC access units)
+// and its offset (milliseconds) from the first frame.
+func loudnessEnvelope(track audioTrack) ([]float64, []int64) {
+	envelope := []float64{}
+	offsets := []int64{}
+	for i, frame := range track.Frames {
+		if len(frame) == 0 {
+			continue
+		}
+
+		loudness := float64(len(frame))
+		if track.Codec == "PCMU" || track.Codec == "PCMA" {
+			sum := 0.0
+			for _, b := range frame {
+				sample := float64(g711ToLinear(b, track.Codec == "PCMU"))
+				sum += sample * sample
+			}
+			loudness = sum / float64(len(frame))
+		}
+
+		envelope = append(envelope, loudness)
+		offsets = append(offsets, int64(track.Pts[i]-track.Pts[0]))
+	}
+	return envelope, offsets
+}
+
+// g711ToLinear decodes a G711 (mu-law or a-law) sample to 16 bits linear PCM.
+func g711ToLinear(b byte, muLaw bool) int16 {
+	if muLaw {
+		b = ^b
+		t := (int16(b&0x0f) << 3) + 0x84
+		t <<= (b & 0x70) >> 4
+		if b&0x80 != 0 {
+			return 0x84 - t
+		}
+		return t - 0x84
+	}
+
+	b ^= 0x55
+	t := int16(b&0x0f) << 4
+	seg := (b & 0x70) >> 4
+	switch seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if b&0x80 != 0 {
+		return t
+	}
+	return -t
+}
+
+//=========================
+// API
+//=========================
+
+// WARNING: Must match the Python API models
+type audioModelRequest struct {
+	ID    string     `json:"id"`
+	URL   string     `json:"url"`
+	Track audioTrack `json:"track"`
+}
+
+type audioModelResponse struct {
+	ID     string          `json:"id"`
+	Events []acousticEvent `json:"events"`
+}
+
+// apiClassifier calls an acoustic model API at INVOKER_API.
+type apiClassifier struct{}
+
+func (apiClassifier) Classify(ctx context.Context, clip models.RecordingClip, track audioTrack) ([]acousticEvent, error) {
+	start := time.Now()
+
+	apiClient := &http.Client{
+		Transport: &headerRoundTripper{
+			Next: &loggingRoundTripper{
+				Next:   http.DefaultTransport,
+				Logger: os.Stdout,
+			},
+		},
+	}
+
+	modelRequest := audioModelRequest{
+		ID:    clip.ID,
+		URL:   clip.CloudReference,
+		Track: track,
+	}
+
+	modelResponse := audioModelResponse{}
+
+	payloadBuf := new(bytes.Buffer)
+	err := json.NewEncoder(payloadBuf).Encode(&modelRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", os.Getenv("INVOKER_API"), payloadBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("audio model API returned %d: %s", res.StatusCode, string(body))
+	}
+
+	err = json.Unmarshal(body, &modelResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Calling the audio model API took %v\n", time.Since(start))
+	return modelResponse.Events, nil
+}
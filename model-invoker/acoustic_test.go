@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+)
+
+const (
+	g711Quiet = 0xfe // mu-law sample of 8
+	g711Loud  = 0x80 // mu-law sample of 32124
+)
+
+// g711Track returns a 20ms per frame mu-law track where the frames in [loudFrom, loudTo) are loud.
+func g711Track(frames, loudFrom, loudTo int) audioTrack {
+	track := audioTrack{Codec: "PCMU", SampleRate: 8000, Channels: 1}
+	for i := 0; i < frames; i++ {
+		sample := byte(g711Quiet)
+		if i >= loudFrom && i < loudTo {
+			sample = g711Loud
+		}
+		track.Frames = append(track.Frames, bytes.Repeat([]byte{sample}, 160))
+		track.Pts = append(track.Pts, uint64(i*20))
+	}
+	return track
+}
+
+// aacTrack returns a 20ms per frame AAC track with access units of the sizes.
+func aacTrack(sizes ...int) audioTrack {
+	track := audioTrack{Codec: "AAC", SampleRate: 48000, Channels: 1}
+	for i, size := range sizes {
+		track.Frames = append(track.Frames, make([]byte, size))
+		track.Pts = append(track.Pts, uint64(i*20))
+	}
+	return track
+}
+
+func TestStubClassifier(t *testing.T) {
+	tests := []struct {
+		name  string
+		track audioTrack
+		want  []acousticEvent
+	}{
+		{
+			name:  "no frames",
+			track: audioTrack{Codec: "PCMU"},
+			want:  []acousticEvent{},
+		},
+		{
+			name:  "quiet g711",
+			track: g711Track(50, 0, 0),
+			want:  []acousticEvent{},
+		},
+		{
+			name:  "g711 impulse is a gunshot",
+			track: g711Track(50, 20, 21),
+			want:  []acousticEvent{{Label: "gunshot", Confidence: 1, Offset: 400}},
+		},
+		{
+			name:  "g711 long burst is a glass break",
+			track: g711Track(50, 10, 30),
+			want:  []acousticEvent{{Label: "glass-break", Confidence: 1, Offset: 200}},
+		},
+		{
+			name:  "g711 short burst is a gunshot",
+			track: g711Track(50, 10, 13),
+			want:  []acousticEvent{{Label: "gunshot", Confidence: 1, Offset: 200}},
+		},
+		{
+			name:  "short moderate aac burst is neither",
+			track: aacTrack(100, 100, 500, 100, 100),
+			want:  []acousticEvent{},
+		},
+		{
+			name:  "steady aac",
+			track: aacTrack(100, 100, 100, 100, 100),
+			want:  []acousticEvent{},
+		},
+		{
+			name:  "large aac access unit is a gunshot",
+			track: aacTrack(100, 100, 1000, 100, 100),
+			want:  []acousticEvent{{Label: "gunshot", Confidence: 0.625, Offset: 40}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The stub is deterministic: the same track always produces the same events
+			for run := 0; run < 2; run++ {
+				got, err := stubClassifier{}.Classify(context.Background(), models.RecordingClip{}, tt.track)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("run %d: got %v, want %v", run, got, tt.want)
+				}
+			}
+		})
+	}
+}
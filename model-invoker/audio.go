@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/khaledhikmat/threat-detection-shared/models"
+	"github.com/khaledhikmat/threat-detection-shared/utils"
+
+	"github.com/khaledhikmat/threat-detection/custody"
+)
+
+// Acoustic events that raise an alert
+var audioAlertLabels = []string{"gunshot", "glass-break"}
+
+func audio(ctx context.Context, clip models.RecordingClip) error {
+	fmt.Printf("audio model invoker received a recording clip - MODEL %s - CLOUD REF %s - PROVIDER %s - CAPTURER %s - AGENT %s\n",
+		configSvc.GetSupportedAIModel(), clip.CloudReference, clip.StorageProvider, clip.Capturer, clip.Camera)
+
+	classifier, ok := acousticClassifiers[acousticClassifierName()]
+	if !ok {
+		return fmt.Errorf("audio model invoker does not support the %s acoustic classifier", acousticClassifierName())
+	}
+
+	// Retrieve the recording clip from storage and verify it was not modified since capture
+	start := time.Now()
+	b, err := custodyLog.RetrieveVerifiedClip(ctx, clip)
+	if err != nil {
+		fmt.Println("Failed to retrieve event's clip", err)
+		return err
+	}
+	fmt.Printf("Retrieved clip for audio model invoker in %v\n", time.Since(start))
+
+	// Extract the audio track
+	track, err := extractAudioTrack(b)
+	if err != nil {
+		fmt.Printf("audio model invoker is unable to extract the audio track: %s %v\n", clip.LocalReference, err)
+		return err
+	}
+
+	recordAnalysis(ctx, clip, custody.ClipHash(b))
+
+	tags := []string{}
+	if track == nil {
+		fmt.Printf("audio model invoker found no audio track: %s\n", clip.LocalReference)
+	} else {
+		// Classify the audio track and turn confident events into tags
+		events, err := classifier.Classify(ctx, clip, *track)
+		if err != nil {
+			fmt.Printf("audio model invoker is unable to classify the audio track: %s %v\n", clip.LocalReference, err)
+			return err
+		}
+
+		for _, event := range events {
+			if event.Confidence < audioConfidenceThreshold() {
+				continue
+			}
+
+			fmt.Printf("audio model invoker detected %s at %dms with confidence %.2f: %s\n", event.Label, event.Offset, event.Confidence, clip.LocalReference)
+			tags = append(tags, event.Label)
+		}
+	}
+
+	// Add the tags to the clip
+	clip.Tags = tags
+	clip.TagsCount = len(tags)
+	clip.ModelInvoker = "audio"
+
+	// Check if the tags contain an alert label which means a threat was heard
+	for _, label := range audioAlertLabels {
+		if !utils.Contains(tags, label) {
+			continue
+		}
+
+		clip.AlertsCount = 1
+		clip.ClipType = 1 // Denote alert type
+		// Publish to the alerts topic
+		fmt.Printf("audio model invoker publishes an alert: %s - tags: %d\n", clip.LocalReference, len(clip.Tags))
+		// Indicate the model invocation has ended
+		clip.ModelInvocationEndTime = time.Now()
+		err = pubsubSvc.PublishRecordingClip(ctx, models.ThreatDetectionPubSub, alertsTopic, clip)
+		if err != nil {
+			fmt.Printf("audio model invoker is unable to publish event to the alert topic: %s %v\n", clip.LocalReference, err)
+		}
+		break
+	}
+
+	// Always publish to the metadata topic
+	fmt.Printf("audio model invoker publishes metadata: %s - tags: %d\n", clip.LocalReference, len(clip.Tags))
+	clip.ClipType = 0 // Denote metadata type
+	// Indicate the model invocation has ended
+	clip.ModelInvocationEndTime = time.Now()
+	err = pubsubSvc.PublishRecordingClip(ctx, models.ThreatDetectionPubSub, metadataTopic, clip)
+	if err != nil {
+		fmt.Printf("audio model invoker is unable to publish event to the metadata topic: %s %v\n", clip.LocalReference, err)
+	}
+
+	return nil
+}
+
+// Acoustic events below this confidence (0 ~ 1) are ignored.
+func audioConfidenceThreshold() float64 {
+	threshold, err := strconv.ParseFloat(os.Getenv("AUDIO_CONFIDENCE_THRESHOLD"), 64)
+	if err != nil || threshold <= 0 {
+		threshold = 0.6
+	}
+
+	return threshold
+}
@@ -13,6 +13,8 @@ import (
 
 	"github.com/khaledhikmat/threat-detection-shared/models"
 	"github.com/khaledhikmat/threat-detection-shared/utils"
+
+	"github.com/khaledhikmat/threat-detection/custody"
 )
 
 func init() {
@@ -27,9 +29,9 @@ func fire(ctx context.Context, clip models.RecordingClip) error {
 		return invokeFireModelViaAPI(ctx, clip)
 	}
 
-	// Retrieve the recording clip from storage
+	// Retrieve the clip to analyse (i.e. the camera's sub-stream clip) and verify it was not modified since capture
 	start := time.Now()
-	_, err := storageSvc.RetrieveRecordingClip(ctx, clip)
+	_, b, err := custodyLog.RetrieveAnalysisClip(ctx, clip)
 	if err != nil {
 		fmt.Println("Failed to retrieve event's clip", err)
 		return err
@@ -40,6 +42,7 @@ func fire(ctx context.Context, clip models.RecordingClip) error {
 
 	// In the meantime....generate 0 ~ 20 random fire tags
 	tags := utils.RandFireTags(rand.Intn(20))
+	recordAnalysis(ctx, clip, custody.ClipHash(b))
 
 	// Add the tags to the clip
 	clip.Tags = tags
@@ -96,16 +99,24 @@ func invokeFireModelViaAPI(ctx context.Context, clip models.RecordingClip) error
 		},
 	}
 
+	// The model analyses the camera's sub-stream clip if there is one...the alerts keep the clip.
+	// It is verified against the clip's chain of custody before the model is given its reference.
+	analysisClip, b, err := custodyLog.RetrieveAnalysisClip(ctx, clip)
+	if err != nil {
+		fmt.Println("Failed to retrieve event's clip", err)
+		return err
+	}
+
 	modelRequest := fireModelRequest{
 		ID:  clip.ID,
-		URL: clip.CloudReference,
+		URL: analysisClip.CloudReference,
 	}
 
 	modelResponse := fireModelResponse{}
 
 	// TODO: Call the API
 	payloadBuf := new(bytes.Buffer)
-	err := json.NewEncoder(payloadBuf).Encode(&modelRequest)
+	err = json.NewEncoder(payloadBuf).Encode(&modelRequest)
 	if err != nil {
 		return err
 	}
@@ -136,6 +147,7 @@ func invokeFireModelViaAPI(ctx context.Context, clip models.RecordingClip) error
 	}
 
 	fmt.Printf("Calling the fire model API took %v\n", time.Since(start))
+	recordAnalysis(ctx, clip, custody.ClipHash(b))
 
 	// In the meantime....generate 0 ~ 20 random fire tags
 	tags := utils.RandFireTags(rand.Intn(20))
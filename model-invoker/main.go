@@ -25,6 +25,8 @@ import (
 	"github.com/khaledhikmat/threat-detection-shared/service/pubsub"
 	"github.com/khaledhikmat/threat-detection-shared/service/storage"
 	otelprovider "github.com/khaledhikmat/threat-detection-shared/telemetry/provider"
+
+	"github.com/khaledhikmat/threat-detection/custody"
 )
 
 type headerRoundTripper struct {
@@ -56,6 +58,7 @@ var recordingsTopicSubscription = &common.Subscription{
 var configSvc config.IService
 var pubsubSvc pubsub.IService
 var storageSvc storage.IService
+var custodyLog *custody.CustodyLog
 
 var recordingsTopic = models.RecordingsTopic
 var alertsTopic = models.AlertsTopic
@@ -69,6 +72,7 @@ var modeProcs = map[string]func(ctx context.Context) error{
 var modelProcs = map[string]func(ctx context.Context, clip models.RecordingClip) error{
 	"weapon": weapon,
 	"fire":   fire,
+	"audio":  audio,
 }
 
 func main() {
@@ -133,6 +137,11 @@ func daprModeProc(_ context.Context) error {
 	// WARNING I am using AWS storage while in DAPR runtime mode because I can store to S3
 	//storageSvc = storage.NewDaprStorage(c, configSvc)
 	storageSvc = storage.NewAwsStorage(configSvc)
+	custodyLog, err = custody.NewCustodyLog(c, storageSvc, fmt.Sprintf("model-invoker-%s", configSvc.GetSupportedAIModel()))
+	if err != nil {
+		fmt.Println("Failed to start the custody log", err)
+		return err
+	}
 
 	// Create a DAPR service using the app port
 	s := daprd.NewService(":" + os.Getenv("APP_PORT"))
@@ -168,6 +177,12 @@ func daprRecordingsHandler(ctx context.Context, e *common.TopicEvent) (bool, err
 func awsModeProc(ctx context.Context) error {
 	pubsubSvc = pubsub.NewAwsPubsub(configSvc)
 	storageSvc = storage.NewAwsStorage(configSvc)
+	var err error
+	custodyLog, err = custody.NewCustodyLog(nil, storageSvc, fmt.Sprintf("model-invoker-%s", configSvc.GetSupportedAIModel()))
+	if err != nil {
+		fmt.Println("Failed to start the custody log", err)
+		return err
+	}
 
 	// Create a topic for my recordings if it does not exist
 	// There could be some competition here, but we will ignore it for now
@@ -258,3 +273,11 @@ func processRecordingClip(ctx context.Context, evt models.RecordingClip) error {
 
 	return nil
 }
+
+// recordAnalysis appends an `analysed` entry with the hash of the analysed clip to the clip's chain of custody.
+func recordAnalysis(ctx context.Context, clip models.RecordingClip, clipHash string) {
+	_, err := custodyLog.Append(ctx, clip.ID, custody.CustodyAnalysed, clipHash)
+	if err != nil {
+		fmt.Printf("custody log - unable to append to the chain of custody of clip %s: %v\n", clip.ID, err)
+	}
+}